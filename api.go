@@ -8,13 +8,51 @@ import (
 
 func handler() http.Handler {
 	r := chi.NewRouter()
+	r.Use(requireAuth)
 
-	r.Post("/create", CreateVmHandler)
-	r.Delete("/delete", DeleteVmHandler)
-	r.Post("/stop", StopVmHandler)
-	r.Post("/resume", ResumeVmHandler)
-	r.Get("/list", ListVmsHandler)
-	r.Get("/vm-state/{vm_id}", InfoVmHandler)
+	r.Route("/v1", v1Handler)
+	r.Get("/events", EventsHandler)
+	r.Post("/apply", ApplyHandler)
+
+	// the unversioned routes are kept for the existing clients, their successor is in /v1
+	r.Group(func(r chi.Router) {
+		r.Use(deprecated)
+
+		r.Post("/create", CreateVmHandler)
+		r.Delete("/delete", DeleteVmHandler)
+		r.Post("/stop", StopVmHandler)
+		r.Post("/resume", ResumeVmHandler)
+		r.Get("/list", ListVmsHandler)
+		r.Get("/vm-state/{vm_id}", InfoVmHandler)
+		r.Get("/vms/metrics", PrometheusVmsHandler)
+		r.Get("/vms/{vm_id}/metrics", MetricsVmHandler)
+		r.Get("/vms/{vm_id}/snapshot", ExportSnapshotHandler)
+		r.Get("/vms/{vm_id}/console", ConsoleVmHandler)
+		r.Get("/vms/{vm_id}/console/attach", AttachConsoleHandler)
+		r.Get("/vms/{vm_id}/health", HealthVmHandler)
+		r.Post("/vms/{vm_id}/signal", SignalVmHandler)
+		r.Post("/vms/{vm_id}/exec", ExecVmHandler)
+		r.Get("/vms/{vm_id}/exec/attach", AttachExecHandler)
+		r.Get("/vms/{vm_id}/files", DownloadFilesHandler)
+		r.Put("/vms/{vm_id}/files", UploadFilesHandler)
+		r.Patch("/vms/{vm_id}/rate-limits", RateLimitsVmHandler)
+		r.Patch("/vms/{vm_id}/balloon", BalloonVmHandler)
+		r.Post("/snapshots/import", ImportSnapshotHandler)
+		r.Get("/kernels", ListKernelsHandler)
+		r.Get("/usage", UsageHandler)
+
+		// volumes are shared by the tenants, only admins manage them
+		r.Group(func(r chi.Router) {
+			r.Use(requireAdmin)
+
+			r.Post("/volumes", CreateVolumeHandler)
+			r.Get("/volumes", ListVolumesHandler)
+			r.Delete("/volumes/{name}", DeleteVolumeHandler)
+			r.Get("/admin/logging", GetLoggingHandler)
+			r.Put("/admin/logging", SetLoggingHandler)
+			r.Get("/admin/usage", HostUsageHandler)
+		})
+	})
 
 	return r
 }
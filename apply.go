@@ -0,0 +1,397 @@
+// apply file is used to converge the vms of an environment to a declarative spec. The spec is
+// diffed against the vms the environment manages, which are then created, updated, replaced,
+// started again or deleted.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultEnvironment manages the vms of the specs naming no environment
+const defaultEnvironment = "default"
+
+// maxSpecSize bounds the specs read from requests
+const maxSpecSize = 1 << 20
+
+// appliedSpec is the spec a vm was created from along with the environment managing it
+type appliedSpec struct {
+	Environment string `json:"environment"`
+	Spec        VmSpec `json:"spec"`
+}
+
+// applyStep is a change of the plan, vm is the vm it acts on and spec the spec it converges to
+type applyStep struct {
+	change ApplyChange
+	vm     *Firecracker
+	spec   *VmSpec
+}
+
+// For converging the vms of an environment to the yaml or json spec of the request body.
+// dry_run only plans the changes, the failure of a change does not stop the others.
+func ApplyHandler(w http.ResponseWriter, r *http.Request) {
+
+	defer r.Body.Close()
+
+	spec, err := decodeSpec(r.Body)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	result := applySpec(r.Context(), spec, ctxGetPrincipal(r.Context()), dryRun)
+
+	// the changes are made one by one, the result tells which failed along with the status
+	status := http.StatusOK
+	for _, change := range result.Changes {
+		if change.Error != "" {
+			ctxGetLogger(r.Context()).Errorf("failed to %s vm %s of environment %s: %s", change.Action, change.Name, result.Environment, change.Error)
+			status = http.StatusUnprocessableEntity
+		}
+	}
+
+	writeResponse(w, status, result)
+}
+
+// decodeSpec reads a yaml or json spec and checks it, unknown fields are rejected to catch typos
+func decodeSpec(r io.Reader) (*Spec, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxSpecSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spec: %v", err)
+	}
+	if len(data) > maxSpecSize {
+		return nil, fmt.Errorf("spec is larger than %d bytes", maxSpecSize)
+	}
+
+	// json is yaml as well, the spec goes through json to be decoded along the tags of the api types
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid spec: %v", err)
+	}
+	js, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid spec: %v", err)
+	}
+
+	spec := new(Spec)
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(spec); err != nil {
+		return nil, fmt.Errorf("invalid spec: %v", err)
+	}
+
+	if err := validateSpec(spec); err != nil {
+		return nil, fmt.Errorf("invalid spec: %v", err)
+	}
+	return spec, nil
+}
+
+// validateSpec checks the spec as a whole, so none of it is applied when a part is wrong.
+// What depends on the host, such as images, volumes or quotas, is checked while applying.
+func validateSpec(spec *Spec) error {
+	if spec.Environment == "" {
+		spec.Environment = defaultEnvironment
+	}
+	if !volumeNamePattern.MatchString(spec.Environment) {
+		return fmt.Errorf("invalid environment name %q", spec.Environment)
+	}
+
+	names := make(map[string]bool)
+	ports := make(map[string]string)
+	for i, vm := range spec.VMs {
+		if vm.Name == "" || vm.Image == "" {
+			return fmt.Errorf("vm %d needs a name and an image", i+1)
+		}
+		if err := validateImage(vm.Name, vm.Image); err != nil {
+			return fmt.Errorf("vm %d: %v", i+1, err)
+		}
+		if names[vm.Name] {
+			return fmt.Errorf("vm %s is defined twice", vm.Name)
+		}
+		names[vm.Name] = true
+
+		if r := vm.Resources; r != nil && (r.VCPUs < 0 || r.VCPUs > maxVCPUs || (r.MemoryMiB != 0 && r.MemoryMiB < minMemoryMiB)) {
+			return fmt.Errorf("vm %s: vcpus must be between 1 and %d and memory at least %d MiB", vm.Name, maxVCPUs, minMemoryMiB)
+		}
+		if err := validateRestartPolicy(vm.RestartPolicy); err != nil {
+			return fmt.Errorf("vm %s: %v", vm.Name, err)
+		}
+		if err := validateEnv(specEnv(vm.Env)); err != nil {
+			return fmt.Errorf("vm %s: %v", vm.Name, err)
+		}
+		if err := validateNetwork(vm.Network, vm.Ports); err != nil {
+			return fmt.Errorf("vm %s: %v", vm.Name, err)
+		}
+		for _, p := range vm.Ports {
+			if other, ok := ports[portKey(p)]; ok && other != vm.Name {
+				return fmt.Errorf("host port %s is published by both %s and %s", portKey(p), other, vm.Name)
+			}
+			ports[portKey(p)] = vm.Name
+		}
+	}
+
+	return nil
+}
+
+// applySpec converges the vms of the tenant of caller managed by the environment of spec to it,
+// or only plans the changes on a dry run
+func applySpec(ctx context.Context, spec *Spec, caller *principal, dryRun bool) *ApplyResult {
+	result := &ApplyResult{Environment: spec.Environment, DryRun: dryRun, Changes: []ApplyChange{}}
+
+	for _, step := range planApply(spec, caller.Tenant) {
+		if !dryRun {
+			step.change = runApplyStep(ctx, step, spec.Environment, caller)
+		}
+		result.Changes = append(result.Changes, step.change)
+	}
+
+	return result
+}
+
+// planApply diffs spec against the vms of tenant its environment manages. The vms to delete come
+// first so they give their resources and ports back before others are created.
+func planApply(spec *Spec, tenant string) []applyStep {
+
+	// the vms of the environment by name, sorted by id so the plan does not depend on the map order
+	var managed []*Firecracker
+	applied := make(map[*Firecracker]*appliedSpec)
+	for _, f := range listVms() {
+		f.mu.Lock()
+		a := f.opts.Applied
+		f.mu.Unlock()
+		if f.opts.Tenant == tenant && a != nil && a.Environment == spec.Environment {
+			managed = append(managed, f)
+			applied[f] = a
+		}
+	}
+
+	current := make(map[string]*Firecracker)
+	var steps []applyStep
+	for _, f := range managed {
+		name := applied[f].Spec.Name
+		if _, ok := current[name]; ok {
+			// a single vm of a name is managed, any other one is deleted
+			steps = append(steps, applyStep{change: ApplyChange{Name: name, Action: ApplyDelete, VmID: f.ID}, vm: f})
+			continue
+		}
+		current[name] = f
+	}
+
+	desired := make(map[string]bool)
+	for _, vm := range spec.VMs {
+		desired[vm.Name] = true
+	}
+	var removed []string
+	for name := range current {
+		if !desired[name] {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+	for _, name := range removed {
+		f := current[name]
+		steps = append(steps, applyStep{change: ApplyChange{Name: name, Action: ApplyDelete, VmID: f.ID}, vm: f})
+	}
+
+	for i := range spec.VMs {
+		vm := &spec.VMs[i]
+		f, ok := current[vm.Name]
+		if !ok {
+			steps = append(steps, applyStep{change: ApplyChange{Name: vm.Name, Action: ApplyCreate}, spec: vm})
+			continue
+		}
+
+		step := applyStep{change: ApplyChange{Name: vm.Name, VmID: f.ID}, vm: f, spec: vm}
+		step.change.Fields = diffSpec(applied[f].Spec, *vm)
+		state := f.currentState()
+		switch {
+		case len(step.change.Fields) == 1 && step.change.Fields[0] == "restart_policy":
+			step.change.Action = ApplyUpdate
+		case len(step.change.Fields) > 0:
+			step.change.Action = ApplyReplace
+		case state == StateExited || state == StateFailed:
+			step.change.Action = ApplyStart
+		default:
+			step.change.Action = ApplyUnchanged
+		}
+		steps = append(steps, step)
+	}
+
+	return steps
+}
+
+// runApplyStep makes the change of step and returns it along with its outcome
+func runApplyStep(ctx context.Context, step applyStep, environment string, caller *principal) ApplyChange {
+	change := step.change
+
+	var err error
+	switch change.Action {
+	case ApplyDelete:
+		deleteVm(step.vm)
+	case ApplyUpdate:
+		// the restart policy is read once the workload exits, there is nothing to tell firecracker
+		step.vm.mu.Lock()
+		step.vm.opts.RestartPolicy = step.spec.RestartPolicy
+		step.vm.opts.Applied = &appliedSpec{Environment: environment, Spec: *step.spec}
+		step.vm.mu.Unlock()
+		if step.vm.currentState() == StateStarted {
+			err = step.vm.saveRecord()
+		}
+	case ApplyStart:
+		_, err = step.vm.boot(ctx)
+	case ApplyReplace, ApplyCreate:
+		// the ports and resources of the replaced vm are released before its successor asks for them,
+		// the vm is only deleted once the successor passed the checks it can go through beforehand
+		if step.vm != nil {
+			if err = checkReplacement(step, caller); err != nil {
+				break
+			}
+			deleteVm(step.vm)
+		}
+		var f *Firecracker
+		f, err = createVm(ctx, specRequest(step.spec), caller, &appliedSpec{Environment: environment, Spec: *step.spec})
+		if err == nil {
+			change.VmID = f.ID
+		}
+	}
+
+	if err != nil {
+		change.Error = err.Error()
+	}
+	return change
+}
+
+// checkReplacement runs the checks of createVm on the vm spec of step, counting the ports,
+// volumes and resources of the vm it replaces as free. Building its rootfs and booting it may
+// still fail once the replaced vm is gone.
+func checkReplacement(step applyStep, caller *principal) error {
+	in := specRequest(step.spec)
+
+	opts, err := createOptions(in, caller)
+	if err != nil {
+		return err
+	}
+	if err := checkPortsFree(in.Ports, step.vm); err != nil {
+		return err
+	}
+	if err := checkVolumes(in.Volumes, caller, step.vm); err != nil {
+		return err
+	}
+	if err := opts.selectBoot(in.Kernel, in.Initrd, in.BootArgs); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidRequest, err)
+	}
+	return fitsReplacing(vmResources(&opts), step.vm)
+}
+
+// diffSpec lists the fields of the vm spec which changed from a to b, leaving out the
+// differences between an unset field and its default
+func diffSpec(a, b VmSpec) []string {
+	a, b = normalizeSpec(a), normalizeSpec(b)
+
+	var fields []string
+	for _, f := range []struct {
+		name string
+		a, b interface{}
+	}{
+		{"image", a.Image, b.Image},
+		{"resources", a.Resources, b.Resources},
+		{"env", a.Env, b.Env},
+		{"command", a.Command, b.Command},
+		{"volumes", a.Volumes, b.Volumes},
+		{"ports", a.Ports, b.Ports},
+		{"network", a.Network, b.Network},
+		{"restart_policy", a.RestartPolicy, b.RestartPolicy},
+		{"kernel", a.Kernel, b.Kernel},
+		{"initrd", a.Initrd, b.Initrd},
+		{"boot_args", a.BootArgs, b.BootArgs},
+	} {
+		if !reflect.DeepEqual(f.a, f.b) {
+			fields = append(fields, f.name)
+		}
+	}
+	return fields
+}
+
+// normalizeSpec fills the defaults of the vm spec s in and drops its empty fields
+func normalizeSpec(s VmSpec) VmSpec {
+	r := VmResources{VCPUs: 1, MemoryMiB: 256}
+	if s.Resources != nil {
+		if s.Resources.VCPUs != 0 {
+			r.VCPUs = s.Resources.VCPUs
+		}
+		if s.Resources.MemoryMiB != 0 {
+			r.MemoryMiB = s.Resources.MemoryMiB
+		}
+	}
+	s.Resources = &r
+
+	if len(s.Env) == 0 {
+		s.Env = nil
+	}
+	if len(s.Command) == 0 {
+		s.Command = nil
+	}
+	if len(s.Volumes) == 0 {
+		s.Volumes = nil
+	}
+
+	if len(s.Ports) == 0 {
+		s.Ports = nil
+	} else {
+		ports := make([]PortMapping, len(s.Ports))
+		for i, p := range s.Ports {
+			ports[i] = PortMapping{HostPort: p.HostPort, GuestPort: p.GuestPort, Protocol: portProtocol(p)}
+		}
+		s.Ports = ports
+	}
+
+	if s.Network == "" {
+		s.Network = NetworkNAT
+	}
+	if p := s.RestartPolicy; p != nil && (p.Name == "" || p.Name == RestartNo) {
+		s.RestartPolicy = nil
+	}
+
+	return s
+}
+
+// specRequest is the request creating the vm of the spec s
+func specRequest(s *VmSpec) *CreateRequest {
+	in := &CreateRequest{
+		Name:          s.Name,
+		DockerImage:   s.Image,
+		RestartPolicy: s.RestartPolicy,
+		Kernel:        s.Kernel,
+		Initrd:        s.Initrd,
+		BootArgs:      s.BootArgs,
+		Volumes:       s.Volumes,
+		Env:           specEnv(s.Env),
+		Command:       s.Command,
+		Ports:         s.Ports,
+		Network:       s.Network,
+	}
+	if s.Resources != nil {
+		in.VCPUs = s.Resources.VCPUs
+		in.MemoryMiB = s.Resources.MemoryMiB
+	}
+	return in
+}
+
+// specEnv writes the variables of env as NAME=VALUE, sorted by name
+func specEnv(env map[string]string) []string {
+	vars := make([]string, 0, len(env))
+	for name, value := range env {
+		vars = append(vars, name+"="+value)
+	}
+	sort.Strings(vars)
+	return vars
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeSpec(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		spec string
+		err  string
+	}{
+		{"yaml", "environment: prod\nvms:\n  - name: web\n    image: nginx:alpine\n    env: {MODE: prod}", ""},
+		{"json", `{"vms": [{"name": "web", "image": "nginx:alpine", "resources": {"vcpus": 2}}]}`, ""},
+		{"unknown field", "vms: [{name: web, image: nginx, memory: 512}]", "unknown field"},
+		{"no image", "vms: [{name: web}]", "needs a name and an image"},
+		{"vm defined twice", "vms: [{name: web, image: nginx}, {name: web, image: httpd}]", "defined twice"},
+		{"invalid environment", "environment: ../prod\nvms: []", "invalid environment name"},
+		{"too many vcpus", fmt.Sprintf("vms: [{name: web, image: nginx, resources: {vcpus: %d}}]", maxVCPUs+1), "vcpus must be"},
+		{"too little memory", "vms: [{name: web, image: nginx, resources: {memory_mib: 1}}]", "memory at least"},
+		{"invalid restart policy", "vms: [{name: web, image: nginx, restart_policy: {name: sometimes}}]", "vm web"},
+		{"host port published twice", "vms: [{name: web, image: nginx, ports: [{host_port: 8080, guest_port: 80}]}, " +
+			"{name: api, image: httpd, ports: [{host_port: 8080, guest_port: 80}]}]", "published by both web and api"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			spec, err := decodeSpec(strings.NewReader(c.spec))
+			if c.err == "" && err != nil || c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+				t.Fatalf("got error %v, want %q", err, c.err)
+			}
+			if err == nil && spec.Environment == "" {
+				t.Fatal("the environment was left empty")
+			}
+		})
+	}
+}
+
+func TestDiffSpec(t *testing.T) {
+	base := VmSpec{Name: "web", Image: "nginx:alpine"}
+	with := func(change func(s *VmSpec)) VmSpec {
+		s := base
+		change(&s)
+		return s
+	}
+
+	for _, c := range []struct {
+		name   string
+		spec   VmSpec
+		fields []string
+	}{
+		{"same", base, nil},
+		{"default resources", with(func(s *VmSpec) { s.Resources = &VmResources{VCPUs: 1, MemoryMiB: 256} }), nil},
+		{"default vcpus", with(func(s *VmSpec) { s.Resources = &VmResources{MemoryMiB: 256} }), nil},
+		{"default network", with(func(s *VmSpec) { s.Network = NetworkNAT }), nil},
+		{"empty env", with(func(s *VmSpec) { s.Env = map[string]string{} }), nil},
+		{"no restart", with(func(s *VmSpec) { s.RestartPolicy = &RestartPolicy{Name: RestartNo} }), nil},
+		{"tcp port", with(func(s *VmSpec) { s.Ports = []PortMapping{{HostPort: 8080, GuestPort: 80}} }), []string{"ports"}},
+		{"image", with(func(s *VmSpec) { s.Image = "nginx:1.25" }), []string{"image"}},
+		{"memory", with(func(s *VmSpec) { s.Resources = &VmResources{MemoryMiB: 512} }), []string{"resources"}},
+		{"restart policy", with(func(s *VmSpec) { s.RestartPolicy = &RestartPolicy{Name: RestartAlways} }), []string{"restart_policy"}},
+		{"env and command", with(func(s *VmSpec) {
+			s.Env = map[string]string{"MODE": "prod"}
+			s.Command = []string{"nginx", "-g", "daemon off;"}
+		}), []string{"env", "command"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := diffSpec(base, c.spec); !reflect.DeepEqual(got, c.fields) {
+				t.Fatalf("got %v, want %v", got, c.fields)
+			}
+		})
+	}
+
+	// the protocol of a port defaults to tcp
+	tcp := with(func(s *VmSpec) { s.Ports = []PortMapping{{HostPort: 8080, GuestPort: 80, Protocol: "tcp"}} })
+	if got := diffSpec(tcp, with(func(s *VmSpec) { s.Ports = []PortMapping{{HostPort: 8080, GuestPort: 80}} })); got != nil {
+		t.Fatalf("got %v", got)
+	}
+}
+
+// testAppliedVm is a vm the environment plan manages, created from the spec of name and image
+func testAppliedVm(t *testing.T, id, name, image string, state VmState) *Firecracker {
+	t.Helper()
+	m := testVm(t, id, 0, state)
+	m.opts.Tenant = "planner"
+	m.opts.Applied = &appliedSpec{Environment: "plan", Spec: VmSpec{Name: name, Image: image}}
+	putVm(m)
+	t.Cleanup(func() { takeVm(id) })
+	return m
+}
+
+func TestPlanApply(t *testing.T) {
+	testAppliedVm(t, "plan-1", "web", "nginx:alpine", StateStarted)
+	testAppliedVm(t, "plan-2", "api", "httpd:2", StateStarted)
+	testAppliedVm(t, "plan-3", "job", "busybox", StateExited)
+	testAppliedVm(t, "plan-4", "old", "busybox", StateStarted)
+	// a second vm of a name is not managed anymore
+	testAppliedVm(t, "plan-5", "web", "nginx:alpine", StateStarted)
+	testAppliedVm(t, "plan-6", "cron", "busybox", StateStarted)
+
+	// vms of other environments and tenants are left alone
+	other := testAppliedVm(t, "plan-7", "old", "busybox", StateStarted)
+	other.opts.Applied.Environment = "staging"
+	foreign := testAppliedVm(t, "plan-8", "old", "busybox", StateStarted)
+	foreign.opts.Tenant = "acme"
+
+	spec := &Spec{Environment: "plan", VMs: []VmSpec{
+		{Name: "web", Image: "nginx:alpine"},
+		{Name: "api", Image: "httpd:2.4"},
+		{Name: "job", Image: "busybox"},
+		{Name: "cron", Image: "busybox", RestartPolicy: &RestartPolicy{Name: RestartAlways}},
+		{Name: "db", Image: "postgres:16"},
+	}}
+
+	var got []string
+	for _, step := range planApply(spec, "planner") {
+		c := step.change
+		got = append(got, fmt.Sprintf("%s %s %s %s", c.Action, c.Name, c.VmID, strings.Join(c.Fields, ",")))
+	}
+	want := []string{
+		"delete web plan-5 ",
+		"delete old plan-4 ",
+		"unchanged web plan-1 ",
+		"replace api plan-2 image",
+		"start job plan-3 ",
+		"update cron plan-6 restart_policy",
+		"create db  ",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got plan\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestApplySpec(t *testing.T) {
+	cron := testAppliedVm(t, "apply-1", "cron", "busybox", StateExited)
+	testAppliedVm(t, "apply-2", "old", "busybox", StateExited)
+
+	spec := &Spec{Environment: "plan", VMs: []VmSpec{
+		{Name: "cron", Image: "busybox", RestartPolicy: &RestartPolicy{Name: RestartAlways}},
+	}}
+
+	// a dry run changes nothing
+	dry := applySpec(context.Background(), spec, &principal{Tenant: "planner"}, true)
+	if len(dry.Changes) != 2 || !dry.DryRun {
+		t.Fatalf("got %+v", dry)
+	}
+	if _, ok := getVm("apply-2"); !ok || cron.opts.RestartPolicy != nil {
+		t.Fatal("the dry run changed the vms")
+	}
+
+	result := applySpec(context.Background(), spec, &principal{Tenant: "planner"}, false)
+	for _, c := range result.Changes {
+		if c.Error != "" {
+			t.Fatalf("%s of %s failed: %s", c.Action, c.Name, c.Error)
+		}
+	}
+	if _, ok := getVm("apply-2"); ok {
+		t.Fatal("the vm left out of the spec was not deleted")
+	}
+	cron.mu.Lock()
+	defer cron.mu.Unlock()
+	if p := cron.opts.RestartPolicy; p == nil || p.Name != RestartAlways || cron.opts.Applied.Spec.RestartPolicy != p {
+		t.Fatalf("the restart policy was not updated in place: %+v", p)
+	}
+}
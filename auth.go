@@ -0,0 +1,554 @@
+// auth file is used to authenticate the callers of the api and to tell which tenant they act for.
+// Callers are known by a static api token, their TLS client certificate or a JWT signed by a key
+// of a local JWKS file. Tenants only see the vms they created, admins see every vm.
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errUnauthenticated = errors.New("authentication required")
+
+// authConfig is read from the file given by the -auth-config flag
+type authConfig struct {
+	Tokens      []*apiToken `json:"tokens,omitempty"`
+	ClientCerts *certAuth   `json:"client_certs,omitempty"`
+	JWT         *jwtAuth    `json:"jwt,omitempty"`
+	// Admins are the tenants which see every vm and may administrate the daemon
+	Admins []string `json:"admins,omitempty"`
+}
+
+// apiToken is a static token, only its sha256 is kept
+type apiToken struct {
+	SHA256 string `json:"sha256"`
+	Tenant string `json:"tenant"`
+}
+
+// certAuth accepts the client certificates signed by the CA file, the tenant is their common name
+// or their first organizational unit
+type certAuth struct {
+	CA         string `json:"ca"`
+	TenantFrom string `json:"tenant_from,omitempty"`
+
+	pool *x509.CertPool
+}
+
+// jwtAuth accepts the JWTs signed by a key of the JWKS file, the tenant is the TenantClaim claim
+type jwtAuth struct {
+	JWKS        string `json:"jwks"`
+	Issuer      string `json:"issuer,omitempty"`
+	Audience    string `json:"audience,omitempty"`
+	TenantClaim string `json:"tenant_claim,omitempty"`
+
+	mu       sync.Mutex
+	keys     map[string]crypto.PublicKey
+	loadedAt time.Time
+}
+
+// principal is the caller of a request
+type principal struct {
+	Tenant string
+	Admin  bool
+	Method string
+}
+
+// anonymous is the caller of every request while authentication is off
+var anonymous = &principal{Admin: true, Method: "none"}
+
+// local is the caller of every request coming through the unix socket
+var local = &principal{Tenant: "local", Admin: true, Method: "unix"}
+
+// auth is the authentication in use, nil when it is off
+var auth *authConfig
+
+// loadAuth turns authentication on with the configuration in the file at path
+func loadAuth(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read auth config: %v", err)
+	}
+
+	cfg := new(authConfig)
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("failed to decode auth config: %v", err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return fmt.Errorf("invalid auth config: %v", err)
+	}
+
+	auth = cfg
+	return nil
+}
+
+// validate checks the configuration and loads the CA and the keys it refers to
+func (c *authConfig) validate() error {
+	if len(c.Tokens) == 0 && c.ClientCerts == nil && c.JWT == nil {
+		return fmt.Errorf("no authentication method is configured")
+	}
+
+	for i, t := range c.Tokens {
+		if sum, err := hex.DecodeString(t.SHA256); err != nil || len(sum) != sha256.Size {
+			return fmt.Errorf("token %d: sha256 must be the hex encoded sha256 of the token", i)
+		}
+		if t.Tenant == "" {
+			return fmt.Errorf("token %d: tenant is required", i)
+		}
+		t.SHA256 = strings.ToLower(t.SHA256)
+	}
+
+	if cc := c.ClientCerts; cc != nil {
+		switch cc.TenantFrom {
+		case "":
+			cc.TenantFrom = "cn"
+		case "cn", "ou":
+		default:
+			return fmt.Errorf("client_certs: tenant_from must be cn or ou")
+		}
+		pem, err := os.ReadFile(cc.CA)
+		if err != nil {
+			return fmt.Errorf("client_certs: failed to read ca: %v", err)
+		}
+		cc.pool = x509.NewCertPool()
+		if !cc.pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("client_certs: no certificate found in %s", cc.CA)
+		}
+	}
+
+	if j := c.JWT; j != nil {
+		if j.TenantClaim == "" {
+			j.TenantClaim = "tenant"
+		}
+		if _, err := j.key(""); err != nil && !errors.Is(err, errUnauthenticated) {
+			return fmt.Errorf("jwt: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// verify checks the client certificate chain against the CA of the authentication, the tls
+// handshake may have accepted it with another CA which only gives access to the api
+func (cc *certAuth) verify(chain []*x509.Certificate) (*x509.Certificate, error) {
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         cc.pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: client certificate: %v", errUnauthenticated, err)
+	}
+
+	return chain[0], nil
+}
+
+// isAdmin tells whether tenant is one of the admins
+func (c *authConfig) isAdmin(tenant string) bool {
+	for _, a := range c.Admins {
+		if a == tenant {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate finds the caller of r, trying its client certificate first and then its bearer token.
+// A certificate the handshake accepted with the -tls-client-ca CA alone does not name a tenant,
+// the caller still authenticates with its token then.
+func (c *authConfig) authenticate(r *http.Request) (*principal, error) {
+	var certErr error
+	if c.ClientCerts != nil && r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cert, err := c.ClientCerts.verify(r.TLS.PeerCertificates)
+		if err == nil {
+			return c.certPrincipal(cert)
+		}
+		certErr = err
+	}
+
+	token, ok := bearerToken(r)
+	if !ok {
+		if certErr != nil {
+			return nil, certErr
+		}
+		return nil, errUnauthenticated
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	presented := hex.EncodeToString(sum[:])
+	for _, t := range c.Tokens {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(t.SHA256)) == 1 {
+			return &principal{Tenant: t.Tenant, Admin: c.isAdmin(t.Tenant), Method: "token"}, nil
+		}
+	}
+
+	if c.JWT != nil && strings.Count(token, ".") == 2 {
+		tenant, err := c.JWT.verify(token, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		return &principal{Tenant: tenant, Admin: c.isAdmin(tenant), Method: "jwt"}, nil
+	}
+
+	return nil, fmt.Errorf("%w: unknown token", errUnauthenticated)
+}
+
+// certPrincipal is the caller holding the client certificate cert of the authentication CA
+func (c *authConfig) certPrincipal(cert *x509.Certificate) (*principal, error) {
+	tenant := cert.Subject.CommonName
+	if c.ClientCerts.TenantFrom == "ou" {
+		tenant = ""
+		if len(cert.Subject.OrganizationalUnit) > 0 {
+			tenant = cert.Subject.OrganizationalUnit[0]
+		}
+	}
+	if tenant == "" {
+		return nil, fmt.Errorf("%w: the client certificate names no tenant", errUnauthenticated)
+	}
+	return &principal{Tenant: tenant, Admin: c.isAdmin(tenant), Method: "mtls"}, nil
+}
+
+// bearerToken is the token of the Authorization header of r
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(header[7:])
+	return token, token != ""
+}
+
+// requireAuth rejects the requests of unknown callers and keeps the caller of the others in their context
+func requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth == nil {
+			next.ServeHTTP(w, r.WithContext(ctxSetPrincipal(r.Context(), anonymous)))
+			return
+		}
+
+		// the permissions of the unix socket decide who may connect to it
+		if ctxIsLocal(r.Context()) {
+			next.ServeHTTP(w, r.WithContext(ctxSetPrincipal(r.Context(), local)))
+			return
+		}
+
+		p, err := auth.authenticate(r)
+		if err != nil {
+			ctxGetLogger(r.Context()).Debugf("rejected request: %v", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="fcland"`)
+			writeMessage(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		ctx := ctxSetPrincipal(r.Context(), p)
+		ctx = ctxSetLogger(ctx, ctxGetLogger(ctx).WithField("tenant", p.Tenant))
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requireAdmin only lets admins through
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ctxGetPrincipal(r.Context()).Admin {
+			writeMessage(w, http.StatusForbidden, "only admins may do this")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// owns tells whether the vm m is visible to p
+func (p *principal) owns(m *Firecracker) bool {
+	return p.Admin || m.opts != nil && m.opts.Tenant == p.Tenant
+}
+
+// lookupVm is the vm id when the caller of r may see it, the vms of other tenants are not found
+func lookupVm(r *http.Request, id string) (*Firecracker, bool) {
+	m, ok := getVm(id)
+	if !ok || !ctxGetPrincipal(r.Context()).owns(m) {
+		return nil, false
+	}
+	return m, true
+}
+
+// jwtHeader is the header of a JWT
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// verify checks the signature and the claims of token and returns its tenant
+func (j *jwtAuth) verify(token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", fmt.Errorf("%w: invalid jwt header: %v", errUnauthenticated, err)
+	}
+
+	key, err := j.key(header.Kid)
+	if err != nil {
+		return "", err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid jwt signature encoding", errUnauthenticated)
+	}
+	if err := verifyJWTSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return "", fmt.Errorf("%w: %v", errUnauthenticated, err)
+	}
+
+	claims := make(map[string]interface{})
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("%w: invalid jwt claims: %v", errUnauthenticated, err)
+	}
+
+	// a minute of leeway for the clocks of the issuer and of the host
+	const leeway = 60
+	exp, ok := claims["exp"].(float64)
+	if !ok || float64(now.Unix()) > exp+leeway {
+		return "", fmt.Errorf("%w: the jwt is expired", errUnauthenticated)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && float64(now.Unix()) < nbf-leeway {
+		return "", fmt.Errorf("%w: the jwt is not valid yet", errUnauthenticated)
+	}
+	if j.Issuer != "" && claims["iss"] != j.Issuer {
+		return "", fmt.Errorf("%w: unexpected jwt issuer", errUnauthenticated)
+	}
+	if j.Audience != "" && !hasAudience(claims["aud"], j.Audience) {
+		return "", fmt.Errorf("%w: unexpected jwt audience", errUnauthenticated)
+	}
+
+	tenant, _ := claims[j.TenantClaim].(string)
+	if tenant == "" {
+		return "", fmt.Errorf("%w: the jwt has no %s claim", errUnauthenticated, j.TenantClaim)
+	}
+
+	return tenant, nil
+}
+
+// decodeJWTPart decodes the base64url json part of a JWT into v
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// hasAudience tells whether the aud claim, a string or a list of them, holds audience
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyJWTSignature checks sig of signed with key for the algorithm alg
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	var hash crypto.Hash
+	switch {
+	case strings.HasSuffix(alg, "256"):
+		hash = crypto.SHA256
+	case strings.HasSuffix(alg, "384"):
+		hash = crypto.SHA384
+	case strings.HasSuffix(alg, "512"):
+		hash = crypto.SHA512
+	}
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") || hash == 0 {
+			return fmt.Errorf("algorithm %s does not match an rsa key", alg)
+		}
+		h := hash.New()
+		h.Write(signed)
+		if err := rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), sig); err != nil {
+			return fmt.Errorf("invalid jwt signature")
+		}
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") || hash == 0 {
+			return fmt.Errorf("algorithm %s does not match an ecdsa key", alg)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return fmt.Errorf("invalid jwt signature")
+		}
+		h := hash.New()
+		h.Write(signed)
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(key, h.Sum(nil), r, s) {
+			return fmt.Errorf("invalid jwt signature")
+		}
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			return fmt.Errorf("algorithm %s does not match an ed25519 key", alg)
+		}
+		if !ed25519.Verify(key, signed, sig) {
+			return fmt.Errorf("invalid jwt signature")
+		}
+	default:
+		return fmt.Errorf("unsupported jwt algorithm %s", alg)
+	}
+
+	return nil
+}
+
+// key is the key kid of the JWKS file, the file is read again whenever it changes so keys can be rotated.
+// An empty kid selects the only key of the file.
+func (j *jwtAuth) key(kid string) (crypto.PublicKey, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	info, err := os.Stat(j.JWKS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jwks: %v", err)
+	}
+	if j.keys == nil || !info.ModTime().Equal(j.loadedAt) {
+		keys, err := readJWKS(j.JWKS)
+		if err != nil {
+			return nil, err
+		}
+		j.keys, j.loadedAt = keys, info.ModTime()
+	}
+
+	if kid == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key, nil
+		}
+	}
+	key, ok := j.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown jwt key %q", errUnauthenticated, kid)
+	}
+	return key, nil
+}
+
+// jwk is a public key of a JWKS file
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// readJWKS reads the signing keys of the JWKS file at path, keyed by their kid
+func readJWKS(path string) (map[string]crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jwks: %v", err)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to decode jwks: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("jwks key %q: %v", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("jwks %s has no signing key", path)
+	}
+
+	return keys, nil
+}
+
+// publicKey decodes the rsa, ec or ed25519 key k
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding
+
+	switch k.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %v", err)
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil || len(e) > 4 {
+			return nil, fmt.Errorf("invalid exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x: %v", err)
+		}
+		y, err := b64.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y: %v", err)
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("the point is not on the curve")
+		}
+		return key, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid x")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
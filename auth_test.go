@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testJWTKeys are the keys the JWKS of the tests holds, by kid
+type testJWTKeys struct {
+	ec  *ecdsa.PrivateKey
+	ed  ed25519.PrivateKey
+	rsa *rsa.PrivateKey
+}
+
+func newTestJWKS(t *testing.T) (*testJWTKeys, string) {
+	t.Helper()
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b64 := base64.RawURLEncoding
+	set := map[string][]jwk{"keys": {
+		{Kty: "EC", Kid: "ec", Crv: "P-256", X: b64.EncodeToString(ec.X.FillBytes(make([]byte, 32))), Y: b64.EncodeToString(ec.Y.FillBytes(make([]byte, 32)))},
+		{Kty: "OKP", Kid: "ed", Crv: "Ed25519", X: b64.EncodeToString(ed.Public().(ed25519.PublicKey))},
+		{Kty: "RSA", Kid: "rsa", N: b64.EncodeToString(rk.N.Bytes()), E: b64.EncodeToString(big.NewInt(int64(rk.E)).Bytes())},
+	}}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &testJWTKeys{ec: ec, ed: ed, rsa: rk}, path
+}
+
+// sign builds a JWT of claims with the header alg and kid, signed with the key of signWith
+func (k *testJWTKeys) sign(t *testing.T, alg, kid, signWith string, claims map[string]interface{}) string {
+	t.Helper()
+	b64 := base64.RawURLEncoding
+	header, _ := json.Marshal(jwtHeader{Alg: alg, Kid: kid})
+	payload, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch signWith {
+	case "ec":
+		r, s, err := ecdsa.Sign(rand.Reader, k.ec, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case "ed":
+		sig = ed25519.Sign(k.ed, []byte(signed))
+	case "hmac":
+		// the public key as the secret, as a verifier trusting the header alg would use it
+		mac := hmac.New(sha256.New, elliptic.Marshal(elliptic.P256(), k.ec.X, k.ec.Y))
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case "none":
+	}
+	return signed + "." + b64.EncodeToString(sig)
+}
+
+func TestJWTVerify(t *testing.T) {
+	keys, path := newTestJWKS(t)
+	j := &jwtAuth{JWKS: path, Issuer: "https://idp.example", Audience: "fcland", TenantClaim: "tenant"}
+	now := time.Now()
+
+	claims := func(change func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":    "https://idp.example",
+			"aud":    "fcland",
+			"exp":    now.Add(time.Hour).Unix(),
+			"nbf":    now.Add(-time.Minute).Unix(),
+			"tenant": "acme",
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+
+	for _, c := range []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"es256", keys.sign(t, "ES256", "ec", "ec", claims(nil)), true},
+		{"eddsa", keys.sign(t, "EdDSA", "ed", "ed", claims(nil)), true},
+		{"audience list", keys.sign(t, "ES256", "ec", "ec", claims(func(c map[string]interface{}) {
+			c["aud"] = []string{"other", "fcland"}
+		})), true},
+		{"expiry within leeway", keys.sign(t, "ES256", "ec", "ec", claims(func(c map[string]interface{}) {
+			c["exp"] = now.Add(-30 * time.Second).Unix()
+		})), true},
+
+		{"alg none", keys.sign(t, "none", "ec", "none", claims(nil)), false},
+		{"alg none without kid", keys.sign(t, "none", "", "none", claims(nil)), false},
+		{"hmac with the public key", keys.sign(t, "HS256", "ec", "hmac", claims(nil)), false},
+		{"rsa alg on ec key", keys.sign(t, "RS256", "ec", "ec", claims(nil)), false},
+		{"ec alg on ed25519 key", keys.sign(t, "ES256", "ed", "ed", claims(nil)), false},
+		{"eddsa alg on rsa key", keys.sign(t, "EdDSA", "rsa", "ed", claims(nil)), false},
+		{"signed by another key", keys.sign(t, "EdDSA", "ed", "ec", claims(nil)), false},
+		{"unknown kid", keys.sign(t, "ES256", "rotated", "ec", claims(nil)), false},
+		{"expired", keys.sign(t, "ES256", "ec", "ec", claims(func(c map[string]interface{}) {
+			c["exp"] = now.Add(-time.Hour).Unix()
+		})), false},
+		{"no expiry", keys.sign(t, "ES256", "ec", "ec", claims(func(c map[string]interface{}) {
+			delete(c, "exp")
+		})), false},
+		{"not valid yet", keys.sign(t, "ES256", "ec", "ec", claims(func(c map[string]interface{}) {
+			c["nbf"] = now.Add(time.Hour).Unix()
+		})), false},
+		{"wrong audience", keys.sign(t, "ES256", "ec", "ec", claims(func(c map[string]interface{}) {
+			c["aud"] = "other"
+		})), false},
+		{"no audience", keys.sign(t, "ES256", "ec", "ec", claims(func(c map[string]interface{}) {
+			delete(c, "aud")
+		})), false},
+		{"wrong issuer", keys.sign(t, "ES256", "ec", "ec", claims(func(c map[string]interface{}) {
+			c["iss"] = "https://evil.example"
+		})), false},
+		{"no tenant", keys.sign(t, "ES256", "ec", "ec", claims(func(c map[string]interface{}) {
+			delete(c, "tenant")
+		})), false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			tenant, err := j.verify(c.token, now)
+			if c.ok {
+				if err != nil || tenant != "acme" {
+					t.Fatalf("got %q, %v, want acme", tenant, err)
+				}
+				return
+			}
+			if !errors.Is(err, errUnauthenticated) {
+				t.Fatalf("got %q, %v, want an authentication error", tenant, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+// balloon file is used to manage the memory balloon of vms, it lets the host take back the
+// memory guests do not use, by hand or when the host itself runs short of memory.
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	log "github.com/sirupsen/logrus"
+)
+
+// validateBalloon checks the balloon b fits in the memory of the vm
+func validateBalloon(b *BalloonConfig, memSizeMiB int64) error {
+	if b == nil {
+		return nil
+	}
+	if b.AmountMiB < 0 || b.AmountMiB >= memSizeMiB {
+		return fmt.Errorf("balloon amount must be between 0 and %d MiB", memSizeMiB-1)
+	}
+	if b.StatsIntervalS < 0 {
+		return fmt.Errorf("balloon statistics interval can not be negative")
+	}
+	return nil
+}
+
+// balloonHandler creates the balloon before the guest boots, it can not be added later on
+func (o *options) balloonHandler() firecracker.Handler {
+	b := o.Balloon
+	return firecracker.NewCreateBalloonHandler(b.AmountMiB, b.DeflateOnOOM, b.StatsIntervalS)
+}
+
+// setBalloon inflates or deflates the balloon of the vm to amountMiB. The target is kept
+// as the amount of the balloon unless reclaim is set, the reclaim policy gives it back later on.
+func (f *Firecracker) setBalloon(ctx context.Context, amountMiB int64, reclaim bool) error {
+	if f.opts.Balloon == nil {
+		return fmt.Errorf("the vm has no balloon")
+	}
+	if amountMiB < 0 || amountMiB >= f.opts.FcMemSz {
+		return fmt.Errorf("balloon amount must be between 0 and %d MiB", f.opts.FcMemSz-1)
+	}
+
+	if err := f.vm.UpdateBalloon(ctx, amountMiB); err != nil {
+		return fmt.Errorf("failed to update balloon: %v", err)
+	}
+
+	f.balloonMu.Lock()
+	f.reclaimed = reclaim
+	if !reclaim {
+		f.opts.Balloon.AmountMiB = amountMiB
+	}
+	f.balloonMu.Unlock()
+
+	return nil
+}
+
+// pollBalloon collects the balloon statistics of the vm until stop is closed
+func (f *Firecracker) pollBalloon(stop <-chan struct{}) {
+	if f.opts.Balloon == nil || f.opts.Balloon.StatsIntervalS == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Duration(f.opts.Balloon.StatsIntervalS) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		stats, err := f.vm.GetBalloonStats(ctx)
+		cancel()
+		if err != nil {
+			f.opts.Logger.Debugf("failed to get balloon statistics of vm %s: %v", f.ID, err)
+			continue
+		}
+
+		f.balloonMu.Lock()
+		f.balloonStats = &BalloonStats{
+			TargetMiB:       firecracker.Int64Value(stats.TargetMib),
+			ActualMiB:       firecracker.Int64Value(stats.ActualMib),
+			TotalMemory:     stats.TotalMemory,
+			FreeMemory:      stats.FreeMemory,
+			AvailableMemory: stats.AvailableMemory,
+			DiskCaches:      stats.DiskCaches,
+			MajorFaults:     stats.MajorFaults,
+			MinorFaults:     stats.MinorFaults,
+			SwapIn:          stats.SwapIn,
+			SwapOut:         stats.SwapOut,
+			UpdatedAt:       time.Now(),
+		}
+		f.balloonMu.Unlock()
+	}
+}
+
+// balloonState is the balloon of the vm as shown by the api
+func (f *Firecracker) balloonState() *BalloonState {
+	if f.opts.Balloon == nil {
+		return nil
+	}
+
+	f.balloonMu.Lock()
+	defer f.balloonMu.Unlock()
+
+	return &BalloonState{
+		BalloonConfig: *f.opts.Balloon,
+		Reclaimed:     f.reclaimed,
+		Stats:         f.balloonStats,
+	}
+}
+
+// hostMemory reads the total and available memory of the host in MiB
+func hostMemory() (total, available int64, err error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kib, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = kib >> 10
+		case "MemAvailable:":
+			available = kib >> 10
+		}
+	}
+	if total == 0 {
+		return 0, 0, fmt.Errorf("no MemTotal in /proc/meminfo")
+	}
+
+	return total, available, scanner.Err()
+}
+
+// reclaimMemory inflates the balloons of idle vms while the host has less than conf.ReclaimThreshold
+// percent of its memory available, and deflates them back to their own amount once it has twice as much.
+// A vm is idle when its guest has more than conf.BalloonReserve MiB available, that much is left to it.
+func reclaimMemory(ctx context.Context) {
+	ticker := time.NewTicker(conf.ReclaimInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		total, available, err := hostMemory()
+		if err != nil {
+			log.Errorf("failed to read host memory: %v", err)
+			continue
+		}
+
+		percent := available * 100 / total
+		switch {
+		case percent < int64(conf.ReclaimThreshold):
+			for _, m := range listVms() {
+				m.reclaim(ctx)
+			}
+		case percent >= 2*int64(conf.ReclaimThreshold):
+			for _, m := range listVms() {
+				m.giveBack(ctx)
+			}
+		}
+	}
+}
+
+// reclaim inflates the balloon of the vm over the memory its guest does not need
+func (f *Firecracker) reclaim(ctx context.Context) {
+	state := f.balloonState()
+	if f.currentState() != StateStarted || state == nil || state.Stats == nil {
+		return
+	}
+
+	spare := state.Stats.AvailableMemory>>20 - conf.BalloonReserve
+	if spare <= 0 {
+		return
+	}
+
+	target := state.Stats.ActualMiB + spare
+	if limit := f.opts.FcMemSz - conf.BalloonReserve; target > limit {
+		target = limit
+	}
+	if target <= state.Stats.TargetMiB {
+		return
+	}
+
+	if err := f.setBalloon(ctx, target, true); err != nil {
+		f.opts.Logger.Errorf("failed to reclaim memory of vm %s: %v", f.ID, err)
+		return
+	}
+	f.opts.Logger.Infof("reclaiming %d MiB from vm %s", target-state.Stats.ActualMiB, f.ID)
+}
+
+// giveBack deflates the balloon of the vm back to its own amount after a reclaim
+func (f *Firecracker) giveBack(ctx context.Context) {
+	state := f.balloonState()
+	if f.currentState() != StateStarted || state == nil || !state.Reclaimed {
+		return
+	}
+
+	if err := f.setBalloon(ctx, state.AmountMiB, false); err != nil {
+		f.opts.Logger.Errorf("failed to give memory back to vm %s: %v", f.ID, err)
+		return
+	}
+	f.opts.Logger.Infof("gave memory back to vm %s", f.ID)
+}
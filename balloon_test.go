@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+func TestValidateBalloon(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		balloon *BalloonConfig
+		ok      bool
+	}{
+		{"none", nil, true},
+		{"deflated", &BalloonConfig{}, true},
+		{"largest", &BalloonConfig{AmountMiB: 255}, true},
+		{"all the memory", &BalloonConfig{AmountMiB: 256}, false},
+		{"negative", &BalloonConfig{AmountMiB: -1}, false},
+		{"negative interval", &BalloonConfig{StatsIntervalS: -1}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if err := validateBalloon(c.balloon, 256); (err == nil) != c.ok {
+				t.Fatalf("got %v", err)
+			}
+		})
+	}
+}
+
+// balloonAPI records the balloon amounts firecracker is asked for
+type balloonAPI struct {
+	mu      sync.Mutex
+	amounts []int64
+}
+
+func (a *balloonAPI) serve(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "api.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			AmountMib int64 `json:"amount_mib"`
+		}
+		data, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPatch || r.URL.Path != "/balloon" || json.Unmarshal(data, &body) != nil {
+			http.Error(w, `{"fault_message":"unexpected request"}`, http.StatusBadRequest)
+			return
+		}
+		a.mu.Lock()
+		a.amounts = append(a.amounts, body.AmountMib)
+		a.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return path
+}
+
+// take returns the amounts asked for since the previous call
+func (a *balloonAPI) take() []int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	amounts := a.amounts
+	a.amounts = nil
+	return amounts
+}
+
+func TestReclaim(t *testing.T) {
+	saved := conf
+	defer func() { conf = saved }()
+	conf.BalloonReserve = 64
+
+	api := new(balloonAPI)
+	socket := api.serve(t)
+
+	vm := func(state VmState, stats *BalloonStats) *Firecracker {
+		m := testVm(t, "ballooned", 0, state)
+		m.opts.FcMemSz = 1024
+		m.opts.Balloon = &BalloonConfig{AmountMiB: 16}
+		m.balloonStats = stats
+		var err error
+		m.vm, err = firecracker.NewMachine(context.Background(), firecracker.Config{VMID: m.ID, SocketPath: socket})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	for _, c := range []struct {
+		name   string
+		state  VmState
+		stats  *BalloonStats
+		amount int64
+	}{
+		{"idle", StateStarted, &BalloonStats{TargetMiB: 16, ActualMiB: 16, AvailableMemory: 512 << 20}, 16 + 512 - 64},
+		{"capped", StateStarted, &BalloonStats{TargetMiB: 16, ActualMiB: 500, AvailableMemory: 800 << 20}, 1024 - 64},
+		{"busy", StateStarted, &BalloonStats{TargetMiB: 16, ActualMiB: 16, AvailableMemory: 32 << 20}, 0},
+		{"reclaimed already", StateStarted, &BalloonStats{TargetMiB: 464, ActualMiB: 400, AvailableMemory: 100 << 20}, 0},
+		{"no statistics", StateStarted, nil, 0},
+		{"exited", StateExited, &BalloonStats{ActualMiB: 16, AvailableMemory: 512 << 20}, 0},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			m := vm(c.state, c.stats)
+			m.reclaim(context.Background())
+
+			amounts := api.take()
+			if c.amount == 0 {
+				if len(amounts) != 0 || m.balloonState().Reclaimed {
+					t.Fatalf("the balloon was set to %v", amounts)
+				}
+				return
+			}
+			if len(amounts) != 1 || amounts[0] != c.amount {
+				t.Fatalf("the balloon was set to %v, want %d", amounts, c.amount)
+			}
+
+			// the amount of the vm is kept, the balloon goes back to it once the host has memory again
+			state := m.balloonState()
+			if !state.Reclaimed || state.AmountMiB != 16 {
+				t.Fatalf("got %+v after reclaiming", state)
+			}
+			m.giveBack(context.Background())
+			if amounts := api.take(); len(amounts) != 1 || amounts[0] != 16 {
+				t.Fatalf("the balloon was set to %v, want 16", amounts)
+			}
+			if m.balloonState().Reclaimed {
+				t.Fatal("the vm is still reclaimed")
+			}
+			m.giveBack(context.Background())
+			if amounts := api.take(); len(amounts) != 0 {
+				t.Fatalf("the balloon of a vm not reclaimed was set to %v", amounts)
+			}
+		})
+	}
+}
+
+func TestSetBalloon(t *testing.T) {
+	api := new(balloonAPI)
+	m := testVm(t, "ballooned", 0, StateStarted)
+	m.opts.Balloon = &BalloonConfig{}
+	var err error
+	m.vm, err = firecracker.NewMachine(context.Background(), firecracker.Config{VMID: m.ID, SocketPath: api.serve(t)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the api reads the balloon while it changes
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				vmResource(m)
+			}
+		}
+	}()
+	for amount := int64(1); amount <= 128 && err == nil; amount *= 2 {
+		err = m.setBalloon(context.Background(), amount, false)
+	}
+	close(stop)
+	<-done
+	if err != nil || m.balloonState().AmountMiB != 128 {
+		t.Fatalf("got %+v, %v", m.balloonState(), err)
+	}
+
+	for _, amount := range []int64{-1, m.opts.FcMemSz} {
+		if err := m.setBalloon(context.Background(), amount, false); err == nil {
+			t.Fatalf("the balloon was set to %d MiB out of %d", amount, m.opts.FcMemSz)
+		}
+	}
+	m.opts.Balloon = nil
+	if err := m.setBalloon(context.Background(), 0, false); err == nil {
+		t.Fatal("a vm without balloon was given one")
+	}
+}
@@ -0,0 +1,59 @@
+// admin file holds the calls only admins may make: volumes, logging and the usage of the host.
+
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// CreateVolume creates an empty ext4 data volume
+func (c *Client) CreateVolume(ctx context.Context, in *VolumeRequest) (*Volume, error) {
+	out := new(Volume)
+	if err := c.call(ctx, http.MethodPost, "/volumes", nil, in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Volumes lists the data volumes along with the vms using them
+func (c *Client) Volumes(ctx context.Context) ([]Volume, error) {
+	var out []Volume
+	if err := c.call(ctx, http.MethodGet, "/volumes", nil, nil, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeleteVolume deletes the data volume name, no vm may be using it
+func (c *Client) DeleteVolume(ctx context.Context, name string) error {
+	return c.call(ctx, http.MethodDelete, "/volumes/"+url.PathEscape(name), nil, nil, nil)
+}
+
+// Logging returns the level and format of the daemon logs
+func (c *Client) Logging(ctx context.Context) (*LoggingConfig, error) {
+	out := new(LoggingConfig)
+	if err := c.call(ctx, http.MethodGet, "/admin/logging", nil, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SetLogging changes the level and format of the daemon logs
+func (c *Client) SetLogging(ctx context.Context, in *LoggingConfig) (*LoggingConfig, error) {
+	out := new(LoggingConfig)
+	if err := c.call(ctx, http.MethodPut, "/admin/logging", nil, in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// HostUsage returns what the vms of every tenant hold on to and what the host can give them
+func (c *Client) HostUsage(ctx context.Context) (*HostUsage, error) {
+	out := new(HostUsage)
+	if err := c.call(ctx, http.MethodGet, "/admin/usage", nil, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,229 @@
+// Package client is the go client of the firecracker-land daemon api.
+//
+//	c, err := client.New("http://localhost:8080", client.WithToken(os.Getenv("FCLAND_TOKEN")))
+//	vm, err := c.CreateVm(ctx, &client.CreateRequest{Name: "hello", DockerImage: "hello-world"})
+//
+// The daemon is reached over http, https or its unix socket when the address is unix:///path.
+// Failed calls return an *Error carrying the status and the message of the daemon.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// apiPrefix is the path of the versioned api on the daemon
+const apiPrefix = "/api/v1"
+
+// requestIDHeader is the header the daemon tags requests and their logs with
+const requestIDHeader = "X-Request-Id"
+
+// Client calls the api of a daemon, it is safe for concurrent use
+type Client struct {
+	base       *url.URL
+	httpClient *http.Client
+	token      string
+	socket     string
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient makes the client send its requests through h, e.g. to set up tls or timeouts.
+// Streams last as long as their context, so h should not set an overall Timeout.
+func WithHTTPClient(h *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = h
+	}
+}
+
+// WithToken authenticates the requests with the api token or JWT token
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// New is the client of the daemon at addr, such as http://localhost:8080, https://fcland:8443
+// or unix:///run/fcland.sock
+func New(addr string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid daemon address %q: %v", addr, err)
+	}
+
+	c := &Client{httpClient: http.DefaultClient}
+
+	switch u.Scheme {
+	case "http", "https":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid daemon address %q: missing host", addr)
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/")
+		c.base = u
+	case "unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("invalid daemon address %q: missing socket path", addr)
+		}
+		c.socket = u.Path
+		c.base = &url.URL{Scheme: "http", Host: "fcland"}
+	default:
+		return nil, fmt.Errorf("invalid daemon address %q: use http, https or unix", addr)
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	// the unix socket is dialed whatever the host of the requests is
+	if c.socket != "" {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", c.socket)
+		}
+		h := *c.httpClient
+		h.Transport = transport
+		c.httpClient = &h
+	}
+
+	return c, nil
+}
+
+// Error is a call the daemon answered with a failure
+type Error struct {
+	StatusCode int
+	Message    string
+	// RequestID tags the logs of the daemon about the call
+	RequestID string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("daemon answered %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("%s (%d %s)", e.Message, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// StatusCode is the status the daemon answered the failed call err with, 0 when it did not answer
+func StatusCode(err error) int {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.StatusCode
+	}
+	return 0
+}
+
+// IsNotFound tells whether err is about a vm or volume which does not exist, or is not visible to the caller
+func IsNotFound(err error) bool {
+	return StatusCode(err) == http.StatusNotFound
+}
+
+// IsConflict tells whether err is about an action the state of the vm does not allow or the host
+// lacking the capacity to run a vm
+func IsConflict(err error) bool {
+	return StatusCode(err) == http.StatusConflict
+}
+
+// IsQuotaExceeded tells whether err is about a vm which would take its tenant over its quota
+func IsQuotaExceeded(err error) bool {
+	return StatusCode(err) == http.StatusTooManyRequests
+}
+
+// decodeError turns the failed response res into an *Error
+func decodeError(res *http.Response) error {
+	e := &Error{StatusCode: res.StatusCode, RequestID: res.Header.Get(requestIDHeader)}
+
+	var msg Message
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&msg); err == nil {
+		e.Message = msg.Message
+	}
+	return e
+}
+
+// url is the url of the api route at path with the query q, path is already escaped
+func (c *Client) url(path string, q url.Values) string {
+	u := c.base.String() + apiPrefix + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	return u
+}
+
+// newRequest is the authenticated request to the api route at path
+func (c *Client) newRequest(ctx context.Context, method, path string, q url.Values, body io.Reader, contentType string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.url(path, q), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// send makes the request and returns its response when it succeeded, it is up to the caller to close its body
+func (c *Client) send(ctx context.Context, method, path string, q url.Values, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := c.newRequest(ctx, method, path, q, body, contentType)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(req)
+}
+
+// do sends req and returns its response when it succeeded
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		defer res.Body.Close()
+		return nil, decodeError(res)
+	}
+	return res, nil
+}
+
+// call sends in as json and decodes the json response into out, either may be nil
+func (c *Client) call(ctx context.Context, method, path string, q url.Values, in, out interface{}) error {
+	var body io.Reader
+	contentType := ""
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body, contentType = bytes.NewReader(data), "application/json"
+	}
+
+	res, err := c.send(ctx, method, path, q, body, contentType)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if out == nil {
+		io.Copy(io.Discard, res.Body)
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
+
+// vmPath is the path of the route below the vm id
+func vmPath(id, route string) string {
+	return "/vms/" + url.PathEscape(id) + route
+}
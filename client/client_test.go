@@ -0,0 +1,261 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeDaemon answers the api routes the tests call the way the daemon does
+func fakeDaemon(t *testing.T) http.Handler {
+	vms := []CreateResponse{{ID: "a", Name: "one"}, {ID: "b", Name: "two"}, {ID: "c", Name: "three"}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiPrefix+"/vms", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set(requestIDHeader, "req-1")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(Message{Message: "invalid token"})
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			in := new(CreateRequest)
+			if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+				t.Errorf("failed to decode the create request: %v", err)
+			}
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(CreateResponse{ID: "new", Name: in.Name, Image: in.DockerImage, State: StateStarted})
+		case http.MethodGet:
+			// pages of two vms, the cursor is the id of the last vm of the previous page
+			start := 0
+			for i, vm := range vms {
+				if vm.ID == r.URL.Query().Get("cursor") {
+					start = i + 1
+				}
+			}
+			end := start + 2
+			list := VmList{}
+			if end < len(vms) {
+				list.NextCursor = vms[end-1].ID
+			} else {
+				end = len(vms)
+			}
+			list.Items = vms[start:end]
+			json.NewEncoder(w).Encode(list)
+		}
+	})
+	mux.HandleFunc(apiPrefix+"/vms/missing", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(Message{Message: "vm not found"})
+	})
+	mux.HandleFunc(apiPrefix+"/vms/a b/actions/pause", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(CreateResponse{ID: "a b", State: StatePaused})
+	})
+	mux.HandleFunc(apiPrefix+"/vms/a/exec", func(w http.ResponseWriter, r *http.Request) {
+		code := 3
+		enc := json.NewEncoder(w)
+		enc.Encode(ExecEvent{Type: ExecStdout, Data: []byte("out")})
+		enc.Encode(ExecEvent{Type: ExecStderr, Data: []byte("err")})
+		enc.Encode(ExecEvent{Type: ExecExit, ExitCode: &code})
+	})
+	mux.HandleFunc(apiPrefix+"/vms/a/files", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("path") != "/etc/hostname" {
+			t.Errorf("unexpected path %q", r.URL.Query().Get("path"))
+		}
+		w.Header().Set("X-File-Mode", "600")
+		w.Header().Set("X-File-Uid", "1000")
+		w.Header().Set("X-File-Gid", "100")
+		io.WriteString(w, "fcland")
+	})
+	mux.HandleFunc(apiPrefix+"/apply", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(ApplyResult{Environment: "staging", Changes: []ApplyChange{
+			{Name: "web", Action: ApplyCreate, VmID: "new"},
+			{Name: "db", Action: ApplyReplace, Error: "volume is used by a vm"},
+		}})
+	})
+	mux.HandleFunc(apiPrefix+"/events", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("type"); got != "started,exited" {
+			t.Errorf("unexpected type filter %q", got)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, ": keep-alive\n\n")
+		for _, e := range []Event{{ID: 7, Type: EventStarted, VmID: "a"}, {ID: 8, Type: EventExited, VmID: "a"}} {
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+		}
+	})
+
+	return mux
+}
+
+func TestCalls(t *testing.T) {
+	srv := httptest.NewServer(fakeDaemon(t))
+	defer srv.Close()
+
+	c, err := New(srv.URL, WithToken("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	vm, err := c.CreateVm(ctx, &CreateRequest{Name: "hello", DockerImage: "hello-world"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.ID != "new" || vm.Name != "hello" || vm.Image != "hello-world" || vm.State != StateStarted {
+		t.Errorf("unexpected vm %+v", vm)
+	}
+
+	vms, err := c.AllVms(ctx, &ListOptions{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vms) != 3 || vms[2].ID != "c" {
+		t.Errorf("expected the 3 vms of both pages, got %+v", vms)
+	}
+
+	// the daemon answers 422 when changes failed, the result still tells which
+	result, err := c.ApplyYAML(ctx, strings.NewReader("environment: staging\n"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Changes) != 2 || result.Changes[1].Error == "" {
+		t.Errorf("unexpected apply result %+v", result)
+	}
+
+	// ids are escaped in the path
+	vm, err = c.PauseVm(ctx, "a b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vm.State != StatePaused {
+		t.Errorf("expected a paused vm, got %s", vm.State)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	srv := httptest.NewServer(fakeDaemon(t))
+	defer srv.Close()
+
+	c, err := New(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.ListVms(context.Background(), nil)
+	e, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("expected an *Error, got %v", err)
+	}
+	if e.StatusCode != http.StatusUnauthorized || e.Message != "invalid token" || e.RequestID != "req-1" {
+		t.Errorf("unexpected error %+v", e)
+	}
+
+	_, err = c.GetVm(context.Background(), "missing")
+	if !IsNotFound(err) || IsConflict(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+
+	for _, addr := range []string{"localhost:8080", "http://", "unix://", "ftp://host"} {
+		if _, err := New(addr); err == nil {
+			t.Errorf("expected address %q to be rejected", addr)
+		}
+	}
+}
+
+func TestStreams(t *testing.T) {
+	srv := httptest.NewServer(fakeDaemon(t))
+	defer srv.Close()
+
+	c, err := New(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	exec, err := c.Exec(ctx, "a", &ExecRequest{Args: []string{"hostname"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout, stderr bytes.Buffer
+	code, err := exec.Wait(&stdout, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 3 || stdout.String() != "out" || stderr.String() != "err" {
+		t.Errorf("unexpected exec result %d %q %q", code, stdout.String(), stderr.String())
+	}
+
+	f, err := c.Download(ctx, "a", "/etc/hostname", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != "fcland" || f.Archive || f.Mode != 0600 || f.UID != 1000 || f.GID != 100 {
+		t.Errorf("unexpected file %q %+v", data, f)
+	}
+
+	stream, err := c.Events(ctx, &EventOptions{Types: []EventType{EventStarted, EventExited}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	for _, want := range []EventType{EventStarted, EventExited} {
+		e, err := stream.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Type != want || e.VmID != "a" {
+			t.Errorf("expected a %s event, got %+v", want, e)
+		}
+	}
+	if stream.LastEventID != 8 {
+		t.Errorf("expected the stream to resume after 8, got %d", stream.LastEventID)
+	}
+	if _, err := stream.Next(); err != io.EOF {
+		t.Errorf("expected the end of the stream, got %v", err)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "fcland.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("unix sockets are not available: %v", err)
+	}
+
+	srv := httptest.NewUnstartedServer(fakeDaemon(t))
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+
+	c, err := New("unix://"+sock, WithToken("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	vms, err := c.AllVms(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vms) != 3 {
+		t.Errorf("expected 3 vms, got %d", len(vms))
+	}
+
+	// the socket is dialed by a copy of the http client given
+	if http.DefaultClient.Transport != nil {
+		t.Errorf("the default http client was modified")
+	}
+}
@@ -0,0 +1,425 @@
+// streams file holds the calls streaming data in or out of the daemon: consoles, commands run
+// in vms, events, snapshots and files.
+
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// tarContentType is the content type of the archives of directories
+const tarContentType = "application/x-tar"
+
+// Console returns the serial console output of the vm id, only its last tail lines when tail is positive
+func (c *Client) Console(ctx context.Context, id string, tail int) ([]byte, error) {
+	res, err := c.send(ctx, http.MethodGet, vmPath(id, "/console"), tailQuery(tail), nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return io.ReadAll(res.Body)
+}
+
+// FollowConsole streams the serial console output of the vm id until ctx is done or the stream is
+// closed, starting with its last tail lines
+func (c *Client) FollowConsole(ctx context.Context, id string, tail int) (io.ReadCloser, error) {
+	q := tailQuery(tail)
+	q.Set("follow", "true")
+	res, err := c.send(ctx, http.MethodGet, vmPath(id, "/console"), q, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// AttachConsole attaches to the serial console of the vm id over a websocket. Binary messages
+// carry the output, starting with the last tail lines, and the messages written are its input.
+func (c *Client) AttachConsole(ctx context.Context, id string, tail int, readOnly bool) (*websocket.Conn, error) {
+	q := tailQuery(tail)
+	if readOnly {
+		q.Set("readonly", "true")
+	}
+	return c.dial(ctx, vmPath(id, "/console/attach"), q)
+}
+
+func tailQuery(tail int) url.Values {
+	q := url.Values{}
+	if tail > 0 {
+		q.Set("tail", strconv.Itoa(tail))
+	}
+	return q
+}
+
+// ExecStream is the output of a command run in a vm
+type ExecStream struct {
+	body io.ReadCloser
+	dec  *json.Decoder
+}
+
+// Exec runs a command in the vm id and streams its output
+func (c *Client) Exec(ctx context.Context, id string, in *ExecRequest) (*ExecStream, error) {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.send(ctx, http.MethodPost, vmPath(id, "/exec"), nil, bytes.NewReader(data), "application/json")
+	if err != nil {
+		return nil, err
+	}
+	return &ExecStream{body: res.Body, dec: json.NewDecoder(res.Body)}, nil
+}
+
+// Next returns the next event of the command, io.EOF once the stream ended
+func (s *ExecStream) Next() (*ExecEvent, error) {
+	ev := new(ExecEvent)
+	if err := s.dec.Decode(ev); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("failed to decode exec event: %v", err)
+	}
+	return ev, nil
+}
+
+// Wait copies the output of the command to stdout and stderr until it exits and returns its exit code
+func (s *ExecStream) Wait(stdout, stderr io.Writer) (int, error) {
+	defer s.Close()
+	for {
+		ev, err := s.Next()
+		if err == io.EOF {
+			return 0, fmt.Errorf("the stream ended before the command exited")
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		switch ev.Type {
+		case ExecStdout:
+			stdout.Write(ev.Data)
+		case ExecStderr:
+			stderr.Write(ev.Data)
+		case ExecError:
+			return 0, fmt.Errorf("command failed: %s", ev.Error)
+		case ExecExit:
+			if ev.ExitCode == nil {
+				return 0, fmt.Errorf("the command exited without an exit code")
+			}
+			return *ev.ExitCode, nil
+		}
+	}
+}
+
+// Close stops reading the output, the command is left to run
+func (s *ExecStream) Close() error {
+	return s.body.Close()
+}
+
+// ExecSession is an interactive command run in a vm over a websocket. Its input and controls may
+// be sent from several goroutines, while events are read from a single one.
+type ExecSession struct {
+	conn *websocket.Conn
+	// mu serializes the writes to conn
+	mu sync.Mutex
+}
+
+// AttachExec runs an interactive command in the vm id, set in.Tty for a terminal
+func (c *Client) AttachExec(ctx context.Context, id string, in *ExecRequest) (*ExecSession, error) {
+	conn, err := c.dial(ctx, vmPath(id, "/exec/attach"), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.WriteJSON(in); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &ExecSession{conn: conn}, nil
+}
+
+// Write sends p to the input of the command
+func (s *ExecSession) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Resize changes the size of the terminal of the command
+func (s *ExecSession) Resize(rows, cols uint16) error {
+	return s.control(ExecControl{Type: ExecResize, Rows: rows, Cols: cols})
+}
+
+// Signal delivers sig, such as SIGINT, to the command
+func (s *ExecSession) Signal(sig string) error {
+	return s.control(ExecControl{Type: ExecSignal, Signal: sig})
+}
+
+// CloseStdin closes the input of the command
+func (s *ExecSession) CloseStdin() error {
+	return s.control(ExecControl{Type: ExecCloseStdin})
+}
+
+func (s *ExecSession) control(c ExecControl) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn.WriteJSON(c)
+}
+
+// Next returns the next event of the command, io.EOF once the daemon closed the session
+func (s *ExecSession) Next() (*ExecEvent, error) {
+	ev := new(ExecEvent)
+	if err := s.conn.ReadJSON(ev); err != nil {
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return ev, nil
+}
+
+// Close ends the session, the daemon stops the command when it still runs
+func (s *ExecSession) Close() error {
+	return s.conn.Close()
+}
+
+// dial opens a websocket to the api route at path
+func (c *Client) dial(ctx context.Context, path string, q url.Values) (*websocket.Conn, error) {
+	u, _ := url.Parse(c.url(path, q))
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+
+	transport := c.httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	dialer := &websocket.Dialer{Proxy: http.ProxyFromEnvironment}
+	if t, ok := transport.(*http.Transport); ok {
+		dialer.NetDialContext = t.DialContext
+		dialer.TLSClientConfig = t.TLSClientConfig
+		dialer.Proxy = t.Proxy
+	}
+
+	header := http.Header{}
+	if c.token != "" {
+		header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	conn, res, err := dialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		if res != nil && res.StatusCode >= 300 {
+			return nil, decodeError(res)
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// EventOptions select the events followed, zero fields are ignored
+type EventOptions struct {
+	VmIDs []string
+	Types []EventType
+	// LastEventID is the id of the last event received, the events the daemon kept since are sent first
+	LastEventID uint64
+}
+
+// EventStream is a stream of events of the daemon
+type EventStream struct {
+	body   io.ReadCloser
+	reader *bufio.Reader
+	// LastEventID is the id of the last event read, to resume the stream from
+	LastEventID uint64
+}
+
+// Events follows the events of the vms of the caller until ctx is done or the stream is closed
+func (c *Client) Events(ctx context.Context, opts *EventOptions) (*EventStream, error) {
+	q := url.Values{}
+	var after uint64
+	if opts != nil {
+		if len(opts.VmIDs) > 0 {
+			q.Set("vm_id", strings.Join(opts.VmIDs, ","))
+		}
+		if len(opts.Types) > 0 {
+			types := make([]string, len(opts.Types))
+			for i, t := range opts.Types {
+				types[i] = string(t)
+			}
+			q.Set("type", strings.Join(types, ","))
+		}
+		if opts.LastEventID > 0 {
+			q.Set("last_event_id", strconv.FormatUint(opts.LastEventID, 10))
+		}
+		after = opts.LastEventID
+	}
+
+	res, err := c.send(ctx, http.MethodGet, "/events", q, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return &EventStream{body: res.Body, reader: bufio.NewReader(res.Body), LastEventID: after}, nil
+}
+
+// Next returns the next event, io.EOF once the daemon ended the stream. The daemon ends the
+// streams of clients too slow to keep up, they can resume from LastEventID.
+func (s *EventStream) Next() (*Event, error) {
+	var data []string
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && line == "" {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "":
+			// a blank line dispatches the event read so far, comments dispatch nothing
+			if data == nil {
+				continue
+			}
+			e := new(Event)
+			if err := json.Unmarshal([]byte(strings.Join(data, "\n")), e); err != nil {
+				return nil, fmt.Errorf("failed to decode event: %v", err)
+			}
+			s.LastEventID = e.ID
+			return e, nil
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+}
+
+// Close ends the stream
+func (s *EventStream) Close() error {
+	return s.body.Close()
+}
+
+// ExportSnapshot streams a snapshot archive of the running vm id
+func (c *Client) ExportSnapshot(ctx context.Context, id string) (io.ReadCloser, error) {
+	res, err := c.send(ctx, http.MethodGet, vmPath(id, "/snapshot"), nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// ImportSnapshot restores the vm of the snapshot archive r, force skips the firecracker version check
+func (c *Client) ImportSnapshot(ctx context.Context, r io.Reader, force bool) (*CreateResponse, error) {
+	q := url.Values{}
+	if force {
+		q.Set("force", "true")
+	}
+	res, err := c.send(ctx, http.MethodPost, "/snapshots/import", q, r, "application/gzip")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	out := new(CreateResponse)
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+	return out, nil
+}
+
+// File is a file or a tar archive pulled out of a vm
+type File struct {
+	io.ReadCloser
+	// Archive is set when the body is a tar archive, of a directory or when asked for
+	Archive bool
+	// Mode, UID and GID are those of a single file, UID and GID are -1 for archives
+	Mode     os.FileMode
+	UID, GID int
+}
+
+// Download pulls the file at the absolute path out of the vm id, or a tar archive when path is
+// a directory or archive is set
+func (c *Client) Download(ctx context.Context, id, path string, archive bool) (*File, error) {
+	q := url.Values{"path": {path}}
+	if archive {
+		q.Set("archive", "true")
+	}
+	res, err := c.send(ctx, http.MethodGet, vmPath(id, "/files"), q, nil, "")
+	if err != nil {
+		return nil, err
+	}
+
+	f := &File{ReadCloser: res.Body, UID: -1, GID: -1, Mode: 0644}
+	if res.Header.Get("Content-Type") == tarContentType {
+		f.Archive = true
+		return f, nil
+	}
+	if mode, err := strconv.ParseUint(res.Header.Get("X-File-Mode"), 8, 32); err == nil {
+		f.Mode = os.FileMode(mode)
+	}
+	if uid, err := strconv.Atoi(res.Header.Get("X-File-Uid")); err == nil {
+		f.UID = uid
+	}
+	if gid, err := strconv.Atoi(res.Header.Get("X-File-Gid")); err == nil {
+		f.GID = gid
+	}
+	return f, nil
+}
+
+// UploadOptions are the mode and owner of a file pushed into a vm, root owned 0644 by default
+type UploadOptions struct {
+	Mode     os.FileMode
+	UID, GID *int
+}
+
+// Upload pushes the content of r as the file at the absolute path of the vm id. size is the
+// length of r, or -1 when it is not known.
+func (c *Client) Upload(ctx context.Context, id, path string, r io.Reader, size int64, opts *UploadOptions) error {
+	q := url.Values{"path": {path}}
+	if opts != nil {
+		if opts.Mode != 0 {
+			q.Set("mode", strconv.FormatUint(uint64(opts.Mode.Perm()), 8))
+		}
+		if opts.UID != nil {
+			q.Set("uid", strconv.Itoa(*opts.UID))
+		}
+		if opts.GID != nil {
+			q.Set("gid", strconv.Itoa(*opts.GID))
+		}
+	}
+	return c.upload(ctx, id, q, r, size, "application/octet-stream")
+}
+
+// UploadArchive extracts the tar archive r into the directory at the absolute path of the vm id,
+// keeping the modes and owners of its entries
+func (c *Client) UploadArchive(ctx context.Context, id, path string, r io.Reader) error {
+	return c.upload(ctx, id, url.Values{"path": {path}}, r, -1, tarContentType)
+}
+
+func (c *Client) upload(ctx context.Context, id string, q url.Values, r io.Reader, size int64, contentType string) error {
+	req, err := c.newRequest(ctx, http.MethodPut, vmPath(id, "/files"), q, r, contentType)
+	if err != nil {
+		return err
+	}
+	// the daemon spools bodies of unknown length before copying them
+	if size >= 0 {
+		req.ContentLength = size
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
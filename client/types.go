@@ -0,0 +1,420 @@
+// types file holds the requests and responses of the daemon api, the daemon serves these very types.
+
+package client
+
+import (
+	"net"
+	"time"
+)
+
+// VmState is the state of a vm
+type VmState string
+
+// available vm states
+const (
+	StateCreated VmState = "created"
+	StateStarted VmState = "started"
+	// the vcpus of the started vm are paused
+	StatePaused VmState = "paused"
+	StateFailed VmState = "failed"
+	// the workload exited and the vm is gone
+	StateExited VmState = "exited"
+	// the vm is waiting to be booted again by its restart policy
+	StateRestarting VmState = "restarting"
+)
+
+// available vm actions
+const (
+	ActionPause  = "pause"
+	ActionResume = "resume"
+	ActionStop   = "stop"
+	ActionStart  = "start"
+)
+
+// kinds of ExecEvent
+const (
+	ExecStdout = "stdout"
+	ExecStderr = "stderr"
+	ExecExit   = "exit"
+	ExecError  = "error"
+)
+
+// kinds of ExecControl
+const (
+	ExecResize     = "resize"
+	ExecSignal     = "signal"
+	ExecCloseStdin = "close_stdin"
+)
+
+// CreateRequest asks for a vm running the docker image DockerImage
+type CreateRequest struct {
+	Name          string         `json:"name" validate:"required"`
+	DockerImage   string         `json:"docker-image" validate:"required"`
+	RestartPolicy *RestartPolicy `json:"restart_policy,omitempty"`
+	// Kernel and Initrd name entries of the kernel registry, the defaults are used when empty
+	Kernel string `json:"kernel,omitempty"`
+	Initrd string `json:"initrd,omitempty"`
+	// BootArgs are appended to the boot args of the kernel
+	BootArgs string `json:"boot_args,omitempty"`
+	// Volumes are attached as extra drives and mounted by the init before the workload starts
+	Volumes []VolumeMount `json:"volumes,omitempty"`
+	// RateLimits override the limits the daemon gives vms by default
+	RateLimits *RateLimits `json:"rate_limits,omitempty"`
+	// Balloon adds a memory balloon to the vm, the host can take memory back from the guest through it
+	Balloon *BalloonConfig `json:"balloon,omitempty"`
+	// VCPUs and MemoryMiB size the vm, 1 vcpu and 256 MiB when not given
+	VCPUs     int64 `json:"vcpus,omitempty"`
+	MemoryMiB int64 `json:"memory_mib,omitempty"`
+	// Env is added to the environment of the image as NAME=VALUE, overriding the variables it sets
+	Env []string `json:"env,omitempty"`
+	// Command replaces the command of the image, its entrypoint is kept
+	Command []string `json:"command,omitempty"`
+	// Ports are published on the host, forwarded to the vm
+	Ports []PortMapping `json:"ports,omitempty"`
+	// Network is NetworkNAT when empty
+	Network NetworkMode `json:"network,omitempty"`
+}
+
+// NetworkMode tells what a vm may reach
+type NetworkMode string
+
+// available network modes
+const (
+	// the vm reaches the network of the host through nat
+	NetworkNAT NetworkMode = "nat"
+	// the vm can not open connections, only its published ports are reachable
+	NetworkIsolated NetworkMode = "isolated"
+)
+
+// PortMapping forwards HostPort of the host to GuestPort of a vm, Protocol is tcp when empty or udp
+type PortMapping struct {
+	HostPort  int    `json:"host_port" validate:"required"`
+	GuestPort int    `json:"guest_port" validate:"required"`
+	Protocol  string `json:"protocol,omitempty"`
+}
+
+// Resources are what vms hold on to. As a quota, a zero field means no limit.
+type Resources struct {
+	VMs       int64 `json:"vms"`
+	VCPUs     int64 `json:"vcpus"`
+	MemoryMiB int64 `json:"memory_mib"`
+	DiskMiB   int64 `json:"disk_mib"`
+}
+
+// Usage is what the vms of Tenant hold on to, along with its quota
+type Usage struct {
+	Tenant string    `json:"tenant"`
+	Used   Resources `json:"used"`
+	Quota  Resources `json:"quota"`
+}
+
+// HostUsage is what the vms of every tenant hold on to and what the host can give them
+type HostUsage struct {
+	Used        Resources `json:"used"`
+	Capacity    Resources `json:"capacity"`
+	FreeDiskMiB int64     `json:"free_disk_mib"`
+	Tenants     []Usage   `json:"tenants"`
+}
+
+// BalloonConfig holds AmountMiB of the guest memory, statistics are polled every StatsIntervalS seconds
+type BalloonConfig struct {
+	AmountMiB      int64 `json:"amount_mib"`
+	DeflateOnOOM   bool  `json:"deflate_on_oom"`
+	StatsIntervalS int64 `json:"stats_polling_interval_s"`
+}
+
+// BalloonRequest sets the size of the balloon of a running vm
+type BalloonRequest struct {
+	AmountMiB int64 `json:"amount_mib"`
+}
+
+// BalloonStats are the latest statistics of the balloon, memory sizes are in bytes
+type BalloonStats struct {
+	TargetMiB       int64     `json:"target_mib"`
+	ActualMiB       int64     `json:"actual_mib"`
+	TotalMemory     int64     `json:"total_memory,omitempty"`
+	FreeMemory      int64     `json:"free_memory,omitempty"`
+	AvailableMemory int64     `json:"available_memory,omitempty"`
+	DiskCaches      int64     `json:"disk_caches,omitempty"`
+	MajorFaults     int64     `json:"major_faults,omitempty"`
+	MinorFaults     int64     `json:"minor_faults,omitempty"`
+	SwapIn          int64     `json:"swap_in,omitempty"`
+	SwapOut         int64     `json:"swap_out,omitempty"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// BalloonState is the balloon of a vm, Reclaimed is set while the host took memory back on its own
+type BalloonState struct {
+	BalloonConfig
+	Reclaimed bool          `json:"reclaimed,omitempty"`
+	Stats     *BalloonStats `json:"stats,omitempty"`
+}
+
+// TokenBucket holds Size tokens refilled every RefillTimeMs, OneTimeBurst extra tokens can be spent once.
+// A bucket of size 0 means no limit.
+type TokenBucket struct {
+	Size         int64 `json:"size"`
+	RefillTimeMs int64 `json:"refill_time_ms"`
+	OneTimeBurst int64 `json:"one_time_burst,omitempty"`
+}
+
+// RateLimit limits bytes through Bandwidth and requests or packets through Ops
+type RateLimit struct {
+	Bandwidth *TokenBucket `json:"bandwidth,omitempty"`
+	Ops       *TokenBucket `json:"ops,omitempty"`
+}
+
+// RateLimits are the limits of the drives and of both directions of the network interface of a vm
+type RateLimits struct {
+	Block *RateLimit `json:"block,omitempty"`
+	NetRx *RateLimit `json:"net_rx,omitempty"`
+	NetTx *RateLimit `json:"net_tx,omitempty"`
+}
+
+// VolumeMount attaches the volume Name to a vm at MountPoint
+type VolumeMount struct {
+	Name       string `json:"name" validate:"required"`
+	MountPoint string `json:"mount_point" validate:"required"`
+	ReadOnly   bool   `json:"read_only,omitempty"`
+}
+
+// VolumeRequest asks for an empty data volume of SizeMiB
+type VolumeRequest struct {
+	Name    string `json:"name" validate:"required"`
+	SizeMiB int64  `json:"size_mib" validate:"required"`
+	// Tenant owns the volume, the tenant of the caller by default
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// Volume is a data volume along with the tenant owning it and the vms using it
+type Volume struct {
+	Name    string   `json:"name"`
+	SizeMiB int64    `json:"size_mib"`
+	Tenant  string   `json:"tenant,omitempty"`
+	UsedBy  []string `json:"used_by"`
+}
+
+// RestartPolicy tells what to do once the workload of a vm exits: no, on-failure or always.
+// MaxRetries bounds the restarts of on-failure, 0 meaning unlimited.
+type RestartPolicy struct {
+	Name       string `json:"name"`
+	MaxRetries int    `json:"max_retries,omitempty"`
+}
+
+// CreateResponse is a vm as shown by the api
+type CreateResponse struct {
+	ID            string         `json:"id,omitempty"`
+	PID           int64          `json:"pid,omitempty"`
+	State         VmState        `json:"state,omitempty"`
+	Name          string         `json:"name,omitempty"`
+	Image         string         `json:"image,omitempty"`
+	Tenant        string         `json:"tenant,omitempty"`
+	IpAddr        string         `json:"ip_address,omitempty"`
+	Agent         net.IP         `json:"agent,omitempty"`
+	ExitCode      *int           `json:"exit_code,omitempty"`
+	RestartCount  int            `json:"restart_count,omitempty"`
+	RestartPolicy *RestartPolicy `json:"restart_policy,omitempty"`
+	Kernel        string         `json:"kernel,omitempty"`
+	VCPUs         int64          `json:"vcpus,omitempty"`
+	MemoryMiB     int64          `json:"memory_mib,omitempty"`
+	Volumes       []VolumeMount  `json:"volumes,omitempty"`
+	RateLimits    *RateLimits    `json:"rate_limits,omitempty"`
+	Balloon       *BalloonState  `json:"balloon,omitempty"`
+	Ports         []PortMapping  `json:"ports,omitempty"`
+	Network       NetworkMode    `json:"network,omitempty"`
+	// Environment is the spec environment managing the vm, empty for vms created on their own
+	Environment string `json:"environment,omitempty"`
+}
+
+// VmList is a page of vms, NextCursor is set when more vms follow
+type VmList struct {
+	Items      []CreateResponse `json:"items"`
+	NextCursor string           `json:"next_cursor,omitempty"`
+}
+
+// VmMetrics are the metrics firecracker flushed for a vm, keyed by their path in its json document
+// such as block.read_count. Latest holds the last flush, Totals the counters summed over every flush.
+type VmMetrics struct {
+	Flushes   int64              `json:"flushes"`
+	UpdatedAt time.Time          `json:"updated_at"`
+	Latest    map[string]float64 `json:"latest"`
+	Totals    map[string]float64 `json:"totals"`
+}
+
+// LoggingConfig is the level and the format, json or text, of the daemon logs
+type LoggingConfig struct {
+	Level  string `json:"level"`
+	Format string `json:"format"`
+}
+
+// DeleteRequest names the vm the deprecated verb style routes act on
+type DeleteRequest struct {
+	ID string `json:"id" validate:"required"`
+}
+
+// SignalRequest delivers Signal to the process Pid of a vm, the container entrypoint by default
+type SignalRequest struct {
+	Signal string `json:"signal" validate:"required"`
+	Pid    int    `json:"pid,omitempty"`
+}
+
+// ExecRequest runs Args in a vm, Stdin is written to the command before its input is closed
+type ExecRequest struct {
+	Args    []string `json:"args" validate:"required"`
+	Env     []string `json:"env,omitempty"`
+	Workdir string   `json:"workdir,omitempty"`
+	Tty     bool     `json:"tty,omitempty"`
+	Stdin   string   `json:"stdin,omitempty"`
+}
+
+// ExecEvent is one line of the output stream of an exec, or a message of an attached exec
+type ExecEvent struct {
+	Type     string `json:"type"`
+	Data     []byte `json:"data,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ExecControl is sent by clients attached to an exec to drive it
+type ExecControl struct {
+	Type   string `json:"type"`
+	Rows   uint16 `json:"rows,omitempty"`
+	Cols   uint16 `json:"cols,omitempty"`
+	Signal string `json:"signal,omitempty"`
+}
+
+// EventType is the kind of an Event
+type EventType string
+
+// available event types
+const (
+	EventCreated  EventType = "created"
+	EventBooting  EventType = "booting"
+	EventStarted  EventType = "started"
+	EventPaused   EventType = "paused"
+	EventResumed  EventType = "resumed"
+	EventStopped  EventType = "stopped"
+	EventExited   EventType = "exited"
+	EventDeleted  EventType = "deleted"
+	EventSnapshot EventType = "snapshot"
+	EventError    EventType = "error"
+)
+
+// Event is something which happened to a vm. State is the state of the vm right after it,
+// ExitCode is set on exited events of vms whose workload reported one and Error on error events.
+type Event struct {
+	ID       uint64    `json:"id"`
+	Type     EventType `json:"type"`
+	Time     time.Time `json:"time"`
+	VmID     string    `json:"vm_id"`
+	Name     string    `json:"name,omitempty"`
+	Tenant   string    `json:"tenant,omitempty"`
+	State    VmState   `json:"state,omitempty"`
+	ExitCode *int      `json:"exit_code,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Message is the body of the responses carrying no resource, errors included
+type Message struct {
+	Message string `json:"message"`
+}
+
+// Health is what the guest agent of a vm reports about it
+type Health struct {
+	Status        string  `json:"status"`
+	Hostname      string  `json:"hostname"`
+	Uptime        float64 `json:"uptime_seconds"`
+	EntrypointPid int     `json:"entrypoint_pid,omitempty"`
+}
+
+// KernelRegistry lists the kernels and initrds vms can boot
+type KernelRegistry struct {
+	Kernels []Kernel `json:"kernels"`
+	Initrds []Initrd `json:"initrds"`
+}
+
+// Kernel is a kernel vms can boot, the Default one boots vms asking for none
+type Kernel struct {
+	Name string `json:"name"`
+	// Path and SHA256 are only listed to admins
+	Path string `json:"path,omitempty"`
+	// SHA256 is checked before every boot when set
+	SHA256 string `json:"sha256,omitempty"`
+	// Arch is x86_64 or aarch64
+	Arch     string `json:"arch"`
+	BootArgs string `json:"boot_args,omitempty"`
+	Default  bool   `json:"default,omitempty"`
+}
+
+// Initrd is an initrd vms can boot, the Default one boots vms asking for none
+type Initrd struct {
+	Name    string `json:"name"`
+	Path    string `json:"path,omitempty"`
+	SHA256  string `json:"sha256,omitempty"`
+	Default bool   `json:"default,omitempty"`
+}
+
+// Spec is the desired state of the vms of an environment. Applying it creates the vms it lists,
+// replaces those whose spec changed and deletes those of the environment it no longer lists.
+type Spec struct {
+	// Environment names the vms the spec manages, default when empty
+	Environment string   `json:"environment,omitempty"`
+	VMs         []VmSpec `json:"vms"`
+}
+
+// VmSpec is a vm of a Spec, its name is unique within the environment
+type VmSpec struct {
+	Name      string       `json:"name" validate:"required"`
+	Image     string       `json:"image" validate:"required"`
+	Resources *VmResources `json:"resources,omitempty"`
+	// Env is added to the environment of the image, overriding the variables it sets
+	Env map[string]string `json:"env,omitempty"`
+	// Command replaces the command of the image, its entrypoint is kept
+	Command       []string       `json:"command,omitempty"`
+	Volumes       []VolumeMount  `json:"volumes,omitempty"`
+	Ports         []PortMapping  `json:"ports,omitempty"`
+	Network       NetworkMode    `json:"network,omitempty"`
+	RestartPolicy *RestartPolicy `json:"restart_policy,omitempty"`
+	Kernel        string         `json:"kernel,omitempty"`
+	Initrd        string         `json:"initrd,omitempty"`
+	BootArgs      string         `json:"boot_args,omitempty"`
+}
+
+// VmResources size a vm, 1 vcpu and 256 MiB when not given
+type VmResources struct {
+	VCPUs     int64 `json:"vcpus,omitempty"`
+	MemoryMiB int64 `json:"memory_mib,omitempty"`
+}
+
+// ApplyAction is what applying a spec does to a vm
+type ApplyAction string
+
+// available apply actions
+const (
+	ApplyCreate ApplyAction = "create"
+	// only the restart policy changed, it is updated in place
+	ApplyUpdate ApplyAction = "update"
+	// the vm is deleted and created again from its new spec
+	ApplyReplace ApplyAction = "replace"
+	// the vm exited or failed and is booted again
+	ApplyStart     ApplyAction = "start"
+	ApplyDelete    ApplyAction = "delete"
+	ApplyUnchanged ApplyAction = "unchanged"
+)
+
+// ApplyChange is the action applying a spec takes on the vm Name, Fields lists what changed in its spec.
+// VmID is the vm acted on, the new one once a create or replace succeeded. Error is set when the action failed.
+type ApplyChange struct {
+	Name   string      `json:"name"`
+	Action ApplyAction `json:"action"`
+	VmID   string      `json:"vm_id,omitempty"`
+	Fields []string    `json:"fields,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// ApplyResult lists the changes applying a spec made, or would make on a dry run
+type ApplyResult struct {
+	Environment string        `json:"environment"`
+	DryRun      bool          `json:"dry_run,omitempty"`
+	Changes     []ApplyChange `json:"changes"`
+}
@@ -0,0 +1,233 @@
+// vms file holds the calls managing vms and their settings.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// ListOptions filter the vms listed and page through them, zero fields are ignored
+type ListOptions struct {
+	State VmState
+	Name  string
+	Image string
+	// Tenant is only honored for admins
+	Tenant string
+	// Limit is how many vms a page holds, 100 by default and at most 1000
+	Limit int
+	// Cursor is the NextCursor of the previous page
+	Cursor string
+}
+
+// values are the query parameters of o
+func (o *ListOptions) values() url.Values {
+	q := url.Values{}
+	if o == nil {
+		return q
+	}
+	for name, v := range map[string]string{"state": string(o.State), "name": o.Name, "image": o.Image, "tenant": o.Tenant, "cursor": o.Cursor} {
+		if v != "" {
+			q.Set(name, v)
+		}
+	}
+	if o.Limit > 0 {
+		q.Set("limit", strconv.Itoa(o.Limit))
+	}
+	return q
+}
+
+// CreateVm builds the rootfs of the vm and boots it, it returns once the vm started
+func (c *Client) CreateVm(ctx context.Context, in *CreateRequest) (*CreateResponse, error) {
+	out := new(CreateResponse)
+	if err := c.call(ctx, http.MethodPost, "/vms", nil, in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ListVms returns a page of the vms of the caller sorted by id, opts may be nil
+func (c *Client) ListVms(ctx context.Context, opts *ListOptions) (*VmList, error) {
+	out := new(VmList)
+	if err := c.call(ctx, http.MethodGet, "/vms", opts.values(), nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AllVms goes through every page of the vms matching opts, its Cursor is ignored
+func (c *Client) AllVms(ctx context.Context, opts *ListOptions) ([]CreateResponse, error) {
+	page := ListOptions{}
+	if opts != nil {
+		page = *opts
+	}
+	page.Cursor = ""
+
+	var vms []CreateResponse
+	for {
+		list, err := c.ListVms(ctx, &page)
+		if err != nil {
+			return nil, err
+		}
+		vms = append(vms, list.Items...)
+		if list.NextCursor == "" {
+			return vms, nil
+		}
+		page.Cursor = list.NextCursor
+	}
+}
+
+// GetVm returns the vm id
+func (c *Client) GetVm(ctx context.Context, id string) (*CreateResponse, error) {
+	out := new(CreateResponse)
+	if err := c.call(ctx, http.MethodGet, vmPath(id, ""), nil, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeleteVm deletes the vm id, it is shut down in the background when it runs
+func (c *Client) DeleteVm(ctx context.Context, id string) error {
+	return c.call(ctx, http.MethodDelete, vmPath(id, ""), nil, nil, nil)
+}
+
+// VmAction runs action, one of the Action constants, on the vm id and returns the vm
+func (c *Client) VmAction(ctx context.Context, id, action string) (*CreateResponse, error) {
+	out := new(CreateResponse)
+	if err := c.call(ctx, http.MethodPost, vmPath(id, "/actions/"+url.PathEscape(action)), nil, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PauseVm freezes the vcpus of the vm id
+func (c *Client) PauseVm(ctx context.Context, id string) (*CreateResponse, error) {
+	return c.VmAction(ctx, id, ActionPause)
+}
+
+// ResumeVm lets the paused vm id run again
+func (c *Client) ResumeVm(ctx context.Context, id string) (*CreateResponse, error) {
+	return c.VmAction(ctx, id, ActionResume)
+}
+
+// StopVm shuts the vm id down in the background, it is kept as exited
+func (c *Client) StopVm(ctx context.Context, id string) (*CreateResponse, error) {
+	return c.VmAction(ctx, id, ActionStop)
+}
+
+// StartVm boots the exited or failed vm id again
+func (c *Client) StartVm(ctx context.Context, id string) (*CreateResponse, error) {
+	return c.VmAction(ctx, id, ActionStart)
+}
+
+// VmMetrics returns the metrics firecracker reported for the vm id
+func (c *Client) VmMetrics(ctx context.Context, id string) (*VmMetrics, error) {
+	out := new(VmMetrics)
+	if err := c.call(ctx, http.MethodGet, vmPath(id, "/metrics"), nil, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// VmHealth asks the guest agent of the vm id whether it is up
+func (c *Client) VmHealth(ctx context.Context, id string) (*Health, error) {
+	out := new(Health)
+	if err := c.call(ctx, http.MethodGet, vmPath(id, "/health"), nil, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SignalVm delivers a signal to a process of the vm id
+func (c *Client) SignalVm(ctx context.Context, id string, in *SignalRequest) error {
+	return c.call(ctx, http.MethodPost, vmPath(id, "/signal"), nil, in, nil)
+}
+
+// SetRateLimits changes the limits of the running vm id and returns all of its limits, those in
+// does not set are kept
+func (c *Client) SetRateLimits(ctx context.Context, id string, in *RateLimits) (*RateLimits, error) {
+	out := new(RateLimits)
+	if err := c.call(ctx, http.MethodPatch, vmPath(id, "/rate-limits"), nil, in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SetBalloon inflates or deflates the balloon of the running vm id to amountMiB
+func (c *Client) SetBalloon(ctx context.Context, id string, amountMiB int64) (*BalloonState, error) {
+	out := new(BalloonState)
+	if err := c.call(ctx, http.MethodPatch, vmPath(id, "/balloon"), nil, &BalloonRequest{AmountMiB: amountMiB}, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Kernels lists the kernels and initrds vms can boot
+func (c *Client) Kernels(ctx context.Context) (*KernelRegistry, error) {
+	out := new(KernelRegistry)
+	if err := c.call(ctx, http.MethodGet, "/kernels", nil, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Usage returns what the vms of the caller hold on to along with its quota
+func (c *Client) Usage(ctx context.Context) (*Usage, error) {
+	out := new(Usage)
+	if err := c.call(ctx, http.MethodGet, "/usage", nil, nil, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Apply converges the vms of the environment of spec to it, dryRun only returns the changes it
+// would make. The changes which failed carry their Error, the others are made nonetheless.
+func (c *Client) Apply(ctx context.Context, spec *Spec, dryRun bool) (*ApplyResult, error) {
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	return c.apply(ctx, bytes.NewReader(data), "application/json", dryRun)
+}
+
+// ApplyYAML is Apply for the spec read from r, written in yaml or json
+func (c *Client) ApplyYAML(ctx context.Context, r io.Reader, dryRun bool) (*ApplyResult, error) {
+	return c.apply(ctx, r, "application/yaml", dryRun)
+}
+
+// apply sends the spec body, the daemon answers 422 along with the result when changes failed
+func (c *Client) apply(ctx context.Context, body io.Reader, contentType string, dryRun bool) (*ApplyResult, error) {
+	req, err := c.newRequest(ctx, http.MethodPost, "/apply", applyQuery(dryRun), body, contentType)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 && res.StatusCode != http.StatusUnprocessableEntity {
+		return nil, decodeError(res)
+	}
+
+	out := new(ApplyResult)
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+	return out, nil
+}
+
+func applyQuery(dryRun bool) url.Values {
+	q := url.Values{}
+	if dryRun {
+		q.Set("dry_run", "true")
+	}
+	return q
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/iradukunda1/firecrackerland/client"
+	"github.com/spf13/cobra"
+)
+
+func applyCommand() *cobra.Command {
+	var (
+		file   string
+		dryRun bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "apply -f FILE",
+		Short: "Converge the vms of an environment to a yaml spec",
+		Long: `Converge the vms of an environment to a yaml or json spec, read from FILE or from the
+standard input for -.
+
+The daemon creates the vms of the spec missing from the environment, replaces those whose spec
+changed, updates the restart policy in place, boots again those which exited and deletes the
+vms of the environment the spec no longer lists. Vms created on their own are left alone.`,
+		Example: `  fcland apply -f staging.yaml --dry-run
+  fcland apply -f staging.yaml`,
+		Args:              cobra.NoArgs,
+		ValidArgsFunction: cobra.NoFileCompletions,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var in io.Reader = os.Stdin
+			if file != "-" {
+				f, err := os.Open(file)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				in = f
+			}
+
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			result, err := c.ApplyYAML(cmd.Context(), in, dryRun)
+			if err != nil {
+				return err
+			}
+
+			if err := printApplyResult(result); err != nil {
+				return err
+			}
+
+			failed := 0
+			for _, change := range result.Changes {
+				if change.Error != "" {
+					failed++
+				}
+			}
+			if failed > 0 {
+				return fmt.Errorf("%d of %d changes failed", failed, len(result.Changes))
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&file, "filename", "f", "", "spec to apply, - for the standard input")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "only print the changes")
+	cmd.MarkFlagRequired("filename")
+	cmd.MarkFlagFilename("filename", "yaml", "yml", "json")
+
+	return cmd
+}
+
+// printApplyResult writes the changes of result as a table, or result as json with --output json
+func printApplyResult(result *client.ApplyResult) error {
+	if output == "json" {
+		return printJSON(result)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NAME\tACTION\tVM ID\tCHANGED\tERROR")
+	for _, change := range result.Changes {
+		action := string(change.Action)
+		if result.DryRun && change.Action != client.ApplyUnchanged {
+			action += " (dry run)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", change.Name, action, change.VmID, strings.Join(change.Fields, ","), change.Error)
+	}
+	return w.Flush()
+}
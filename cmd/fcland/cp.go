@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/iradukunda1/firecrackerland/client"
+	"github.com/iradukunda1/firecrackerland/cmd/initrd/agent"
+	"github.com/spf13/cobra"
+)
+
+func cpCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "cp SRC DST",
+		Short: "Copy files between the host and a vm",
+		Long: `Copy files between the host and a vm, the vm side is written VM_ID:PATH.
+
+Directories are copied into DST, so "fcland cp ./conf vm:/etc" creates /etc/conf.
+A single file is copied to DST itself unless DST is a directory or ends with a slash.
+Modes are kept, and so are owners inside the vm or when copying out as root.`,
+		Example: `  fcland cp app.conf 4f1c...:/etc/app.conf
+  fcland cp 4f1c...:/var/log ./logs`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			srcVM, src := splitVMPath(args[0])
+			dstVM, dst := splitVMPath(args[1])
+
+			switch {
+			case srcVM == "" && dstVM != "":
+				return copyIn(cmd.Context(), src, dstVM, dst)
+			case srcVM != "" && dstVM == "":
+				return copyOut(cmd.Context(), srcVM, src, dst)
+			default:
+				return fmt.Errorf("exactly one of SRC and DST must be VM_ID:PATH")
+			}
+		},
+	}
+}
+
+// splitVMPath splits VM_ID:PATH, a local path gives an empty vm id
+func splitVMPath(arg string) (string, string) {
+	i := strings.Index(arg, ":")
+	if i <= 0 || strings.ContainsRune(arg[:i], '/') {
+		return "", arg
+	}
+	return arg[:i], arg[i+1:]
+}
+
+func copyIn(ctx context.Context, src, vm, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	if info.Mode().IsRegular() && !strings.HasSuffix(dst, "/") {
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		opts := &client.UploadOptions{Mode: info.Mode().Perm()}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			uid, gid := int(stat.Uid), int(stat.Gid)
+			opts.UID, opts.GID = &uid, &gid
+		}
+		return c.Upload(ctx, vm, dst, f, info.Size(), opts)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(agent.WriteTar(pw, src))
+	}()
+	defer pr.Close()
+
+	return c.UploadArchive(ctx, vm, dst, pr)
+}
+
+func copyOut(ctx context.Context, vm, src, dst string) error {
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	file, err := c.Download(ctx, vm, src, false)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	sameOwner := os.Geteuid() == 0
+
+	if file.Archive {
+		return agent.ExtractTar(file, dst, sameOwner)
+	}
+
+	if info, err := os.Stat(dst); (err == nil && info.IsDir()) || strings.HasSuffix(dst, "/") {
+		dst = filepath.Join(dst, filepath.Base(src))
+	}
+
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, file.Mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, file); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(dst, file.Mode.Perm()); err != nil {
+		return err
+	}
+
+	if sameOwner && file.UID >= 0 && file.GID >= 0 {
+		return os.Chown(dst, file.UID, file.GID)
+	}
+
+	return nil
+}
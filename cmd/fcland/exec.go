@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/iradukunda1/firecrackerland/client"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+func execCommand() *cobra.Command {
+	var (
+		req         client.ExecRequest
+		interactive bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "exec VM_ID -- COMMAND [ARG...]",
+		Short: "Run a command in a vm",
+		Long: `Run a command in a vm, fcland exits with the exit code of the command.
+
+With --interactive the standard input is sent to the command, and --tty runs it in a
+terminal the local one is switched to raw mode for.`,
+		Example: `  fcland exec 4f1c... -- cat /etc/os-release
+  fcland exec -it 4f1c... -- /bin/sh`,
+		Args:              cobra.MinimumNArgs(2),
+		ValidArgsFunction: completeVms,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req.Args = args[1:]
+
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+
+			if !interactive && !req.Tty {
+				stream, err := c.Exec(cmd.Context(), args[0], &req)
+				if err != nil {
+					return err
+				}
+				code, err := stream.Wait(os.Stdout, os.Stderr)
+				if err != nil {
+					return err
+				}
+				return exitStatus(code)
+			}
+
+			session, err := c.AttachExec(cmd.Context(), args[0], &req)
+			if err != nil {
+				return err
+			}
+			defer session.Close()
+
+			if req.Tty && term.IsTerminal(int(os.Stdin.Fd())) {
+				restore, err := rawTerminal(session)
+				if err != nil {
+					return err
+				}
+				defer restore()
+			}
+
+			if interactive {
+				go func() {
+					io.Copy(session, os.Stdin)
+					session.CloseStdin()
+				}()
+			} else {
+				session.CloseStdin()
+			}
+
+			for {
+				ev, err := session.Next()
+				if err == io.EOF {
+					return fmt.Errorf("the session ended before the command exited")
+				}
+				if err != nil {
+					return err
+				}
+
+				switch ev.Type {
+				case client.ExecStdout:
+					os.Stdout.Write(ev.Data)
+				case client.ExecStderr:
+					os.Stderr.Write(ev.Data)
+				case client.ExecError:
+					return fmt.Errorf("command failed: %s", ev.Error)
+				case client.ExecExit:
+					if ev.ExitCode == nil {
+						return fmt.Errorf("the command exited without an exit code")
+					}
+					return exitStatus(*ev.ExitCode)
+				}
+			}
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.BoolVarP(&interactive, "interactive", "i", false, "send the standard input to the command")
+	flags.BoolVarP(&req.Tty, "tty", "t", false, "run the command in a terminal")
+	flags.StringArrayVarP(&req.Env, "env", "e", nil, "environment variable NAME=VALUE, may be repeated")
+	flags.StringVarP(&req.Workdir, "workdir", "w", "", "working directory of the command")
+	// the flags of the command run in the vm are left to it
+	flags.SetInterspersed(false)
+
+	return cmd
+}
+
+// exitStatus is the error fcland exits with for the exit code of a command
+func exitStatus(code int) error {
+	if code == 0 {
+		return nil
+	}
+	return exitCode(code)
+}
+
+// rawTerminal switches the local terminal to raw mode and keeps the size of the terminal of
+// session in sync with it, until the returned function restores it
+func rawTerminal(session *client.ExecSession) (func(), error) {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set the terminal to raw mode: %v", err)
+	}
+
+	resize := func() {
+		if cols, rows, err := term.GetSize(fd); err == nil {
+			session.Resize(uint16(rows), uint16(cols))
+		}
+	}
+	resize()
+
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	go func() {
+		for range winch {
+			resize()
+		}
+	}()
+
+	return func() {
+		signal.Stop(winch)
+		close(winch)
+		term.Restore(fd, state)
+	}, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func logsCommand() *cobra.Command {
+	var (
+		follow bool
+		tail   int
+	)
+
+	cmd := &cobra.Command{
+		Use:               "logs VM_ID",
+		Short:             "Print the serial console output of a vm",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeVms,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+
+			if !follow {
+				out, err := c.Console(cmd.Context(), args[0], tail)
+				if err != nil {
+					return err
+				}
+				_, err = os.Stdout.Write(out)
+				return err
+			}
+
+			stream, err := c.FollowConsole(cmd.Context(), args[0], tail)
+			if err != nil {
+				return err
+			}
+			defer stream.Close()
+
+			// following ends with an interrupt, which is not a failure
+			if _, err := io.Copy(os.Stdout, stream); err != nil && !errors.Is(cmd.Context().Err(), context.Canceled) {
+				return err
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVarP(&follow, "follow", "f", false, "keep printing the new output")
+	cmd.Flags().IntVarP(&tail, "tail", "n", 0, "only print the last lines, all of them when 0")
+
+	return cmd
+}
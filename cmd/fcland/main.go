@@ -0,0 +1,89 @@
+// fcland is the command line client of the firecracker-land daemon.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/iradukunda1/firecrackerland/client"
+	"github.com/spf13/cobra"
+)
+
+var (
+	host   string
+	token  string
+	output string
+)
+
+// exitCode is returned by commands which exit with the code of a command run in a vm
+type exitCode int
+
+func (c exitCode) Error() string {
+	return fmt.Sprintf("exit code %d", int(c))
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := rootCommand().ExecuteContext(ctx)
+	stop()
+
+	var code exitCode
+	if errors.As(err, &code) {
+		os.Exit(int(code))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fcland:", err)
+		os.Exit(1)
+	}
+}
+
+// rootCommand is the fcland command, its flags are bound to host, token and output
+func rootCommand() *cobra.Command {
+	root := &cobra.Command{
+		Use:           "fcland",
+		Short:         "Manage firecracker-land vms",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if output != "table" && output != "json" {
+				return fmt.Errorf("unknown output format %q, use table or json", output)
+			}
+			return nil
+		},
+	}
+
+	defaultHost := os.Getenv("FCLAND_HOST")
+	if defaultHost == "" {
+		defaultHost = "http://localhost:8080"
+	}
+	root.PersistentFlags().StringVar(&host, "host", defaultHost, "address of the daemon, http(s)://host:port or unix:///path, also read from FCLAND_HOST")
+	root.PersistentFlags().StringVar(&token, "token", os.Getenv("FCLAND_TOKEN"), "api token or JWT token, also read from FCLAND_TOKEN")
+	root.PersistentFlags().StringVarP(&output, "output", "o", "table", "output format, table or json")
+	root.RegisterFlagCompletionFunc("output", cobra.FixedCompletions([]string{"table", "json"}, cobra.ShellCompDirectiveNoFileComp))
+
+	root.AddCommand(
+		runCommand(),
+		lsCommand(),
+		inspectCommand(),
+		rmCommand(),
+		actionCommand(client.ActionPause, "Pause the vcpus of vms"),
+		actionCommand(client.ActionResume, "Resume paused vms"),
+		actionCommand(client.ActionStop, "Stop vms, they are kept as exited"),
+		logsCommand(),
+		execCommand(),
+		snapshotCommand(),
+		cpCommand(),
+		applyCommand(),
+	)
+
+	return root
+}
+
+// newClient is the client of the daemon at --host
+func newClient() (*client.Client, error) {
+	return client.New(host, client.WithToken(token))
+}
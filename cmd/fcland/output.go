@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/iradukunda1/firecrackerland/client"
+)
+
+// printJSON writes v indented to the standard output
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// printVms writes vms as a table, or as a json array with --output json
+func printVms(vms []client.CreateResponse) error {
+	if output == "json" {
+		if vms == nil {
+			vms = []client.CreateResponse{}
+		}
+		return printJSON(vms)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "ID\tNAME\tIMAGE\tSTATE\tIP\tVCPUS\tMEMORY")
+	for _, vm := range vms {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%dMiB\n", vm.ID, vm.Name, vm.Image, vmState(vm), vm.IpAddr, vm.VCPUs, vm.MemoryMiB)
+	}
+	return w.Flush()
+}
+
+// printVm writes the details of vm as aligned fields, or as json with --output json
+func printVm(vm *client.CreateResponse) error {
+	if output == "json" {
+		return printJSON(vm)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	field := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(w, "%s:\t%s\n", name, value)
+		}
+	}
+
+	field("ID", vm.ID)
+	field("Name", vm.Name)
+	field("Image", vm.Image)
+	field("Tenant", vm.Tenant)
+	field("State", vmState(*vm))
+	if vm.PID > 0 {
+		field("PID", strconv.FormatInt(vm.PID, 10))
+	}
+	field("IP", vm.IpAddr)
+	if vm.Agent != nil {
+		field("Agent", vm.Agent.String())
+	}
+	field("Kernel", vm.Kernel)
+	field("VCPUs", strconv.FormatInt(vm.VCPUs, 10))
+	field("Memory", fmt.Sprintf("%dMiB", vm.MemoryMiB))
+	if p := vm.RestartPolicy; p != nil {
+		policy := p.Name
+		if p.MaxRetries > 0 {
+			policy += ":" + strconv.Itoa(p.MaxRetries)
+		}
+		field("Restart", fmt.Sprintf("%s (%d restarts)", policy, vm.RestartCount))
+	}
+	for _, v := range vm.Volumes {
+		mount := v.Name + ":" + v.MountPoint
+		if v.ReadOnly {
+			mount += ":ro"
+		}
+		field("Volume", mount)
+	}
+	if b := vm.Balloon; b != nil {
+		field("Balloon", fmt.Sprintf("%dMiB", b.AmountMiB))
+	}
+	return w.Flush()
+}
+
+// vmState is the state of vm along with its exit code once it exited
+func vmState(vm client.CreateResponse) string {
+	if vm.ExitCode != nil && (vm.State == client.StateExited || vm.State == client.StateFailed) {
+		return fmt.Sprintf("%s (%d)", vm.State, *vm.ExitCode)
+	}
+	return string(vm.State)
+}
+
+// printIDs writes one id per line
+func printIDs(ids []string) {
+	if len(ids) > 0 {
+		fmt.Println(strings.Join(ids, "\n"))
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/iradukunda1/firecrackerland/client"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+func snapshotCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "snapshot",
+		Short: "Save running vms to snapshot archives and restore them, on this host or another",
+	}
+	cmd.AddCommand(snapshotSaveCommand(), snapshotRestoreCommand())
+	return cmd
+}
+
+func snapshotSaveCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "save VM_ID FILE",
+		Short: "Save the snapshot archive of a running vm to FILE, or to the standard output for -",
+		Example: `  fcland snapshot save 4f1c... web.tar.gz
+  fcland --host http://a:8080 snapshot save 4f1c... - | fcland --host http://b:8080 snapshot restore -`,
+		Args: cobra.ExactArgs(2),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) == 0 {
+				return completeVms(cmd, args, toComplete)
+			}
+			return nil, cobra.ShellCompDirectiveDefault
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var out io.Writer = os.Stdout
+			if args[1] == "-" {
+				if term.IsTerminal(int(os.Stdout.Fd())) {
+					return fmt.Errorf("refusing to write the archive to a terminal")
+				}
+			} else {
+				f, err := os.Create(args[1])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				out = f
+			}
+
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			archive, err := c.ExportSnapshot(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			defer archive.Close()
+
+			if _, err := io.Copy(out, archive); err != nil {
+				return fmt.Errorf("failed to save snapshot: %v", err)
+			}
+			if f, ok := out.(*os.File); ok && f != os.Stdout {
+				return f.Close()
+			}
+			return nil
+		},
+	}
+}
+
+func snapshotRestoreCommand() *cobra.Command {
+	var force bool
+
+	cmd := &cobra.Command{
+		Use:   "restore FILE",
+		Short: "Restore the vm of a snapshot archive read from FILE, or from the standard input for -",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var in io.Reader = os.Stdin
+			if args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				in = f
+			}
+
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			vm, err := c.ImportSnapshot(cmd.Context(), in, force)
+			if err != nil {
+				return err
+			}
+			return printVms([]client.CreateResponse{*vm})
+		},
+	}
+
+	cmd.Flags().BoolVar(&force, "force", false, "skip the firecracker version check")
+
+	return cmd
+}
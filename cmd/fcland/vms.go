@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/iradukunda1/firecrackerland/client"
+	"github.com/spf13/cobra"
+)
+
+// vmStates are completed for the --state flag
+var vmStates = []string{
+	string(client.StateCreated), string(client.StateStarted), string(client.StatePaused),
+	string(client.StateFailed), string(client.StateExited), string(client.StateRestarting),
+}
+
+func runCommand() *cobra.Command {
+	var (
+		req     client.CreateRequest
+		restart string
+		volumes []string
+	)
+
+	cmd := &cobra.Command{
+		Use:   "run IMAGE",
+		Short: "Create a vm running a docker image",
+		Long: `Create a vm running a docker image, the command returns once the vm started.
+
+Volumes are attached with --volume NAME:MOUNT_POINT[:ro], the restart policy is
+no, on-failure[:MAX_RETRIES] or always.`,
+		Example: `  fcland run --name web nginx:alpine
+  fcland run --name job --restart on-failure:3 --volume data:/data --memory 512 busybox`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: cobra.NoFileCompletions,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			req.DockerImage = args[0]
+
+			if restart != "" {
+				policy, err := parseRestartPolicy(restart)
+				if err != nil {
+					return err
+				}
+				req.RestartPolicy = policy
+			}
+			for _, v := range volumes {
+				mount, err := parseVolume(v)
+				if err != nil {
+					return err
+				}
+				req.Volumes = append(req.Volumes, *mount)
+			}
+
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			vm, err := c.CreateVm(cmd.Context(), &req)
+			if err != nil {
+				return err
+			}
+			return printVms([]client.CreateResponse{*vm})
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&req.Name, "name", "", "name of the vm")
+	flags.Int64Var(&req.VCPUs, "cpus", 0, "vcpus of the vm, 1 by default")
+	flags.Int64Var(&req.MemoryMiB, "memory", 0, "memory of the vm in MiB, 256 by default")
+	flags.StringVar(&req.Kernel, "kernel", "", "kernel of the registry to boot, the default one when empty")
+	flags.StringVar(&req.Initrd, "initrd", "", "initrd of the registry to boot, the default one when empty")
+	flags.StringVar(&req.BootArgs, "boot-args", "", "boot args appended to those of the kernel")
+	flags.StringVar(&restart, "restart", "", "restart policy: no, on-failure[:MAX_RETRIES] or always")
+	flags.StringArrayVarP(&volumes, "volume", "v", nil, "volume to attach as NAME:MOUNT_POINT[:ro], may be repeated")
+	cmd.MarkFlagRequired("name")
+	cmd.RegisterFlagCompletionFunc("restart", cobra.FixedCompletions([]string{"no", "on-failure", "always"}, cobra.ShellCompDirectiveNoFileComp))
+	cmd.RegisterFlagCompletionFunc("kernel", completeKernels)
+	cmd.RegisterFlagCompletionFunc("initrd", completeInitrds)
+
+	return cmd
+}
+
+// parseRestartPolicy parses no, on-failure[:MAX_RETRIES] or always
+func parseRestartPolicy(s string) (*client.RestartPolicy, error) {
+	name, retries, found := strings.Cut(s, ":")
+	policy := &client.RestartPolicy{Name: name}
+	if found {
+		n, err := strconv.Atoi(retries)
+		if err != nil || n < 0 || name != "on-failure" {
+			return nil, fmt.Errorf("invalid restart policy %q", s)
+		}
+		policy.MaxRetries = n
+	}
+	return policy, nil
+}
+
+// parseVolume parses NAME:MOUNT_POINT[:ro]
+func parseVolume(s string) (*client.VolumeMount, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid volume %q, use NAME:MOUNT_POINT[:ro]", s)
+	}
+	mount := &client.VolumeMount{Name: parts[0], MountPoint: parts[1]}
+	if len(parts) == 3 {
+		if parts[2] != "ro" {
+			return nil, fmt.Errorf("invalid volume %q, use NAME:MOUNT_POINT[:ro]", s)
+		}
+		mount.ReadOnly = true
+	}
+	return mount, nil
+}
+
+func lsCommand() *cobra.Command {
+	var (
+		opts  client.ListOptions
+		state string
+		quiet bool
+	)
+
+	cmd := &cobra.Command{
+		Use:               "ls",
+		Aliases:           []string{"list", "ps"},
+		Short:             "List vms",
+		Args:              cobra.NoArgs,
+		ValidArgsFunction: cobra.NoFileCompletions,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts.State = client.VmState(state)
+
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			vms, err := c.AllVms(cmd.Context(), &opts)
+			if err != nil {
+				return err
+			}
+
+			if quiet {
+				ids := make([]string, len(vms))
+				for i, vm := range vms {
+					ids[i] = vm.ID
+				}
+				printIDs(ids)
+				return nil
+			}
+			return printVms(vms)
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&state, "state", "", "only the vms in this state")
+	flags.StringVar(&opts.Name, "name", "", "only the vms with this name")
+	flags.StringVar(&opts.Image, "image", "", "only the vms of this docker image")
+	flags.StringVar(&opts.Tenant, "tenant", "", "only the vms of this tenant, for admins")
+	flags.BoolVarP(&quiet, "quiet", "q", false, "only print the ids")
+	cmd.RegisterFlagCompletionFunc("state", cobra.FixedCompletions(vmStates, cobra.ShellCompDirectiveNoFileComp))
+
+	return cmd
+}
+
+func inspectCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:               "inspect VM_ID",
+		Short:             "Show the details of a vm",
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeVms,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+			vm, err := c.GetVm(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			return printVm(vm)
+		},
+	}
+}
+
+func rmCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:               "rm VM_ID...",
+		Aliases:           []string{"delete"},
+		Short:             "Delete vms, running ones are shut down",
+		Args:              cobra.MinimumNArgs(1),
+		ValidArgsFunction: completeVms,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+
+			// every vm is deleted before the failures are reported
+			var failed []error
+			for _, id := range args {
+				if err := c.DeleteVm(cmd.Context(), id); err != nil {
+					failed = append(failed, fmt.Errorf("failed to delete %s: %v", id, err))
+					continue
+				}
+				printIDs([]string{id})
+			}
+			return errors.Join(failed...)
+		},
+	}
+}
+
+// actionCommand runs the vm action on the vms given and prints them
+func actionCommand(action, short string) *cobra.Command {
+	return &cobra.Command{
+		Use:               action + " VM_ID...",
+		Short:             short,
+		Args:              cobra.MinimumNArgs(1),
+		ValidArgsFunction: completeVms,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := newClient()
+			if err != nil {
+				return err
+			}
+
+			// the action runs on every vm before the failures are reported
+			var (
+				vms    []client.CreateResponse
+				failed []error
+			)
+			for _, id := range args {
+				vm, err := c.VmAction(cmd.Context(), id, action)
+				if err != nil {
+					failed = append(failed, fmt.Errorf("failed to %s %s: %v", action, id, err))
+					continue
+				}
+				vms = append(vms, *vm)
+			}
+			if len(vms) > 0 {
+				if err := printVms(vms); err != nil {
+					return err
+				}
+			}
+			return errors.Join(failed...)
+		},
+	}
+}
+
+// completeVms completes the ids of the vms of the caller, showing their names
+func completeVms(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	c, err := newClient()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	vms, err := c.AllVms(cmd.Context(), nil)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+
+	var ids []string
+	for _, vm := range vms {
+		if strings.HasPrefix(vm.ID, toComplete) {
+			ids = append(ids, vm.ID+"\t"+vm.Name)
+		}
+	}
+	return ids, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeKernels completes the names of the kernels of the registry
+func completeKernels(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return completeBoot(cmd, true)
+}
+
+// completeInitrds completes the names of the initrds of the registry
+func completeInitrds(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return completeBoot(cmd, false)
+}
+
+func completeBoot(cmd *cobra.Command, kernel bool) ([]string, cobra.ShellCompDirective) {
+	c, err := newClient()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	reg, err := c.Kernels(cmd.Context())
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+
+	var names []string
+	if kernel {
+		for _, k := range reg.Kernels {
+			names = append(names, k.Name+"\t"+k.Arch)
+		}
+	} else {
+		for _, rd := range reg.Initrds {
+			names = append(names, rd.Name)
+		}
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
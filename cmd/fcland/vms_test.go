@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/iradukunda1/firecrackerland/client"
+)
+
+func TestParseRestartPolicy(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want *client.RestartPolicy
+	}{
+		{"no", &client.RestartPolicy{Name: "no"}},
+		{"always", &client.RestartPolicy{Name: "always"}},
+		{"on-failure", &client.RestartPolicy{Name: "on-failure"}},
+		{"on-failure:3", &client.RestartPolicy{Name: "on-failure", MaxRetries: 3}},
+		{"on-failure:-1", nil},
+		{"on-failure:many", nil},
+		{"always:3", nil},
+	} {
+		t.Run(c.in, func(t *testing.T) {
+			got, err := parseRestartPolicy(c.in)
+			if (err != nil) != (c.want == nil) || !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("got %+v, %v, want %+v", got, err, c.want)
+			}
+		})
+	}
+}
+
+func TestParseVolume(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want *client.VolumeMount
+	}{
+		{"data:/data", &client.VolumeMount{Name: "data", MountPoint: "/data"}},
+		{"data:/data:ro", &client.VolumeMount{Name: "data", MountPoint: "/data", ReadOnly: true}},
+		{"data:/data:rw", nil},
+		{"data", nil},
+		{":/data", nil},
+		{"data:", nil},
+		{"data:/data:ro:x", nil},
+	} {
+		t.Run(c.in, func(t *testing.T) {
+			got, err := parseVolume(c.in)
+			if (err != nil) != (c.want == nil) || !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("got %+v, %v, want %+v", got, err, c.want)
+			}
+		})
+	}
+}
+
+func TestVmState(t *testing.T) {
+	code := 3
+	for _, c := range []struct {
+		name string
+		vm   client.CreateResponse
+		want string
+	}{
+		{"started", client.CreateResponse{State: client.StateStarted}, "started"},
+		{"exited", client.CreateResponse{State: client.StateExited, ExitCode: &code}, "exited (3)"},
+		{"failed", client.CreateResponse{State: client.StateFailed, ExitCode: &code}, "failed (3)"},
+		{"restarting", client.CreateResponse{State: client.StateRestarting, ExitCode: &code}, "restarting"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := vmState(c.vm); got != c.want {
+				t.Fatalf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+// testDaemon is the address of a daemon knowing the vm vm-1 only
+func testDaemon(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/v1/vms/vm-1") {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(client.Message{Message: "no such vm"})
+			return
+		}
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		json.NewEncoder(w).Encode(client.CreateResponse{ID: "vm-1", Name: "web", State: client.StatePaused})
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// captureStdout is what run writes to the standard output
+func captureStdout(t *testing.T, run func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = saved }()
+
+	out := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- string(data)
+	}()
+	run()
+	w.Close()
+	return <-out
+}
+
+func TestVmCommands(t *testing.T) {
+	addr := testDaemon(t)
+
+	for _, c := range []struct {
+		name string
+		args []string
+		out  []string
+		err  string
+	}{
+		{"rm", []string{"rm", "vm-1"}, []string{"vm-1"}, ""},
+		// every vm is tried before the failures are reported
+		{"rm with a missing vm", []string{"rm", "vm-2", "vm-1"}, []string{"vm-1"}, "failed to delete vm-2"},
+		{"pause", []string{"pause", "vm-1"}, []string{"vm-1", "web", "paused"}, ""},
+		{"pause with a missing vm", []string{"pause", "vm-1", "vm-2"}, []string{"vm-1"}, "failed to pause vm-2"},
+		{"stop of missing vms", []string{"stop", "vm-2"}, nil, "failed to stop vm-2"},
+		{"inspect", []string{"inspect", "vm-1"}, []string{"Name:", "web"}, ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var err error
+			out := captureStdout(t, func() {
+				root := rootCommand()
+				root.SetArgs(append([]string{"--host", addr, "--token", ""}, c.args...))
+				err = root.ExecuteContext(context.Background())
+			})
+			if c.err == "" && err != nil || c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+				t.Fatalf("got error %v, want %q", err, c.err)
+			}
+			for _, s := range c.out {
+				if !strings.Contains(out, s) {
+					t.Fatalf("%q is not in the output %q", s, out)
+				}
+			}
+			if c.out == nil && out != "" {
+				t.Fatalf("got output %q", out)
+			}
+		})
+	}
+}
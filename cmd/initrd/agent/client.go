@@ -0,0 +1,261 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/firecracker-microvm/firecracker-go-sdk/vsock"
+	"golang.org/x/sys/unix"
+)
+
+// Client talks to the agent of one vm through the vsock unix socket firecracker exposes on the host.
+type Client struct {
+	path  string
+	port  uint32
+	token string
+}
+
+// NewClient returns a client for the agent listening on port behind the firecracker vsock socket at path.
+func NewClient(path string, port uint32, token string) *Client {
+	return &Client{path: path, port: port, token: token}
+}
+
+// open dials the agent, sends req and closes the connection once ctx is done
+func (c *Client) open(ctx context.Context, req Request) (*Conn, func(), error) {
+	nc, err := vsock.DialContext(ctx, c.path, c.port, vsock.WithRetryTimeout(5*time.Second))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to dial agent: %w", err)
+	}
+
+	conn := NewConn(nc)
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(done)
+			conn.Close()
+		})
+	}
+
+	req.Token = c.token
+	if err := conn.WriteJSON(FrameRequest, &req); err != nil {
+		stop()
+		return nil, nil, fmt.Errorf("failed to send agent request: %w", err)
+	}
+
+	return conn, stop, nil
+}
+
+// call runs an operation without streams and returns its result
+func (c *Client) call(ctx context.Context, req Request) (*Result, error) {
+	conn, stop, err := c.open(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+
+	return readResult(conn, nil, nil)
+}
+
+// readResult reads frames until the result, handing stdout and stderr frames to the writers
+func readResult(conn *Conn, stdout, stderr io.Writer) (*Result, error) {
+	for {
+		typ, payload, err := conn.ReadFrame()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read agent response: %w", err)
+		}
+
+		switch typ {
+		case FrameStdout:
+			if stdout != nil {
+				stdout.Write(payload)
+			}
+		case FrameStderr:
+			if stderr != nil {
+				stderr.Write(payload)
+			}
+		case FrameResult:
+			res := new(Result)
+			if err := json.Unmarshal(payload, res); err != nil {
+				return nil, fmt.Errorf("failed to decode agent result: %w", err)
+			}
+			if res.Error == ErrUnauthorized.Error() {
+				return nil, ErrUnauthorized
+			}
+			if res.Error != "" {
+				return res, errors.New(res.Error)
+			}
+			return res, nil
+		}
+	}
+}
+
+// Health reports whether the agent is up along with some details about the guest.
+func (c *Client) Health(ctx context.Context) (*Health, error) {
+	res, err := c.call(ctx, Request{Op: OpHealth})
+	if err != nil {
+		return nil, err
+	}
+	return res.Health, nil
+}
+
+// Signal delivers sig to the guest process pid, 0 being the container entrypoint.
+func (c *Client) Signal(ctx context.Context, pid int, sig syscall.Signal) error {
+	_, err := c.call(ctx, Request{Op: OpSignal, Signal: &SignalRequest{Pid: pid, Signal: int(sig)}})
+	return err
+}
+
+// CopyIn extracts the tar stream r into the guest directory dst.
+func (c *Client) CopyIn(ctx context.Context, dst string, r io.Reader) error {
+	conn, stop, err := c.open(ctx, Request{Op: OpCopyIn, Path: dst})
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	if _, err := io.Copy(conn.Writer(FrameStdin), r); err != nil {
+		return fmt.Errorf("failed to send archive: %w", err)
+	}
+	if err := conn.WriteFrame(FrameClose, []byte{FrameStdin}); err != nil {
+		return fmt.Errorf("failed to send archive: %w", err)
+	}
+
+	_, err = readResult(conn, nil, nil)
+	return err
+}
+
+// CopyOut writes the guest path src into w as a tar stream.
+func (c *Client) CopyOut(ctx context.Context, src string, w io.Writer) error {
+	conn, stop, err := c.open(ctx, Request{Op: OpCopyOut, Path: src})
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	_, err = readResult(conn, w, nil)
+	return err
+}
+
+// Session is a command running in the guest.
+type Session struct {
+	conn *Conn
+	stop func()
+	done chan struct{}
+	res  *Result
+	err  error
+}
+
+// Start runs req in the guest, its output is written into stdout and stderr as it comes.
+// With a tty everything goes to stdout.
+func (c *Client) Start(ctx context.Context, req ExecRequest, stdout, stderr io.Writer) (*Session, error) {
+	conn, stop, err := c.open(ctx, Request{Op: OpExec, Exec: &req})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Session{conn: conn, stop: stop, done: make(chan struct{})}
+
+	go func() {
+		s.res, s.err = readResult(conn, stdout, stderr)
+		close(s.done)
+	}()
+
+	return s, nil
+}
+
+// Write sends p to the stdin of the command.
+func (s *Session) Write(p []byte) (int, error) {
+	return s.conn.Writer(FrameStdin).Write(p)
+}
+
+// CloseStdin signals the end of the input.
+func (s *Session) CloseStdin() error {
+	return s.conn.WriteFrame(FrameClose, []byte{FrameStdin})
+}
+
+// Resize changes the window size of the tty of the command.
+func (s *Session) Resize(rows, cols uint16) error {
+	return s.conn.WriteJSON(FrameResize, &Winsize{Rows: rows, Cols: cols})
+}
+
+// Signal delivers sig to the command.
+func (s *Session) Signal(sig syscall.Signal) error {
+	return s.conn.WriteJSON(FrameSignal, &SignalRequest{Signal: int(sig)})
+}
+
+// Done is closed once the command has exited.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Wait waits for the command and returns its exit code.
+func (s *Session) Wait() (int, error) {
+	<-s.done
+	s.stop()
+	if s.err != nil {
+		return -1, s.err
+	}
+	return s.res.ExitCode, nil
+}
+
+// Close abandons the session, killing the command.
+func (s *Session) Close() error {
+	s.stop()
+	<-s.done
+	return nil
+}
+
+// Exec runs req in the guest feeding it stdin and returns its exit code.
+func (c *Client) Exec(ctx context.Context, req ExecRequest, stdin io.Reader, stdout, stderr io.Writer) (int, error) {
+	req.Stdin = stdin != nil
+
+	s, err := c.Start(ctx, req, stdout, stderr)
+	if err != nil {
+		return -1, err
+	}
+
+	if stdin != nil {
+		go func() {
+			io.Copy(s, stdin)
+			s.CloseStdin()
+		}()
+	}
+
+	return s.Wait()
+}
+
+// ParseSignal accepts a signal number or a name such as TERM or SIGTERM.
+func ParseSignal(s string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		return syscall.Signal(n), nil
+	}
+
+	name := strings.ToUpper(s)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+
+	sig := unix.SignalNum(name)
+	if sig == 0 {
+		return 0, fmt.Errorf("unknown signal %q", s)
+	}
+
+	return sig, nil
+}
@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testAgent serves s behind a unix socket speaking the vsock handshake of firecracker and
+// returns a client of it
+func testAgent(t *testing.T, s *Server) *Client {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "vsock.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s.started = time.Now()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				// the handshake is read a byte at a time, the request follows it
+				line := make([]byte, 0, 32)
+				b := make([]byte, 1)
+				for len(line) == 0 || line[len(line)-1] != '\n' {
+					if _, err := conn.Read(b); err != nil {
+						conn.Close()
+						return
+					}
+					line = append(line, b[0])
+				}
+				if string(line) != fmt.Sprintf("CONNECT %d\n", DefaultPort) {
+					conn.Close()
+					return
+				}
+				conn.Write([]byte("OK 1073741824\n"))
+				s.handle(NewConn(conn))
+			}()
+		}
+	}()
+
+	return NewClient(path, DefaultPort, s.Token)
+}
+
+func TestExec(t *testing.T) {
+	c := testAgent(t, &Server{Token: "secret"})
+	dir := t.TempDir()
+
+	for _, cs := range []struct {
+		name   string
+		req    ExecRequest
+		stdin  string
+		stdout string
+		stderr string
+		code   int
+		err    string
+	}{
+		{"output and exit code", ExecRequest{Args: []string{"sh", "-c", "echo out; echo err >&2; exit 3"}}, "", "out\n", "err\n", 3, ""},
+		{"stdin", ExecRequest{Args: []string{"cat"}}, "hello", "hello", "", 0, ""},
+		{"environment", ExecRequest{Args: []string{"sh", "-c", "echo $GREETING"}, Env: []string{"GREETING=hi"}}, "", "hi\n", "", 0, ""},
+		{"workdir", ExecRequest{Args: []string{"pwd"}, Workdir: dir}, "", dir + "\n", "", 0, ""},
+		{"killed", ExecRequest{Args: []string{"sh", "-c", "kill -KILL $$"}}, "", "", "", 128 + int(syscall.SIGKILL), ""},
+		{"no command", ExecRequest{}, "", "", "", 0, "missing command"},
+		{"unknown command", ExecRequest{Args: []string{"/does/not/exist"}}, "", "", "", 0, "failed to start command"},
+	} {
+		t.Run(cs.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			var code int
+			var err error
+			if cs.stdin != "" {
+				code, err = c.Exec(context.Background(), cs.req, strings.NewReader(cs.stdin), &stdout, &stderr)
+			} else {
+				code, err = c.Exec(context.Background(), cs.req, nil, &stdout, &stderr)
+			}
+			if cs.err != "" {
+				if err == nil || !strings.Contains(err.Error(), cs.err) {
+					t.Fatalf("got %v, want %q", err, cs.err)
+				}
+				return
+			}
+			if err != nil || code != cs.code || stdout.String() != cs.stdout || stderr.String() != cs.stderr {
+				t.Fatalf("got %d, %q, %q, %v", code, stdout.String(), stderr.String(), err)
+			}
+		})
+	}
+}
+
+// notifyWriter closes ready on the first write
+type notifyWriter struct {
+	once  sync.Once
+	ready chan struct{}
+}
+
+func (w *notifyWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.ready) })
+	return len(p), nil
+}
+
+func TestExecSignal(t *testing.T) {
+	c := testAgent(t, &Server{Token: "secret"})
+
+	stdout := &notifyWriter{ready: make(chan struct{})}
+	s, err := c.Start(context.Background(), ExecRequest{Args: []string{"sh", "-c", "trap 'exit 7' TERM; echo ready; while :; do sleep 0.05; done"}}, stdout, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// the trap is set once the shell wrote to stdout
+	select {
+	case <-stdout.ready:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the command did not start")
+	}
+	if err := s.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := s.Wait()
+	if err != nil || code != 7 {
+		t.Fatalf("got %d, %v", code, err)
+	}
+}
+
+func TestExecUnauthorized(t *testing.T) {
+	c := testAgent(t, &Server{Token: "secret"})
+	c.token = "guess"
+
+	if _, err := c.Exec(context.Background(), ExecRequest{Args: []string{"true"}}, nil, nil, nil); err != ErrUnauthorized {
+		t.Fatalf("got %v, want %v", err, ErrUnauthorized)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	c := testAgent(t, &Server{Token: "secret"})
+	ctx := context.Background()
+
+	dst := t.TempDir()
+	archive := buildTar(t, []tarEntry{{name: "app/"}, {name: "app/config", data: "port=80"}, {name: "app/current", link: "config"}})
+	if err := c.CopyIn(ctx, dst, archive); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := c.CopyOut(ctx, filepath.Join(dst, "app"), &out); err != nil {
+		t.Fatal(err)
+	}
+	back := t.TempDir()
+	if err := ExtractTar(&out, back, false); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(back, "app", "current")); err != nil || string(data) != "port=80" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+
+	for _, cs := range []struct {
+		name string
+		copy func() error
+	}{
+		{"through a symlink", func() error {
+			return c.CopyIn(ctx, dst, buildTar(t, []tarEntry{{name: "out", link: t.TempDir()}, {name: "out/file", data: "x"}}))
+		}},
+		{"no destination", func() error { return c.CopyIn(ctx, "", buildTar(t, nil)) }},
+		{"missing source", func() error { return c.CopyOut(ctx, filepath.Join(dst, "missing"), io.Discard) }},
+		{"no source", func() error { return c.CopyOut(ctx, "", io.Discard) }},
+	} {
+		t.Run(cs.name, func(t *testing.T) {
+			if err := cs.copy(); err == nil {
+				t.Fatal("the copy went through")
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package agent
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ReportExit tells the host listening behind conn how the container entrypoint exited and
+// waits for the acknowledgement, the guest is about to go away.
+func ReportExit(conn net.Conn, token string, code int) error {
+	c := NewConn(conn)
+	defer c.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	err := c.WriteJSON(FrameRequest, &Request{Token: token, Op: OpExit, Exit: &ExitReport{ExitCode: code}})
+	if err != nil {
+		return fmt.Errorf("failed to send exit report: %w", err)
+	}
+
+	typ, payload, err := c.ReadFrame()
+	if err != nil || typ != FrameResult {
+		return fmt.Errorf("exit report was not acknowledged: %v", err)
+	}
+
+	res := new(Result)
+	if err := json.Unmarshal(payload, res); err != nil {
+		return fmt.Errorf("failed to decode exit acknowledgement: %w", err)
+	}
+	if res.Error != "" {
+		return fmt.Errorf("exit report was rejected: %s", res.Error)
+	}
+
+	return nil
+}
+
+// AcceptExit waits on l for the exit report of the guest presenting token and returns the
+// exit code of its entrypoint. It fails once l is closed.
+func AcceptExit(l net.Listener, token string) (int, error) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return 0, err
+		}
+
+		code, err := readExit(NewConn(conn), token)
+		if err == nil {
+			return code, nil
+		}
+	}
+}
+
+func readExit(c *Conn, token string) (int, error) {
+	defer c.Close()
+
+	typ, payload, err := c.ReadFrame()
+	if err != nil || typ != FrameRequest {
+		return 0, fmt.Errorf("invalid exit report")
+	}
+
+	req := new(Request)
+	if err := json.Unmarshal(payload, req); err != nil || req.Op != OpExit || req.Exit == nil {
+		c.WriteJSON(FrameResult, &Result{Error: "invalid exit report"})
+		return 0, fmt.Errorf("invalid exit report")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(req.Token), []byte(token)) != 1 {
+		c.WriteJSON(FrameResult, &Result{Error: ErrUnauthorized.Error()})
+		return 0, ErrUnauthorized
+	}
+
+	c.WriteJSON(FrameResult, &Result{ExitCode: req.Exit.ExitCode})
+
+	return req.Exit.ExitCode, nil
+}
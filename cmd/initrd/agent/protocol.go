@@ -0,0 +1,193 @@
+// Package agent is the guest agent of firecracker-land. It runs inside the initrd, listens on vsock
+// and lets the daemon run commands, copy files, deliver signals and check the health of the guest.
+//
+// Every operation uses its own connection. Both ends exchange frames made of a one byte type,
+// a big endian uint32 length and the payload. The host starts with a FrameRequest, the guest
+// always ends with a FrameResult. The exit report is the only connection going the other way:
+// the guest sends it to the host when the container entrypoint exits.
+package agent
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DefaultPort is the vsock port the agent listens on inside the guest.
+const DefaultPort = 10789
+
+// DefaultExitPort is the vsock port the host listens on for the exit report of the guest.
+const DefaultExitPort = DefaultPort + 1
+
+// maxFrameSize bounds the payload of a single frame.
+const maxFrameSize = 1 << 20
+
+// Frame types.
+const (
+	FrameRequest byte = iota
+	FrameStdin
+	FrameStdout
+	FrameStderr
+	FrameClose
+	FrameResize
+	FrameSignal
+	FrameResult
+)
+
+// Operations supported by the agent.
+const (
+	OpHealth  = "health"
+	OpExec    = "exec"
+	OpSignal  = "signal"
+	OpCopyIn  = "copy-in"
+	OpCopyOut = "copy-out"
+	OpExit    = "exit"
+)
+
+// ErrUnauthorized is returned when the agent rejects the supplied token.
+var ErrUnauthorized = errors.New("agent: unauthorized")
+
+// Request is the first frame of every operation.
+type Request struct {
+	Token  string         `json:"token"`
+	Op     string         `json:"op"`
+	Exec   *ExecRequest   `json:"exec,omitempty"`
+	Signal *SignalRequest `json:"signal,omitempty"`
+	Path   string         `json:"path,omitempty"`
+	Exit   *ExitReport    `json:"exit,omitempty"`
+}
+
+// ExecRequest describes a command to run in the guest.
+type ExecRequest struct {
+	Args    []string `json:"args"`
+	Env     []string `json:"env,omitempty"`
+	Workdir string   `json:"workdir,omitempty"`
+	Tty     bool     `json:"tty,omitempty"`
+	Stdin   bool     `json:"stdin,omitempty"`
+}
+
+// SignalRequest asks the agent to signal a guest process, Pid 0 is the container entrypoint.
+type SignalRequest struct {
+	Pid    int `json:"pid,omitempty"`
+	Signal int `json:"signal"`
+}
+
+// ExitReport is sent by the guest to the host once the container entrypoint has exited.
+type ExitReport struct {
+	ExitCode int `json:"exit_code"`
+}
+
+// Winsize is the payload of a FrameResize.
+type Winsize struct {
+	Rows uint16 `json:"rows"`
+	Cols uint16 `json:"cols"`
+}
+
+// Health is reported by the health operation.
+type Health struct {
+	Status        string  `json:"status"`
+	Hostname      string  `json:"hostname"`
+	Uptime        float64 `json:"uptime_seconds"`
+	EntrypointPid int     `json:"entrypoint_pid,omitempty"`
+}
+
+// Result is the last frame of every operation.
+type Result struct {
+	Error    string  `json:"error,omitempty"`
+	ExitCode int     `json:"exit_code"`
+	Health   *Health `json:"health,omitempty"`
+}
+
+// Conn reads and writes frames, writes are safe for concurrent use.
+type Conn struct {
+	rw  io.ReadWriteCloser
+	wmu sync.Mutex
+}
+
+// NewConn wraps rw into a frame connection.
+func NewConn(rw io.ReadWriteCloser) *Conn {
+	return &Conn{rw: rw}
+}
+
+// WriteFrame writes a single frame.
+func (c *Conn) WriteFrame(typ byte, payload []byte) error {
+	if len(payload) > maxFrameSize {
+		return fmt.Errorf("agent: frame of %d bytes is too large", len(payload))
+	}
+
+	hdr := make([]byte, 5)
+	hdr[0] = typ
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(payload)))
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if _, err := c.rw.Write(hdr); err != nil {
+		return err
+	}
+	_, err := c.rw.Write(payload)
+	return err
+}
+
+// WriteJSON writes v encoded as json in a single frame.
+func (c *Conn) WriteJSON(typ byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.WriteFrame(typ, data)
+}
+
+// ReadFrame reads the next frame.
+func (c *Conn) ReadFrame() (byte, []byte, error) {
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(c.rw, hdr); err != nil {
+		return 0, nil, err
+	}
+
+	size := binary.BigEndian.Uint32(hdr[1:])
+	if size > maxFrameSize {
+		return 0, nil, fmt.Errorf("agent: frame of %d bytes is too large", size)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.rw, payload); err != nil {
+		return 0, nil, err
+	}
+
+	return hdr[0], payload, nil
+}
+
+// Writer returns an io.Writer sending everything written to it as frames of typ.
+func (c *Conn) Writer(typ byte) io.Writer {
+	return &frameWriter{conn: c, typ: typ}
+}
+
+// Close closes the underlying connection.
+func (c *Conn) Close() error {
+	return c.rw.Close()
+}
+
+type frameWriter struct {
+	conn *Conn
+	typ  byte
+}
+
+func (w *frameWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxFrameSize {
+			n = maxFrameSize
+		}
+		if err := w.conn.WriteFrame(w.typ, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,135 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// bufConn is a connection of the tests reading what was written to it
+type bufConn struct {
+	bytes.Buffer
+}
+
+func (b *bufConn) Close() error { return nil }
+
+func TestFrames(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		typ  byte
+		size int
+	}{
+		{"empty", FrameClose, 0},
+		{"small", FrameStdout, 5},
+		{"largest", FrameStdin, maxFrameSize},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			conn := NewConn(new(bufConn))
+			payload := bytes.Repeat([]byte{'x'}, c.size)
+			if err := conn.WriteFrame(c.typ, payload); err != nil {
+				t.Fatal(err)
+			}
+			typ, got, err := conn.ReadFrame()
+			if err != nil || typ != c.typ || !bytes.Equal(got, payload) {
+				t.Fatalf("got type %d with %d bytes, %v", typ, len(got), err)
+			}
+		})
+	}
+}
+
+func TestInvalidFrames(t *testing.T) {
+	if err := NewConn(new(bufConn)).WriteFrame(FrameStdout, make([]byte, maxFrameSize+1)); err == nil {
+		t.Fatal("a frame over the limit was written")
+	}
+
+	for _, c := range []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"no frame", nil, io.EOF},
+		{"short header", []byte{FrameStdout, 0, 0}, io.ErrUnexpectedEOF},
+		{"short payload", []byte{FrameStdout, 0, 0, 0, 4, 'a', 'b'}, io.ErrUnexpectedEOF},
+		{"over the limit", []byte{FrameStdout, 0xff, 0xff, 0xff, 0xff}, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			b := new(bufConn)
+			b.Write(c.data)
+			_, _, err := NewConn(b).ReadFrame()
+			if err == nil || c.err != nil && !errors.Is(err, c.err) {
+				t.Fatalf("got %v, want %v", err, c.err)
+			}
+		})
+	}
+}
+
+func TestFrameWriter(t *testing.T) {
+	b := new(bufConn)
+	conn := NewConn(b)
+	data := bytes.Repeat([]byte("0123456789"), maxFrameSize/4)
+
+	n, err := conn.Writer(FrameStderr).Write(data)
+	if err != nil || n != len(data) {
+		t.Fatalf("wrote %d bytes: %v", n, err)
+	}
+
+	var got []byte
+	frames := 0
+	for b.Len() > 0 {
+		typ, payload, err := conn.ReadFrame()
+		if err != nil || typ != FrameStderr {
+			t.Fatalf("got type %d: %v", typ, err)
+		}
+		if len(payload) > maxFrameSize {
+			t.Fatalf("frame of %d bytes", len(payload))
+		}
+		got = append(got, payload...)
+		frames++
+	}
+	if frames != 3 || !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes in %d frames", len(got), frames)
+	}
+}
+
+func TestServerRequests(t *testing.T) {
+	s := &Server{Token: "secret", Entrypoint: func() int { return 0 }}
+
+	for _, c := range []struct {
+		name    string
+		request string
+		err     string
+	}{
+		{"health", `{"token":"secret","op":"health"}`, ""},
+		{"wrong token", `{"token":"guess","op":"health"}`, ErrUnauthorized.Error()},
+		{"no token", `{"op":"health"}`, ErrUnauthorized.Error()},
+		{"unknown operation", `{"token":"secret","op":"reboot"}`, "unknown operation"},
+		{"invalid request", `{"token":`, "invalid request"},
+		{"signal without request", `{"token":"secret","op":"signal"}`, "missing signal request"},
+		{"signal without entrypoint", `{"token":"secret","op":"signal","signal":{"signal":15}}`, "entrypoint is not running"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			host, guest := net.Pipe()
+			go s.handle(NewConn(guest))
+
+			conn := NewConn(host)
+			defer conn.Close()
+			if err := conn.WriteFrame(FrameRequest, []byte(c.request)); err != nil {
+				t.Fatal(err)
+			}
+
+			res, err := readResult(conn, nil, nil)
+			if c.err == "" {
+				if err != nil || res.Health == nil || res.Health.Status != "ok" {
+					t.Fatalf("got %+v, %v", res, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("got %v, want %q", err, c.err)
+			}
+		})
+	}
+}
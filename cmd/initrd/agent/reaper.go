@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// Reaper waits on every child of init, orphans re-parented to it included. Commands that
+// need their exit status have to be started through it, waiting on them directly would race
+// with the reaping.
+type Reaper struct {
+	mu      sync.Mutex
+	waiting map[int]chan syscall.WaitStatus
+}
+
+// StartReaper starts reaping children on every SIGCHLD.
+func StartReaper() *Reaper {
+	r := &Reaper{waiting: make(map[int]chan syscall.WaitStatus)}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGCHLD)
+
+	go func() {
+		// children which exited before the signal was hooked are reaped straight away
+		r.reap()
+		for range sigs {
+			r.reap()
+		}
+	}()
+
+	return r
+}
+
+// reap collects every child that has exited, signals coalesce so one may stand for several
+func (r *Reaper) reap() {
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || pid <= 0 {
+			return
+		}
+
+		r.mu.Lock()
+		ch, ok := r.waiting[pid]
+		delete(r.waiting, pid)
+		r.mu.Unlock()
+
+		if ok {
+			ch <- status
+		}
+	}
+}
+
+// Start starts cmd, through start when it needs more than cmd.Start, and returns a channel
+// receiving its wait status once it exits. cmd.Wait must not be called.
+func (r *Reaper) Start(cmd *exec.Cmd, start func() error) (<-chan syscall.WaitStatus, error) {
+	if start == nil {
+		start = cmd.Start
+	}
+
+	// the lock holds back the status of a child exiting right away until it is registered
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := start(); err != nil {
+		return nil, err
+	}
+
+	ch := make(chan syscall.WaitStatus, 1)
+	r.waiting[cmd.Process.Pid] = ch
+
+	return ch, nil
+}
+
+// ExitCode follows the shell convention of 128+signal for processes killed by a signal.
+func ExitCode(status syscall.WaitStatus) int {
+	if status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return status.ExitStatus()
+}
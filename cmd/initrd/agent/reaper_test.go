@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestExitCode(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		script string
+		code   int
+	}{
+		{"success", "exit 0", 0},
+		{"failure", "exit 42", 42},
+		{"terminated", "kill -TERM $$", 128 + int(syscall.SIGTERM)},
+		{"killed", "kill -KILL $$", 128 + int(syscall.SIGKILL)},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cmd := exec.Command("sh", "-c", c.script)
+			cmd.Run()
+			if got := ExitCode(cmd.ProcessState.Sys().(syscall.WaitStatus)); got != c.code {
+				t.Fatalf("got %d, want %d", got, c.code)
+			}
+		})
+	}
+}
+
+// TestReaper runs in a process of its own, the reaper waits on every child of the process it
+// runs in and would take them from the other tests
+func TestReaper(t *testing.T) {
+	if os.Getenv("AGENT_TEST_REAPER") != "1" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestReaper$", "-test.v")
+		cmd.Env = append(os.Environ(), "AGENT_TEST_REAPER=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+		return
+	}
+
+	r := StartReaper()
+
+	// the exit status of the commands started through the reaper reaches them, even when
+	// they exit right away
+	for i, script := range []string{"exit 0", "exit 3", "kill -TERM $$"} {
+		status, err := r.Start(exec.Command("sh", "-c", script), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case st := <-status:
+			if want := []int{0, 3, 128 + int(syscall.SIGTERM)}[i]; ExitCode(st) != want {
+				t.Fatalf("%q exited with %d, want %d", script, ExitCode(st), want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q was not reaped", script)
+		}
+	}
+
+	// orphans and children nobody waits on are reaped as well, none is left a zombie
+	orphan := exec.Command("sh", "-c", "sleep 0.1 & exit 0")
+	if err := orphan.Start(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var st syscall.WaitStatus
+		if _, err := syscall.Wait4(orphan.Process.Pid, &st, syscall.WNOHANG, nil); err == syscall.ECHILD {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the child was not reaped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// exec waits on its commands through the reaper
+	s := &Server{Reaper: r}
+	host, guest := net.Pipe()
+	go func() {
+		c := NewConn(guest)
+		c.WriteJSON(FrameResult, s.exec(c, &ExecRequest{Args: []string{"sh", "-c", "exit 5"}}))
+		c.Close()
+	}()
+	res, err := readResult(NewConn(host), nil, nil)
+	if err != nil || res.ExitCode != 5 {
+		t.Fatalf("got %+v, %v", res, err)
+	}
+}
+
+func TestExitReport(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"reported", "secret", true},
+		{"wrong token", "guess", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			host, guest := net.Pipe()
+			reported := make(chan error, 1)
+			go func() { reported <- ReportExit(guest, c.token, 17) }()
+
+			code, err := readExit(NewConn(host), "secret")
+			if c.ok {
+				if err != nil || code != 17 {
+					t.Fatalf("got %d, %v", code, err)
+				}
+				if err := <-reported; err != nil {
+					t.Fatalf("the report was not acknowledged: %v", err)
+				}
+				return
+			}
+			if err != ErrUnauthorized {
+				t.Fatalf("got %d, %v, want %v", code, err, ErrUnauthorized)
+			}
+			if err := <-reported; err == nil {
+				t.Fatal("the rejected report was acknowledged")
+			}
+		})
+	}
+}
+
+func TestAcceptExit(t *testing.T) {
+	l, err := net.Listen("unix", t.TempDir()+"/exit.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan int, 1)
+	go func() {
+		code, _ := AcceptExit(l, "secret")
+		accepted <- code
+	}()
+
+	// a report with the wrong token is ignored, the next one is taken
+	for _, token := range []string{"guess", "secret"} {
+		conn, err := net.Dial("unix", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ReportExit(conn, token, 9)
+	}
+
+	select {
+	case code := <-accepted:
+		if code != 9 {
+			t.Fatalf("got %d", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the exit was not accepted")
+	}
+}
@@ -0,0 +1,323 @@
+package agent
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+// Server answers the requests of the daemon inside the guest.
+type Server struct {
+	// Token is the secret the daemon provisioned for this vm through MMDS.
+	Token string
+	// Entrypoint returns the pid of the container entrypoint, 0 when it is not running.
+	Entrypoint func() int
+	// Reaper starts the commands the agent runs when the agent lives in init, which reaps every child.
+	Reaper *Reaper
+
+	started time.Time
+}
+
+// Serve accepts connections on l until it fails.
+func (s *Server) Serve(l net.Listener) error {
+	s.started = time.Now()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return fmt.Errorf("agent: failed to accept connection: %w", err)
+		}
+		go s.handle(NewConn(conn))
+	}
+}
+
+func (s *Server) handle(c *Conn) {
+	defer c.Close()
+
+	typ, payload, err := c.ReadFrame()
+	if err != nil || typ != FrameRequest {
+		return
+	}
+
+	req := new(Request)
+	if err := json.Unmarshal(payload, req); err != nil {
+		c.WriteJSON(FrameResult, &Result{Error: fmt.Sprintf("invalid request: %v", err)})
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(req.Token), []byte(s.Token)) != 1 {
+		c.WriteJSON(FrameResult, &Result{Error: ErrUnauthorized.Error()})
+		return
+	}
+
+	var res *Result
+	switch req.Op {
+	case OpHealth:
+		res = s.health()
+	case OpSignal:
+		res = s.signal(req.Signal)
+	case OpExec:
+		res = s.exec(c, req.Exec)
+	case OpCopyIn:
+		res = s.copyIn(c, req.Path)
+	case OpCopyOut:
+		res = s.copyOut(c, req.Path)
+	default:
+		res = &Result{Error: fmt.Sprintf("unknown operation %q", req.Op)}
+	}
+
+	c.WriteJSON(FrameResult, res)
+}
+
+func (s *Server) entrypoint() int {
+	if s.Entrypoint == nil {
+		return 0
+	}
+	return s.Entrypoint()
+}
+
+func (s *Server) health() *Result {
+	hostname, _ := os.Hostname()
+	return &Result{
+		Health: &Health{
+			Status:        "ok",
+			Hostname:      hostname,
+			Uptime:        time.Since(s.started).Seconds(),
+			EntrypointPid: s.entrypoint(),
+		},
+	}
+}
+
+func (s *Server) signal(req *SignalRequest) *Result {
+	if req == nil {
+		return &Result{Error: "missing signal request"}
+	}
+
+	pid := req.Pid
+	if pid == 0 {
+		pid = s.entrypoint()
+	}
+	if pid <= 0 {
+		return &Result{Error: "entrypoint is not running"}
+	}
+
+	if err := syscall.Kill(pid, syscall.Signal(req.Signal)); err != nil {
+		return &Result{Error: fmt.Sprintf("failed to signal %d: %v", pid, err)}
+	}
+
+	return &Result{}
+}
+
+// exec runs the command while relaying stdin, resizes and signals sent by the daemon
+func (s *Server) exec(c *Conn, req *ExecRequest) *Result {
+	if req == nil || len(req.Args) == 0 {
+		return &Result{Error: "missing command"}
+	}
+
+	cmd := exec.Command(req.Args[0], req.Args[1:]...)
+	cmd.Env = append(os.Environ(), req.Env...)
+	cmd.Dir = req.Workdir
+
+	var stdin io.WriteCloser
+	var tty *os.File
+	var start func() error
+	var output sync.WaitGroup
+
+	if req.Tty {
+		start = func() error {
+			f, err := pty.Start(cmd)
+			tty = f
+			return err
+		}
+	} else {
+		stdout, err := pipeTo(c.Writer(FrameStdout), &output)
+		if err != nil {
+			return &Result{Error: fmt.Sprintf("failed to open stdout: %v", err)}
+		}
+		defer stdout.Close()
+		stderr, err := pipeTo(c.Writer(FrameStderr), &output)
+		if err != nil {
+			return &Result{Error: fmt.Sprintf("failed to open stderr: %v", err)}
+		}
+		defer stderr.Close()
+		cmd.Stdout, cmd.Stderr = stdout, stderr
+
+		if req.Stdin {
+			pipe, err := cmd.StdinPipe()
+			if err != nil {
+				return &Result{Error: fmt.Sprintf("failed to open stdin: %v", err)}
+			}
+			stdin = pipe
+		}
+	}
+
+	wait, err := s.start(cmd, start)
+	if err != nil {
+		return &Result{Error: fmt.Sprintf("failed to start command: %v", err)}
+	}
+
+	if tty != nil {
+		stdin = tty
+		output.Add(1)
+		go func() {
+			// reading the pty fails with EIO once the command is gone
+			io.Copy(c.Writer(FrameStdout), tty)
+			output.Done()
+		}()
+	} else {
+		// only the command holds the write ends now, the output ends when it closes them
+		cmd.Stdout.(*os.File).Close()
+		cmd.Stderr.(*os.File).Close()
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		for {
+			typ, payload, err := c.ReadFrame()
+			if err != nil {
+				select {
+				case <-exited:
+				default:
+					// the daemon went away, there is nobody left to report to
+					cmd.Process.Kill()
+				}
+				return
+			}
+			switch typ {
+			case FrameStdin:
+				if stdin != nil {
+					stdin.Write(payload)
+				}
+			case FrameClose:
+				if stdin != nil && tty == nil {
+					stdin.Close()
+				}
+			case FrameResize:
+				var ws Winsize
+				if tty != nil && json.Unmarshal(payload, &ws) == nil {
+					pty.Setsize(tty, &pty.Winsize{Rows: ws.Rows, Cols: ws.Cols})
+				}
+			case FrameSignal:
+				var sig SignalRequest
+				if json.Unmarshal(payload, &sig) == nil {
+					cmd.Process.Signal(syscall.Signal(sig.Signal))
+				}
+			}
+		}
+	}()
+
+	code := wait()
+	close(exited)
+	output.Wait()
+	if tty != nil {
+		tty.Close()
+	} else if stdin != nil {
+		stdin.Close()
+	}
+
+	return &Result{ExitCode: code}
+}
+
+// start runs cmd through the reaper when there is one and returns a function waiting for its exit code
+func (s *Server) start(cmd *exec.Cmd, start func() error) (func() int, error) {
+	if s.Reaper != nil {
+		status, err := s.Reaper.Start(cmd, start)
+		if err != nil {
+			return nil, err
+		}
+		return func() int { return ExitCode(<-status) }, nil
+	}
+
+	if start == nil {
+		start = cmd.Start
+	}
+	if err := start(); err != nil {
+		return nil, err
+	}
+
+	return func() int {
+		if err := cmd.Wait(); cmd.ProcessState == nil {
+			if err != nil {
+				return 1
+			}
+			return 0
+		}
+		return ExitCode(cmd.ProcessState.Sys().(syscall.WaitStatus))
+	}, nil
+}
+
+// pipeTo returns the write end of a pipe whose content is copied into w, wg tracks the copy
+func pipeTo(w io.Writer, wg *sync.WaitGroup) (*os.File, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	wg.Add(1)
+	go func() {
+		io.Copy(w, pr)
+		pr.Close()
+		wg.Done()
+	}()
+
+	return pw, nil
+}
+
+func (s *Server) copyIn(c *Conn, path string) *Result {
+	if path == "" {
+		return &Result{Error: "missing destination path"}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		for {
+			typ, payload, err := c.ReadFrame()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			switch typ {
+			case FrameStdin:
+				if _, err := pw.Write(payload); err != nil {
+					return
+				}
+			case FrameClose:
+				pw.Close()
+				return
+			}
+		}
+	}()
+
+	if err := ExtractTar(pr, path, true); err != nil {
+		pr.CloseWithError(err)
+		return &Result{Error: err.Error()}
+	}
+
+	return &Result{}
+}
+
+func (s *Server) copyOut(c *Conn, path string) *Result {
+	if path == "" {
+		return &Result{Error: "missing source path"}
+	}
+
+	if err := WriteTar(c.Writer(FrameStdout), path); err != nil {
+		return &Result{Error: err.Error()}
+	}
+
+	return &Result{}
+}
@@ -0,0 +1,186 @@
+package agent
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// WriteTar writes path as a tar stream into w. Entries are named relative to the parent
+// directory of path, so copying /var/log gives log/... entries. Modes, owners and
+// modification times are preserved.
+func WriteTar(w io.Writer, path string) error {
+	path = filepath.Clean(path)
+	base := filepath.Dir(path)
+
+	tw := tar.NewWriter(w)
+
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(base, file)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			hdr.Uid = int(stat.Uid)
+			hdr.Gid = int(stat.Gid)
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to archive %s: %w", path, err)
+	}
+
+	return tw.Close()
+}
+
+// ExtractTar unpacks the tar stream r into the directory dst, creating it when missing.
+// Modes and modification times of the entries are restored, and so are their owners when
+// sameOwner is set. Entries escaping dst, by their name or through a symlink, are rejected.
+func ExtractTar(r io.Reader, dst string, sameOwner bool) error {
+	dst = filepath.Clean(dst)
+
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", dst, err)
+	}
+
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		target := filepath.Join(dst, hdr.Name)
+		if target != dst && !strings.HasPrefix(target, dst+string(filepath.Separator)) {
+			return fmt.Errorf("archive entry %q escapes %s", hdr.Name, dst)
+		}
+		// a symlink entry replaces the file it is named after, the others are written to it
+		beneath := target
+		if hdr.Typeflag == tar.TypeSymlink {
+			beneath = filepath.Dir(target)
+		}
+		if err := checkBeneath(dst, beneath); err != nil {
+			return fmt.Errorf("archive entry %q escapes %s: %w", hdr.Name, dst, err)
+		}
+
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode); err != nil {
+				return fmt.Errorf("failed to create %s: %w", target, err)
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("failed to create %s: %w", filepath.Dir(target), err)
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+			if err != nil {
+				return fmt.Errorf("failed to create %s: %w", target, err)
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("failed to write %s: %w", target, err)
+			}
+		case tar.TypeSymlink:
+			os.Remove(target)
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return fmt.Errorf("failed to create symlink %s: %w", target, err)
+			}
+		default:
+			// devices, fifos and hard links are not worth carrying in and out of a vm
+			continue
+		}
+
+		if sameOwner {
+			if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+				return fmt.Errorf("failed to chown %s: %w", target, err)
+			}
+		}
+
+		if hdr.Typeflag == tar.TypeSymlink {
+			continue
+		}
+
+		// chmod again since the umask applied when creating it
+		if err := os.Chmod(target, mode); err != nil {
+			return fmt.Errorf("failed to chmod %s: %w", target, err)
+		}
+
+		if err := os.Chtimes(target, hdr.ModTime, hdr.ModTime); err != nil {
+			return fmt.Errorf("failed to set times of %s: %w", target, err)
+		}
+	}
+}
+
+// checkBeneath makes sure no file from dst down to target is a symlink, what is written through
+// one may land anywhere. The files which do not exist yet are created by the extraction.
+func checkBeneath(dst, target string) error {
+	rel, err := filepath.Rel(dst, target)
+	if err != nil || rel == "." {
+		return err
+	}
+
+	path := dst
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		path = filepath.Join(path, part)
+		info, err := os.Lstat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symlink", path)
+		}
+	}
+	return nil
+}
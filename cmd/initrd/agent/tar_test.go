@@ -0,0 +1,119 @@
+package agent
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tarEntry is an entry of the archives of the tests, a directory when its name ends with /
+type tarEntry struct {
+	name string
+	link string
+	data string
+}
+
+func buildTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, ModTime: time.Now(), Typeflag: tar.TypeReg, Size: int64(len(e.data))}
+		switch {
+		case e.link != "":
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, e.link, 0
+		case e.name[len(e.name)-1] == '/':
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write([]byte(e.data))
+		}
+	}
+	tw.Close()
+	return buf
+}
+
+func TestExtractTar(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		entries []tarEntry
+		ok      bool
+	}{
+		{"files and directories", []tarEntry{{name: "d/"}, {name: "d/f", data: "x"}, {name: "d/e/g", data: "y"}}, true},
+		{"symlink kept as is", []tarEntry{{name: "l", link: "/etc/passwd"}}, true},
+		{"symlink inside", []tarEntry{{name: "d/"}, {name: "l", link: "d"}}, true},
+		{"dot dot", []tarEntry{{name: "../f", data: "x"}}, false},
+		{"dot dot below a directory", []tarEntry{{name: "d/../../f", data: "x"}}, false},
+		{"file through a symlink", []tarEntry{{name: "x", link: "OUTSIDE"}, {name: "x/authorized_keys", data: "key"}}, false},
+		{"directory through a symlink", []tarEntry{{name: "x", link: "OUTSIDE"}, {name: "x/ssh/"}}, false},
+		{"file over a symlink", []tarEntry{{name: "x", link: "OUTSIDE/f"}, {name: "x", data: "key"}}, false},
+		{"symlink through a symlink", []tarEntry{{name: "x", link: "OUTSIDE"}, {name: "x/l", link: "/"}}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			outside := t.TempDir()
+			dst := filepath.Join(t.TempDir(), "dst")
+
+			// OUTSIDE stands for a directory the archive must not write into
+			for i := range c.entries {
+				c.entries[i].link = strings.Replace(c.entries[i].link, "OUTSIDE", outside, 1)
+			}
+
+			err := ExtractTar(buildTar(t, c.entries), dst, false)
+			if c.ok && err != nil {
+				t.Fatalf("failed to extract: %v", err)
+			}
+			if !c.ok && err == nil {
+				t.Fatal("the archive was extracted")
+			}
+
+			written, _ := os.ReadDir(outside)
+			if len(written) != 0 {
+				t.Fatalf("the archive wrote %s outside of its destination", written[0].Name())
+			}
+		})
+	}
+}
+
+func TestTarRoundTrip(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "sub", "f"), []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub/f", filepath.Join(src, "l")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := WriteTar(buf, src); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	if err := ExtractTar(buf, dst, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// entries are named after the parent of the source
+	data, err := os.ReadFile(filepath.Join(dst, "src", "sub", "f"))
+	if err != nil || string(data) != "data" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "src", "sub", "f")); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("the mode was not kept: %v, %v", info.Mode(), err)
+	}
+	if info, err := os.Stat(filepath.Join(dst, "src", "sub")); err != nil || info.Mode().Perm() != 0750 {
+		t.Fatalf("the directory mode was not kept: %v, %v", info.Mode(), err)
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "src", "l")); err != nil || link != "sub/f" {
+		t.Fatalf("got the link %q, %v", link, err)
+	}
+}
@@ -6,12 +6,17 @@ package main
 
 import (
 	"fmt"
-	"io"
+	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/iradukunda1/firecrackerland/cmd/initrd/agent"
 	"github.com/iradukunda1/firecrackerland/cmd/initrd/netsettings"
+	"github.com/mdlayher/vsock"
 
 	"github.com/iradukunda1/firecrackerland/cmd/initrd/mmds"
 )
@@ -47,6 +52,17 @@ func main() {
 		panic(fmt.Errorf("failed to retrieve runtime configuration: %w", err))
 	}
 
+	agentConfig, err := mmds.FetchAgentConfig()
+	if err != nil {
+		panic(fmt.Errorf("failed to retrieve agent configuration: %w", err))
+	}
+
+	volumes, err := mmds.FetchVolumes()
+	if err != nil {
+		panic(fmt.Errorf("failed to retrieve volumes: %w", err))
+	}
+	MountVolumes(volumes)
+
 	routeConfig := make([]netsettings.RouteConfig, len(mmdsConfig.Routes))
 	for i, route := range mmdsConfig.Routes {
 		routeConfig[i] = netsettings.RouteConfig{
@@ -100,39 +116,93 @@ func main() {
 
 	os.Chdir(runtimeConfig.Workdir)
 
+	// Ctrl-Alt-Del from the host becomes a SIGINT for init instead of an immediate reboot,
+	// it is forwarded to the entrypoint like SIGTERM so the workload gets to shut down cleanly.
+	if err := syscall.Reboot(syscall.LINUX_REBOOT_CMD_CAD_OFF); err != nil {
+		fmt.Printf("Failed to disable ctrl-alt-del: %v\n", err)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	// As init every orphan is re-parented to us, so we reap all children from now on.
+	// Processes we need the exit status of have to be started through the reaper.
+	reaper := agent.StartReaper()
+
 	cmd := exec.Command(execArgs[0], execArgs[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
 
-	stdout, err := cmd.StdoutPipe()
+	exited, err := reaper.Start(cmd, nil)
 	if err != nil {
-		panic(fmt.Errorf("failed to get stdout: %w", err))
+		fmt.Printf("Failed to start entrypoint: %v\n", err)
+		powerOff(agentConfig, 127)
 	}
-	stderr, err := cmd.StderrPipe()
+
+	go serveAgent(agentConfig, reaper, cmd.Process.Pid)
+
+	// The entrypoint exiting ends the vm
+	for {
+		select {
+		case sig := <-signals:
+			fmt.Printf("Forwarding %v to the entrypoint\n", sig)
+			cmd.Process.Signal(sig)
+		case status := <-exited:
+			powerOff(agentConfig, agent.ExitCode(status))
+		}
+	}
+}
+
+// serveAgent serves the daemon over vsock, it authenticates with the token it put in MMDS
+func serveAgent(config *mmds.AgentConfig, reaper *agent.Reaper, entrypoint int) {
+	listener, err := vsock.Listen(config.Port, nil)
 	if err != nil {
-		panic(fmt.Errorf("failed to get stderr: %w", err))
+		fmt.Printf("Failed to listen on vsock port %d: %v\n", config.Port, err)
+		return
 	}
 
-	go io.CopyBuffer(os.Stdout, stdout, make([]byte, 255))
-	go io.CopyBuffer(os.Stdout, stderr, make([]byte, 255))
+	server := &agent.Server{
+		Token:      config.Token,
+		Entrypoint: func() int { return entrypoint },
+		Reaper:     reaper,
+	}
 
-	cmd.Start()
-	// If we're in dev mode, spawn the SSH server by re-invoking ourselves
-	err = StartServer()
-	if err != nil {
-		panic(fmt.Errorf("failed to start ssh server: %v", err))
-	}
-
-	// Connect up to the manager over vsock
-	// Retrieve this VM's configuration via manager RPC method
-	// Set hostname (should eventually be based on config...)
-	// Set resolv.conf
-	// Set up signal handlers.
-	//
-	// We've done most of our exec-ing...
-	// Start reaping child processes who were re-parented.
-	// From here on out, you have to be careful when you spawn programs - you can't
-	// use os/exec and expect to get the return code, since this loop will be Wait4-ing on everything.
-	// If you start a process, you'll have to clean it up from this loop.
-	// Most processes are just waited on and discarded. Two processes are special cases:
-	//  - The entrypoint for this container - exiting will cause the VM to exit.
-	//  - If enabled, the debug SSH server (aka this process with different args) - exiting will cause it to be re-spawned.
+	fmt.Printf("Agent listening on vsock port %d\n", config.Port)
+	if err := server.Serve(listener); err != nil {
+		fmt.Printf("Agent stopped: %v\n", err)
+	}
+}
+
+// powerOff reports the exit code of the entrypoint to the host, stops what is left and powers the vm off
+func powerOff(config *mmds.AgentConfig, code int) {
+	fmt.Printf("Entrypoint exited with code %d\n", code)
+
+	if err := reportExit(config, code); err != nil {
+		fmt.Printf("Failed to report exit code: %v\n", err)
+	}
+
+	// give the processes left behind a moment to exit before pulling the plug
+	if err := syscall.Kill(-1, syscall.SIGTERM); err == nil {
+		time.Sleep(time.Second)
+		syscall.Kill(-1, syscall.SIGKILL)
+	}
+	syscall.Sync()
+
+	// firecracker has no power management, it exits once the guest reboots
+	if err := syscall.Reboot(syscall.LINUX_REBOOT_CMD_RESTART); err != nil {
+		panic(fmt.Errorf("failed to power off: %w", err))
+	}
+}
+
+// reportExit sends the exit code of the entrypoint to the daemon over vsock
+func reportExit(config *mmds.AgentConfig, code int) error {
+	var err error
+	// the host may not be listening yet, give it a few seconds
+	for i := 0; i < 50; i++ {
+		var conn net.Conn
+		if conn, err = vsock.Dial(vsock.Host, config.ExitPort, nil); err == nil {
+			return agent.ReportExit(conn, config.Token, code)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return err
 }
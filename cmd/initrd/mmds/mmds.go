@@ -27,52 +27,83 @@ type ContainerRuntimeConfig struct {
 	Workdir     string
 }
 
+// AgentConfig tells the guest agent where to listen and which token the daemon will present,
+// the guest presents the same token when reporting the exit of its entrypoint on ExitPort.
+type AgentConfig struct {
+	Token    string `json:"token"`
+	Port     uint32 `json:"port"`
+	ExitPort uint32 `json:"exitPort"`
+}
+
+// VolumeConfig tells the init where to mount a data volume attached as Device.
+type VolumeConfig struct {
+	Device     string `json:"device"`
+	MountPoint string `json:"mountPoint"`
+	ReadOnly   bool   `json:"readOnly"`
+}
+
 // FetchIPConfig will retrieve the desired IP configuration for this VM from MMDS.
 func FetchIPConfig() (*MMDSIPConfig, error) {
-	client := &http.Client{
-		Timeout: 2 * time.Second,
-	}
-	resp, err := client.Get("http://169.254.169.254/ipconfig")
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch ipconfig from mmds: %w", err)
-	}
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("failed to fetch ipconfi from mmds (status code %d)", resp.StatusCode)
-	}
-	bodyBytes, err := io.ReadAll(resp.Body)
-	resp.Body.Close()
-	if err != nil {
-		return nil, fmt.Errorf("could not read body from mmds response: %w", err)
-	}
 	ipConfig := &MMDSIPConfig{}
-	err = json.Unmarshal(bodyBytes, ipConfig)
-	if err != nil {
-		return nil, fmt.Errorf("could not decode mmds response: %w", err)
+	if err := fetch("ipconfig", ipConfig); err != nil {
+		return nil, err
 	}
 	return ipConfig, nil
 }
 
 // FetchRuntimeConfig will retrieve the desired exec configuration for this VM from MMDS.
 func FetchRuntimeConfig() (*ContainerRuntimeConfig, error) {
+	rconfig := &ContainerRuntimeConfig{}
+	if err := fetch("runtimeConfig", rconfig); err != nil {
+		return nil, err
+	}
+	return rconfig, nil
+}
+
+// FetchAgentConfig will retrieve the guest agent configuration for this VM from MMDS.
+func FetchAgentConfig() (*AgentConfig, error) {
+	aconfig := &AgentConfig{}
+	if err := fetch("agent", aconfig); err != nil {
+		return nil, err
+	}
+	return aconfig, nil
+}
+
+// FetchVolumes will retrieve the data volumes to mount for this VM from MMDS.
+func FetchVolumes() ([]VolumeConfig, error) {
+	volumes := []VolumeConfig{}
+	if err := fetch("volumes", &volumes); err != nil {
+		return nil, err
+	}
+	return volumes, nil
+}
+
+// fetch decodes the json document MMDS holds under key into v.
+func fetch(key string, v interface{}) error {
 	client := &http.Client{
 		Timeout: 2 * time.Second,
 	}
-	resp, err := client.Get("http://169.254.169.254/runtimeConfig")
+	req, err := http.NewRequest(http.MethodGet, "http://169.254.169.254/"+key, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch runtime config from mmds: %w", err)
+		return fmt.Errorf("failed to build %s request: %w", key, err)
 	}
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("failed to fetch runtime config from mmds (status code %d)", resp.StatusCode)
+	// without it MMDS answers with the list of keys instead of the document
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch %s from mmds: %w", key, err)
 	}
 	bodyBytes, err := io.ReadAll(resp.Body)
 	resp.Body.Close()
-	if err != nil {
-		return nil, fmt.Errorf("could not read body from mmds response: %w", err)
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("failed to fetch %s from mmds (status code %d)", key, resp.StatusCode)
 	}
-	rconfig := &ContainerRuntimeConfig{}
-	err = json.Unmarshal(bodyBytes, rconfig)
 	if err != nil {
-		return nil, fmt.Errorf("could not decode mmds response: %w", err)
+		return fmt.Errorf("could not read body from mmds response: %w", err)
 	}
-	return rconfig, nil
+	if err := json.Unmarshal(bodyBytes, v); err != nil {
+		return fmt.Errorf("could not decode mmds response: %w", err)
+	}
+	return nil
 }
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"syscall"
+
+	"github.com/iradukunda1/firecrackerland/cmd/initrd/mmds"
 )
 
 type mountHelper interface {
@@ -110,3 +113,22 @@ func mountAndPivotWithHelper(mh mountHelper) {
 	// and chroot into it to complete moving off of the initramfs.
 	mh.MustChroot(".")
 }
+
+// MountVolumes mounts the data volumes attached to the vm, read only ones with MS_RDONLY.
+// Like the root fs, failing to mount one is fatal since the workload expects its data there.
+func MountVolumes(volumes []mmds.VolumeConfig) {
+	mountVolumesWithHelper(&mountHelperImpl{}, volumes)
+}
+
+func mountVolumesWithHelper(mh mountHelper, volumes []mmds.VolumeConfig) {
+	for _, v := range volumes {
+		var flags uintptr
+		if v.ReadOnly {
+			flags |= syscall.MS_RDONLY
+		}
+
+		fmt.Printf("Mounting %s on %s\n", v.Device, v.MountPoint)
+		mh.MustMkdir(v.MountPoint, 0755)
+		mh.MustMount(v.Device, v.MountPoint, "ext4", flags, "")
+	}
+}
@@ -43,3 +43,14 @@ func runCommand(command string, sudo bool) (int, error) {
 	}
 	return 0, nil
 }
+
+// RunOutput runs a shell command without sudo and returns what it wrote to stdout.
+func RunOutput(command string) ([]byte, error) {
+	cmd := exec.Command("/bin/sh", []string{`-c`, command}...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed running %q: %+v", command, err)
+	}
+	return out, nil
+}
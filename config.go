@@ -10,46 +10,76 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-func getOptions(id byte, req CreateRequest) options {
-	fc_ip := net.IPv4(172, 102, 0, id).String()
-	gateway_ip := "172.102.0.1"
-	mask_long := "255.255.255.0"
-	bootArgs := "ro console=ttyS0 noapic reboot=k panic=1 earlycon pci=off init=init nomodules random.trust_cpu=on tsc=reliable quiet "
-	bootArgs = bootArgs + fmt.Sprintf("ip=%s::%s:%s::eth0:off", fc_ip, gateway_ip, mask_long)
+const gatewayIP = "172.102.0.1"
+
+// chrootBaseDir holds the jails of the vms
+const chrootBaseDir = "/tmp"
+
+// getOptions are the options of a new vm, its network comes with the vm index given by setVmIndex
+func getOptions(req CreateRequest) options {
+	// the defaults of the registry, CreateVmHandler selects the ones asked for
+	k, _ := kernels.kernel("")
+	rd, _ := kernels.initrd("")
 	return options{
-		VmIndex:        int64(id),
-		FcBinary:       "firecracker",
-		FcKernelImage:  "vmlinux.bin", // make sure that this file exists in the current directory with valid sum5
-		KernelBootArgs: bootArgs,
-		ProvidedImage:  req.DockerImage,
-		TapMacAddr:     fmt.Sprintf("02:FC:00:00:00:%02x", id),
-		Tap:            fmt.Sprintf("fc-tap-%d", id),
-		FcIP:           fc_ip,
-		BackBone:       "enp0s25", // eth0 or enp7s0,enp0s25
+		FcBinary:      "firecracker",
+		Kernel:        k.Name,
+		FcKernelImage: k.Path,
+		Initrd:        rd.Name,
+		FcInitrd:      rd.Path,
+		Name:          req.Name,
+		ProvidedImage: req.DockerImage,
+		BackBone:      "enp0s25", // eth0 or enp7s0,enp0s25
 		// ApiSocket:      fmt.Sprintf("/tmp/firecracker-%d.sock", id),
 		FcCPUCount: 1,
 		FcMemSz:    256,
-		Logger:     log.New(),
+		Logger:     log.NewEntry(daemonLogger),
 	}
 }
 
+// setVmIndex gives the vm the address, tap device and mac address of the vm index id
+func (opts *options) setVmIndex(id int64) {
+	opts.VmIndex = id
+	opts.FcIP = net.IPv4(172, 102, 0, byte(id)).String()
+	opts.Tap = fmt.Sprintf("fc-tap-%d", id)
+	opts.TapMacAddr = fmt.Sprintf("02:FC:00:00:00:%02x", id)
+}
+
 func (opts *options) getConfig() firecracker.Config {
 
+	drives := []models.Drive{
+		{
+			DriveID:      firecracker.String("1"),
+			PathOnHost:   &opts.RootFsImage,
+			IsRootDevice: firecracker.Bool(true),
+			IsReadOnly:   firecracker.Bool(false),
+		},
+	}
+	var block, rx, tx *models.RateLimiter
+	if opts.RateLimits != nil {
+		block = limiterModel(opts.RateLimits.Block)
+		rx = limiterModel(opts.RateLimits.NetRx)
+		tx = limiterModel(opts.RateLimits.NetTx)
+	}
+	drives[0].RateLimiter = block
+	// the volumes follow the rootfs, the guest sees them as /dev/vdb onwards in this order
+	for i, v := range opts.Volumes {
+		drives = append(drives, models.Drive{
+			DriveID:      firecracker.String(volumeDriveID(i)),
+			PathOnHost:   firecracker.String(volumePath(v.Name)),
+			IsRootDevice: firecracker.Bool(false),
+			IsReadOnly:   firecracker.Bool(v.ReadOnly),
+			RateLimiter:  block,
+		})
+	}
+
 	return firecracker.Config{
 		VMID:            opts.Id,
 		SocketPath:      opts.ApiSocket,
 		KernelImagePath: opts.FcKernelImage,
 		KernelArgs:      opts.KernelBootArgs,
 		LogLevel:        "debug",
-		InitrdPath:      "initrd.cpio",
-		Drives: []models.Drive{
-			{
-				DriveID:      firecracker.String("1"),
-				PathOnHost:   &opts.RootFsImage,
-				IsRootDevice: firecracker.Bool(true),
-				IsReadOnly:   firecracker.Bool(false),
-			},
-		},
+		InitrdPath:      opts.FcInitrd,
+		Drives:          drives,
 
 		//for setting up networking tap config vmmd config
 		NetworkInterfaces: []firecracker.NetworkInterface{
@@ -58,35 +88,56 @@ func (opts *options) getConfig() firecracker.Config {
 					MacAddress:  opts.TapMacAddr,
 					HostDevName: opts.Tap,
 				},
-				AllowMMDS: true,
+				AllowMMDS:      true,
+				InRateLimiter:  rx,
+				OutRateLimiter: tx,
 			},
 		},
 
 		//for specifying the number of cpus and memory
 		MachineCfg: models.MachineConfiguration{
-			VcpuCount:  firecracker.Int64(1),
+			VcpuCount:  firecracker.Int64(opts.FcCPUCount),
 			Smt:        firecracker.Bool(false),
-			MemSizeMib: firecracker.Int64(256),
+			MemSizeMib: firecracker.Int64(opts.FcMemSz),
 		},
 
 		JailerCfg: &firecracker.JailerConfig{
 			UID:            firecracker.Int(1),
 			GID:            firecracker.Int(1),
 			NumaNode:       firecracker.Int(0),
-			Daemonize:      true,
+			Daemonize:      false, // the jailer stdio carries the serial console, daemonizing sends it to /dev/null
 			ExecFile:       "/usr/bin/" + opts.FcBinary,
 			JailerBinary:   "jailer",
-			ChrootBaseDir:  "/tmp",
+			ChrootBaseDir:  chrootBaseDir,
 			CgroupVersion:  "1",
-			Stdout:         opts.Logger.WithField("vmm_stream", "stdout").WriterLevel(log.DebugLevel),
+			Stdout:         opts.Console.Stdout(),
 			Stderr:         opts.Logger.WithField("vmm_stream", "stderr").WriterLevel(log.DebugLevel),
-			Stdin:          os.Stdin,
-			ChrootStrategy: firecracker.NewNaiveChrootStrategy("vmlinux.bin"),
+			Stdin:          opts.Console.Stdin(),
+			ChrootStrategy: firecracker.NewNaiveChrootStrategy(opts.FcKernelImage),
+		},
+		VsockDevices: []firecracker.VsockDevice{
+			{
+				ID:   "agent",
+				Path: agentSocket,
+				CID:  agentCID,
+			},
 		},
-		//VsockDevices:      vsocks,
-		//LogFifo:           opts.FcLogFifo,
-		//LogLevel:          opts.FcLogLevel,
-		//MetricsFifo:       opts.FcMetricsFifo,
-		//FifoLogWriter:     fifo,
+		// the daemon stops its vms itself when it is signaled, see shutdownVMs
+		ForwardSignals: []os.Signal{},
+		LogFifo:        opts.FcLogFifo,
+		MetricsFifo:    opts.FcMetricsFifo,
 	}
 }
+
+// driveIDs are the ids of the rootfs and volume drives of the vm, reattached vms do not know their config
+func (opts *options) driveIDs() []string {
+	ids := []string{"1"}
+	for i := range opts.Volumes {
+		ids = append(ids, volumeDriveID(i))
+	}
+	return ids
+}
+
+func volumeDriveID(i int) string {
+	return fmt.Sprintf("volume%d", i+1)
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMachineConfig(t *testing.T) {
+	opts := options{
+		FcBinary:   "firecracker",
+		FcCPUCount: 4,
+		FcMemSz:    1024,
+		Console:    &vmConsole{},
+		Logger:     log.NewEntry(log.New()),
+	}
+
+	cfg := opts.getConfig()
+	if got := firecracker.Int64Value(cfg.MachineCfg.VcpuCount); got != 4 {
+		t.Errorf("vcpu count is %d, want 4", got)
+	}
+	if got := firecracker.Int64Value(cfg.MachineCfg.MemSizeMib); got != 1024 {
+		t.Errorf("memory is %d MiB, want 1024", got)
+	}
+}
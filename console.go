@@ -0,0 +1,317 @@
+// console file is used to capture the serial console of every vm into a log file
+// and a ring buffer, and to fan it out to the clients following or attached to it.
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// subscriberBacklog is how many pending chunks a slow console client may have before being dropped
+const subscriberBacklog = 256
+
+// ringBuffer keeps the last len(data) bytes written to it
+type ringBuffer struct {
+	data []byte
+	pos  int
+	full bool
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{data: make([]byte, size)}
+}
+
+// Write stores p, overwriting the oldest bytes once the buffer is full
+func (r *ringBuffer) Write(p []byte) {
+	size := len(r.data)
+	if len(p) >= size {
+		copy(r.data, p[len(p)-size:])
+		r.pos = 0
+		r.full = true
+		return
+	}
+
+	end := r.pos + len(p)
+	if end >= size {
+		r.full = true
+	}
+
+	n := copy(r.data[r.pos:], p)
+	copy(r.data, p[n:])
+	r.pos = end % size
+}
+
+// Bytes returns a copy of the buffered content, oldest byte first
+func (r *ringBuffer) Bytes() []byte {
+	if !r.full {
+		return append([]byte(nil), r.data[:r.pos]...)
+	}
+	out := make([]byte, 0, len(r.data))
+	out = append(out, r.data[r.pos:]...)
+	return append(out, r.data[:r.pos]...)
+}
+
+// consolePollInterval is how often the console log is checked for new output
+const consolePollInterval = 100 * time.Millisecond
+
+// vmConsole is the serial console of a vm. Firecracker writes the guest output straight into
+// the console log and reads the guest input from a fifo next to it, so the console keeps working
+// while the daemon is down. The log is followed to feed the ring buffer and the clients.
+type vmConsole struct {
+	mu     sync.Mutex
+	ring   *ringBuffer
+	subs   map[chan []byte]struct{}
+	closed bool
+
+	// out is appended to by firecracker, log follows it
+	out *os.File
+	log *os.File
+	// path is the file of the log, moved to path.1 once maxLog bytes were read from it
+	path   string
+	maxLog int64
+	// in is the input fifo, opened for reading and writing so it never reports an end of file
+	in *os.File
+	// inMu keeps input coming from several attached clients from interleaving
+	inMu sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newConsole opens the console logged into the file at path, buffering its last size bytes and
+// rotating the log once it holds maxLog bytes, zero for no limit. The console of a vm which
+// already ran picks up where its log ends.
+func newConsole(path string, size int, maxLog int64) (*vmConsole, error) {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create console directory: %v", err)
+	}
+
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open console log: %v", err)
+	}
+
+	c := &vmConsole{
+		ring:   newRingBuffer(size),
+		subs:   make(map[chan []byte]struct{}),
+		out:    out,
+		path:   path,
+		maxLog: maxLog,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	if c.log, err = os.Open(path); err != nil {
+		out.Close()
+		return nil, fmt.Errorf("failed to open console log: %v", err)
+	}
+
+	// history kept from a previous run of the daemon
+	if info, err := c.log.Stat(); err == nil && info.Size() > 0 {
+		offset := info.Size() - int64(size)
+		if offset < 0 {
+			offset = 0
+		}
+		c.log.Seek(offset, io.SeekStart)
+		history, _ := io.ReadAll(c.log)
+		c.ring.Write(history)
+	}
+
+	fifo := path + ".in"
+	if err := unix.Mkfifo(fifo, 0600); err != nil && !errors.Is(err, os.ErrExist) {
+		c.log.Close()
+		out.Close()
+		return nil, fmt.Errorf("failed to create console input: %v", err)
+	}
+	if c.in, err = os.OpenFile(fifo, os.O_RDWR, 0); err != nil {
+		c.log.Close()
+		out.Close()
+		return nil, fmt.Errorf("failed to open console input: %v", err)
+	}
+
+	go c.follow()
+
+	return c, nil
+}
+
+// Stdout is the file firecracker writes the guest output into
+func (c *vmConsole) Stdout() *os.File {
+	return c.out
+}
+
+// Stdin is the file firecracker reads the guest input from
+func (c *vmConsole) Stdin() *os.File {
+	return c.in
+}
+
+// follow reads what firecracker appends to the log until the console is closed
+func (c *vmConsole) follow() {
+	defer close(c.done)
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := c.log.Read(buf)
+		if n > 0 {
+			c.publish(buf[:n])
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return
+		}
+		if pos, err := c.log.Seek(0, io.SeekCurrent); err == nil && c.maxLog > 0 && pos >= c.maxLog {
+			c.rotate(pos)
+		}
+
+		select {
+		case <-c.stop:
+			// the vm is gone, nothing is appended anymore once the log is drained
+			return
+		case <-time.After(consolePollInterval):
+		}
+	}
+}
+
+// rotate moves the size bytes of the log read so far to the file .1 next to it and empties the
+// log, firecracker keeps appending to it. As with the copytruncate of logrotate, output written
+// in between is lost.
+func (c *vmConsole) rotate(size int64) {
+	old, err := os.OpenFile(c.path+".1", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(old, io.NewSectionReader(c.log, 0, size))
+	old.Close()
+	if err != nil {
+		return
+	}
+
+	if err := c.out.Truncate(0); err != nil {
+		return
+	}
+	c.log.Seek(0, io.SeekStart)
+}
+
+// publish records output of the vm and hands it to the clients
+func (c *vmConsole) publish(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ring.Write(p)
+
+	for ch := range c.subs {
+		select {
+		case ch <- append([]byte(nil), p...):
+		default:
+			// the client is not keeping up, drop it instead of stalling the others
+			delete(c.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Input sends p to the vm serial console as one uninterrupted write
+func (c *vmConsole) Input(p []byte) error {
+	c.inMu.Lock()
+	defer c.inMu.Unlock()
+
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return io.ErrClosedPipe
+	}
+
+	_, err := c.in.Write(p)
+	return err
+}
+
+// Tail returns the last n lines kept in the buffer, or all of it when n is not positive
+func (c *vmConsole) Tail(n int) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return tailLines(c.ring.Bytes(), n)
+}
+
+// Follow returns the last n lines kept in the buffer along with a subscription to
+// everything written after them, so nothing is lost or repeated in between.
+// The channel is closed when the console is closed or the subscriber falls too far behind.
+func (c *vmConsole) Follow(n int) ([]byte, <-chan []byte, func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	backlog := tailLines(c.ring.Bytes(), n)
+
+	ch := make(chan []byte, subscriberBacklog)
+	if c.closed {
+		close(ch)
+		return backlog, ch, func() {}
+	}
+
+	c.subs[ch] = struct{}{}
+
+	return backlog, ch, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if _, ok := c.subs[ch]; ok {
+			delete(c.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// tailLines returns the last n lines of data, or all of it when n is not positive
+func tailLines(data []byte, n int) []byte {
+	if n <= 0 {
+		return data
+	}
+
+	end := len(data)
+	if end > 0 && data[end-1] == '\n' {
+		end--
+	}
+
+	idx := end
+	for i := 0; i < n; i++ {
+		idx = bytes.LastIndexByte(data[:idx], '\n')
+		if idx < 0 {
+			return data
+		}
+	}
+
+	return data[idx+1:]
+}
+
+// Close stops the console once the vm is gone, buffered output stays readable
+func (c *vmConsole) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	close(c.stop)
+	<-c.done
+
+	c.mu.Lock()
+	for ch := range c.subs {
+		delete(c.subs, ch)
+		close(ch)
+	}
+	c.mu.Unlock()
+
+	c.in.Close()
+	c.log.Close()
+	return c.out.Close()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConsoleRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vm.log")
+	c, err := newConsole(path, 1024, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// firecracker appends to the log through its own descriptor
+	first := bytes.Repeat([]byte("a"), 150)
+	if _, err := c.Stdout().Write(first); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if old, err := os.ReadFile(path + ".1"); err == nil && bytes.Equal(old, first) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the console log was not rotated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := c.Stdout().Write([]byte("b\n")); err != nil {
+		t.Fatal(err)
+	}
+	for !bytes.HasSuffix(c.Tail(0), []byte("b\n")) {
+		if time.Now().After(deadline) {
+			t.Fatal("the output written after the rotation was not followed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	log, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(log) != "b\n" {
+		t.Fatalf("the rotated log holds %q", log)
+	}
+	if got := c.Tail(0); !bytes.Equal(got, append(first, "b\n"...)) {
+		t.Fatalf("the buffer lost output across the rotation: %q", got)
+	}
+}
@@ -10,14 +10,40 @@ type ctxKey int
 
 const (
 	loggerKey ctxKey = iota
+	principalKey
+	localKey
 )
 
 // set logger into context
-func ctxSetLogger(ctx context.Context, logger *lgg.Logger) context.Context {
+func ctxSetLogger(ctx context.Context, logger *lgg.Entry) context.Context {
 	return context.WithValue(ctx, loggerKey, logger)
 }
 
 // get logger from context
-func ctxGetLogger(ctx context.Context) *lgg.Logger {
-	return ctx.Value(loggerKey).(*lgg.Logger)
+func ctxGetLogger(ctx context.Context) *lgg.Entry {
+	return ctx.Value(loggerKey).(*lgg.Entry)
+}
+
+// set the caller of the request into context
+func ctxSetPrincipal(ctx context.Context, p *principal) context.Context {
+	return context.WithValue(ctx, principalKey, p)
+}
+
+// get the caller of the request from context, requests which did not go through requireAuth have none
+func ctxGetPrincipal(ctx context.Context) *principal {
+	if p, ok := ctx.Value(principalKey).(*principal); ok {
+		return p
+	}
+	return &principal{}
+}
+
+// mark the context of a connection of the unix socket
+func ctxSetLocal(ctx context.Context) context.Context {
+	return context.WithValue(ctx, localKey, true)
+}
+
+// tell whether the request came through the unix socket
+func ctxIsLocal(ctx context.Context) bool {
+	local, _ := ctx.Value(localKey).(bool)
+	return local
 }
@@ -3,32 +3,67 @@ package main
 import (
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
 	"time"
 
 	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
-	log "github.com/sirupsen/logrus"
+	"github.com/iradukunda1/firecrackerland/cmd/initrd/agent"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var duration = 120 * time.Second
 
 // CreateVmm is responsible to create vm and return its ip address
-func (o *options) createVMM(ctx context.Context, id string) (*Firecracker, error) {
+func (o *options) createVMM(ctx context.Context, id string) (res *Firecracker, err error) {
 
-	llg := log.New()
+	ctx, span := tracer.Start(ctx, "createVMM", trace.WithAttributes(vmAttributes(id, o)...))
+	defer func() { endSpan(span, err) }()
+
+	o.Logger = vmLogger(id, o)
+
+	// a restarted vm keeps writing to the console it had
+	if o.Console == nil {
+		console, err := newConsole(filepath.Join(conf.ConsoleDir, id+".log"), conf.ConsoleBufferSize, conf.ConsoleLogSize<<20)
+		if err != nil {
+			return nil, err
+		}
+		o.Console = console
+	}
+	o.AgentToken = token()
+
+	if err := o.prepareFifos(id); err != nil {
+		return nil, err
+	}
 
 	cfg := o.getConfig()
 
 	// client := firecracker.NewClient(fcCfg.SocketPath, llg.WithContext(vmmCtx), true)
 
 	machineOpts := []firecracker.Opt{
-		firecracker.WithLogger(log.NewEntry(llg)),
+		firecracker.WithLogger(o.Logger),
 	}
 
 	cfg.VMID = id
 	cfg.JailerCfg.ID = id
 
-	if err := exposeBlockDeviceToJail(o.RootFsImage, *cfg.JailerCfg.UID, *cfg.JailerCfg.GID); err != nil {
-		return nil, fmt.Errorf("failed to expose fs to jail: %v", err)
+	if err := traceStep(ctx, "jail", func() error {
+		if err := exposeBlockDeviceToJail(o.RootFsImage, *cfg.JailerCfg.UID, *cfg.JailerCfg.GID); err != nil {
+			return fmt.Errorf("failed to expose fs to jail: %v", err)
+		}
+		for _, v := range o.Volumes {
+			if err := exposeBlockDeviceToJail(volumePath(v.Name), *cfg.JailerCfg.UID, *cfg.JailerCfg.GID); err != nil {
+				return fmt.Errorf("failed to expose volume %s to jail: %v", v.Name, err)
+			}
+		}
+
+		// a restarted vm boots in a fresh jail
+		if err := os.RemoveAll(filepath.Dir(jailRoot(cfg.JailerCfg))); err != nil {
+			return fmt.Errorf("failed to clean previous jail: %v", err)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
 	}
 
 	// remove old socket path if it exists
@@ -36,24 +71,51 @@ func (o *options) createVMM(ctx context.Context, id string) (*Firecracker, error
 		return nil, fmt.Errorf("failed to delete old socket path: %s", err)
 	}
 
-	if err := o.SetNetwork(); err != nil {
+	if err := traceStep(ctx, "SetNetwork", o.SetNetwork); err != nil {
 		return nil, fmt.Errorf("failed to set network: %s", err)
 	}
 
-	m, err := firecracker.NewMachine(ctx, cfg, machineOpts...)
+	// the vm outlives the request creating it, firecracker is killed once vmCtx is done
+	vmCtx, cancel := context.WithCancel(context.Background())
+
+	machineOpts = append(machineOpts, firecracker.WithProcessRunner(jailerCommand(vmCtx, cfg)))
+
+	m, err := firecracker.NewMachine(vmCtx, cfg, machineOpts...)
 	if err != nil {
+		cancel()
 		return nil, fmt.Errorf("failed creating machine: %v", err)
 	}
 
-	installSignalHandlers(ctx, m)
+	// hand the network, runtime and agent settings to the initrd before the guest boots
+	m.Handlers.FcInit = m.Handlers.FcInit.AppendAfter(firecracker.ConfigMmdsHandlerName,
+		firecracker.NewSetMetadataHandler(o.metadata()))
+
+	if o.Balloon != nil {
+		m.Handlers.FcInit = m.Handlers.FcInit.AppendAfter(firecracker.CreateMachineHandlerName, o.balloonHandler())
+	}
 
-	res := &Firecracker{
-		ctx:  ctx,
-		Name: o.ProvidedImage,
-		// cancelCtx: nil,
-		vm:    m,
-		state: StateCreated,
+	res = &Firecracker{
+		ID:        id,
+		ctx:       vmCtx,
+		Name:      o.ProvidedImage,
+		cancelCtx: cancel,
+		vm:        m,
+		state:     StateCreated,
+		opts:      o,
+		rootDir:   jailRoot(cfg.JailerCfg),
+		console:   o.Console,
 	}
+	res.agent = agent.NewClient(res.chrootPath(agentSocket), agent.DefaultPort, o.AgentToken)
+
+	m.Handlers.FcInit = m.Handlers.FcInit.AppendAfter(firecracker.CreateLogFilesHandlerName, res.collectFifosHandler())
+
+	// the jail exists once the files are linked into it, the guest may report its exit from then on
+	m.Handlers.FcInit = m.Handlers.FcInit.AppendAfter(firecracker.LinkFilesToRootFSHandlerName, firecracker.Handler{
+		Name: listenExitHandlerName,
+		Fn: func(ctx context.Context, m *firecracker.Machine) error {
+			return res.listenExit(*cfg.JailerCfg.UID, *cfg.JailerCfg.GID)
+		},
+	})
 
 	return res, nil
 }
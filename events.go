@@ -0,0 +1,315 @@
+// events file is used to publish what happens to vms on a bus, streamed to the clients of
+// /api/events over server-sent events or a websocket and delivered to the webhooks.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// eventBacklog is how many of the last events are kept for the clients resuming a stream
+const eventBacklog = 256
+
+// eventSubscriberBacklog is how many pending events a slow client may have before being dropped
+const eventSubscriberBacklog = 256
+
+// eventKeepAlive is how often an idle event stream gets a comment, so proxies keep it open
+const eventKeepAlive = 15 * time.Second
+
+// eventTypes are the known event types
+var eventTypes = map[EventType]bool{
+	EventCreated: true, EventBooting: true, EventStarted: true, EventPaused: true, EventResumed: true,
+	EventStopped: true, EventExited: true, EventDeleted: true, EventSnapshot: true, EventError: true,
+}
+
+// eventBus hands every published event to its subscribers
+type eventBus struct {
+	mu     sync.Mutex
+	seq    uint64
+	recent []Event
+	subs   map[chan Event]struct{}
+}
+
+// events is the bus of the daemon
+var events = &eventBus{subs: make(map[chan Event]struct{})}
+
+// publish numbers e and hands it to the subscribers and the webhooks
+func (b *eventBus) publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	e.ID = b.seq
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	b.recent = append(b.recent, e)
+	if len(b.recent) > eventBacklog {
+		b.recent = b.recent[len(b.recent)-eventBacklog:]
+	}
+
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			// the client is not keeping up, drop it instead of stalling the others,
+			// it can resume from the last event it got
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+
+	enqueueWebhooks(e)
+}
+
+// subscribe returns the kept events published after the event after, the channel of the
+// following ones and the function to unsubscribe
+func (b *eventBus) subscribe(after uint64) ([]Event, <-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var backlog []Event
+	if after > 0 {
+		for _, e := range b.recent {
+			if e.ID > after {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+
+	ch := make(chan Event, eventSubscriberBacklog)
+	b.subs[ch] = struct{}{}
+
+	return backlog, ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// vmEvent is the event t of the vm id created with the options o
+func vmEvent(t EventType, id string, o *options) Event {
+	e := Event{Type: t, VmID: id}
+	if o != nil {
+		e.Name, e.Tenant = o.Name, o.Tenant
+	}
+	return e
+}
+
+// emit publishes the event t of the vm
+func (f *Firecracker) emit(t EventType) {
+	e := vmEvent(t, f.ID, f.opts)
+	e.State = f.status()
+	if t == EventExited {
+		e.ExitCode = f.lastExitCode()
+	}
+	events.publish(e)
+}
+
+// emitError publishes the failure err of the vm
+func (f *Firecracker) emitError(err error) {
+	e := vmEvent(EventError, f.ID, f.opts)
+	e.State = f.status()
+	e.Error = err.Error()
+	events.publish(e)
+}
+
+// eventFilter selects the events a client of /api/events gets
+type eventFilter struct {
+	caller *principal
+	vms    map[string]bool
+	types  map[EventType]bool
+}
+
+// parseEventFilter reads the vm_id and type query parameters of r, both take comma separated
+// lists and may be repeated
+func parseEventFilter(r *http.Request) (*eventFilter, error) {
+	f := &eventFilter{caller: ctxGetPrincipal(r.Context())}
+
+	q := r.URL.Query()
+	for _, v := range q["vm_id"] {
+		for _, id := range strings.Split(v, ",") {
+			if f.vms == nil {
+				f.vms = make(map[string]bool)
+			}
+			f.vms[id] = true
+		}
+	}
+	for _, v := range q["type"] {
+		for _, t := range strings.Split(v, ",") {
+			if !eventTypes[EventType(t)] {
+				return nil, fmt.Errorf("unknown event type %q", t)
+			}
+			if f.types == nil {
+				f.types = make(map[EventType]bool)
+			}
+			f.types[EventType(t)] = true
+		}
+	}
+
+	return f, nil
+}
+
+// match tells whether e goes to the client, tenants only get the events of their vms
+func (f *eventFilter) match(e Event) bool {
+	switch {
+	case !f.caller.Admin && e.Tenant != f.caller.Tenant:
+		return false
+	case f.vms != nil && !f.vms[e.VmID]:
+		return false
+	case f.types != nil && !f.types[e.Type]:
+		return false
+	}
+	return true
+}
+
+// For following the events of the vms of the caller, over server-sent events or a websocket.
+// vm_id and type narrow the events down, a client resuming a stream sends the Last-Event-ID header
+// or the last_event_id parameter to get the events it missed first.
+func EventsHandler(w http.ResponseWriter, r *http.Request) {
+
+	filter, err := parseEventFilter(r)
+	if err != nil {
+		writeMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	after, _ := strconv.ParseUint(lastID, 10, 64)
+
+	if websocket.IsWebSocketUpgrade(r) {
+		streamEventsWebsocket(w, r, filter, after)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeMessage(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	backlog, ch, stop := events.subscribe(after)
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// keeps nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(e Event) error {
+		if !filter.match(e) {
+			return nil
+		}
+		data, _ := json.Marshal(e)
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	for _, e := range backlog {
+		if err := send(e); err != nil {
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := send(e); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// streamEventsWebsocket sends every event matching filter as a json text message
+func streamEventsWebsocket(w http.ResponseWriter, r *http.Request, filter *eventFilter, after uint64) {
+
+	log := ctxGetLogger(r.Context())
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Errorf("failed to upgrade events connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	backlog, ch, stop := events.subscribe(after)
+	defer stop()
+
+	// the client sends nothing, reading is only needed to notice it is gone
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, e := range backlog {
+		if filter.match(e) {
+			if err := conn.WriteJSON(e); err != nil {
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case e, ok := <-ch:
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"))
+				return
+			}
+			if !filter.match(e) {
+				continue
+			}
+			if err := conn.WriteJSON(e); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// publishError publishes the failure err of the vm id, created with the options o, which never came up
+func publishError(id string, o *options, err error) {
+	e := vmEvent(EventError, id, o)
+	e.State = StateFailed
+	e.Error = err.Error()
+	events.publish(e)
+}
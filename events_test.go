@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := &eventBus{subs: make(map[chan Event]struct{})}
+	for i := 0; i < eventBacklog+10; i++ {
+		bus.publish(Event{Type: EventStarted, VmID: fmt.Sprintf("vm-%d", i)})
+	}
+
+	for _, c := range []struct {
+		name  string
+		after uint64
+		first uint64
+		count int
+	}{
+		{"new stream", 0, 0, 0},
+		{"resumed stream", eventBacklog + 5, eventBacklog + 6, 5},
+		{"caught up stream", eventBacklog + 10, 0, 0},
+		// the events before the kept ones are lost
+		{"stream resumed too late", 3, 11, eventBacklog},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			backlog, _, stop := bus.subscribe(c.after)
+			defer stop()
+			if len(backlog) != c.count {
+				t.Fatalf("got %d events, want %d", len(backlog), c.count)
+			}
+			if c.count > 0 && backlog[0].ID != c.first {
+				t.Fatalf("the backlog starts at %d, want %d", backlog[0].ID, c.first)
+			}
+		})
+	}
+
+	t.Run("subscriber", func(t *testing.T) {
+		_, ch, stop := bus.subscribe(0)
+		defer stop()
+		bus.publish(Event{Type: EventPaused, VmID: "vm-1"})
+		if e := <-ch; e.ID != eventBacklog+11 || e.Type != EventPaused || e.Time.IsZero() {
+			t.Fatalf("got %+v", e)
+		}
+	})
+
+	t.Run("slow subscriber", func(t *testing.T) {
+		_, ch, stop := bus.subscribe(0)
+		defer stop()
+		for i := 0; i <= eventSubscriberBacklog; i++ {
+			bus.publish(Event{Type: EventStarted, VmID: "vm-1"})
+		}
+		for i := 0; i < eventSubscriberBacklog; i++ {
+			<-ch
+		}
+		if _, ok := <-ch; ok {
+			t.Fatal("the subscriber not keeping up was not dropped")
+		}
+	})
+}
+
+func TestEventFilter(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		query  string
+		caller *principal
+		event  Event
+		match  bool
+		err    bool
+	}{
+		{"own vm", "", &principal{Tenant: "acme"}, Event{Type: EventStarted, VmID: "vm-1", Tenant: "acme"}, true, false},
+		{"vm of another tenant", "", &principal{Tenant: "acme"}, Event{Type: EventStarted, VmID: "vm-1", Tenant: "globex"}, false, false},
+		{"admin", "", &principal{Tenant: "ops", Admin: true}, Event{Type: EventStarted, VmID: "vm-1", Tenant: "globex"}, true, false},
+		{"listed vm", "vm_id=vm-2,vm-1", anonymous, Event{Type: EventStarted, VmID: "vm-1"}, true, false},
+		{"repeated vm_id", "vm_id=vm-2&vm_id=vm-1", anonymous, Event{Type: EventStarted, VmID: "vm-1"}, true, false},
+		{"other vm", "vm_id=vm-2", anonymous, Event{Type: EventStarted, VmID: "vm-1"}, false, false},
+		{"listed type", "type=exited,error", anonymous, Event{Type: EventError, VmID: "vm-1"}, true, false},
+		{"other type", "type=exited", anonymous, Event{Type: EventStarted, VmID: "vm-1"}, false, false},
+		{"unknown type", "type=exploded", anonymous, Event{}, false, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/events?"+c.query, nil)
+			r = r.WithContext(ctxSetPrincipal(r.Context(), c.caller))
+			f, err := parseEventFilter(r)
+			if (err != nil) != c.err {
+				t.Fatalf("got error %v", err)
+			}
+			if err == nil && f.match(c.event) != c.match {
+				t.Fatalf("got match %v, want %v", !c.match, c.match)
+			}
+		})
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		EventsHandler(w, r.WithContext(ctxSetPrincipal(r.Context(), &principal{Tenant: "acme"})))
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "?type=exploded")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("an unknown type got status %d", resp.StatusCode)
+	}
+
+	// the events published after the last one the client got are sent from the backlog
+	events.publish(Event{Type: EventCreated, VmID: "vm-1", Tenant: "acme"})
+	events.mu.Lock()
+	last := events.seq
+	events.mu.Unlock()
+	events.publish(Event{Type: EventStarted, VmID: "vm-globex", Tenant: "globex"})
+	events.publish(Event{Type: EventStarted, VmID: "vm-1", Tenant: "acme"})
+	events.publish(Event{Type: EventExited, VmID: "vm-1", Tenant: "acme"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"?type=exited", nil)
+	req.Header.Set("Last-Event-ID", fmt.Sprint(last))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("got content type %s", ct)
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() && scanner.Text() != "" {
+		lines = append(lines, scanner.Text())
+	}
+	if len(lines) != 3 || lines[0] != fmt.Sprintf("id: %d", last+3) || lines[1] != "event: exited" {
+		t.Fatalf("got %q", lines)
+	}
+	var e Event
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &e); err != nil || e.VmID != "vm-1" {
+		t.Fatalf("got %s: %v", lines[2], err)
+	}
+}
@@ -0,0 +1,97 @@
+// exec file is used to relay commands run inside vms by their guest agent
+// to http clients, either as a stream of json lines or over a websocket.
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/iradukunda1/firecrackerland/client"
+)
+
+// kinds of ExecEvent
+const (
+	execStdout = client.ExecStdout
+	execStderr = client.ExecStderr
+	execExit   = client.ExecExit
+	execError  = client.ExecError
+)
+
+// kinds of ExecControl
+const (
+	execResize     = client.ExecResize
+	execSignal     = client.ExecSignal
+	execCloseStdin = client.ExecCloseStdin
+)
+
+// execSink delivers exec events to a client, it is safe for concurrent use
+type execSink interface {
+	send(ev ExecEvent) error
+}
+
+// execWriter turns everything written to it into events of the same type
+type execWriter struct {
+	sink execSink
+	typ  string
+}
+
+func (w *execWriter) Write(p []byte) (int, error) {
+	if err := w.sink.send(ExecEvent{Type: w.typ, Data: p}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// httpExecSink writes events as newline delimited json, flushing every one of them
+type httpExecSink struct {
+	mu      sync.Mutex
+	enc     *json.Encoder
+	flusher http.Flusher
+}
+
+func newHttpExecSink(w http.ResponseWriter) *httpExecSink {
+	flusher, _ := w.(http.Flusher)
+	return &httpExecSink{enc: json.NewEncoder(w), flusher: flusher}
+}
+
+func (s *httpExecSink) send(ev ExecEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.enc.Encode(&ev); err != nil {
+		return err
+	}
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+	return nil
+}
+
+// wsExecSink writes events as json text messages of a websocket
+type wsExecSink struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+func (s *wsExecSink) send(ev ExecEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.conn.WriteJSON(&ev)
+}
+
+// close ends the websocket conversation
+func (s *wsExecSink) close(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason))
+}
+
+// execWriters returns the stdout and stderr writers of an exec reporting to sink
+func execWriters(sink execSink) (io.Writer, io.Writer) {
+	return &execWriter{sink: sink, typ: execStdout}, &execWriter{sink: sink, typ: execStderr}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHttpExecSink(t *testing.T) {
+	w := httptest.NewRecorder()
+	sink := newHttpExecSink(w)
+	stdout, stderr := execWriters(sink)
+
+	stdout.Write([]byte("out"))
+	stderr.Write([]byte("err"))
+	code := 3
+	sink.send(ExecEvent{Type: execExit, ExitCode: &code})
+
+	if !w.Flushed {
+		t.Fatal("the events were not flushed")
+	}
+
+	dec := json.NewDecoder(w.Body)
+	for _, want := range []struct {
+		typ  string
+		data string
+	}{
+		{execStdout, "out"},
+		{execStderr, "err"},
+		{execExit, ""},
+	} {
+		var ev ExecEvent
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Type != want.typ || string(ev.Data) != want.data {
+			t.Fatalf("got %s %q, want %s %q", ev.Type, ev.Data, want.typ, want.data)
+		}
+		if ev.Type == execExit && (ev.ExitCode == nil || *ev.ExitCode != 3) {
+			t.Fatalf("got exit code %v", ev.ExitCode)
+		}
+	}
+}
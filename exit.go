@@ -0,0 +1,53 @@
+// exit file is used to learn how the workload of a vm ended, the initrd reports the
+// exit code of the container entrypoint over vsock right before powering the vm off.
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/iradukunda1/firecrackerland/cmd/initrd/agent"
+)
+
+const listenExitHandlerName = "fcland.ListenExit"
+
+// listenExit listens for the exit report of the guest. Firecracker forwards guest connections
+// to port P of the host to the unix socket next to the vsock one suffixed with _P, it runs as
+// uid:gid so the socket is handed over to it.
+func (f *Firecracker) listenExit(uid, gid int) error {
+	path := f.chrootPath(fmt.Sprintf("%s_%d", agentSocket, agent.DefaultExitPort))
+	os.Remove(path)
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to listen for the vm exit: %v", err)
+	}
+	if err := os.Chown(path, uid, gid); err != nil {
+		l.Close()
+		return fmt.Errorf("failed to expose exit socket to jail: %v", err)
+	}
+
+	f.exitListener = l
+	f.uid, f.gid = uid, gid
+
+	go func() {
+		code, err := agent.AcceptExit(l, f.opts.AgentToken)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.exitCode = &code
+		f.mu.Unlock()
+		f.opts.Logger.Infof("entrypoint of vm %s exited with code %d", f.ID, code)
+	}()
+
+	return nil
+}
+
+// closeExit stops listening for the exit report once the vm is gone
+func (f *Firecracker) closeExit() {
+	if f.exitListener != nil {
+		f.exitListener.Close()
+	}
+}
@@ -0,0 +1,254 @@
+// fcmetrics file is used to collect what firecracker writes to the log and metrics fifos of
+// every vm. Log lines go to the daemon log, the json metrics are kept to be served by the api.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+const collectFifosHandlerName = "fcland.CollectFifos"
+
+// fifoBaseDir holds the fifos of the vms, the jailer links them so it must be next to the jails
+const fifoBaseDir = chrootBaseDir + "/fcland"
+
+// fifoDir is the directory holding the log and metrics fifos of the vm id
+func fifoDir(id string) string {
+	return filepath.Join(fifoBaseDir, id)
+}
+
+// prepareFifos points the options at fresh fifo paths for the vm id, the sdk creates the fifos
+func (o *options) prepareFifos(id string) error {
+	dir := fifoDir(id)
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to clean previous fifos: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create fifo directory: %v", err)
+	}
+
+	o.FcLogFifo = filepath.Join(dir, "log.fifo")
+	o.FcMetricsFifo = filepath.Join(dir, "metrics.fifo")
+
+	return nil
+}
+
+// collectFifosHandler starts reading the fifos as soon as the sdk created them
+func (f *Firecracker) collectFifosHandler() firecracker.Handler {
+	return firecracker.Handler{
+		Name: collectFifosHandlerName,
+		Fn: func(ctx context.Context, m *firecracker.Machine) error {
+			return f.collectFifos()
+		},
+	}
+}
+
+// vmMetrics are the metrics firecracker flushed for a vm. Firecracker writes the counters
+// as deltas since the previous flush, they are summed up into Totals.
+type vmMetrics struct {
+	mu        sync.Mutex
+	latest    map[string]float64
+	totals    map[string]float64
+	flushes   int64
+	updatedAt time.Time
+}
+
+// collectFifos reads the log and metrics fifos of the vm until closeFifos is called.
+// They are opened read write so firecracker restarting its writes does not end the reads.
+func (f *Firecracker) collectFifos() error {
+	if f.opts.FcLogFifo == "" || f.opts.FcMetricsFifo == "" {
+		return nil
+	}
+
+	logs, err := os.OpenFile(f.opts.FcLogFifo, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open log fifo: %v", err)
+	}
+	metrics, err := os.OpenFile(f.opts.FcMetricsFifo, os.O_RDWR, 0)
+	if err != nil {
+		logs.Close()
+		return fmt.Errorf("failed to open metrics fifo: %v", err)
+	}
+
+	f.fifos = []io.Closer{logs, metrics}
+	if f.metrics == nil {
+		f.metrics = &vmMetrics{}
+	}
+
+	go f.readLogs(logs)
+	go f.readMetrics(metrics)
+
+	return nil
+}
+
+// closeFifos stops reading the fifos once the vm is gone
+func (f *Firecracker) closeFifos() {
+	for _, c := range f.fifos {
+		c.Close()
+	}
+	if f.opts.FcLogFifo != "" {
+		os.RemoveAll(filepath.Dir(f.opts.FcLogFifo))
+	}
+}
+
+// readLogs forwards the log lines of firecracker to the daemon log at their own level
+func (f *Firecracker) readLogs(r io.Reader) {
+	logger := f.opts.Logger.WithField("vmm_stream", "log")
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.Contains(line, ":ERROR:"):
+			logger.Error(line)
+		case strings.Contains(line, ":WARN:"):
+			logger.Warn(line)
+		case strings.Contains(line, ":INFO:"):
+			logger.Info(line)
+		default:
+			logger.Debug(line)
+		}
+	}
+}
+
+// readMetrics decodes every json document firecracker flushes to the metrics fifo
+func (f *Firecracker) readMetrics(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	// a flush is a single line of a few dozens of KiB
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+
+	for scanner.Scan() {
+		doc := make(map[string]interface{})
+		if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+			f.opts.Logger.Debugf("failed to decode metrics of vm %s: %v", f.ID, err)
+			continue
+		}
+
+		latest := make(map[string]float64)
+		flattenMetrics("", doc, latest)
+		delete(latest, "utc_timestamp_ms")
+
+		f.metrics.add(latest)
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, os.ErrClosed) {
+		f.opts.Logger.Errorf("failed to read metrics of vm %s: %v", f.ID, err)
+	}
+}
+
+// flattenMetrics collects the numbers of the nested json document doc into out, keyed by their path
+func flattenMetrics(prefix string, doc map[string]interface{}, out map[string]float64) {
+	for k, v := range doc {
+		name := k
+		if prefix != "" {
+			name = prefix + "." + k
+		}
+		switch v := v.(type) {
+		case float64:
+			out[name] = v
+		case map[string]interface{}:
+			flattenMetrics(name, v, out)
+		}
+	}
+}
+
+// isGauge tells the metrics firecracker stores as they are rather than counting them,
+// those are the durations in microseconds
+func isGauge(name string) bool {
+	return strings.HasSuffix(name, "_us") || strings.Contains(name, "latencies_us.")
+}
+
+// add records a flush of the metrics
+func (m *vmMetrics) add(latest map[string]float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.totals == nil {
+		m.totals = make(map[string]float64)
+	}
+	for name, v := range latest {
+		if isGauge(name) {
+			m.totals[name] = v
+		} else {
+			m.totals[name] += v
+		}
+	}
+	m.latest = latest
+	m.flushes++
+	m.updatedAt = time.Now()
+}
+
+// snapshot copies the metrics for the api
+func (m *vmMetrics) snapshot() *VmMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := &VmMetrics{
+		Flushes:   m.flushes,
+		UpdatedAt: m.updatedAt,
+		Latest:    make(map[string]float64, len(m.latest)),
+		Totals:    make(map[string]float64, len(m.totals)),
+	}
+	for k, v := range m.latest {
+		res.Latest[k] = v
+	}
+	for k, v := range m.totals {
+		res.Totals[k] = v
+	}
+	return res
+}
+
+// writePrometheus writes the totals of the metrics of every vm in the prometheus text format.
+// Metric names are the path of the value in the firecracker document, e.g. firecracker_block_read_count.
+func writePrometheus(w io.Writer, vms map[string]*VmMetrics) {
+	series := make(map[string][]string)
+	for id, m := range vms {
+		for name, v := range m.Totals {
+			metric := "firecracker_" + promName(name)
+			if !isGauge(name) {
+				metric += "_total"
+			}
+			series[metric] = append(series[metric], fmt.Sprintf("%s{vm_id=%q} %v", metric, id, v))
+		}
+	}
+
+	names := make([]string, 0, len(series))
+	for name := range series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		kind := "counter"
+		if !strings.HasSuffix(name, "_total") {
+			kind = "gauge"
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+		lines := series[name]
+		sort.Strings(lines)
+		for _, line := range lines {
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+// promName turns a firecracker metric path into a valid prometheus name
+func promName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
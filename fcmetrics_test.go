@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsGauge(t *testing.T) {
+	for name, gauge := range map[string]bool{
+		"block.read_count":                     false,
+		"net.tx_bytes_count":                   false,
+		"api_server.process_startup_time_us":   true,
+		"latencies_us.full_create_snapshot":    true,
+		"vcpu.exit_io_in":                      false,
+		"signals.sigbus":                       false,
+		"balloon.inflate_count":                false,
+		"patch_api_requests.drive_fails":       false,
+		"get_api_requests.instance_info_count": false,
+	} {
+		if isGauge(name) != gauge {
+			t.Errorf("%s: got gauge %v", name, !gauge)
+		}
+	}
+}
+
+func TestReadMetrics(t *testing.T) {
+	m := testVm(t, "measured", 0, StateStarted)
+	m.metrics = &vmMetrics{}
+
+	// every flush holds the counters since the previous one, latencies are kept as they are
+	flushes := strings.Join([]string{
+		`{"utc_timestamp_ms":1,"block":{"read_count":2,"write_bytes":100},"latencies_us":{"load_snapshot":50},"vmm":{"state":"Running"}}`,
+		`not json`,
+		`{"utc_timestamp_ms":2,"block":{"read_count":3,"write_bytes":0},"latencies_us":{"load_snapshot":40}}`,
+	}, "\n")
+	m.readMetrics(strings.NewReader(flushes))
+
+	got := m.metrics.snapshot()
+	if got.Flushes != 2 {
+		t.Fatalf("got %d flushes", got.Flushes)
+	}
+	if want := map[string]float64{"block.read_count": 3, "block.write_bytes": 0, "latencies_us.load_snapshot": 40}; !reflect.DeepEqual(got.Latest, want) {
+		t.Fatalf("got latest %v, want %v", got.Latest, want)
+	}
+	if want := map[string]float64{"block.read_count": 5, "block.write_bytes": 100, "latencies_us.load_snapshot": 40}; !reflect.DeepEqual(got.Totals, want) {
+		t.Fatalf("got totals %v, want %v", got.Totals, want)
+	}
+
+	// the api gets a copy
+	got.Totals["block.read_count"] = 0
+	if m.metrics.snapshot().Totals["block.read_count"] != 5 {
+		t.Fatal("the snapshot shares the totals")
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	var buf bytes.Buffer
+	writePrometheus(&buf, map[string]*VmMetrics{
+		"b": {Totals: map[string]float64{"block.read_count": 2}},
+		"a": {Totals: map[string]float64{"block.read_count": 5, "latencies_us.load-snapshot": 40}},
+	})
+
+	want := `# TYPE firecracker_block_read_count_total counter
+firecracker_block_read_count_total{vm_id="a"} 5
+firecracker_block_read_count_total{vm_id="b"} 2
+# TYPE firecracker_latencies_us_load_snapshot gauge
+firecracker_latencies_us_load_snapshot{vm_id="a"} 40
+`
+	if buf.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestCollectFifos(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "fifos")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	m := testVm(t, "measured", 0, StateStarted)
+	m.opts.FcLogFifo, m.opts.FcMetricsFifo = filepath.Join(dir, "log.fifo"), filepath.Join(dir, "metrics.fifo")
+	for _, fifo := range []string{m.opts.FcLogFifo, m.opts.FcMetricsFifo} {
+		if err := syscall.Mkfifo(fifo, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := m.collectFifos(); err != nil {
+		t.Fatal(err)
+	}
+
+	// firecracker writes to the fifos as it would
+	metrics, err := os.OpenFile(m.opts.FcMetricsFifo, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics.Write([]byte(`{"net":{"rx_count":7}}` + "\n"))
+	metrics.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for m.metrics.snapshot().Totals["net.rx_count"] != 7 {
+		if time.Now().After(deadline) {
+			t.Fatal("the metrics were not read")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	m.closeFifos()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("the fifos are left behind: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+// files file is used to carry files in and out of vms through their guest agent.
+// The agent only speaks tar, single files are wrapped and unwrapped here so http
+// clients can push and pull them as plain bodies.
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+const tarContentType = "application/x-tar"
+
+// headers describing a single file transferred as a plain body
+const (
+	fileModeHeader = "X-File-Mode"
+	fileUidHeader  = "X-File-Uid"
+	fileGidHeader  = "X-File-Gid"
+)
+
+// fileOwnership holds the mode and owner given to a file pushed as a plain body
+type fileOwnership struct {
+	mode int64
+	uid  int
+	gid  int
+}
+
+// parseFileOwnership reads the mode, uid and gid query parameters, defaulting to a root owned 0644 file
+func parseFileOwnership(r *http.Request) (*fileOwnership, error) {
+	q := r.URL.Query()
+	own := &fileOwnership{mode: 0644}
+
+	if v := q.Get("mode"); v != "" {
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mode %q: %v", v, err)
+		}
+		own.mode = int64(mode)
+	}
+
+	for name, dst := range map[string]*int{"uid": &own.uid, "gid": &own.gid} {
+		if v := q.Get(name); v != "" {
+			id, err := strconv.Atoi(v)
+			if err != nil || id < 0 {
+				return nil, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*dst = id
+		}
+	}
+
+	return own, nil
+}
+
+// sizedBody returns the body of r along with its size, spooling it to a temporary file
+// when the client did not announce it since tar headers need the size upfront
+func sizedBody(r *http.Request) (io.Reader, int64, func(), error) {
+	if r.ContentLength >= 0 {
+		return r.Body, r.ContentLength, func() {}, nil
+	}
+
+	f, err := ioutil.TempFile("", "upload-")
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("failed to spool upload: %v", err)
+	}
+	cleanup := func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+
+	size, err := io.Copy(f, r.Body)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return nil, 0, nil, fmt.Errorf("failed to spool upload: %v", err)
+	}
+
+	return f, size, cleanup, nil
+}
+
+// wrapFile streams body as a tar archive holding a single file named name
+func wrapFile(name string, body io.Reader, size int64, own *fileOwnership) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Size:     size,
+			Mode:     own.mode,
+			Uid:      own.uid,
+			Gid:      own.gid,
+			ModTime:  time.Now(),
+		})
+		if err == nil {
+			_, err = io.CopyN(tw, body, size)
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	return pr
+}
+
+// fileDisposition is the Content-Disposition of a file or archive downloaded from guestPath
+func fileDisposition(guestPath string, archive bool) string {
+	name := path.Base(guestPath)
+	if archive {
+		name += ".tar"
+	}
+	return fmt.Sprintf("attachment; filename=%q", name)
+}
@@ -1,232 +1,934 @@
 package main
 
 import (
+	"archive/tar"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
+	"github.com/gorilla/websocket"
+	"github.com/iradukunda1/firecrackerland/cmd/initrd/agent"
 )
 
-var runVms map[string]*Firecracker = make(map[string]*Firecracker)
-var ipByte byte = 3
-
 // For creating new vm instance
 func CreateVmHandler(w http.ResponseWriter, r *http.Request) {
 
-	log := ctxGetLogger(r.Context())
+	defer r.Body.Close()
+
+	in := new(CreateRequest)
+	if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+		writeMessage(w, http.StatusBadRequest, fmt.Sprintf("error during reading passed request body: %v", err))
+		return
+	}
 
-	ipByte += 1
-	body, err := io.ReadAll(r.Body)
+	m, err := createVm(r.Context(), in, ctxGetPrincipal(r.Context()), nil)
 	if err != nil {
-		log.Fatalf("failed to read body, %s", err)
+		ctxGetLogger(r.Context()).Errorf("failed to create vm: %v", err)
+		writeMessage(w, vmStatus(err), err.Error())
+		return
+	}
+
+	writeResponse(w, http.StatusOK, vmResource(m))
+}
+
+// for deleting supplied vm id
+func DeleteVmHandler(w http.ResponseWriter, r *http.Request) {
+
+	in, ok := readVmID(w, r)
+	if !ok {
+		return
+	}
+
+	running, ok := lookupVm(r, in.ID)
+	if !ok {
+		writeMessage(w, http.StatusNotFound, fmt.Sprintf("the vm machine with this id %s is not exist", in.ID))
+		return
+	}
+
+	deleteVm(running)
+
+	writeMessage(w, http.StatusOK, "vm deleted successfully")
+}
+
+// For pausing vm using supplied vm id, the vm is paused rather than stopped
+func StopVmHandler(w http.ResponseWriter, r *http.Request) {
+
+	in, ok := readVmID(w, r)
+	if !ok {
+		return
+	}
+
+	running, ok := lookupVm(r, in.ID)
+	if !ok {
+		writeMessage(w, http.StatusNotFound, fmt.Sprintf("the vm machine with this id %s is not exist", in.ID))
+		return
+	}
+
+	if err := running.pause(r.Context()); err != nil {
+		writeMessage(w, vmStatus(err), err.Error())
+		return
+	}
+
+	writeMessage(w, http.StatusOK, "vm stopped successfully")
+}
+
+// For resuming vm using supplied vm id
+func ResumeVmHandler(w http.ResponseWriter, r *http.Request) {
+
+	in, ok := readVmID(w, r)
+	if !ok {
+		return
 	}
+
+	running, ok := lookupVm(r, in.ID)
+	if !ok {
+		writeMessage(w, http.StatusNotFound, fmt.Sprintf("the vm machine with this id %s is not exist", in.ID))
+		return
+	}
+
+	if err := running.resume(r.Context()); err != nil {
+		writeMessage(w, vmStatus(err), err.Error())
+		return
+	}
+
+	writeMessage(w, http.StatusOK, "vm resumed successfully")
+}
+
+// readVmID decodes the DeleteRequest body the verb style handlers take the vm id from
+func readVmID(w http.ResponseWriter, r *http.Request) (*DeleteRequest, bool) {
+
 	defer r.Body.Close()
 
-	in := new(CreateRequest)
+	in := new(DeleteRequest)
+	if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+		writeMessage(w, http.StatusBadRequest, fmt.Sprintf("error during reading passed request body: %v", err))
+		return nil, false
+	}
+
+	return in, true
+}
 
-	if err := json.Unmarshal([]byte(body), in); err != nil {
-		log.Fatalf("error during reading passed request body: %v", err.Error())
+// For getting all running vms
+func ListVmsHandler(w http.ResponseWriter, r *http.Request) {
+
+	caller := ctxGetPrincipal(r.Context())
+
+	resp := make([]CreateResponse, 0)
+	for _, v := range listVms() {
+		if caller.owns(v) {
+			resp = append(resp, vmResource(v))
+		}
 	}
 
-	id := uuid()
+	writeResponse(w, http.StatusOK, resp)
+}
+
+// For getting vm details using supplied vm id
+func InfoVmHandler(w http.ResponseWriter, r *http.Request) {
 
-	opts := getOptions(ipByte, *in)
+	id := chi.URLParam(r, "vm_id")
 
-	opts.RootFsImage, err = opts.GenerateRFs(in.Name)
-	if err != nil {
-		fmt.Printf("failed to generate rootfs image, %s", err)
+	running, ok := lookupVm(r, id)
+	if !ok {
+		writeMessage(w, http.StatusNotFound, fmt.Sprintf("the vm machine with this id %s is not exist", id))
 		return
 	}
 
-	m, err := opts.createVMM(r.Context(), id)
-	if err != nil {
-		fmt.Printf("failed to start and create vm %v", err)
+	writeResponse(w, http.StatusOK, vmResource(running))
+}
+
+// For exporting a snapshot archive of the supplied vm id
+func ExportSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+
+	log := ctxGetLogger(r.Context())
+
+	id := chi.URLParam(r, "vm_id")
+
+	running, ok := lookupVm(r, id)
+	if !ok {
+		writeMessage(w, http.StatusNotFound, fmt.Sprintf("the vm machine with this id %s is not exist", id))
 		return
 	}
 
-	resp := CreateResponse{
-		Name:   in.Name,
-		State:  m.state,
-		IpAddr: opts.FcIP,
-		ID:     id,
-		Agent:  m.Agent,
+	w.Header().Add("Content-Type", "application/gzip")
+	w.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+".tar.gz"))
+
+	// the archive is streamed, failures past this point can only be logged
+	if err := running.exportSnapshot(r.Context(), w); err != nil {
+		log.Errorf("failed to export snapshot of vm %s: %v", id, err)
+		running.emitError(fmt.Errorf("failed to export snapshot: %v", err))
+		return
 	}
+	running.emit(EventSnapshot)
+}
+
+// For importing a snapshot archive supplied as request body and restoring its vm
+func ImportSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+
+	log := ctxGetLogger(r.Context())
+
+	defer r.Body.Close()
+
+	force := r.URL.Query().Get("force") == "true"
 
-	response, err := json.Marshal(&resp)
+	body := http.MaxBytesReader(w, r.Body, conf.SnapshotMaxSize<<20)
+
+	m, err := importSnapshot(body, force, ctxGetPrincipal(r.Context()))
 	if err != nil {
-		log.Fatalf("failed to marshal json, %s", err)
+		log.Errorf("failed to import snapshot: %v", err)
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			writeMessage(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("%v: the limit is %d MiB", errSnapshotTooLarge, conf.SnapshotMaxSize))
+		case errors.Is(err, errSnapshotVersion), errors.Is(err, errSnapshotTapInUse), errors.Is(err, errPortInUse):
+			writeMessage(w, http.StatusConflict, err.Error())
+		case errors.Is(err, errQuotaExceeded), errors.Is(err, errNoCapacity):
+			writeMessage(w, admissionStatus(err), err.Error())
+		case errors.Is(err, errSnapshotChecksum), errors.Is(err, errInvalidRequest):
+			writeMessage(w, http.StatusBadRequest, err.Error())
+		default:
+			writeMessage(w, http.StatusInternalServerError, err.Error())
+		}
+		return
 	}
-	w.Header().Add("Content-Type", "application/json")
-	w.Write(response)
 
-	m, err = StartVm(m)
-	if err != nil {
-		fmt.Printf("failed to start vm, %s", err)
+	writeResponse(w, http.StatusCreated, &CreateResponse{
+		ID:     m.ID,
+		Name:   m.Name,
+		Tenant: m.opts.Tenant,
+		State:  m.status(),
+		IpAddr: m.opts.FcIP,
+	})
+}
+
+// For reading the serial console output of the supplied vm id.
+// tail limits the output to the last lines and follow keeps streaming new output.
+func ConsoleVmHandler(w http.ResponseWriter, r *http.Request) {
+
+	id := chi.URLParam(r, "vm_id")
+
+	running, ok := lookupVm(r, id)
+	if !ok {
+		writeMessage(w, http.StatusNotFound, fmt.Sprintf("the vm machine with this id %s is not exist", id))
 		return
 	}
 
-	runVms[id] = m
+	tail, _ := strconv.Atoi(r.URL.Query().Get("tail"))
 
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+
+	if r.URL.Query().Get("follow") != "true" {
+		w.Write(running.console.Tail(tail))
+		return
+	}
+
+	backlog, output, stop := running.console.Follow(tail)
+	defer stop()
+
+	flusher, _ := w.(http.Flusher)
+
+	w.Write(backlog)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case chunk, ok := <-output:
+			if !ok {
+				return
+			}
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
 }
 
-// for deleting supplied vm id
-func DeleteVmHandler(w http.ResponseWriter, r *http.Request) {
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     checkOrigin,
+}
+
+// checkOrigin keeps other sites from opening websockets on the api with the credentials the
+// browser sends on its own, such as a client certificate, or none at all when authentication is
+// off. Clients which are not browsers send no Origin, and browsers can not set an Authorization
+// header on websockets.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if _, ok := bearerToken(r); ok {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// For attaching to the serial console of the supplied vm id over a websocket.
+// Every attached client sees the output, input of each message is written to the vm as a whole.
+func AttachConsoleHandler(w http.ResponseWriter, r *http.Request) {
 
 	log := ctxGetLogger(r.Context())
 
-	body, err := io.ReadAll(r.Body)
+	id := chi.URLParam(r, "vm_id")
+
+	running, ok := lookupVm(r, id)
+	if !ok {
+		writeMessage(w, http.StatusNotFound, fmt.Sprintf("the vm machine with this id %s is not exist", id))
+		return
+	}
+
+	tail, _ := strconv.Atoi(r.URL.Query().Get("tail"))
+	readOnly := r.URL.Query().Get("readonly") == "true"
+
+	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Fatalf("failed to read body, %s", err)
+		log.Errorf("failed to upgrade console connection of vm %s: %v", id, err)
+		return
 	}
-	defer r.Body.Close()
+	defer conn.Close()
+
+	backlog, output, stop := running.console.Follow(tail)
+	defer stop()
+
+	// the read loop is the only reader and the loop below the only writer of conn
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if readOnly {
+				continue
+			}
+			if err := running.console.Input(data); err != nil {
+				return
+			}
+		}
+	}()
 
-	in := new(DeleteRequest)
+	if err := conn.WriteMessage(websocket.BinaryMessage, backlog); err != nil {
+		return
+	}
 
-	err = json.Unmarshal([]byte(body), in)
+	for {
+		select {
+		case <-done:
+			return
+		case chunk, ok := <-output:
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "console closed"))
+				return
+			}
+			if err := conn.WriteMessage(websocket.BinaryMessage, chunk); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// For checking the guest agent of the supplied vm id
+func HealthVmHandler(w http.ResponseWriter, r *http.Request) {
+
+	id := chi.URLParam(r, "vm_id")
+
+	running, ok := lookupVm(r, id)
+	if !ok {
+		writeMessage(w, http.StatusNotFound, fmt.Sprintf("the vm machine with this id %s is not exist", id))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+
+	health, err := running.agent.Health(ctx)
 	if err != nil {
-		log.Fatalf("error during reading passed request body: %v", err.Error())
+		writeMessage(w, http.StatusServiceUnavailable, fmt.Sprintf("guest agent is not healthy: %v", err))
+		return
 	}
 
-	running := runVms[in.ID]
+	writeResponse(w, http.StatusOK, health)
+}
+
+// For delivering a signal to a process of the supplied vm id, the container entrypoint by default
+func SignalVmHandler(w http.ResponseWriter, r *http.Request) {
+
+	id := chi.URLParam(r, "vm_id")
 
-	if err := running.vm.Shutdown(running.ctx); err != nil {
-		log.Fatalf("failed to delete vm, %s", err)
+	running, ok := lookupVm(r, id)
+	if !ok {
+		writeMessage(w, http.StatusNotFound, fmt.Sprintf("the vm machine with this id %s is not exist", id))
+		return
 	}
 
-	res, err := json.Marshal(&responseMessage{Message: "vm deleted successfully"})
+	in := new(SignalRequest)
+	if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+		writeMessage(w, http.StatusBadRequest, fmt.Sprintf("error during reading passed request body: %v", err))
+		return
+	}
+	defer r.Body.Close()
+
+	sig, err := agent.ParseSignal(in.Signal)
 	if err != nil {
-		log.Fatalf("failed to marshal json, %s", err)
+		writeMessage(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	w.Header().Add("Content-Type", "application/json")
-	w.Write(res)
+	if err := running.agent.Signal(r.Context(), in.Pid, sig); err != nil {
+		writeMessage(w, http.StatusBadGateway, fmt.Sprintf("failed to deliver signal: %v", err))
+		return
+	}
 
-	delete(runVms, in.ID)
+	writeMessage(w, http.StatusOK, "signal delivered successfully")
 }
 
-// For stopping vm using supplied vm id
-func StopVmHandler(w http.ResponseWriter, r *http.Request) {
+// For running a command inside the supplied vm id.
+// Its output is streamed as json lines ending with an exit event carrying the exit code.
+func ExecVmHandler(w http.ResponseWriter, r *http.Request) {
 
-	log := ctxGetLogger(r.Context())
+	id := chi.URLParam(r, "vm_id")
 
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Fatalf("failed to read body, %s", err)
+	running, ok := lookupVm(r, id)
+	if !ok {
+		writeMessage(w, http.StatusNotFound, fmt.Sprintf("the vm machine with this id %s is not exist", id))
+		return
+	}
+
+	in := new(ExecRequest)
+	if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+		writeMessage(w, http.StatusBadRequest, fmt.Sprintf("error during reading passed request body: %v", err))
+		return
 	}
 	defer r.Body.Close()
 
-	in := new(DeleteRequest)
+	if len(in.Args) == 0 {
+		writeMessage(w, http.StatusBadRequest, "args are required")
+		return
+	}
+
+	sink := newHttpExecSink(w)
+	stdout, stderr := execWriters(sink)
+
+	w.Header().Add("Content-Type", "application/x-ndjson")
+	w.Header().Add("Trailer", "X-Exit-Code")
 
-	json.Unmarshal([]byte(body), in)
+	session, err := running.agent.Start(r.Context(), agent.ExecRequest{
+		Args:    in.Args,
+		Env:     in.Env,
+		Workdir: in.Workdir,
+		Tty:     in.Tty,
+		Stdin:   in.Stdin != "",
+	}, stdout, stderr)
 	if err != nil {
-		log.Fatalf("error during reading passed request body: %v", err.Error())
+		w.Header().Del("Content-Type")
+		w.Header().Del("Trailer")
+		writeMessage(w, http.StatusBadGateway, fmt.Sprintf("failed to run command: %v", err))
+		return
 	}
 
-	running := runVms[in.ID]
-
-	if err := running.vm.PauseVM(running.ctx); err != nil {
-		log.Fatalf("failed to pause vm, %s", err)
+	if in.Stdin != "" {
+		go func() {
+			io.Copy(session, strings.NewReader(in.Stdin))
+			session.CloseStdin()
+		}()
 	}
-	defer running.cancelCtx()
 
-	res, err := json.Marshal(&responseMessage{Message: "vm stopped successfully"})
+	code, err := session.Wait()
 	if err != nil {
-		log.Fatalf("failed to marshal json, %s", err)
+		sink.send(ExecEvent{Type: execError, Error: err.Error()})
+		return
 	}
-	w.Header().Add("Content-Type", "application/json")
-	w.Write(res)
+
+	w.Header().Set("X-Exit-Code", strconv.Itoa(code))
+	sink.send(ExecEvent{Type: execExit, ExitCode: &code})
 }
 
-// For resuming vm using supplied vm id
-func ResumeVmHandler(w http.ResponseWriter, r *http.Request) {
+// For running an interactive command inside the supplied vm id over a websocket.
+// The first message is the ExecRequest, binary messages are stdin and text messages are ExecControl.
+func AttachExecHandler(w http.ResponseWriter, r *http.Request) {
 
 	log := ctxGetLogger(r.Context())
 
-	body, err := io.ReadAll(r.Body)
+	id := chi.URLParam(r, "vm_id")
+
+	running, ok := lookupVm(r, id)
+	if !ok {
+		writeMessage(w, http.StatusNotFound, fmt.Sprintf("the vm machine with this id %s is not exist", id))
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Errorf("failed to upgrade exec connection of vm %s: %v", id, err)
+		return
+	}
+	defer conn.Close()
+
+	sink := &wsExecSink{conn: conn}
+
+	in := new(ExecRequest)
+	if err := conn.ReadJSON(in); err != nil || len(in.Args) == 0 {
+		sink.send(ExecEvent{Type: execError, Error: "the first message must be an exec request with args"})
+		sink.close("invalid exec request")
+		return
+	}
+
+	stdout, stderr := execWriters(sink)
+
+	session, err := running.agent.Start(r.Context(), agent.ExecRequest{
+		Args:    in.Args,
+		Env:     in.Env,
+		Workdir: in.Workdir,
+		Tty:     in.Tty,
+		Stdin:   true,
+	}, stdout, stderr)
+	if err != nil {
+		sink.send(ExecEvent{Type: execError, Error: err.Error()})
+		sink.close("failed to run command")
+		return
+	}
+
+	go func() {
+		for {
+			typ, data, err := conn.ReadMessage()
+			if err != nil {
+				// the client is gone, do not leave the command behind
+				session.Close()
+				return
+			}
+
+			if typ == websocket.BinaryMessage {
+				session.Write(data)
+				continue
+			}
+
+			var ctl ExecControl
+			if err := json.Unmarshal(data, &ctl); err != nil {
+				sink.send(ExecEvent{Type: execError, Error: fmt.Sprintf("invalid control message: %v", err)})
+				continue
+			}
+
+			switch ctl.Type {
+			case execResize:
+				session.Resize(ctl.Rows, ctl.Cols)
+			case execCloseStdin:
+				session.CloseStdin()
+			case execSignal:
+				sig, err := agent.ParseSignal(ctl.Signal)
+				if err != nil {
+					sink.send(ExecEvent{Type: execError, Error: err.Error()})
+					continue
+				}
+				session.Signal(sig)
+			default:
+				sink.send(ExecEvent{Type: execError, Error: fmt.Sprintf("unknown control message %q", ctl.Type)})
+			}
+		}
+	}()
+
+	code, err := session.Wait()
 	if err != nil {
-		log.Fatalf("failed to read body, %s", err)
+		sink.send(ExecEvent{Type: execError, Error: err.Error()})
+		sink.close("command failed")
+		return
+	}
+
+	sink.send(ExecEvent{Type: execExit, ExitCode: &code})
+	sink.close("command exited")
+}
+
+// For listing the kernels and initrds vms can boot, only admins see where they are on the host
+func ListKernelsHandler(w http.ResponseWriter, r *http.Request) {
+	if !ctxGetPrincipal(r.Context()).Admin {
+		writeResponse(w, http.StatusOK, kernels.public())
+		return
 	}
+	writeResponse(w, http.StatusOK, kernels)
+}
+
+// For changing the rate limits of a running vm, the limits which are not given are kept
+func RateLimitsVmHandler(w http.ResponseWriter, r *http.Request) {
+
+	id := chi.URLParam(r, "vm_id")
+
+	running, ok := lookupVm(r, id)
+	if !ok {
+		writeMessage(w, http.StatusNotFound, fmt.Sprintf("the vm machine with this id %s is not exist", id))
+		return
+	}
+
 	defer r.Body.Close()
 
-	in := new(DeleteRequest)
+	in := new(RateLimits)
+	if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+		writeMessage(w, http.StatusBadRequest, fmt.Sprintf("error during reading passed request body: %v", err))
+		return
+	}
+	if err := validateRateLimits(in); err != nil {
+		writeMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if state := running.currentState(); state != StateStarted {
+		writeMessage(w, http.StatusConflict, fmt.Sprintf("the vm machine with this id %s is %s", id, state))
+		return
+	}
 
-	json.Unmarshal([]byte(body), in)
+	limits, err := running.updateRateLimits(r.Context(), in)
 	if err != nil {
-		log.Fatalf("error during reading passed request body: %v", err.Error())
+		writeMessage(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	// restarts and reattaches keep the new limits
+	if err := running.saveRecord(); err != nil {
+		ctxGetLogger(r.Context()).Errorf("failed to save record of vm %s: %v", id, err)
+	}
+
+	writeResponse(w, http.StatusOK, limits)
+}
+
+// For inflating or deflating the balloon of a running vm
+func BalloonVmHandler(w http.ResponseWriter, r *http.Request) {
+
+	id := chi.URLParam(r, "vm_id")
+
+	running, ok := lookupVm(r, id)
+	if !ok {
+		writeMessage(w, http.StatusNotFound, fmt.Sprintf("the vm machine with this id %s is not exist", id))
+		return
+	}
+
+	defer r.Body.Close()
+
+	in := new(BalloonRequest)
+	if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+		writeMessage(w, http.StatusBadRequest, fmt.Sprintf("error during reading passed request body: %v", err))
+		return
+	}
+
+	if running.opts.Balloon == nil || running.currentState() != StateStarted {
+		writeMessage(w, http.StatusConflict, fmt.Sprintf("the vm machine with this id %s has no running balloon", id))
+		return
+	}
+	if in.AmountMiB < 0 || in.AmountMiB >= running.opts.FcMemSz {
+		writeMessage(w, http.StatusBadRequest, fmt.Sprintf("balloon amount must be between 0 and %d MiB", running.opts.FcMemSz-1))
+		return
+	}
+
+	if err := running.setBalloon(r.Context(), in.AmountMiB, false); err != nil {
+		writeMessage(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	if err := running.saveRecord(); err != nil {
+		ctxGetLogger(r.Context()).Errorf("failed to save record of vm %s: %v", id, err)
+	}
+
+	writeResponse(w, http.StatusOK, running.balloonState())
+}
+
+// For getting the metrics firecracker reported for a vm
+func MetricsVmHandler(w http.ResponseWriter, r *http.Request) {
+
+	id := chi.URLParam(r, "vm_id")
+
+	running, ok := lookupVm(r, id)
+	if !ok {
+		writeMessage(w, http.StatusNotFound, fmt.Sprintf("the vm machine with this id %s is not exist", id))
+		return
+	}
+
+	if running.metrics == nil {
+		writeMessage(w, http.StatusNotFound, fmt.Sprintf("no metrics were collected for the vm machine with this id %s", id))
+		return
+	}
+
+	writeResponse(w, http.StatusOK, running.metrics.snapshot())
+}
+
+// For scraping the firecracker metrics of every vm in the prometheus text format
+func PrometheusVmsHandler(w http.ResponseWriter, r *http.Request) {
+
+	caller := ctxGetPrincipal(r.Context())
+
+	vms := make(map[string]*VmMetrics)
+	for _, m := range listVms() {
+		if m.metrics != nil && caller.owns(m) {
+			vms[m.ID] = m.metrics.snapshot()
+		}
 	}
 
-	running := runVms[in.ID]
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writePrometheus(w, vms)
+}
+
+// For creating an empty data volume
+func CreateVolumeHandler(w http.ResponseWriter, r *http.Request) {
+
+	defer r.Body.Close()
+
+	in := new(VolumeRequest)
+	if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+		writeMessage(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
 
-	if err := running.vm.ResumeVM(running.ctx); err != nil {
-		log.Fatalf("failed to resume vm, %s", err)
+	tenant := in.Tenant
+	if tenant == "" {
+		tenant = ctxGetPrincipal(r.Context()).Tenant
 	}
 
-	res, err := json.Marshal(&responseMessage{Message: "vm resumed successfully"})
+	v, err := createVolume(in.Name, in.SizeMiB, tenant)
 	if err != nil {
-		log.Fatalf("failed to marshal json, %s", err)
+		writeMessage(w, volumeStatus(err), err.Error())
+		return
 	}
-	w.Header().Add("Content-Type", "application/json")
-	w.Write(res)
+
+	writeResponse(w, http.StatusCreated, v)
 }
 
-// For getting all running vms
-func ListVmsHandler(w http.ResponseWriter, r *http.Request) {
+// For listing the data volumes and the vms using them
+func ListVolumesHandler(w http.ResponseWriter, r *http.Request) {
 
-	log := ctxGetLogger(r.Context())
+	volumes, err := listVolumes()
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeResponse(w, http.StatusOK, volumes)
+}
+
+// For deleting a data volume no vm uses anymore
+func DeleteVolumeHandler(w http.ResponseWriter, r *http.Request) {
+
+	name := chi.URLParam(r, "name")
+
+	if err := deleteVolume(name); err != nil {
+		writeMessage(w, volumeStatus(err), err.Error())
+		return
+	}
+
+	writeMessage(w, http.StatusOK, fmt.Sprintf("volume %s deleted", name))
+}
+
+// For getting what the vms of the caller hold on to and its quota
+func UsageHandler(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, http.StatusOK, tenantUsage(ctxGetPrincipal(r.Context()).Tenant))
+}
+
+// For getting what the vms of every tenant hold on to and what the host can give them
+func HostUsageHandler(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, http.StatusOK, hostUsage())
+}
 
-	var resp []CreateResponse = make([]CreateResponse, 0)
+// vmStatus maps the errors of creating vms and acting on them to http status codes
+func vmStatus(err error) int {
+	switch {
+	case errors.Is(err, errInvalidRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, errVmState), errors.Is(err, errPortInUse):
+		return http.StatusConflict
+	case errors.Is(err, errQuotaExceeded), errors.Is(err, errNoCapacity):
+		return admissionStatus(err)
+	case errors.Is(err, errVolumeInvalid), errors.Is(err, errVolumeNotFound),
+		errors.Is(err, errVolumeExists), errors.Is(err, errVolumeInUse):
+		return volumeStatus(err)
+	}
+	return http.StatusInternalServerError
+}
 
-	for _, v := range runVms {
-		pid, _ := v.vm.PID()
-		resp = append(resp, CreateResponse{
-			Name:   v.Name,
-			State:  v.state,
-			IpAddr: string(v.vm.Cfg.MmdsAddress),
-			ID:     v.vm.Cfg.VMID,
-			PID:    int64(pid),
-		})
+// admissionStatus maps the errors of admit to http status codes
+func admissionStatus(err error) int {
+	if errors.Is(err, errQuotaExceeded) {
+		return http.StatusTooManyRequests
 	}
+	return http.StatusConflict
+}
 
-	response, err := json.Marshal(&resp)
+// volumeStatus maps the errors of the volume functions to http status codes
+func volumeStatus(err error) int {
+	switch {
+	case errors.Is(err, errVolumeInvalid):
+		return http.StatusBadRequest
+	case errors.Is(err, errVolumeNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errVolumeExists), errors.Is(err, errVolumeInUse):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// For pushing a file, or a tar archive of a directory, into a vm
+func UploadFilesHandler(w http.ResponseWriter, r *http.Request) {
+
+	id := chi.URLParam(r, "vm_id")
+
+	running, ok := lookupVm(r, id)
+	if !ok {
+		writeMessage(w, http.StatusNotFound, fmt.Sprintf("the vm machine with this id %s is not exist", id))
+		return
+	}
+
+	defer r.Body.Close()
+
+	guestPath := r.URL.Query().Get("path")
+	if !path.IsAbs(guestPath) {
+		writeMessage(w, http.StatusBadRequest, "an absolute path is required")
+		return
+	}
+
+	// archives are extracted into path, plain bodies become the file at path
+	if r.Header.Get("Content-Type") == tarContentType {
+		if err := running.agent.CopyIn(r.Context(), guestPath, r.Body); err != nil {
+			writeMessage(w, http.StatusBadGateway, fmt.Sprintf("failed to copy files: %v", err))
+			return
+		}
+		writeMessage(w, http.StatusOK, "files copied successfully")
+		return
+	}
+
+	own, err := parseFileOwnership(r)
 	if err != nil {
-		log.Fatalf("failed to marshal json, %s", err)
+		writeMessage(w, http.StatusBadRequest, err.Error())
+		return
 	}
-	w.Header().Add("Content-Type", "application/json")
-	w.Write(response)
+
+	body, size, cleanup, err := sizedBody(r)
+	if err != nil {
+		writeMessage(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer cleanup()
+
+	archive := wrapFile(path.Base(guestPath), body, size, own)
+	defer archive.Close()
+
+	if err := running.agent.CopyIn(r.Context(), path.Dir(guestPath), archive); err != nil {
+		writeMessage(w, http.StatusBadGateway, fmt.Sprintf("failed to copy file: %v", err))
+		return
+	}
+
+	writeMessage(w, http.StatusOK, "file copied successfully")
 }
 
-// For getting vm details using supplied vm id
-func InfoVmHandler(w http.ResponseWriter, r *http.Request) {
+// For pulling a file, or a tar archive of a directory, out of a vm
+func DownloadFilesHandler(w http.ResponseWriter, r *http.Request) {
 
 	log := ctxGetLogger(r.Context())
 
 	id := chi.URLParam(r, "vm_id")
 
-	running, ok := runVms[id]
+	running, ok := lookupVm(r, id)
 	if !ok {
-		res := &responseMessage{
-			Message: fmt.Sprintf("the vm machine with this id %s is not exist", id),
+		writeMessage(w, http.StatusNotFound, fmt.Sprintf("the vm machine with this id %s is not exist", id))
+		return
+	}
+
+	guestPath := r.URL.Query().Get("path")
+	if !path.IsAbs(guestPath) {
+		writeMessage(w, http.StatusBadRequest, "an absolute path is required")
+		return
+	}
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	copied := make(chan error, 1)
+	go func() {
+		err := running.agent.CopyOut(r.Context(), guestPath, pw)
+		pw.CloseWithError(err)
+		copied <- err
+	}()
+
+	// the first entry tells whether path is a single file or a directory
+	tr := tar.NewReader(pr)
+	hdr, err := tr.Next()
+	if err != nil {
+		pr.Close()
+		if copyErr := <-copied; copyErr != nil {
+			err = copyErr
+		}
+		if strings.Contains(err.Error(), "no such file or directory") {
+			writeMessage(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeMessage(w, http.StatusBadGateway, fmt.Sprintf("failed to copy files: %v", err))
+		return
+	}
+
+	if hdr.Typeflag == tar.TypeReg && r.URL.Query().Get("archive") != "true" {
+		w.Header().Add("Content-Type", "application/octet-stream")
+		w.Header().Add("Content-Disposition", fileDisposition(guestPath, false))
+		w.Header().Add("Content-Length", strconv.FormatInt(hdr.Size, 10))
+		w.Header().Add(fileModeHeader, fmt.Sprintf("%04o", hdr.Mode&07777))
+		w.Header().Add(fileUidHeader, strconv.Itoa(hdr.Uid))
+		w.Header().Add(fileGidHeader, strconv.Itoa(hdr.Gid))
+
+		if _, err := io.Copy(w, tr); err != nil {
+			log.Errorf("failed to copy %s out of vm %s: %v", guestPath, id, err)
 		}
-		resp, _ := json.Marshal(&res)
-		w.Header().Add("Content-Type", "application/json")
-		w.Write(resp)
 		return
 	}
 
-	resp := CreateResponse{
-		Name:   running.Name,
-		State:  running.state,
-		IpAddr: string(running.vm.Cfg.MmdsAddress),
-		ID:     running.vm.Cfg.VMID,
-		Agent:  running.Agent,
+	w.Header().Add("Content-Type", tarContentType)
+	w.Header().Add("Content-Disposition", fileDisposition(guestPath, true))
+
+	// the archive is streamed, failures past this point can only be logged
+	tw := tar.NewWriter(w)
+	for err == nil {
+		if err = tw.WriteHeader(hdr); err != nil {
+			break
+		}
+		if _, err = io.Copy(tw, tr); err != nil {
+			break
+		}
+		hdr, err = tr.Next()
+	}
+	if err == io.EOF {
+		err = tw.Close()
 	}
+	if err != nil {
+		log.Errorf("failed to copy %s out of vm %s: %v", guestPath, id, err)
+	}
+}
 
-	response, err := json.Marshal(&resp)
+// writeResponse encodes v as json response with the supplied status code
+func writeResponse(w http.ResponseWriter, status int, v interface{}) {
+	response, err := json.Marshal(v)
 	if err != nil {
-		log.Fatalf("failed to marshal json, %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
 	w.Write(response)
 }
+
+// writeMessage responds with a responseMessage carrying msg
+func writeMessage(w http.ResponseWriter, status int, msg string) {
+	writeResponse(w, status, &responseMessage{Message: msg})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		origin string
+		token  string
+		ok     bool
+	}{
+		{"no origin", "", "", true},
+		{"same host", "http://fcland.example:8080", "", true},
+		{"same host other case", "http://FCLAND.example:8080", "", true},
+		{"other site", "https://evil.example", "", false},
+		{"other port", "http://fcland.example:9090", "", false},
+		{"other site with a token", "https://dashboard.example", "secret", true},
+		{"invalid origin", "://", "", false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://fcland.example:8080/api/v1/events", nil)
+			if c.origin != "" {
+				r.Header.Set("Origin", c.origin)
+			}
+			if c.token != "" {
+				r.Header.Set("Authorization", "Bearer "+c.token)
+			}
+			if got := checkOrigin(r); got != c.ok {
+				t.Fatalf("got %v, want %v", got, c.ok)
+			}
+		})
+	}
+}
+
+func TestListKernels(t *testing.T) {
+	saved := kernels
+	defer func() { kernels = saved }()
+	kernels = &kernelRegistry{
+		Kernels: []*kernel{{Name: "6.1", Path: "/srv/kernels/vmlinux-6.1", SHA256: "ab12", Arch: "x86_64", Default: true}},
+		Initrds: []*initrd{{Name: "default", Path: "/srv/kernels/initrd.cpio", SHA256: "cd34", Default: true}},
+	}
+
+	for _, c := range []struct {
+		name   string
+		caller *principal
+		paths  bool
+	}{
+		{"tenant", &principal{Tenant: "acme"}, false},
+		{"admin", &principal{Tenant: "ops", Admin: true}, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/kernels", nil)
+			r = r.WithContext(ctxSetPrincipal(r.Context(), c.caller))
+			w := httptest.NewRecorder()
+			ListKernelsHandler(w, r)
+
+			body := w.Body.String()
+			if !strings.Contains(body, `"6.1"`) || !strings.Contains(body, `"x86_64"`) {
+				t.Fatalf("the kernels are not listed: %s", body)
+			}
+			for _, leak := range []string{"/srv/kernels", "ab12", "cd34"} {
+				if strings.Contains(body, leak) != c.paths {
+					t.Fatalf("%q listed %v: %s", leak, !c.paths, body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+// kernels file is used to keep the registry of the kernels and initrds vms can boot,
+// so workloads can be tried against several kernel versions.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/iradukunda1/firecrackerland/client"
+)
+
+// baseBootArgs are the boot args of kernels which do not set their own
+const baseBootArgs = "ro console=ttyS0 noapic reboot=k panic=1 earlycon pci=off nomodules random.trust_cpu=on tsc=reliable quiet"
+
+// daemonBootArgs are set by the daemon itself, they can not be overridden per vm
+var daemonBootArgs = []string{"init=", "ip="}
+
+// kernel is a kernel image vms can boot
+type kernel = client.Kernel
+
+// initrd is an initrd holding the init of the vms
+type initrd = client.Initrd
+
+// kernelRegistry is read from the file given by the -kernels flag
+type kernelRegistry struct {
+	Kernels []*kernel `json:"kernels"`
+	Initrds []*initrd `json:"initrds"`
+}
+
+// kernels is the registry in use, the built in one boots the files fetched by the taskfile
+var kernels = &kernelRegistry{
+	Kernels: []*kernel{{Name: "default", Path: "vmlinux.bin", Arch: hostArch(), Default: true}},
+	Initrds: []*initrd{{Name: "default", Path: "initrd.cpio", Default: true}},
+}
+
+// hostArch names the architecture of the host the way kernels are built for
+func hostArch() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x86_64"
+	case "arm64":
+		return "aarch64"
+	}
+	return runtime.GOARCH
+}
+
+// loadKernels replaces the built in registry with the one in the file at path
+func loadKernels(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read kernel registry: %v", err)
+	}
+
+	reg := new(kernelRegistry)
+	if err := json.Unmarshal(data, reg); err != nil {
+		return fmt.Errorf("failed to decode kernel registry: %v", err)
+	}
+
+	if err := reg.validate(); err != nil {
+		return fmt.Errorf("invalid kernel registry: %v", err)
+	}
+
+	kernels = reg
+	return nil
+}
+
+// validate checks the entries are named once, have a path and that there is a single default of each
+func (reg *kernelRegistry) validate() error {
+	names := make(map[string]bool)
+	defaults := 0
+	for _, k := range reg.Kernels {
+		if k.Name == "" || k.Path == "" {
+			return fmt.Errorf("kernels need a name and a path")
+		}
+		if names[k.Name] {
+			return fmt.Errorf("kernel %q is defined twice", k.Name)
+		}
+		if k.Arch != "x86_64" && k.Arch != "aarch64" {
+			return fmt.Errorf("kernel %q has unknown arch %q", k.Name, k.Arch)
+		}
+		if err := checkBootArgs(k.BootArgs); err != nil {
+			return fmt.Errorf("kernel %q: %v", k.Name, err)
+		}
+		names[k.Name] = true
+		if k.Default {
+			defaults++
+		}
+	}
+	if defaults != 1 {
+		return fmt.Errorf("exactly one kernel must be the default")
+	}
+
+	names = make(map[string]bool)
+	defaults = 0
+	for _, rd := range reg.Initrds {
+		if rd.Name == "" || rd.Path == "" {
+			return fmt.Errorf("initrds need a name and a path")
+		}
+		if names[rd.Name] {
+			return fmt.Errorf("initrd %q is defined twice", rd.Name)
+		}
+		names[rd.Name] = true
+		if rd.Default {
+			defaults++
+		}
+	}
+	if defaults != 1 {
+		return fmt.Errorf("exactly one initrd must be the default")
+	}
+
+	return nil
+}
+
+// public is the registry as tenants see it: the files on the host and their checksums are left to admins
+func (reg *kernelRegistry) public() *kernelRegistry {
+	res := &kernelRegistry{Kernels: make([]*kernel, 0, len(reg.Kernels)), Initrds: make([]*initrd, 0, len(reg.Initrds))}
+	for _, k := range reg.Kernels {
+		res.Kernels = append(res.Kernels, &kernel{Name: k.Name, Arch: k.Arch, BootArgs: k.BootArgs, Default: k.Default})
+	}
+	for _, i := range reg.Initrds {
+		res.Initrds = append(res.Initrds, &initrd{Name: i.Name, Default: i.Default})
+	}
+	return res
+}
+
+// kernel returns the kernel called name, the default one when name is empty
+func (reg *kernelRegistry) kernel(name string) (*kernel, error) {
+	for _, k := range reg.Kernels {
+		if (name == "" && k.Default) || (name != "" && k.Name == name) {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown kernel %q", name)
+}
+
+// initrd returns the initrd called name, the default one when name is empty
+func (reg *kernelRegistry) initrd(name string) (*initrd, error) {
+	for _, rd := range reg.Initrds {
+		if (name == "" && rd.Default) || (name != "" && rd.Name == name) {
+			return rd, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown initrd %q", name)
+}
+
+// checkBootArgs rejects boot args the daemon relies on setting itself
+func checkBootArgs(args string) error {
+	if strings.ContainsAny(args, "\n\x00") {
+		return fmt.Errorf("boot args must hold on a single line")
+	}
+	for _, arg := range strings.Fields(args) {
+		for _, reserved := range daemonBootArgs {
+			if strings.HasPrefix(arg, reserved) {
+				return fmt.Errorf("boot arg %s is set by the daemon", reserved)
+			}
+		}
+	}
+	return nil
+}
+
+// bootArgs is the kernel command line of a vm with address ip booting k, extra is appended to it
+func bootArgs(k *kernel, ip, extra string) string {
+	args := k.BootArgs
+	if args == "" {
+		args = baseBootArgs
+	}
+	args += fmt.Sprintf(" init=init ip=%s::%s:255.255.255.0::eth0:off", ip, gatewayIP)
+	if extra != "" {
+		args += " " + extra
+	}
+	return args
+}
+
+// selectBoot sets the kernel, initrd and boot args the vm boots with after checking them
+func (o *options) selectBoot(kernelName, initrdName, extraArgs string) error {
+	k, err := kernels.kernel(kernelName)
+	if err != nil {
+		return err
+	}
+	if k.Arch != hostArch() {
+		return fmt.Errorf("kernel %q is built for %s, this host runs %s", k.Name, k.Arch, hostArch())
+	}
+	if err := verifyFile(k.Path, k.SHA256); err != nil {
+		return fmt.Errorf("kernel %q: %v", k.Name, err)
+	}
+
+	rd, err := kernels.initrd(initrdName)
+	if err != nil {
+		return err
+	}
+	if err := verifyFile(rd.Path, rd.SHA256); err != nil {
+		return fmt.Errorf("initrd %q: %v", rd.Name, err)
+	}
+
+	if err := checkBootArgs(extraArgs); err != nil {
+		return err
+	}
+
+	o.Kernel = k.Name
+	o.FcKernelImage = k.Path
+	o.Initrd = rd.Name
+	o.FcInitrd = rd.Path
+	o.KernelBootArgs = bootArgs(k, o.FcIP, extraArgs)
+
+	return nil
+}
+
+// checksum caches the sha256 of a file as long as it is not modified
+type checksum struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+var (
+	checksumsMu sync.Mutex
+	checksums   = make(map[string]checksum)
+)
+
+// verifyFile makes sure the file at path exists and, when sum is set, that its sha256 matches
+func verifyFile(path, sum string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	if sum == "" {
+		return nil
+	}
+
+	checksumsMu.Lock()
+	cached, ok := checksums[path]
+	checksumsMu.Unlock()
+
+	if !ok || cached.size != info.Size() || !cached.modTime.Equal(info.ModTime()) {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return fmt.Errorf("failed to checksum %s: %v", path, err)
+		}
+
+		cached = checksum{size: info.Size(), modTime: info.ModTime(), sum: hex.EncodeToString(h.Sum(nil))}
+
+		checksumsMu.Lock()
+		checksums[path] = cached
+		checksumsMu.Unlock()
+	}
+
+	if !strings.EqualFold(cached.sum, sum) {
+		return fmt.Errorf("checksum of %s does not match", path)
+	}
+
+	return nil
+}
@@ -0,0 +1,397 @@
+// lifecycle file is used to create, pause, resume, stop, start again and delete vms. The handlers
+// of the versioned api and the deprecated verb style ones both go through it.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// errInvalidRequest is returned when the request to create a vm is not valid
+	errInvalidRequest = errors.New("invalid request")
+	// errVmState is returned when the vm is not in a state allowing the action
+	errVmState = errors.New("invalid vm state")
+)
+
+// createVm builds the rootfs of the vm asked for by in, boots it for the tenant of caller and adds
+// it to runVms. applied is the spec in comes from when the vm is created by applying one.
+func createVm(ctx context.Context, in *CreateRequest, caller *principal, applied *appliedSpec) (*Firecracker, error) {
+
+	opts, err := createOptions(in, caller)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPortsFree(in.Ports, nil); err != nil {
+		return nil, err
+	}
+
+	id := uuid()
+
+	if in.Balloon != nil && in.Balloon.StatsIntervalS == 0 {
+		in.Balloon.StatsIntervalS = conf.BalloonStats
+	}
+
+	// the resources and the vm index are held from now on, until the vm is in runVms or failed to come up
+	rsv, err := admit(opts.Tenant, vmResources(&opts), 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rsv.release()
+	opts.setVmIndex(rsv.index)
+
+	if err := checkVolumes(in.Volumes, caller, nil); err != nil {
+		return nil, err
+	}
+	if err := opts.selectBoot(in.Kernel, in.Initrd, in.BootArgs); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidRequest, err)
+	}
+
+	opts.RestartPolicy = in.RestartPolicy
+	opts.RateLimits = mergeRateLimits(in.RateLimits, defaultRateLimits())
+	opts.Balloon = in.Balloon
+	opts.Volumes = in.Volumes
+	opts.Env = in.Env
+	opts.Command = in.Command
+	opts.Ports = in.Ports
+	opts.Network = in.Network
+	if opts.Network == "" {
+		opts.Network = NetworkNAT
+	}
+	opts.Applied = applied
+
+	ctx, span := tracer.Start(ctx, "createVm", trace.WithAttributes(vmAttributes(id, &opts)...))
+	defer span.End()
+
+	buildStart := time.Now()
+	opts.RootFsImage, err = opts.GenerateRFs(ctx, in.Name)
+	if err != nil {
+		vmFailures.WithLabelValues("rootfs").Inc()
+		err = fmt.Errorf("failed to generate rootfs image: %v", err)
+		endSpan(span, err)
+		publishError(id, &opts, err)
+		return nil, err
+	}
+	observeSince(rootfsBuildSeconds, buildStart)
+
+	m, err := opts.createVMM(ctx, id)
+	if err != nil {
+		vmFailures.WithLabelValues("create").Inc()
+		endSpan(span, err)
+		err = fmt.Errorf("failed to create vm: %v", err)
+		publishError(id, &opts, err)
+		return nil, err
+	}
+	m.emit(EventCreated)
+
+	m, err = StartVm(ctx, m)
+	if err != nil {
+		vmFailures.WithLabelValues("start").Inc()
+		endSpan(span, err)
+		return nil, err
+	}
+
+	putVm(m)
+	rsv.keep()
+	vmCreates.Inc()
+
+	return m, nil
+}
+
+// createOptions checks the request in and turns it into the options of a vm of the tenant of caller
+func createOptions(in *CreateRequest, caller *principal) (options, error) {
+
+	if err := validateImage(in.Name, in.DockerImage); err != nil {
+		return options{}, fmt.Errorf("%w: %v", errInvalidRequest, err)
+	}
+	if err := validateRestartPolicy(in.RestartPolicy); err != nil {
+		return options{}, fmt.Errorf("%w: %v", errInvalidRequest, err)
+	}
+	if in.VCPUs < 0 || in.VCPUs > maxVCPUs {
+		return options{}, fmt.Errorf("%w: vcpus must be between 1 and %d", errInvalidRequest, maxVCPUs)
+	}
+	if in.MemoryMiB != 0 && in.MemoryMiB < minMemoryMiB {
+		return options{}, fmt.Errorf("%w: memory must be at least %d MiB", errInvalidRequest, minMemoryMiB)
+	}
+	if err := validateRateLimits(in.RateLimits); err != nil {
+		return options{}, fmt.Errorf("%w: %v", errInvalidRequest, err)
+	}
+	if err := validateEnv(in.Env); err != nil {
+		return options{}, fmt.Errorf("%w: %v", errInvalidRequest, err)
+	}
+	if err := validateNetwork(in.Network, in.Ports); err != nil {
+		return options{}, err
+	}
+
+	opts := getOptions(*in)
+	opts.Tenant = caller.Tenant
+	if in.VCPUs != 0 {
+		opts.FcCPUCount = in.VCPUs
+	}
+	if in.MemoryMiB != 0 {
+		opts.FcMemSz = in.MemoryMiB
+	}
+
+	if err := validateBalloon(in.Balloon, opts.FcMemSz); err != nil {
+		return options{}, fmt.Errorf("%w: %v", errInvalidRequest, err)
+	}
+
+	return opts, nil
+}
+
+// status is the state of the vm as shown by the api
+func (f *Firecracker) status() VmState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.statusLocked()
+}
+
+// statusLocked is status for the callers holding f.mu
+func (f *Firecracker) statusLocked() VmState {
+	if f.state == StateStarted && f.paused {
+		return StatePaused
+	}
+	return f.state
+}
+
+// currentState is the state of the vm, paused vms are started
+func (f *Firecracker) currentState() VmState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.state
+}
+
+// setState moves the vm to state
+func (f *Firecracker) setState(state VmState) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.state = state
+}
+
+// isStopping tells whether the vm is stopped on purpose
+func (f *Firecracker) isStopping() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.stopping
+}
+
+// markStopping tells the vm is stopped on purpose and returns its state
+func (f *Firecracker) markStopping() VmState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.stopping = true
+	return f.state
+}
+
+// settle leaves the vm in state once firecracker is gone for good and tells whether the vm was
+// deleted while it was restarting, its vm index is to be given back then
+func (f *Firecracker) settle(state VmState) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	orphaned := f.deleted && f.state == StateRestarting
+	f.state = state
+	return orphaned
+}
+
+// lastExitCode is the exit code the workload reported, nil when it did not
+func (f *Firecracker) lastExitCode() *int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.exitCode
+}
+
+// pause freezes the vcpus of the started vm
+func (f *Firecracker) pause(ctx context.Context) error {
+	if state := f.currentState(); state != StateStarted {
+		return fmt.Errorf("%w: the vm %s is %s", errVmState, f.ID, f.status())
+	}
+	if err := f.vm.PauseVM(ctx); err != nil {
+		return fmt.Errorf("failed to pause vm: %v", err)
+	}
+	f.mu.Lock()
+	f.paused = true
+	f.mu.Unlock()
+	f.emit(EventPaused)
+	return nil
+}
+
+// resume lets the paused vm run again
+func (f *Firecracker) resume(ctx context.Context) error {
+	if state := f.currentState(); state != StateStarted {
+		return fmt.Errorf("%w: the vm %s is %s", errVmState, f.ID, f.status())
+	}
+	if err := f.vm.ResumeVM(ctx); err != nil {
+		return fmt.Errorf("failed to resume vm: %v", err)
+	}
+	f.mu.Lock()
+	f.paused = false
+	f.mu.Unlock()
+	f.emit(EventResumed)
+	return nil
+}
+
+// stop shuts the vm down in the background, it stays around as exited and can be booted again
+func (f *Firecracker) stop() error {
+	switch f.status() {
+	case StatePaused:
+		// a paused guest can not handle Ctrl-Alt-Del
+		if err := f.resume(context.Background()); err != nil {
+			return err
+		}
+		go f.shutdown(context.Background(), conf.ShutdownTimeout)
+	case StateStarted:
+		go f.shutdown(context.Background(), conf.ShutdownTimeout)
+	case StateRestarting:
+		// the pending restart gives up once it sees the vm stopping
+		f.markStopping()
+	default:
+		return fmt.Errorf("%w: the vm %s is %s", errVmState, f.ID, f.status())
+	}
+	f.emit(EventStopped)
+	return nil
+}
+
+// boot starts the exited or failed vm again from its rootfs, keeping its id, network and console log.
+// The vm is replaced in runVms by the one returned.
+func (f *Firecracker) boot(ctx context.Context) (*Firecracker, error) {
+	// the vm restarts until it is replaced, a second boot or a delete meanwhile see it restarting
+	f.mu.Lock()
+	prev := f.state
+	if prev != StateExited && prev != StateFailed {
+		f.mu.Unlock()
+		return nil, fmt.Errorf("%w: the vm %s is %s", errVmState, f.ID, prev)
+	}
+	f.state = StateRestarting
+	f.mu.Unlock()
+
+	next, err := f.bootAgain(ctx)
+	if err != nil && f.settle(prev) {
+		releaseVmIndex(f.opts.VmIndex)
+	}
+	return next, err
+}
+
+// bootAgain boots the vm restarting at the request of the api again
+func (f *Firecracker) bootAgain(ctx context.Context) (*Firecracker, error) {
+	// exited vms only hold on to their disk, the cpus and memory have to be admitted again. The
+	// vm is restarting by now and counted in full, it is left out not to be counted twice.
+	res := vmResources(f.opts)
+	res.VMs, res.DiskMiB = 0, 0
+	rsv, err := admit(f.opts.Tenant, res, 0, f)
+	if err != nil {
+		return nil, err
+	}
+	defer rsv.release()
+
+	ctx, span := tracer.Start(ctx, "boot", trace.WithAttributes(vmAttributes(f.ID, f.opts)...))
+	defer span.End()
+
+	// the console was closed when the vm exited, the new one picks up where its log ends
+	f.opts.Console = nil
+
+	next, err := f.opts.createVMM(ctx, f.ID)
+	if err != nil {
+		endSpan(span, err)
+		err = fmt.Errorf("failed to create vm: %v", err)
+		f.emitError(err)
+		return nil, err
+	}
+	next.restarts = f.restarts
+
+	next, err = StartVm(ctx, next)
+	if err != nil {
+		endSpan(span, err)
+		return nil, err
+	}
+
+	if !replaceVm(f, next) {
+		next.discard()
+		return nil, fmt.Errorf("%w: the vm %s was deleted while booting", errVmState, f.ID)
+	}
+
+	return next, nil
+}
+
+// discard brings down the vm booted again after the vm it replaces was deleted, the deleted vm
+// gives the vm index back once it returns
+func (f *Firecracker) discard() {
+	f.shutdown(context.Background(), conf.ShutdownTimeout)
+}
+
+// deleteVm removes the vm from runVms, shutting it down in the background when it still runs
+func deleteVm(f *Firecracker) {
+	// f may have been booted again since it was looked up, the current vm is the one to delete
+	if f = takeVm(f.ID); f == nil {
+		return
+	}
+
+	f.mu.Lock()
+	f.stopping, f.deleted = true, true
+	state := f.state
+	f.mu.Unlock()
+
+	// the vm index is given back once nothing uses the tap device anymore: right away for exited
+	// vms, after the shutdown of started ones, paused ones included, and by the restart in progress
+	// of restarting ones
+	switch state {
+	case StateStarted:
+		go func() {
+			f.shutdown(context.Background(), conf.ShutdownTimeout)
+			releaseVmIndex(f.opts.VmIndex)
+		}()
+	case StateRestarting:
+	default:
+		releaseVmIndex(f.opts.VmIndex)
+	}
+
+	f.opts.ClearNetwork()
+	vmDeletes.Inc()
+	f.emit(EventDeleted)
+}
+
+// vmResource is the vm f as shown by the api
+func vmResource(f *Firecracker) CreateResponse {
+	pid, _ := f.PID()
+	balloon := f.balloonState()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	vm := CreateResponse{
+		ID:     f.ID,
+		PID:    int64(pid),
+		Name:   f.opts.Name,
+		Image:  f.opts.ProvidedImage,
+		Tenant: f.opts.Tenant,
+		State:  f.statusLocked(),
+		IpAddr: f.opts.FcIP,
+		Agent:  f.Agent,
+
+		ExitCode:      f.exitCode,
+		RestartCount:  f.restarts,
+		RestartPolicy: f.opts.RestartPolicy,
+		Kernel:        f.opts.Kernel,
+		VCPUs:         f.opts.FcCPUCount,
+		MemoryMiB:     f.opts.FcMemSz,
+		Volumes:       f.opts.Volumes,
+		RateLimits:    f.opts.RateLimits,
+		Balloon:       balloon,
+		Ports:         f.opts.Ports,
+		Network:       f.opts.Network,
+	}
+	if f.opts.Applied != nil {
+		vm.Environment = f.opts.Applied.Environment
+	}
+	return vm
+}
@@ -0,0 +1,93 @@
+// logging file is used to configure the daemon logger and hand out loggers tagged with the
+// request or the vm they log about. The level and format can be changed while running.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	lgg "github.com/sirupsen/logrus"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+// daemonLogger is the logger everything goes through, the logrus standard one so that the
+// package level log calls and the loggers derived from it all follow configureLogging
+var daemonLogger = lgg.StandardLogger()
+
+// loggingMu guards conf.LogLevel and conf.LogFormat, the api changes them while the daemon runs
+var loggingMu sync.Mutex
+
+// configureLogging sets the level and the format, json or text, of the daemon logger
+func configureLogging(level, format string) error {
+	lvl, err := lgg.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	var formatter lgg.Formatter
+	switch format {
+	case "json":
+		formatter = &lgg.JSONFormatter{}
+	case "text":
+		formatter = &lgg.TextFormatter{FullTimestamp: true}
+	default:
+		return fmt.Errorf("unknown log format %q, use json or text", format)
+	}
+
+	loggingMu.Lock()
+	defer loggingMu.Unlock()
+
+	daemonLogger.SetFormatter(formatter)
+	daemonLogger.SetLevel(lvl)
+	conf.LogLevel, conf.LogFormat = lvl.String(), format
+
+	return nil
+}
+
+// loggingConfig is the level and the format of the daemon logs in use
+func loggingConfig() LoggingConfig {
+	loggingMu.Lock()
+	defer loggingMu.Unlock()
+
+	return LoggingConfig{Level: conf.LogLevel, Format: conf.LogFormat}
+}
+
+// vmLogger is the logger of the vm id, the sdk logs of the vm go through it as well
+func vmLogger(id string, o *options) *lgg.Entry {
+	return daemonLogger.WithFields(lgg.Fields{
+		"vm_id": id,
+		"name":  o.Name,
+		"tap":   o.Tap,
+		"ip":    o.FcIP,
+	})
+}
+
+// For getting the level and format of the daemon logs
+func GetLoggingHandler(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, http.StatusOK, loggingConfig())
+}
+
+// For changing the level or the format of the daemon logs while it runs
+func SetLoggingHandler(w http.ResponseWriter, r *http.Request) {
+
+	defer r.Body.Close()
+
+	in := loggingConfig()
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeMessage(w, http.StatusBadRequest, fmt.Sprintf("error during reading passed request body: %v", err))
+		return
+	}
+
+	if err := configureLogging(in.Level, in.Format); err != nil {
+		writeMessage(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	out := loggingConfig()
+	ctxGetLogger(r.Context()).Infof("logging set to level %s in %s", out.Level, out.Format)
+
+	writeResponse(w, http.StatusOK, out)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	lgg "github.com/sirupsen/logrus"
+)
+
+// TestLoggingConcurrent is meant to be run with -race, the logging api is used while it changes
+func TestLoggingConcurrent(t *testing.T) {
+	saved := loggingConfig()
+	defer configureLogging(saved.Level, saved.Format)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		format := []string{"json", "text"}[i%2]
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				r := httptest.NewRequest("PUT", "/api/logging", strings.NewReader(`{"level":"info","format":"`+format+`"}`))
+				r = r.WithContext(ctxSetLogger(r.Context(), lgg.NewEntry(lgg.New())))
+				w := httptest.NewRecorder()
+				SetLoggingHandler(w, r)
+				if w.Code != http.StatusOK {
+					t.Errorf("got %d: %s", w.Code, w.Body)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				w := httptest.NewRecorder()
+				GetLoggingHandler(w, httptest.NewRequest("GET", "/api/logging", nil))
+				var got LoggingConfig
+				if err := json.NewDecoder(w.Body).Decode(&got); err != nil || got.Level == "" || got.Format == "" {
+					t.Errorf("got %+v, %v", got, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := loggingConfig(); got.Level != "info" {
+		t.Fatalf("the level is %s", got.Level)
+	}
+}
@@ -2,36 +2,57 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"io"
 	"net"
-	"os"
-	"os/signal"
+	"os/exec"
+	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
 
 	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/iradukunda1/firecrackerland/cmd/initrd/agent"
+	"github.com/iradukunda1/firecrackerland/cmd/initrd/mmds"
 	llg "github.com/sirupsen/logrus"
 )
 
-// vmState this kind of vm-machine status
-type VmState string
-
-// avaliable vmState kind status
-const (
-	StateCreated VmState = "created"
-	StateStarted VmState = "started"
-	StateFailed  VmState = "failed"
-	// StatePending VmState = "pending"
-)
-
 type Firecracker struct {
+	ID        string
 	Name      string
 	ctx       context.Context
 	cancelCtx context.CancelFunc
 	vm        *firecracker.Machine
-	state     VmState
 	Agent     net.IP
+	opts      *options
+	rootDir   string
+	console   *vmConsole
+	agent     *agent.Client
+
+	exitListener net.Listener
+	restarts     int
+
+	// mu guards the state of the vm, which its monitor changes while the api reads it
+	mu       sync.Mutex
+	state    VmState
+	exitCode *int
+	// stopping is set when the vm is stopped on purpose, it is not restarted then
+	stopping bool
+	// deleted is set once the vm is deleted, the one bringing it down gives its vm index back
+	deleted bool
+	paused  bool
+	// pid of firecracker when it was started by a previous run of the daemon, the sdk
+	// only knows about the processes it started itself
+	pid int
+	// owner of the sockets firecracker connects to
+	uid, gid int
+
+	balloonMu    sync.Mutex
+	balloonStats *BalloonStats
+	// reclaimed is set while the balloon is inflated by the reclaim policy
+	reclaimed bool
+
+	fifos   []io.Closer
+	metrics *vmMetrics
 }
 
 type options struct {
@@ -40,8 +61,13 @@ type options struct {
 	ApiSocket      string `long:"socket-path" short:"s" description:"path to use for firecracker socket"`
 	IpId           byte   `byte:"id" description:"an ip we use to generate an ip address"`
 	FcBinary       string `long:"firecracker-binary" description:"Path to firecracker binary"`
+	Name           string `long:"name" description:"Name the vm was created with"`
+	Tenant         string `long:"tenant" description:"Tenant owning the vm"`
+	Kernel         string `long:"kernel-name" description:"Name of the kernel in the registry"`
 	FcKernelImage  string `long:"kernel" description:"Path to the kernel image"`
 	KernelBootArgs string `long:"kernel-opts" description:"Kernel commandline"`
+	Initrd         string `long:"initrd-name" description:"Name of the initrd in the registry"`
+	FcInitrd       string `long:"initrd" description:"Path to the initrd"`
 	RootFsImage    string `long:"root-drive" description:"Path to root disk image"`
 	TapMacAddr     string `long:"tap-mac-addr" description:"tap macaddress"`
 	Tap            string `long:"tap-dev" description:"tap device"`
@@ -53,7 +79,23 @@ type options struct {
 	InitBaseTar   string `long:"init-base-tar" description:"init-base-tar is our init base image file"`                                                                                                   // make sure that this file is currently exists in the current directory by running task extract-init-base-tar
 	ProvidedImage string `long:"provided-image" description:"provided-image is the image that we want to run in the VM"`
 	InitdPath     string `long:"initd-path" description:"initd-path is the path to the init binary file"`
-	Logger        *llg.Logger
+	ImageConfig   *mmds.ContainerRuntimeConfig
+	AgentToken    string
+	Console       *vmConsole `json:"-"`
+	RestartPolicy *RestartPolicy
+	Volumes       []VolumeMount
+	RateLimits    *RateLimits
+	FcLogFifo     string
+	FcMetricsFifo string
+	Balloon       *BalloonConfig
+	// Env and Command override the runtime config of the image
+	Env     []string
+	Command []string
+	Ports   []PortMapping
+	Network NetworkMode
+	// Applied is the spec the vm was created from, nil for vms created on their own
+	Applied *appliedSpec
+	Logger  *llg.Entry `json:"-"`
 }
 
 // JailingFirecrackerConfig represents Jailerspecific configuration options.
@@ -73,45 +115,111 @@ type JailingFirecrackerConfig struct {
 	VmmID string
 }
 
-func installSignalHandlers(ctx context.Context, m *firecracker.Machine) {
-
-	log := llg.New()
-
-	go func() {
-		// Clear some default handlers installed by the firecracker SDK:
-		signal.Reset(os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
-
-		for {
-			switch s := <-c; {
-			case s == syscall.SIGTERM || s == os.Interrupt:
-				fmt.Println("Caught SIGTERM, requesting clean shutdown")
-				if err := m.Shutdown(ctx); err != nil {
-					log.Errorf("Machine shutdown failed with error: %v", err)
-				}
-				time.Sleep(20 * time.Second)
-
-				// There's no direct way of checking if a VM is running, so we test if we can send it another shutdown
-				// request. If that fails, the VM is still running and we need to kill it.
-				if err := m.Shutdown(ctx); err == nil {
-					fmt.Println("Timeout exceeded, forcing shutdown") // TODO: Proper logging
-					if err := m.StopVMM(); err != nil {
-						log.Errorf("VMM stop failed with error: %v", err)
-					}
-				}
-			case s == syscall.SIGQUIT:
-				fmt.Println("Caught SIGQUIT, forcing shutdown")
-				if err := m.StopVMM(); err != nil {
-					log.Errorf("VMM stop failed with error: %v", err)
-				}
-			}
+// chrootPath returns the host path of a file firecracker refers to relative to its root
+func (f *Firecracker) chrootPath(name string) string {
+	return filepath.Join(f.rootDir, name)
+}
+
+// jailRoot returns the host directory the jailer chroots firecracker into
+func jailRoot(jailer *firecracker.JailerConfig) string {
+	return filepath.Join(jailer.ChrootBaseDir, filepath.Base(jailer.ExecFile), jailer.ID, "root")
+}
+
+// jailerCommand is the jailer command the sdk builds for cfg, started in a session of its own.
+// Without daemonizing, firecracker would otherwise stay in the process group of the daemon and
+// get the signals a supervisor sends it, killing the vms -leave-running should keep.
+func jailerCommand(ctx context.Context, cfg firecracker.Config) *exec.Cmd {
+	j := cfg.JailerCfg
+
+	socket := cfg.SocketPath
+	if socket == "" {
+		socket = "/run/firecracker.socket"
+	}
+	args := []string{"--api-sock", socket}
+	if !cfg.Seccomp.Enabled {
+		args = append([]string{"--no-seccomp"}, args...)
+	} else if cfg.Seccomp.Filter != "" {
+		args = append([]string{"--seccomp-filter", cfg.Seccomp.Filter}, args...)
+	}
+
+	builder := firecracker.NewJailerCommandBuilder().
+		WithBin(j.JailerBinary).
+		WithID(j.ID).
+		WithUID(*j.UID).
+		WithGID(*j.GID).
+		WithNumaNode(*j.NumaNode).
+		WithExecFile(j.ExecFile).
+		WithChrootBaseDir(j.ChrootBaseDir).
+		WithDaemonize(j.Daemonize).
+		WithCgroupVersion(j.CgroupVersion).
+		WithFirecrackerArgs(args...).
+		WithStdout(j.Stdout).
+		WithStderr(j.Stderr).
+		WithStdin(j.Stdin)
+	if cfg.NetNS != "" {
+		builder = builder.WithNetNS(cfg.NetNS)
+	}
+
+	cmd := builder.Build(ctx)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	return cmd
+}
+
+// PID returns the pid of firecracker
+func (f *Firecracker) PID() (int, error) {
+	if f.pid != 0 {
+		return f.pid, nil
+	}
+	return f.vm.PID()
+}
+
+// wait returns once firecracker has exited or ctx is done
+func (f *Firecracker) wait(ctx context.Context) error {
+	if f.pid == 0 {
+		return f.vm.Wait(ctx)
+	}
+
+	// a reattached firecracker is not our child, all there is to do is to watch it
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for processAlive(f.pid) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
 		}
-	}()
+	}
+
+	return nil
 }
 
-func Cleanup() {
-	for _, run := range runVms {
-		run.vm.StopVMM()
+// stopVMM kills firecracker
+func (f *Firecracker) stopVMM() error {
+	if f.pid == 0 {
+		return f.vm.StopVMM()
 	}
+
+	if err := syscall.Kill(f.pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
+
+// monitor waits for firecracker to exit and deals with the end of the vm
+func (f *Firecracker) monitor() {
+	stop := make(chan struct{})
+	go f.pollBalloon(stop)
+
+	f.wait(f.ctx)
+	close(stop)
+	f.closeFifos()
+	f.closeExit()
+	f.exited()
+}
+
+// processAlive tells whether the process pid still exists
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
 }
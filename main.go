@@ -2,83 +2,206 @@ package main
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/cors"
 	lgg "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/sync/errgroup"
 )
 
 func main() {
 
+	parseFlags()
+
+	daemonLogger.SetOutput(os.Stdout)
+	if err := configureLogging(conf.LogLevel, conf.LogFormat); err != nil {
+		lgg.Fatal(err)
+	}
+
+	if conf.AuthConfig != "" {
+		if err := loadAuth(conf.AuthConfig); err != nil {
+			lgg.Fatal(err)
+		}
+	}
+
+	if conf.Quotas != "" {
+		if err := loadQuotas(conf.Quotas); err != nil {
+			lgg.Fatal(err)
+		}
+	}
+
+	if conf.Webhooks != "" {
+		if err := loadWebhooks(conf.Webhooks); err != nil {
+			lgg.Fatal(err)
+		}
+	}
+
+	if conf.KernelRegistry != "" {
+		if err := loadKernels(conf.KernelRegistry); err != nil {
+			lgg.Fatal(err)
+		}
+	}
+
+	reattachVMs()
+
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-	lg := lgg.New()
+	shutdownTracing, err := setupTracing(ctx)
+	if err != nil {
+		lgg.Fatal(err)
+	}
+	defer func() {
+		flushCtx, done := context.WithTimeout(context.Background(), 5*time.Second)
+		defer done()
+		shutdownTracing(flushCtx)
+	}()
 
-	lg.SetFormatter(&lgg.JSONFormatter{})
-	lg.SetOutput(os.Stdout)
-	lg.SetLevel(lgg.DebugLevel)
+	lg := daemonLogger
 
 	r := chi.NewMux()
 	r.Use(corsHandler)
 	r.Use(middleware.Recoverer)
+	r.Use(traceRequests)
 	r.Use(includeLogger(lg))
+	r.Use(measureRequests)
 	r.Mount("/api", handler())
+	r.Handle("/metrics", metricsHandler())
 
-	lg.Infof("Listening on port 8080")
+	srv := &http.Server{Addr: conf.ListenAddr, Handler: r, ConnContext: markLocal}
+
+	tlsConf, certs, err := apiTLSConfig()
+	if err != nil {
+		lgg.Fatal(err)
+	}
+	srv.TLSConfig = tlsConf
+
+	var listeners []net.Listener
+	if conf.ListenAddr != "" {
+		ln, err := net.Listen("tcp", conf.ListenAddr)
+		if err != nil {
+			lgg.Fatal(err)
+		}
+		listeners = append(listeners, ln)
+	}
+	if conf.UnixSocket != "" {
+		ln, err := listenUnix(conf.UnixSocket, conf.UnixSocketMode, conf.UnixSocketGroup)
+		if err != nil {
+			lgg.Fatal(err)
+		}
+		listeners = append(listeners, ln)
+	}
+	if len(listeners) == 0 {
+		lgg.Fatal("nothing to listen on, set -listen or -unix-socket")
+	}
+
+	for _, ln := range listeners {
+		lg.Infof("Listening on %s", ln.Addr())
+	}
 
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt)
-	defer func() {
-		signal.Stop(signalChan)
-		cancel()
-	}()
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signalChan)
+
+	// the first signal shuts down gracefully, a second one kills the vms right away
+	force, forceCancel := context.WithCancel(context.Background())
+	defer forceCancel()
 
 	go func() {
 		select {
-		case <-signalChan: // first signal, cancel context
+		case <-signalChan:
 			cancel()
 		case <-ctx.Done():
+			return
 		}
-		<-signalChan // second signal, hard exit
-		os.Exit(1)
+		<-signalChan
+		lg.Warnln("forcing shutdown")
+		forceCancel()
 	}()
 
-	// for killing all running VMs
-	defer func() {
-		Cleanup()
-		cancel()
-	}()
+	g, gctx := errgroup.WithContext(ctx)
+
+	if conf.ReclaimThreshold > 0 {
+		go reclaimMemory(gctx)
+	}
+
+	runWebhooks(gctx)
 
-	g := errgroup.Group{}
+	if certs != nil {
+		go certs.watch(gctx, conf.TLSReload)
+	}
+
+	for _, ln := range listeners {
+		ln := ln
+		g.Go(func() error {
+			return serveAPI(srv, ln)
+		})
+	}
 
 	g.Go(func() error {
-		return http.ListenAndServe(":8080", r)
-	})
+		<-gctx.Done()
+
+		lg.Infoln("shutting down app")
+
+		// streams such as followed consoles never end on their own, do not wait on them for long
+		shutdownCtx, done := context.WithTimeout(force, 5*time.Second)
+		defer done()
+		srv.Shutdown(shutdownCtx)
 
-	<-ctx.Done()
+		if conf.LeaveRunning {
+			lg.Infof("leaving %d vms running", countVms())
+			return nil
+		}
 
-	lg.Infoln("shutting down app")
+		shutdownVMs(force, conf.ShutdownTimeout)
+		return nil
+	})
 
 	if err := g.Wait(); err != nil {
-		lg.Fatal("main: runtime program terminated")
+		lg.Fatalf("main: runtime program terminated: %v", err)
 	}
 }
 
-// include context with logger in http server for downstream use
+// include context with logger in http server for downstream use, the logger is tagged
+// with the id of the request, taken from the client when it sent one, and with its trace
 func includeLogger(lg *lgg.Logger) Middleware {
 
 	return func(next http.Handler) http.Handler {
 
 		f := func(w http.ResponseWriter, r *http.Request) {
 
-			r = r.WithContext(ctxSetLogger(r.Context(), lg))
+			id := r.Header.Get(requestIDHeader)
+			if id == "" {
+				id = uuid()
+			}
+			w.Header().Set(requestIDHeader, id)
+
+			entry := lg.WithField("request_id", id)
+			if sc := trace.SpanContextFromContext(r.Context()); sc.HasTraceID() {
+				entry = entry.WithField("trace_id", sc.TraceID().String())
+			}
+
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+			r = r.WithContext(ctxSetLogger(r.Context(), entry))
+
+			next.ServeHTTP(ww, r)
 
-			next.ServeHTTP(w, r)
+			entry.WithFields(lgg.Fields{
+				"method":   r.Method,
+				"path":     r.URL.Path,
+				"status":   ww.Status(),
+				"duration": time.Since(start).String(),
+			}).Debug("request served")
 		}
 
 		return http.HandlerFunc(f)
@@ -87,9 +210,9 @@ func includeLogger(lg *lgg.Logger) Middleware {
 
 var corsHandler = cors.Handler(cors.Options{
 	AllowedOrigins:   []string{"*"},
-	AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-	AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-	ExposedHeaders:   []string{"Link"},
+	AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+	AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", requestIDHeader},
+	ExposedHeaders:   []string{"Link", requestIDHeader},
 	AllowCredentials: false,
 	MaxAge:           300,
 })
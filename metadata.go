@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/iradukunda1/firecrackerland/cmd/initrd/agent"
+	"github.com/iradukunda1/firecrackerland/cmd/initrd/mmds"
+)
+
+const (
+	// agentSocket is the host side of the vm vsock, relative to the firecracker root
+	agentSocket = "agent.sock"
+	// agentCID is the guest context id, every vm has its own vsock device so it can be shared
+	agentCID = 3
+)
+
+// vmMetadata is the MMDS document the initrd reads while booting
+type vmMetadata struct {
+	IPConfig      mmds.MMDSIPConfig            `json:"ipconfig"`
+	RuntimeConfig *mmds.ContainerRuntimeConfig `json:"runtimeConfig"`
+	Agent         mmds.AgentConfig             `json:"agent"`
+	Volumes       []mmds.VolumeConfig          `json:"volumes"`
+}
+
+// metadata builds the MMDS document of the vm described by the options
+func (o *options) metadata() vmMetadata {
+	volumes := make([]mmds.VolumeConfig, 0, len(o.Volumes))
+	for i, v := range o.Volumes {
+		volumes = append(volumes, mmds.VolumeConfig{
+			Device:     volumeDevice(i),
+			MountPoint: v.MountPoint,
+			ReadOnly:   v.ReadOnly,
+		})
+	}
+
+	return vmMetadata{
+		IPConfig: mmds.MMDSIPConfig{
+			IPCIDR:       o.FcIP + "/24",
+			PrimaryDNS:   "8.8.8.8",
+			SecondaryDNS: "1.1.1.1",
+			Routes: []mmds.MMDSRoute{
+				{Gw: gatewayIP, Network: "0.0.0.0/0"},
+			},
+		},
+		RuntimeConfig: o.ImageConfig,
+		Agent: mmds.AgentConfig{
+			Token:    o.AgentToken,
+			Port:     agent.DefaultPort,
+			ExitPort: agent.DefaultExitPort,
+		},
+		Volumes: volumes,
+	}
+}
@@ -0,0 +1,129 @@
+// metrics file is used to expose the prometheus metrics of the daemon itself: what it did
+// to vms, how long it took and what the running vms hold on to.
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// registry holds the metrics of the daemon, served on /metrics
+var registry = prometheus.NewRegistry()
+
+var (
+	vmCreates = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "fcland_vm_creates_total",
+		Help: "VMs created and started.",
+	})
+	vmDeletes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "fcland_vm_deletes_total",
+		Help: "VMs deleted.",
+	})
+	vmFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fcland_vm_failures_total",
+		Help: "VMs which could not be brought up, by the stage which failed.",
+	}, []string{"stage"})
+
+	rootfsBuildSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "fcland_rootfs_build_seconds",
+		Help:    "Time taken to build the rootfs of a VM out of its docker image.",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 10),
+	})
+	bootSeconds = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "fcland_vm_boot_seconds",
+		Help:    "Time taken by firecracker to start a VM.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	})
+	snapshotSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "fcland_snapshot_duration_seconds",
+		Help:    "Time taken to create, export, load or restore snapshots.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"op"})
+	httpSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "fcland_http_request_duration_seconds",
+		Help:    "Time taken to serve api requests, by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "code"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		vmCreates, vmDeletes, vmFailures,
+		rootfsBuildSeconds, bootSeconds, snapshotSeconds, httpSeconds,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "fcland_vms_running",
+			Help: "VMs currently running.",
+		}, func() float64 { return float64(runningUsage().vms) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "fcland_vm_memory_mib",
+			Help: "Memory allocated to the running VMs, in MiB.",
+		}, func() float64 { return float64(runningUsage().memMiB) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "fcland_vm_vcpus",
+			Help: "vCPUs allocated to the running VMs.",
+		}, func() float64 { return float64(runningUsage().vcpus) }),
+	)
+}
+
+// usage sums up what vms hold on to
+type usage struct {
+	vms    int
+	memMiB int64
+	vcpus  int64
+}
+
+// runningUsage is the usage of the vms which are started
+func runningUsage() usage {
+	var u usage
+	for _, m := range listVms() {
+		if m.currentState() != StateStarted {
+			continue
+		}
+		u.vms++
+		u.memMiB += m.opts.FcMemSz
+		u.vcpus += m.opts.FcCPUCount
+	}
+	return u
+}
+
+// observeSince records the time elapsed since start in h
+func observeSince(h prometheus.Observer, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// metricsHandler serves the metrics of the daemon. They tell about the vms of every tenant,
+// so only admins may scrape them once authentication is set up.
+func metricsHandler() http.Handler {
+	return requireAuth(requireAdmin(promhttp.HandlerFor(registry, promhttp.HandlerOpts{})))
+}
+
+// measureRequests records the latency of every request under the pattern of the route it matched,
+// so vm ids do not end up in the labels
+func measureRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		httpSeconds.WithLabelValues(r.Method, route, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+	lgg "github.com/sirupsen/logrus"
+)
+
+func TestMetricsAuth(t *testing.T) {
+	saved := auth
+	defer func() { auth = saved }()
+
+	token := func(s string) *apiToken {
+		sum := sha256.Sum256([]byte(s))
+		return &apiToken{SHA256: hex.EncodeToString(sum[:]), Tenant: s}
+	}
+	configured := &authConfig{Tokens: []*apiToken{token("acme"), token("ops")}, Admins: []string{"ops"}}
+
+	for _, c := range []struct {
+		name   string
+		auth   *authConfig
+		token  string
+		status int
+	}{
+		{"no authentication", nil, "", http.StatusOK},
+		{"anonymous", configured, "", http.StatusUnauthorized},
+		{"tenant", configured, "acme", http.StatusForbidden},
+		{"admin", configured, "ops", http.StatusOK},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			auth = c.auth
+			r := httptest.NewRequest("GET", "/metrics", nil)
+			r = r.WithContext(ctxSetLogger(r.Context(), lgg.NewEntry(lgg.New())))
+			if c.token != "" {
+				r.Header.Set("Authorization", "Bearer "+c.token)
+			}
+			w := httptest.NewRecorder()
+			metricsHandler().ServeHTTP(w, r)
+			if w.Code != c.status {
+				t.Fatalf("got %d, want %d", w.Code, c.status)
+			}
+		})
+	}
+}
+
+// scrapeMetrics returns the value of every series /metrics serves, by series
+func scrapeMetrics(t *testing.T) map[string]float64 {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r = r.WithContext(ctxSetLogger(r.Context(), lgg.NewEntry(lgg.New())))
+	w := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, r)
+
+	series := make(map[string]float64)
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		i := strings.LastIndex(line, " ")
+		if strings.HasPrefix(line, "#") || i < 0 {
+			continue
+		}
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("invalid series %q", line)
+		}
+		series[line[:i]] = v
+	}
+	return series
+}
+
+func TestMeasureRequests(t *testing.T) {
+	saved := auth
+	defer func() { auth = saved }()
+	auth = nil
+
+	requests := `fcland_http_request_duration_seconds_count{code="404",method="GET",route="/api/vms/{vm_id}"}`
+	before := scrapeMetrics(t)[requests]
+
+	r := chi.NewRouter()
+	r.Use(measureRequests)
+	r.Get("/api/vms/{vm_id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	for _, id := range []string{"vm-1", "vm-2"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/vms/"+id, nil))
+	}
+
+	// the running vms are counted, those which exited are not
+	for i, state := range []VmState{StateStarted, StateStarted, StateExited} {
+		m := testVm(t, fmt.Sprintf("measured-%d", i), 0, state)
+		putVm(m)
+		defer takeVm(m.ID)
+	}
+
+	after := scrapeMetrics(t)
+	for series, want := range map[string]float64{
+		requests:               before + 2,
+		"fcland_vms_running":   2,
+		"fcland_vm_vcpus":      2,
+		"fcland_vm_memory_mib": 512,
+	} {
+		if got := after[series]; got != want {
+			t.Errorf("%s is %v, want %v", series, got, want)
+		}
+	}
+	for series := range after {
+		if strings.Contains(series, "vm-1") {
+			t.Errorf("a vm id ended up in the labels of %s", series)
+		}
+	}
+}
@@ -1,6 +1,19 @@
 package main
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
+
+// errPortInUse is returned when a host port is already published by another vm
+var errPortInUse = errors.New("port is already published")
+
+// iptablesRule is a rule of chain in table, args match the packets and tell what to do with them
+type iptablesRule struct {
+	table string
+	chain string
+	args  string
+}
 
 func (o *options) SetNetwork() error {
 
@@ -57,6 +70,108 @@ func (o *options) SetNetwork() error {
 		return fmt.Errorf("failed to add iptables rule to forward packets from eth0 to tap: %v", err)
 	}
 
+	// the rules publishing ports and isolating the vm are kept across its restarts, so only missing ones are added
+	for _, rule := range o.iptablesRules() {
+		if _, err := RunSudo(fmt.Sprintf("iptables -t %s -C %s %s 2> /dev/null", rule.table, rule.chain, rule.args)); err == nil {
+			continue
+		}
+		if _, err := RunSudo(fmt.Sprintf("iptables -t %s -I %s %s", rule.table, rule.chain, rule.args)); err != nil {
+			return fmt.Errorf("failed to add iptables rule %s %s: %v", rule.chain, rule.args, err)
+		}
+	}
+
 	return nil
 
 }
+
+// ClearNetwork removes the rules publishing the ports of the vm and isolating it
+func (o *options) ClearNetwork() {
+	for _, rule := range o.iptablesRules() {
+		if _, err := RunSudo(fmt.Sprintf("iptables -t %s -D %s %s 2> /dev/null", rule.table, rule.chain, rule.args)); err != nil {
+			o.Logger.Warnf("failed to remove iptables rule %s %s: %v", rule.chain, rule.args, err)
+		}
+	}
+}
+
+// removeTap deletes the tap device of the vm
+func (o *options) removeTap() {
+	if _, err := RunSudo(fmt.Sprintf("ip link del %s 2> /dev/null || true", o.Tap)); err != nil {
+		o.Logger.Warnf("failed to remove tap device %s: %v", o.Tap, err)
+	}
+}
+
+// iptablesRules are the rules publishing the ports of the vm, and keeping it from opening
+// connections when it is isolated
+func (o *options) iptablesRules() []iptablesRule {
+	var rules []iptablesRule
+	if o.Network == NetworkIsolated {
+		// replies to the published ports are still let through by the RELATED,ESTABLISHED rule
+		rules = append(rules, iptablesRule{"filter", "FORWARD", fmt.Sprintf("-i %s -m conntrack --ctstate NEW -j DROP", o.Tap)})
+	}
+	for _, p := range o.Ports {
+		proto := portProtocol(p)
+		to := fmt.Sprintf("%s:%d", o.FcIP, p.GuestPort)
+		rules = append(rules,
+			// from other hosts, and from the host itself to one of its addresses
+			iptablesRule{"nat", "PREROUTING", fmt.Sprintf("-p %s --dport %d -m addrtype --dst-type LOCAL -j DNAT --to-destination %s", proto, p.HostPort, to)},
+			iptablesRule{"nat", "OUTPUT", fmt.Sprintf("-p %s --dport %d -m addrtype --dst-type LOCAL -j DNAT --to-destination %s", proto, p.HostPort, to)},
+			iptablesRule{"filter", "FORWARD", fmt.Sprintf("-o %s -p %s -d %s --dport %d -j ACCEPT", o.Tap, proto, o.FcIP, p.GuestPort)},
+		)
+	}
+	return rules
+}
+
+// portProtocol is the protocol of p, tcp when not given
+func portProtocol(p PortMapping) string {
+	if p.Protocol == "" {
+		return "tcp"
+	}
+	return p.Protocol
+}
+
+// validateNetwork checks the network mode and the ports of a vm
+func validateNetwork(mode NetworkMode, ports []PortMapping) error {
+	if mode != "" && mode != NetworkNAT && mode != NetworkIsolated {
+		return fmt.Errorf("%w: unknown network %q, use %s or %s", errInvalidRequest, mode, NetworkNAT, NetworkIsolated)
+	}
+
+	published := make(map[string]bool)
+	for _, p := range ports {
+		if p.HostPort < 1 || p.HostPort > 65535 || p.GuestPort < 1 || p.GuestPort > 65535 {
+			return fmt.Errorf("%w: ports must be between 1 and 65535", errInvalidRequest)
+		}
+		proto := portProtocol(p)
+		if proto != "tcp" && proto != "udp" {
+			return fmt.Errorf("%w: unknown protocol %q, use tcp or udp", errInvalidRequest, p.Protocol)
+		}
+		if published[portKey(p)] {
+			return fmt.Errorf("%w: host port %s is published twice", errInvalidRequest, portKey(p))
+		}
+		published[portKey(p)] = true
+	}
+
+	return nil
+}
+
+// checkPortsFree makes sure no vm publishes the host ports of ports already, but the vm except
+// which is about to be replaced
+func checkPortsFree(ports []PortMapping, except *Firecracker) error {
+	for _, vm := range listVms() {
+		if vm == except {
+			continue
+		}
+		for _, published := range vm.opts.Ports {
+			for _, p := range ports {
+				if portKey(p) == portKey(published) {
+					return fmt.Errorf("%w: host port %s is published by the vm %s", errPortInUse, portKey(p), vm.ID)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// portKey is the host side of p, such as 8080/tcp
+func portKey(p PortMapping) string {
+	return fmt.Sprintf("%d/%s", p.HostPort, portProtocol(p))
+}
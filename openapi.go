@@ -0,0 +1,250 @@
+// openapi file is used to describe the versioned api as an OpenAPI document, built from the
+// route table the router is built from and from the request and response types of the handlers.
+package main
+
+import (
+	"net"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiRoute is a route of the versioned api
+type apiRoute struct {
+	ID      string
+	Method  string
+	Pattern string
+	Handler http.HandlerFunc
+	Summary string
+	// Admin routes are only served to admins
+	Admin bool
+	Query []apiParam
+	// Request is a value of the type of the json body, RequestType the content type of other bodies.
+	// When both are set, the body of RequestType holds the same document as the json one.
+	Request     interface{}
+	RequestType string
+	// Status is the status of success, Response a value of the type of its json body and
+	// ResponseType the content type of other bodies
+	Status       int
+	Response     interface{}
+	ResponseType string
+}
+
+// apiParam is a query parameter of a route, Type is a json schema type
+type apiParam struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+// schemaNames rename the types whose go name does not suit the api
+var schemaNames = map[reflect.Type]string{
+	reflect.TypeOf(CreateResponse{}): "Vm",
+}
+
+// schemaEnums are the values of the string types only taking a few
+var schemaEnums = map[reflect.Type][]string{
+	reflect.TypeOf(VmState("")): {
+		string(StateCreated), string(StateStarted), string(StatePaused), string(StateRestarting),
+		string(StateExited), string(StateFailed),
+	},
+	reflect.TypeOf(NetworkMode("")): {string(NetworkNAT), string(NetworkIsolated)},
+	reflect.TypeOf(ApplyAction("")): {
+		string(ApplyCreate), string(ApplyUpdate), string(ApplyReplace), string(ApplyStart),
+		string(ApplyDelete), string(ApplyUnchanged),
+	},
+}
+
+var pathParamPattern = regexp.MustCompile(`\{([^}]+)\}`)
+
+// openAPI is the OpenAPI 3 document of routes served under prefix
+func openAPI(routes []apiRoute, prefix string) map[string]interface{} {
+	schemas := make(map[string]interface{})
+	paths := make(map[string]interface{})
+
+	for _, route := range routes {
+		op := map[string]interface{}{
+			"operationId": route.ID,
+			"summary":     route.Summary,
+		}
+
+		var params []interface{}
+		for _, name := range pathParamPattern.FindAllStringSubmatch(route.Pattern, -1) {
+			params = append(params, map[string]interface{}{
+				"name": name[1], "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		for _, q := range route.Query {
+			params = append(params, map[string]interface{}{
+				"name": q.Name, "in": "query", "description": q.Description, "schema": map[string]interface{}{"type": q.Type},
+			})
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+
+		if body := content(schemas, route.Request, route.RequestType); body != nil {
+			op["requestBody"] = map[string]interface{}{"required": true, "content": body}
+		}
+
+		success := map[string]interface{}{"description": http.StatusText(route.Status)}
+		if body := content(schemas, route.Response, route.ResponseType); body != nil {
+			success["content"] = body
+		}
+		op["responses"] = map[string]interface{}{
+			strconv.Itoa(route.Status): success,
+			"default": map[string]interface{}{
+				"description": "The error which occurred",
+				"content":     content(schemas, responseMessage{}, ""),
+			},
+		}
+		if route.Admin {
+			op["description"] = "Only admins may call this route."
+		}
+
+		path := prefix + route.Pattern
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			item = make(map[string]interface{})
+			paths[path] = item
+		}
+		item[strings.ToLower(route.Method)] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "fcland",
+			"version": "v1",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "An api token or a JWT, when the daemon runs with -auth-config",
+				},
+			},
+		},
+		"security": []interface{}{map[string]interface{}{"bearer": []string{}}},
+	}
+}
+
+// content describes a body holding v as json, or a body of contentType
+func content(schemas map[string]interface{}, v interface{}, contentType string) map[string]interface{} {
+	switch {
+	case v != nil:
+		body := map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schemaOf(schemas, reflect.TypeOf(v))},
+		}
+		if contentType != "" {
+			body[contentType] = body["application/json"]
+		}
+		return body
+	case contentType != "":
+		return map[string]interface{}{
+			contentType: map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}},
+		}
+	}
+	return nil
+}
+
+// schemaOf is the json schema of t, the structs it refers to are added to schemas
+func schemaOf(schemas map[string]interface{}, t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(net.IP{}):
+		return map[string]interface{}{"type": "string", "format": "ipv4"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		s := map[string]interface{}{"type": "string"}
+		if enum, ok := schemaEnums[t]; ok {
+			s["enum"] = enum
+		}
+		return s
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": schemaOf(schemas, t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(schemas, t.Elem())}
+	case reflect.Struct:
+		name := schemaName(t)
+		if _, ok := schemas[name]; !ok {
+			// set first so types referring to themselves end
+			schemas[name] = nil
+			schemas[name] = structSchema(schemas, t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+
+	return map[string]interface{}{}
+}
+
+// schemaName is the name of the struct t in the document
+func schemaName(t reflect.Type) string {
+	if name, ok := schemaNames[t]; ok {
+		return name
+	}
+	return strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+}
+
+// structSchema is the object schema of the struct t, fields are required when tagged validate:"required"
+func structSchema(schemas map[string]interface{}, t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	var required []string
+
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+
+			// embedded structs lend their fields, as encoding/json does
+			if field.Anonymous && tag == "" && field.Type.Kind() == reflect.Struct {
+				walk(field.Type)
+				continue
+			}
+			if !field.IsExported() || tag == "-" {
+				continue
+			}
+
+			name := strings.Split(tag, ",")[0]
+			if name == "" {
+				name = field.Name
+			}
+			props[name] = schemaOf(schemas, field.Type)
+			if strings.Contains(field.Tag.Get("validate"), "required") {
+				required = append(required, name)
+			}
+		}
+	}
+	walk(t)
+
+	s := map[string]interface{}{"type": "object", "properties": props}
+	if required != nil {
+		s["required"] = required
+	}
+	return s
+}
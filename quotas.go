@@ -0,0 +1,342 @@
+// quotas file is used to admit new vms only when their tenant stays within its quota and the
+// host has the cpus, memory, disk and ip addresses left to run them.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+var (
+	// errQuotaExceeded is returned when the tenant would go over its quota
+	errQuotaExceeded = errors.New("quota exceeded")
+	// errNoCapacity is returned when the host can not take the vm
+	errNoCapacity = errors.New("not enough capacity")
+	// errVmIndexInUse is returned when the vm index asked for is taken by another vm
+	errVmIndexInUse = errors.New("vm index in use")
+)
+
+// firstVmIndex is the first vm index, the addresses below it are left to the gateway
+const firstVmIndex = 4
+
+// maxVmIndex is the last vm index, the ip address of a vm ends with its index and .255 is the broadcast
+const maxVmIndex = 254
+
+// maxVCPUs is the most vcpus firecracker gives a vm
+const maxVCPUs = 32
+
+// minMemoryMiB is the least memory a vm boots with
+const minMemoryMiB = 128
+
+// quotaConfig is read from the file given by the -quotas flag. Tenants missing from Tenants get Default.
+type quotaConfig struct {
+	Default Resources            `json:"default"`
+	Tenants map[string]Resources `json:"tenants,omitempty"`
+}
+
+// quotas is the configuration in use, nil when tenants have no quota
+var quotas *quotaConfig
+
+// loadQuotas reads the quotas of the tenants from the file at path
+func loadQuotas(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read quotas: %v", err)
+	}
+
+	cfg := new(quotaConfig)
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("failed to decode quotas: %v", err)
+	}
+
+	if err := validateResources(cfg.Default); err != nil {
+		return fmt.Errorf("invalid default quota: %v", err)
+	}
+	for tenant, q := range cfg.Tenants {
+		if err := validateResources(q); err != nil {
+			return fmt.Errorf("invalid quota of tenant %s: %v", tenant, err)
+		}
+	}
+
+	quotas = cfg
+	return nil
+}
+
+// validateResources checks none of the limits of r is negative
+func validateResources(r Resources) error {
+	if r.VMs < 0 || r.VCPUs < 0 || r.MemoryMiB < 0 || r.DiskMiB < 0 {
+		return fmt.Errorf("limits can not be negative")
+	}
+	return nil
+}
+
+// quota is the quota of tenant, a zero limit means no limit
+func quota(tenant string) Resources {
+	if quotas == nil {
+		return Resources{}
+	}
+	if q, ok := quotas.Tenants[tenant]; ok {
+		return q
+	}
+	return quotas.Default
+}
+
+// addResources sums up r and o
+func addResources(r, o Resources) Resources {
+	return Resources{
+		VMs:       r.VMs + o.VMs,
+		VCPUs:     r.VCPUs + o.VCPUs,
+		MemoryMiB: r.MemoryMiB + o.MemoryMiB,
+		DiskMiB:   r.DiskMiB + o.DiskMiB,
+	}
+}
+
+// subResources takes o away from r
+func subResources(r, o Resources) Resources {
+	return addResources(r, Resources{VMs: -o.VMs, VCPUs: -o.VCPUs, MemoryMiB: -o.MemoryMiB, DiskMiB: -o.DiskMiB})
+}
+
+// exceeds names the first limit of limits r goes over, zero limits are ignored
+func exceeds(r, limits Resources) string {
+	switch {
+	case limits.VMs > 0 && r.VMs > limits.VMs:
+		return fmt.Sprintf("%d vms out of %d", r.VMs, limits.VMs)
+	case limits.VCPUs > 0 && r.VCPUs > limits.VCPUs:
+		return fmt.Sprintf("%d vcpus out of %d", r.VCPUs, limits.VCPUs)
+	case limits.MemoryMiB > 0 && r.MemoryMiB > limits.MemoryMiB:
+		return fmt.Sprintf("%d MiB of memory out of %d", r.MemoryMiB, limits.MemoryMiB)
+	case limits.DiskMiB > 0 && r.DiskMiB > limits.DiskMiB:
+		return fmt.Sprintf("%d MiB of disk out of %d", r.DiskMiB, limits.DiskMiB)
+	}
+	return ""
+}
+
+// rootfsDiskMiB is the disk the rootfs of a vm takes
+var rootfsDiskMiB = int64(rootfsSize >> 20)
+
+// vmResources is what a vm with the options o holds on to
+func vmResources(o *options) Resources {
+	return Resources{VMs: 1, VCPUs: o.FcCPUCount, MemoryMiB: o.FcMemSz, DiskMiB: rootfsDiskMiB}
+}
+
+// heldResources is what the vm m holds on to, vms which exited or failed only keep their disk
+func heldResources(m *Firecracker) Resources {
+	res := vmResources(m.opts)
+	if state := m.currentState(); state == StateExited || state == StateFailed {
+		res.VCPUs, res.MemoryMiB = 0, 0
+	}
+	return res
+}
+
+// admission keeps the resources of the vms being created, they are not in runVms until they started
+var admission = struct {
+	sync.Mutex
+	pending map[string][]Resources
+	// indexes are the vm indexes taken, from the admission of a vm until it is deleted
+	indexes map[int64]bool
+}{pending: make(map[string][]Resources), indexes: make(map[int64]bool)}
+
+// reservation is what admit set aside for a vm
+type reservation struct {
+	// index is the vm index of a new vm, zero when the vm has one already
+	index  int64
+	tenant string
+	res    Resources
+	kept   bool
+	once   sync.Once
+}
+
+// usedResources is what the vms of every tenant hold on to, pending creations included
+func usedResources() map[string]Resources {
+	used := make(map[string]Resources)
+	for _, m := range listVms() {
+		if m.opts == nil {
+			continue
+		}
+		used[m.opts.Tenant] = addResources(used[m.opts.Tenant], heldResources(m))
+	}
+	for tenant, pending := range admission.pending {
+		for _, res := range pending {
+			used[tenant] = addResources(used[tenant], res)
+		}
+	}
+	return used
+}
+
+// hostCapacity is what the host can give vms: its cpus and memory times the overcommit ratios,
+// its free disk and the ip addresses of the vm network. Zero ratios leave cpus or memory unchecked.
+func hostCapacity() Resources {
+	capacity := Resources{VMs: maxVmIndex - firstVmIndex + 1}
+
+	capacity.VCPUs = int64(float64(runtime.NumCPU()) * conf.CPUOvercommit)
+	if total, _, err := hostMemory(); err == nil {
+		capacity.MemoryMiB = int64(float64(total) * conf.MemoryOvercommit)
+	}
+
+	return capacity
+}
+
+// freeDiskMiB is the disk left to the rootfs images, they are created in the working directory
+func freeDiskMiB() (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(".", &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize) >> 20, nil
+}
+
+// admit reserves res for a vm of tenant when it fits in its quota and on the host. A new vm,
+// counted by res.VMs, also gets the vm index asked for, or the lowest free one when index is zero.
+// release must be called once the vm is in runVms or failed to be created, after keep when the
+// vm came up and holds on to its index until deleteVm gives it back. A vm booting again is
+// passed as replaced, so what it holds is not counted along with res.
+func admit(tenant string, res Resources, index int64, replaced *Firecracker) (*reservation, error) {
+	admission.Lock()
+	defer admission.Unlock()
+
+	if err := fits(tenant, res, replaced); err != nil {
+		return nil, err
+	}
+	if res.VMs > 0 {
+		switch {
+		case index == 0:
+			if index = freeVmIndex(); index == 0 {
+				return nil, fmt.Errorf("%w: no ip address left for new vms", errNoCapacity)
+			}
+		case index < firstVmIndex || index > maxVmIndex:
+			return nil, fmt.Errorf("%w: vm index %d is out of range", errInvalidRequest, index)
+		case admission.indexes[index]:
+			return nil, fmt.Errorf("%w: %d", errVmIndexInUse, index)
+		}
+	}
+
+	admission.pending[tenant] = append(admission.pending[tenant], res)
+	if res.VMs > 0 {
+		admission.indexes[index] = true
+	} else {
+		index = 0
+	}
+
+	return &reservation{index: index, tenant: tenant, res: res}, nil
+}
+
+// fits tells whether res fits in the quota of tenant and on the host, once the vm replaced gave
+// back what it holds when it is not nil. The admission lock must be held.
+func fits(tenant string, res Resources, replaced *Firecracker) error {
+	used := usedResources()
+
+	total := Resources{}
+	for _, u := range used {
+		total = addResources(total, u)
+	}
+
+	freed := Resources{}
+	if replaced != nil {
+		freed = heldResources(replaced)
+	}
+
+	if over := exceeds(subResources(addResources(used[tenant], res), freed), quota(tenant)); over != "" {
+		return fmt.Errorf("%w: tenant %q would use %s", errQuotaExceeded, tenant, over)
+	}
+	if over := exceeds(subResources(addResources(total, res), freed), hostCapacity()); over != "" {
+		return fmt.Errorf("%w: the host would run %s", errNoCapacity, over)
+	}
+	if free, err := freeDiskMiB(); err == nil && free+freed.DiskMiB < res.DiskMiB {
+		return fmt.Errorf("%w: %d MiB of disk left", errNoCapacity, free)
+	}
+	return nil
+}
+
+// fitsReplacing is admit for a vm taking the place of replaced, nothing is set aside
+func fitsReplacing(res Resources, replaced *Firecracker) error {
+	admission.Lock()
+	defer admission.Unlock()
+
+	return fits(replaced.opts.Tenant, res, replaced)
+}
+
+// keep hands the vm index over to the vm, which came up
+func (r *reservation) keep() {
+	r.kept = true
+}
+
+// release gives the resources set aside back, they are counted in runVms by now, along with
+// the vm index unless the vm keeps it
+func (r *reservation) release() {
+	r.once.Do(func() {
+		admission.Lock()
+		defer admission.Unlock()
+
+		pending := admission.pending[r.tenant]
+		for i := range pending {
+			if pending[i] == r.res {
+				admission.pending[r.tenant] = append(pending[:i], pending[i+1:]...)
+				break
+			}
+		}
+		if len(admission.pending[r.tenant]) == 0 {
+			delete(admission.pending, r.tenant)
+		}
+
+		if r.index != 0 && !r.kept {
+			delete(admission.indexes, r.index)
+		}
+	})
+}
+
+// freeVmIndex is the lowest vm index not taken, zero when they all are. The admission lock must be held.
+func freeVmIndex() int64 {
+	for i := int64(firstVmIndex); i <= maxVmIndex; i++ {
+		if !admission.indexes[i] {
+			return i
+		}
+	}
+	return 0
+}
+
+// holdVmIndex marks the index of a vm reattached after a restart of the daemon as taken
+func holdVmIndex(index int64) {
+	admission.Lock()
+	defer admission.Unlock()
+
+	admission.indexes[index] = true
+}
+
+// releaseVmIndex gives the index of a deleted vm back once nothing uses its tap device anymore
+func releaseVmIndex(index int64) {
+	admission.Lock()
+	defer admission.Unlock()
+
+	delete(admission.indexes, index)
+}
+
+// tenantUsage is the usage of tenant along with its quota
+func tenantUsage(tenant string) Usage {
+	admission.Lock()
+	defer admission.Unlock()
+
+	return Usage{Tenant: tenant, Used: usedResources()[tenant], Quota: quota(tenant)}
+}
+
+// hostUsage is the usage of every tenant and of the whole host
+func hostUsage() HostUsage {
+	admission.Lock()
+	defer admission.Unlock()
+
+	res := HostUsage{Capacity: hostCapacity(), Tenants: make([]Usage, 0)}
+	res.FreeDiskMiB, _ = freeDiskMiB()
+
+	for tenant, used := range usedResources() {
+		res.Used = addResources(res.Used, used)
+		res.Tenants = append(res.Tenants, Usage{Tenant: tenant, Used: used, Quota: quota(tenant)})
+	}
+	sort.Slice(res.Tenants, func(i, j int) bool { return res.Tenants[i].Tenant < res.Tenants[j].Tenant })
+
+	return res
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestVmIndexes(t *testing.T) {
+	// the cpus and memory of the host are left unchecked
+	saved := conf
+	defer func() { conf = saved }()
+	conf.CPUOvercommit, conf.MemoryOvercommit = 0, 0
+
+	res := Resources{VMs: 1, VCPUs: 1, MemoryMiB: minMemoryMiB}
+
+	// concurrent creates get an index of their own
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		rsvs []*reservation
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rsv, err := admit("acme", res, 0, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			rsvs = append(rsvs, rsv)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	seen := make(map[int64]bool)
+	for _, rsv := range rsvs {
+		if rsv.index < firstVmIndex || rsv.index > maxVmIndex || seen[rsv.index] {
+			t.Fatalf("vm index %d given twice or out of range", rsv.index)
+		}
+		seen[rsv.index] = true
+	}
+
+	// vms failing to come up give their index back, those which came up keep it until deleted
+	kept := rsvs[0]
+	kept.keep()
+	for _, rsv := range rsvs {
+		rsv.release()
+	}
+	if _, err := admit("acme", res, kept.index, nil); !errors.Is(err, errVmIndexInUse) {
+		t.Fatalf("the index of a running vm was given again: %v", err)
+	}
+	releaseVmIndex(kept.index)
+
+	// indexes of deleted vms are reused, the daemon does not run out of them
+	for i := 0; i < 2*maxVmIndex; i++ {
+		rsv, err := admit("acme", res, 0, nil)
+		if err != nil {
+			t.Fatalf("create %d: %v", i, err)
+		}
+		rsv.keep()
+		rsv.release()
+		releaseVmIndex(rsv.index)
+	}
+
+	// vms booting again have their index already
+	rsv, err := admit("acme", Resources{VCPUs: 1}, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsv.index != 0 {
+		t.Fatalf("a vm booting again got the index %d", rsv.index)
+	}
+	rsv.release()
+}
+
+func TestBootAgainAtQuota(t *testing.T) {
+	saved, savedQuotas := conf, quotas
+	defer func() { conf, quotas = saved, savedQuotas }()
+	conf.CPUOvercommit, conf.MemoryOvercommit = 0, 0
+	quotas = &quotaConfig{Tenants: map[string]Resources{"acme": {VMs: 2, VCPUs: 2, MemoryMiB: 512}}}
+
+	// the tenant is right at its quota while both vms run
+	running := testVm(t, "at-quota-running", 0, StateStarted)
+	putVm(running)
+	defer takeVm(running.ID)
+
+	for _, state := range []VmState{StateExited, StateFailed} {
+		t.Run(string(state), func(t *testing.T) {
+			m := testVm(t, "at-quota", 0, state)
+			putVm(m)
+			defer takeVm(m.ID)
+
+			if used := tenantUsage("acme").Used; used.VCPUs != 1 || used.MemoryMiB != 256 {
+				t.Fatalf("a vm which is %s holds %d vcpus and %d MiB", state, used.VCPUs, used.MemoryMiB)
+			}
+
+			// boot moves the vm to restarting before it is admitted again
+			m.setState(StateRestarting)
+			res := Resources{VCPUs: m.opts.FcCPUCount, MemoryMiB: m.opts.FcMemSz}
+			rsv, err := admit("acme", res, 0, m)
+			if err != nil {
+				t.Fatalf("the vm could not boot again: %v", err)
+			}
+			rsv.release()
+
+			// another vm would still go over the quota
+			if _, err := admit("acme", res, 0, nil); !errors.Is(err, errQuotaExceeded) {
+				t.Fatalf("got %v, want %v", err, errQuotaExceeded)
+			}
+		})
+	}
+}
@@ -16,3 +16,15 @@ func uuid() string {
 
 	return fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
 }
+
+// token returns a random hex secret shared between the daemon and one vm
+func token() string {
+
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Fatalf("failed to generate token, %s", err)
+	}
+
+	return fmt.Sprintf("%x", b)
+}
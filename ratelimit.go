@@ -0,0 +1,148 @@
+// ratelimit file is used to cap the disk and network usage of vms through the token
+// buckets firecracker puts in front of their drives and network interface.
+package main
+
+import (
+	"context"
+	"fmt"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	ops "github.com/firecracker-microvm/firecracker-go-sdk/client/operations"
+)
+
+// netIfaceID is the id the sdk gives the only network interface of the vms
+const netIfaceID = "1"
+
+// validateRateLimits rejects negative buckets and buckets which would never refill
+func validateRateLimits(l *RateLimits) error {
+	if l == nil {
+		return nil
+	}
+	for name, limit := range map[string]*RateLimit{"block": l.Block, "net_rx": l.NetRx, "net_tx": l.NetTx} {
+		if limit == nil {
+			continue
+		}
+		for kind, b := range map[string]*TokenBucket{"bandwidth": limit.Bandwidth, "ops": limit.Ops} {
+			if b == nil {
+				continue
+			}
+			if b.Size < 0 || b.RefillTimeMs < 0 || b.OneTimeBurst < 0 {
+				return fmt.Errorf("%s %s limit can not be negative", name, kind)
+			}
+			if b.Size > 0 && b.RefillTimeMs == 0 {
+				return fmt.Errorf("%s %s limit needs a refill_time_ms", name, kind)
+			}
+		}
+	}
+	return nil
+}
+
+// mergeRateLimits returns the limits of l, taking the ones it does not set from defaults
+func mergeRateLimits(l, defaults *RateLimits) *RateLimits {
+	if l == nil && defaults == nil {
+		return nil
+	}
+
+	res := new(RateLimits)
+	if defaults != nil {
+		*res = *defaults
+	}
+	if l != nil {
+		if l.Block != nil {
+			res.Block = l.Block
+		}
+		if l.NetRx != nil {
+			res.NetRx = l.NetRx
+		}
+		if l.NetTx != nil {
+			res.NetTx = l.NetTx
+		}
+	}
+	return res
+}
+
+// defaultRateLimits are the limits given on the command line, as buckets refilled every second
+func defaultRateLimits() *RateLimits {
+	perSecond := func(bandwidth, ops int64) *RateLimit {
+		if bandwidth == 0 && ops == 0 {
+			return nil
+		}
+		l := new(RateLimit)
+		if bandwidth > 0 {
+			l.Bandwidth = &TokenBucket{Size: bandwidth, RefillTimeMs: 1000}
+		}
+		if ops > 0 {
+			l.Ops = &TokenBucket{Size: ops, RefillTimeMs: 1000}
+		}
+		return l
+	}
+
+	l := &RateLimits{
+		Block: perSecond(conf.BlockBandwidth, conf.BlockOps),
+		NetRx: perSecond(conf.NetBandwidth, conf.NetOps),
+		NetTx: perSecond(conf.NetBandwidth, conf.NetOps),
+	}
+	if l.Block == nil && l.NetRx == nil {
+		return nil
+	}
+	return l
+}
+
+// bucketModel converts the bucket b to the firecracker one, a bucket of size 0 removes the limit
+func bucketModel(b *TokenBucket) *models.TokenBucket {
+	if b == nil {
+		return nil
+	}
+	return &models.TokenBucket{
+		Size:         firecracker.Int64(b.Size),
+		RefillTime:   firecracker.Int64(b.RefillTimeMs),
+		OneTimeBurst: firecracker.Int64(b.OneTimeBurst),
+	}
+}
+
+// limiterModel converts the limit l to the firecracker rate limiter
+func limiterModel(l *RateLimit) *models.RateLimiter {
+	if l == nil {
+		return nil
+	}
+	return &models.RateLimiter{
+		Bandwidth: bucketModel(l.Bandwidth),
+		Ops:       bucketModel(l.Ops),
+	}
+}
+
+// updateRateLimits changes the limits of the running vm, those l does not set are kept, and
+// returns the limits in use. Block limits apply to every drive of the vm on its own.
+func (f *Firecracker) updateRateLimits(ctx context.Context, l *RateLimits) (*RateLimits, error) {
+	if l.Block != nil {
+		limiter := limiterModel(l.Block)
+		for _, drive := range f.opts.driveIDs() {
+			// an empty path only patches the rate limiter, the drive file is kept
+			err := f.vm.UpdateGuestDrive(ctx, drive, "", func(p *ops.PatchGuestDriveByIDParams) {
+				p.Body.RateLimiter = limiter
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to update rate limiter of drive %s: %v", drive, err)
+			}
+		}
+	}
+
+	if l.NetRx != nil || l.NetTx != nil {
+		// the sdk sets the inbound limiter as the outbound one, the body is fixed up here
+		err := f.vm.UpdateGuestNetworkInterfaceRateLimit(ctx, netIfaceID, firecracker.RateLimiterSet{}, func(p *ops.PatchGuestNetworkInterfaceByIDParams) {
+			p.Body.RxRateLimiter = limiterModel(l.NetRx)
+			p.Body.TxRateLimiter = limiterModel(l.NetTx)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to update rate limiter of network interface: %v", err)
+		}
+	}
+
+	// the api and the records read the limits of the vm while they change
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.opts.RateLimits = mergeRateLimits(l, f.opts.RateLimits)
+	return f.opts.RateLimits, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+func TestValidateRateLimits(t *testing.T) {
+	bucket := func(size, refill, burst int64) *RateLimits {
+		return &RateLimits{NetTx: &RateLimit{Ops: &TokenBucket{Size: size, RefillTimeMs: refill, OneTimeBurst: burst}}}
+	}
+
+	for _, c := range []struct {
+		name   string
+		limits *RateLimits
+		ok     bool
+	}{
+		{"none", nil, true},
+		{"empty", &RateLimits{Block: &RateLimit{}}, true},
+		{"limited", bucket(1000, 1000, 5000), true},
+		{"removed", bucket(0, 0, 0), true},
+		{"negative size", bucket(-1, 1000, 0), false},
+		{"negative refill", bucket(1000, -1, 0), false},
+		{"negative burst", bucket(1000, 1000, -1), false},
+		{"never refilled", bucket(1000, 0, 0), false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if err := validateRateLimits(c.limits); (err == nil) != c.ok {
+				t.Fatalf("got %v", err)
+			}
+		})
+	}
+}
+
+func TestMergeRateLimits(t *testing.T) {
+	slow := &RateLimit{Bandwidth: &TokenBucket{Size: 1 << 20, RefillTimeMs: 1000}}
+	fast := &RateLimit{Bandwidth: &TokenBucket{Size: 1 << 30, RefillTimeMs: 1000}}
+
+	for _, c := range []struct {
+		name     string
+		l        *RateLimits
+		defaults *RateLimits
+		want     *RateLimits
+	}{
+		{"none", nil, nil, nil},
+		{"defaults only", nil, &RateLimits{Block: slow}, &RateLimits{Block: slow}},
+		{"limits only", &RateLimits{NetRx: fast}, nil, &RateLimits{NetRx: fast}},
+		{"overridden", &RateLimits{Block: fast}, &RateLimits{Block: slow, NetTx: slow}, &RateLimits{Block: fast, NetTx: slow}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := mergeRateLimits(c.l, c.defaults); !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("got %+v, want %+v", got, c.want)
+			}
+		})
+	}
+
+	defaults := &RateLimits{Block: slow}
+	mergeRateLimits(&RateLimits{Block: fast}, defaults)
+	if defaults.Block != slow {
+		t.Fatal("the defaults were changed")
+	}
+}
+
+func TestDefaultRateLimits(t *testing.T) {
+	saved := conf
+	defer func() { conf = saved }()
+
+	conf.BlockBandwidth, conf.BlockOps, conf.NetBandwidth, conf.NetOps = 0, 0, 0, 0
+	if l := defaultRateLimits(); l != nil {
+		t.Fatalf("got %+v without limits", l)
+	}
+
+	conf.BlockOps, conf.NetBandwidth = 500, 1<<20
+	l := defaultRateLimits()
+	if l == nil || l.Block == nil || l.Block.Bandwidth != nil || *l.Block.Ops != (TokenBucket{Size: 500, RefillTimeMs: 1000}) {
+		t.Fatalf("got block limits %+v", l)
+	}
+	for _, net := range []*RateLimit{l.NetRx, l.NetTx} {
+		if net == nil || net.Ops != nil || *net.Bandwidth != (TokenBucket{Size: 1 << 20, RefillTimeMs: 1000}) {
+			t.Fatalf("got network limits %+v", net)
+		}
+	}
+}
+
+func TestUpdateRateLimits(t *testing.T) {
+	// firecracker is asked to patch every drive and the network interface
+	var mu sync.Mutex
+	patched := make(map[string]json.RawMessage)
+	path := filepath.Join(t.TempDir(), "api.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		patched[r.Method+" "+r.URL.Path] = body
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	m := testVm(t, "limited", 0, StateStarted)
+	m.opts.Volumes = []VolumeMount{{Name: "data", MountPoint: "/data"}}
+	m.opts.RateLimits = &RateLimits{NetTx: &RateLimit{Ops: &TokenBucket{Size: 10, RefillTimeMs: 1000}}}
+	m.vm, err = firecracker.NewMachine(context.Background(), firecracker.Config{VMID: m.ID, SocketPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the api reads the vm while its limits change
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			vmResource(m)
+		}
+	}()
+
+	block := &RateLimit{Bandwidth: &TokenBucket{Size: 1 << 20, RefillTimeMs: 100}}
+	got, err := m.updateRateLimits(context.Background(), &RateLimits{Block: block})
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Block != block || got.NetTx == nil || got.NetTx.Ops.Size != 10 {
+		t.Fatalf("got %+v, the limits not given must be kept", got)
+	}
+
+	var calls []string
+	for call := range patched {
+		calls = append(calls, call)
+	}
+	sort.Strings(calls)
+	if want := []string{"PATCH /drives/1", "PATCH /drives/volume1"}; !reflect.DeepEqual(calls, want) {
+		t.Fatalf("got %v, want %v", calls, want)
+	}
+	var drive struct {
+		RateLimiter struct {
+			Bandwidth struct {
+				Size       int64 `json:"size"`
+				RefillTime int64 `json:"refill_time"`
+			} `json:"bandwidth"`
+		} `json:"rate_limiter"`
+	}
+	if err := json.Unmarshal(patched["PATCH /drives/1"], &drive); err != nil || drive.RateLimiter.Bandwidth.Size != 1<<20 || drive.RateLimiter.Bandwidth.RefillTime != 100 {
+		t.Fatalf("got %s, %v", patched["PATCH /drives/1"], err)
+	}
+
+	// network limits go to the interface, in the direction they were given
+	if _, err := m.updateRateLimits(context.Background(), &RateLimits{NetRx: block}); err != nil {
+		t.Fatal(err)
+	}
+	var iface struct {
+		Rx json.RawMessage `json:"rx_rate_limiter"`
+		Tx json.RawMessage `json:"tx_rate_limiter"`
+	}
+	body := patched["PATCH /network-interfaces/"+netIfaceID]
+	if err := json.Unmarshal(body, &iface); err != nil || len(iface.Rx) == 0 || len(iface.Tx) != 0 && string(iface.Tx) != "null" {
+		t.Fatalf("got %s, %v", body, err)
+	}
+}
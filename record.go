@@ -0,0 +1,203 @@
+// record file is used to keep the running vms on disk, so the next run of the daemon
+// can reattach to the firecracker processes a previous one left running.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/iradukunda1/firecrackerland/cmd/initrd/agent"
+	log "github.com/sirupsen/logrus"
+)
+
+// vmRecord is what the daemon needs to take a running vm over
+type vmRecord struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Pid        int      `json:"pid"`
+	SocketPath string   `json:"socket_path"`
+	RootDir    string   `json:"root_dir"`
+	Uid        int      `json:"uid"`
+	Gid        int      `json:"gid"`
+	Restarts   int      `json:"restarts"`
+	Options    *options `json:"options"`
+}
+
+func recordPath(id string) string {
+	return filepath.Join(conf.StateDir, id+".json")
+}
+
+// saveRecord writes the record of the started vm, it holds the agent token so only root may read it
+func (f *Firecracker) saveRecord() error {
+	pid, err := f.PID()
+	if err != nil {
+		return err
+	}
+
+	// the api changes the options of running vms, such as their rate limits, under f.mu
+	f.mu.Lock()
+	data, err := json.MarshalIndent(&vmRecord{
+		ID:         f.ID,
+		Name:       f.Name,
+		Pid:        pid,
+		SocketPath: f.vm.Cfg.SocketPath,
+		RootDir:    f.rootDir,
+		Uid:        f.uid,
+		Gid:        f.gid,
+		Restarts:   f.restarts,
+		Options:    f.opts,
+	}, "", "  ")
+	f.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode vm record: %v", err)
+	}
+
+	if err := os.MkdirAll(conf.StateDir, 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+
+	// written aside and renamed so a crash never leaves half a record behind
+	tmp := recordPath(f.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write vm record: %v", err)
+	}
+
+	return os.Rename(tmp, recordPath(f.ID))
+}
+
+// removeRecord forgets a vm which is gone
+func removeRecord(id string) {
+	if err := os.Remove(recordPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Warnf("failed to remove record of vm %s: %v", id, err)
+	}
+}
+
+// reattachVMs takes over the vms a previous run of the daemon left running
+func reattachVMs() {
+	entries, err := os.ReadDir(conf.StateDir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Errorf("failed to read state directory: %v", err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		id := strings.TrimSuffix(entry.Name(), ".json")
+
+		data, err := os.ReadFile(recordPath(id))
+		if err != nil {
+			log.Errorf("failed to read record of vm %s: %v", id, err)
+			continue
+		}
+
+		rec := new(vmRecord)
+		if err := json.Unmarshal(data, rec); err != nil || rec.Options == nil {
+			log.Errorf("invalid record of vm %s: %v", id, err)
+			removeRecord(id)
+			continue
+		}
+
+		m, err := reattach(rec)
+		if err != nil {
+			log.Warnf("vm %s can not be reattached: %v", id, err)
+			removeRecord(id)
+			continue
+		}
+
+		// new vms must not get the address of a reattached one
+		holdVmIndex(rec.Options.VmIndex)
+
+		putVm(m)
+
+		m.opts.Logger.Infof("reattached vm %s running as pid %d", m.ID, rec.Pid)
+	}
+}
+
+// reattach connects to the api socket of the firecracker described by rec
+func reattach(rec *vmRecord) (*Firecracker, error) {
+	if !isFirecracker(rec.Pid, rec.Options.FcBinary) {
+		return nil, fmt.Errorf("firecracker is not running anymore")
+	}
+
+	opts := rec.Options
+	opts.Logger = vmLogger(rec.ID, opts)
+
+	console, err := newConsole(filepath.Join(conf.ConsoleDir, rec.ID+".log"), conf.ConsoleBufferSize, conf.ConsoleLogSize<<20)
+	if err != nil {
+		return nil, err
+	}
+	opts.Console = console
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	m, err := firecracker.NewMachine(ctx, firecracker.Config{VMID: rec.ID, SocketPath: rec.SocketPath},
+		firecracker.WithLogger(opts.Logger))
+	if err != nil {
+		cancel()
+		console.Close()
+		return nil, fmt.Errorf("failed creating machine: %v", err)
+	}
+
+	infoCtx, done := context.WithTimeout(ctx, 5*time.Second)
+	defer done()
+
+	if _, err := m.DescribeInstanceInfo(infoCtx); err != nil {
+		cancel()
+		console.Close()
+		return nil, fmt.Errorf("firecracker api does not answer: %v", err)
+	}
+
+	res := &Firecracker{
+		ID:        rec.ID,
+		Name:      rec.Name,
+		ctx:       ctx,
+		cancelCtx: cancel,
+		vm:        m,
+		state:     StateStarted,
+		opts:      opts,
+		rootDir:   rec.RootDir,
+		console:   console,
+		restarts:  rec.Restarts,
+		pid:       rec.Pid,
+	}
+	res.agent = agent.NewClient(res.chrootPath(agentSocket), agent.DefaultPort, opts.AgentToken)
+
+	// firecracker keeps writing to the fifos it was given, they outlive the daemon
+	if err := res.collectFifos(); err != nil {
+		log.Errorf("failed to collect logs and metrics of vm %s: %v", rec.ID, err)
+	}
+
+	if err := res.listenExit(rec.Uid, rec.Gid); err != nil {
+		log.Errorf("vm %s will not report its exit: %v", rec.ID, err)
+	}
+
+	go res.monitor()
+
+	return res, nil
+}
+
+// isFirecracker tells whether pid is still a running firecracker, and not a process which reused its pid
+func isFirecracker(pid int, bin string) bool {
+	if !processAlive(pid) {
+		return false
+	}
+
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return false
+	}
+
+	return filepath.Base(exe) == filepath.Base(bin)
+}
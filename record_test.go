@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+)
+
+// testFirecrackerAPI answers the instance info requests of reattach on a unix socket
+func testFirecrackerAPI(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "api.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"vm","state":"Running","vmm_version":"1.0.0","app_name":"Firecracker"}`))
+	})}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return path
+}
+
+func TestReattachVMs(t *testing.T) {
+	saved := conf
+	defer func() { conf = saved }()
+	conf.StateDir, conf.ConsoleDir = t.TempDir(), t.TempDir()
+
+	// a process which is not our child stands in for the firecracker left running
+	fc := exec.Command("sleep", "30")
+	if err := fc.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer fc.Process.Kill()
+	bin, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", fc.Process.Pid))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gone := exec.Command("true")
+	if err := gone.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	api := testFirecrackerAPI(t)
+	record := func(id string, pid int, bin string, index int64) []byte {
+		data, err := json.Marshal(&vmRecord{ID: id, Pid: pid, SocketPath: api, RootDir: t.TempDir(), Uid: os.Getuid(), Gid: os.Getgid(),
+			Options: &options{Name: id, Tenant: "acme", VmIndex: index, FcBinary: bin, FcCPUCount: 1, FcMemSz: 256}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	files := map[string][]byte{
+		"running.json":  record("running", fc.Process.Pid, bin, 200),
+		"gone.json":     record("gone", gone.Process.Pid, bin, 201),
+		"reused.json":   record("reused", os.Getpid(), "/usr/bin/firecracker", 202),
+		"invalid.json":  []byte("{"),
+		"no-opts.json":  []byte(`{"id":"no-opts"}`),
+		"notes.txt":     []byte("kept"),
+		"running.json~": []byte("kept"),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(conf.StateDir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reattachVMs()
+
+	for name := range files {
+		_, err := os.Stat(filepath.Join(conf.StateDir, name))
+		kept := name == "running.json" || name == "notes.txt" || name == "running.json~"
+		if kept != (err == nil) {
+			t.Errorf("record %s kept %v: %v", name, err == nil, err)
+		}
+	}
+	for _, id := range []string{"gone", "reused", "invalid", "no-opts"} {
+		if _, ok := getVm(id); ok {
+			t.Errorf("the vm %s was reattached", id)
+		}
+	}
+
+	m, ok := getVm("running")
+	if !ok {
+		t.Fatal("the running vm was not reattached")
+	}
+	if state := m.status(); state != StateStarted {
+		t.Fatalf("the reattached vm is %s", state)
+	}
+	if _, err := admit("acme", Resources{VMs: 1}, 200, nil); err == nil {
+		t.Fatal("the index of the reattached vm was given to a new vm")
+	}
+
+	// the vm exits along with its firecracker, which is not a child of the daemon
+	fc.Process.Kill()
+	fc.Wait()
+	deadline := time.Now().Add(10 * time.Second)
+	for m.currentState() != StateExited {
+		if time.Now().After(deadline) {
+			t.Fatal("the exit of firecracker went unnoticed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if _, err := os.Stat(recordPath(m.ID)); !os.IsNotExist(err) {
+		t.Fatalf("the record of the exited vm is left: %v", err)
+	}
+
+	// the exited vm can boot again with its address until it is deleted
+	if _, err := admit("acme", Resources{VMs: 1}, 200, nil); err == nil {
+		t.Fatal("the index of the exited vm was given to a new vm")
+	}
+	deleteVm(m)
+	rsv, err := admit("acme", Resources{VMs: 1}, 200, nil)
+	if err != nil {
+		t.Fatalf("the index of the deleted vm was not given back: %v", err)
+	}
+	rsv.release()
+}
+
+func TestJailerCommand(t *testing.T) {
+	uid, gid, numa := 123, 456, 0
+	cfg := firecracker.Config{
+		SocketPath: "/run/firecracker.socket",
+		JailerCfg: &firecracker.JailerConfig{
+			JailerBinary:  "jailer",
+			ID:            "vm",
+			UID:           &uid,
+			GID:           &gid,
+			NumaNode:      &numa,
+			ExecFile:      "/usr/bin/firecracker",
+			ChrootBaseDir: "/srv/jailer",
+			CgroupVersion: "2",
+		},
+	}
+
+	for _, c := range []struct {
+		name    string
+		seccomp firecracker.SeccompConfig
+		netns   string
+		want    []string
+		not     []string
+	}{
+		{"seccomp off", firecracker.SeccompConfig{}, "", []string{"--no-seccomp", "--api-sock"}, []string{"--netns"}},
+		{"seccomp filter", firecracker.SeccompConfig{Enabled: true, Filter: "/etc/filter.bpf"}, "/var/run/netns/vm", []string{"--seccomp-filter", "--netns"}, []string{"--no-seccomp"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			cfg.Seccomp, cfg.NetNS = c.seccomp, c.netns
+			cmd := jailerCommand(context.Background(), cfg)
+
+			// firecracker leaves the session of the daemon, the vms outlive it
+			if cmd.SysProcAttr == nil || !cmd.SysProcAttr.Setsid {
+				t.Fatal("firecracker is not started in a session of its own")
+			}
+			args := strings.Join(cmd.Args, " ")
+			for _, w := range c.want {
+				if !strings.Contains(args, w) {
+					t.Errorf("%q is missing from %s", w, args)
+				}
+			}
+			for _, n := range c.not {
+				if strings.Contains(args, n) {
+					t.Errorf("%q is in %s", n, args)
+				}
+			}
+		})
+	}
+}
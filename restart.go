@@ -0,0 +1,129 @@
+// restart file is used to bring vms back up once their workload exits,
+// following the restart policy they were created with.
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// available restart policies
+const (
+	RestartNo        = "no"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+// validateRestartPolicy rejects unknown policies and retry limits they do not use
+func validateRestartPolicy(p *RestartPolicy) error {
+	if p == nil {
+		return nil
+	}
+
+	switch p.Name {
+	case "", RestartNo, RestartAlways:
+		if p.MaxRetries != 0 {
+			return fmt.Errorf("max_retries only applies to the %s restart policy", RestartOnFailure)
+		}
+	case RestartOnFailure:
+		if p.MaxRetries < 0 {
+			return fmt.Errorf("max_retries can not be negative")
+		}
+	default:
+		return fmt.Errorf("unknown restart policy %q, expected %s, %s or %s", p.Name, RestartNo, RestartOnFailure, RestartAlways)
+	}
+
+	return nil
+}
+
+// shouldRestart tells whether a vm with the policy p, restarted restarts times already, has to be
+// brought back up. A vm going away without reporting an exit code is considered failed.
+func shouldRestart(p *RestartPolicy, exitCode *int, restarts int) bool {
+	if p == nil {
+		return false
+	}
+
+	switch p.Name {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		failed := exitCode == nil || *exitCode != 0
+		return failed && (p.MaxRetries == 0 || restarts < p.MaxRetries)
+	}
+
+	return false
+}
+
+// restartDelay doubles the wait before every restart, up to the configured maximum
+func restartDelay(restarts int) time.Duration {
+	delay := conf.RestartBackoff
+	for i := 0; i < restarts && delay < conf.RestartMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > conf.RestartMaxBackoff {
+		delay = conf.RestartMaxBackoff
+	}
+	return delay
+}
+
+// exited is called once firecracker is gone, it restarts the vm when its policy asks for it
+func (f *Firecracker) exited() {
+	f.mu.Lock()
+	restart := !f.stopping && shouldRestart(f.opts.RestartPolicy, f.exitCode, f.restarts)
+	if restart {
+		f.state = StateRestarting
+	}
+	f.mu.Unlock()
+
+	if !restart {
+		f.finish(StateExited)
+		f.emit(EventExited)
+		return
+	}
+
+	delay := restartDelay(f.restarts)
+	f.opts.Logger.Infof("vm %s exited, restarting it in %s", f.ID, delay)
+
+	// the exit is published once, whether the vm comes back or not
+	f.emit(EventExited)
+	time.Sleep(delay)
+
+	if f.isStopping() {
+		f.finish(StateExited)
+		return
+	}
+
+	// the vm boots again from its rootfs, keeping its network and console
+	ctx, span := tracer.Start(context.Background(), "restart", trace.WithAttributes(vmAttributes(f.ID, f.opts)...))
+	next, err := f.opts.createVMM(ctx, f.ID)
+	if err == nil {
+		next.restarts = f.restarts + 1
+		next, err = StartVm(ctx, next)
+	}
+	endSpan(span, err)
+	if err != nil {
+		vmFailures.WithLabelValues("restart").Inc()
+		f.opts.Logger.Errorf("failed to restart vm %s: %v", f.ID, err)
+		f.emitError(fmt.Errorf("failed to restart vm: %v", err))
+		f.finish(StateFailed)
+		return
+	}
+
+	if !replaceVm(f, next) {
+		// deleted while restarting
+		next.discard()
+		f.finish(StateExited)
+	}
+}
+
+// finish leaves the vm in its final state, there is nothing left to reattach to
+func (f *Firecracker) finish(state VmState) {
+	if f.settle(state) {
+		releaseVmIndex(f.opts.VmIndex)
+	}
+	f.console.Close()
+	removeRecord(f.ID)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestStopWhileRestarting checks a vm stopped during its restart backoff reports its exit once
+func TestStopWhileRestarting(t *testing.T) {
+	saved := conf
+	defer func() { conf = saved }()
+	conf.RestartBackoff, conf.RestartMaxBackoff = 100*time.Millisecond, 100*time.Millisecond
+
+	for _, c := range []struct {
+		name   string
+		policy *RestartPolicy
+		stop   bool
+	}{
+		{"no restart", nil, false},
+		{"stopped during the backoff", &RestartPolicy{Name: RestartAlways}, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			m := testVm(t, "exiting", 0, StateStarted)
+			m.opts.RestartPolicy = c.policy
+			putVm(m)
+			defer takeVm(m.ID)
+
+			_, ch, unsubscribe := events.subscribe(0)
+			defer unsubscribe()
+
+			done := make(chan struct{})
+			go func() {
+				m.exited()
+				close(done)
+			}()
+			if c.stop {
+				for m.currentState() != StateRestarting {
+					time.Sleep(time.Millisecond)
+				}
+				m.mu.Lock()
+				m.stopping = true
+				m.mu.Unlock()
+			}
+			<-done
+
+			exits := 0
+			for len(ch) > 0 {
+				if e := <-ch; e.VmID == m.ID && e.Type == EventExited {
+					exits++
+				}
+			}
+			if exits != 1 {
+				t.Fatalf("the exit was published %d times", exits)
+			}
+			if state := m.currentState(); state != StateExited {
+				t.Fatalf("the vm is %s", state)
+			}
+		})
+	}
+}
@@ -3,10 +3,38 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"os"
+	"regexp"
+	"strings"
+
+	"github.com/iradukunda1/firecrackerland/cmd/initrd/mmds"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// rootfsSize is the size in bytes of the rootfs image of every vm, 526MB
+const rootfsSize = 526 * 1000 * 1000
+
+// imageRefPattern matches the docker references [domain[:port]/]path[:tag][@digest]. Images and
+// vm names end up in shell commands, some of them run with sudo, so nothing else is let through.
+var imageRefPattern = regexp.MustCompile(`^(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?(?:\.[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)*(?::[0-9]+)?/)?` +
+	`[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*` +
+	`(?::[a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127})?(?:@[a-zA-Z][a-zA-Z0-9]*(?:[-_+.][a-zA-Z][a-zA-Z0-9]*)*:[0-9a-fA-F]{32,})?$`)
+
+// validateImage checks the vm name and the docker image of a vm
+func validateImage(name, image string) error {
+	if !volumeNamePattern.MatchString(name) {
+		return fmt.Errorf("name %q must be letters, digits, '_', '.' or '-', 64 at most", name)
+	}
+	if len(image) > 255 || !imageRefPattern.MatchString(image) {
+		return fmt.Errorf("image %q is not a docker image reference", image)
+	}
+	return nil
+}
+
 // GenerateRFs generates root filesystem for the VM according to the below steps:
 // 1. create a directory for the rootfs
 // 2. copy the init binary to the rootfs
@@ -17,17 +45,26 @@ import (
 // 7. delete the init base tar file
 // 8. delete the docker supplied tar file
 // 9. return the rootfs path or name
-func (o *options) GenerateRFs(name string) (string, error) {
+func (o *options) GenerateRFs(ctx context.Context, name string) (string, error) {
+
+	ctx, span := tracer.Start(ctx, "GenerateRFs", trace.WithAttributes(attribute.String("vm.image", o.ProvidedImage)))
+	defer span.End()
 
 	fsName := fmt.Sprintf("%d-%s.ext4", o.VmIndex, name)
 
 	// for creating the rootfs directory with 526MB size
-	if _, err := RunNoneSudo(fmt.Sprintf("fallocate -l 526MB %s", fsName)); err != nil {
+	if err := traceStep(ctx, "fallocate", func() error {
+		_, err := RunNoneSudo(fmt.Sprintf("fallocate -l %d %s", rootfsSize, fsName))
+		return err
+	}); err != nil {
 		return "", fmt.Errorf("failed to create rootfs file: %v", err)
 	}
 
 	//for making the rootfs file as ext4 file system
-	if _, err := RunNoneSudo(fmt.Sprintf("mkfs.ext4 %s", fsName)); err != nil {
+	if err := traceStep(ctx, "mkfs.ext4", func() error {
+		_, err := RunNoneSudo(fmt.Sprintf("mkfs.ext4 %s", fsName))
+		return err
+	}); err != nil {
 		return "", fmt.Errorf("failed to create ext4 file system: %v", err)
 	}
 
@@ -50,18 +87,38 @@ func (o *options) GenerateRFs(name string) (string, error) {
 	imageName := fmt.Sprintf("%d-%s", o.VmIndex, name)
 
 	// for exporting the docker tar file from supplied docker image
-	if _, err := RunNoneSudo(fmt.Sprintf("docker create --name %s %s", imageName, o.ProvidedImage)); err != nil {
+	if err := traceStep(ctx, "docker create", func() error {
+		_, err := RunNoneSudo(fmt.Sprintf("docker create --name %s %s", imageName, o.ProvidedImage))
+		return err
+	}); err != nil {
 		return "", fmt.Errorf("failed to export docker tar file: %v", err)
 	}
 	defer RunNoneSudo(fmt.Sprintf("docker rm -f %s", imageName))
 
+	// keep the image entrypoint, cmd, env and workdir around for the init process
+	if err := traceStep(ctx, "docker inspect", func() (err error) {
+		o.ImageConfig, err = inspectImage(o.ProvidedImage)
+		if err == nil {
+			overrideRuntimeConfig(o.ImageConfig, o.Env, o.Command)
+		}
+		return err
+	}); err != nil {
+		return "", err
+	}
+
 	// for exporting the docker tar file from supplied docker image
-	if _, err := RunNoneSudo(fmt.Sprintf("docker export %s -o %s", imageName, imageTar)); err != nil {
+	if err := traceStep(ctx, "docker export", func() error {
+		_, err := RunNoneSudo(fmt.Sprintf("docker export %s -o %s", imageName, imageTar))
+		return err
+	}); err != nil {
 		return "", fmt.Errorf("failed to export docker tar file: %v", err)
 	}
 
 	// for extracting the docker supplied tar file to the rootfs directory
-	if _, err := RunSudo(fmt.Sprintf("tar -xvf %s -C %s", imageTar, tmpDir)); err != nil {
+	if err := traceStep(ctx, "extract", func() error {
+		_, err := RunSudo(fmt.Sprintf("tar -xvf %s -C %s", imageTar, tmpDir))
+		return err
+	}); err != nil {
 		return "", fmt.Errorf("failed to extract docker supplied tar file: %v", err)
 	}
 
@@ -77,3 +134,69 @@ func (o *options) GenerateRFs(name string) (string, error) {
 
 	return fsName, nil
 }
+
+// dockerImageConfig is the subset of `docker inspect` image config we care about
+type dockerImageConfig struct {
+	Entrypoint []string `json:"Entrypoint"`
+	Cmd        []string `json:"Cmd"`
+	Env        []string `json:"Env"`
+	WorkingDir string   `json:"WorkingDir"`
+}
+
+// inspectImage reads the runtime configuration of the supplied docker image
+func inspectImage(image string) (*mmds.ContainerRuntimeConfig, error) {
+
+	out, err := RunOutput(fmt.Sprintf("docker inspect --format '{{json .Config}}' %s", image))
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect docker image: %v", err)
+	}
+
+	var cfg dockerImageConfig
+	if err := json.Unmarshal(out, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode docker image config: %v", err)
+	}
+
+	workdir := cfg.WorkingDir
+	if workdir == "" {
+		workdir = "/"
+	}
+
+	return &mmds.ContainerRuntimeConfig{
+		Entrypoint:  cfg.Entrypoint,
+		Cmd:         cfg.Cmd,
+		Environment: cfg.Env,
+		Workdir:     workdir,
+	}, nil
+}
+
+// overrideRuntimeConfig sets the variables of env in the environment of cfg and replaces its
+// command with command when given, the entrypoint of the image is kept
+func overrideRuntimeConfig(cfg *mmds.ContainerRuntimeConfig, env, command []string) {
+	for _, v := range env {
+		name := strings.SplitN(v, "=", 2)[0]
+		replaced := false
+		for i, existing := range cfg.Environment {
+			if strings.HasPrefix(existing, name+"=") {
+				cfg.Environment[i] = v
+				replaced = true
+			}
+		}
+		if !replaced {
+			cfg.Environment = append(cfg.Environment, v)
+		}
+	}
+	if len(command) > 0 {
+		cfg.Cmd = command
+	}
+}
+
+// validateEnv checks the variables are written NAME=VALUE
+func validateEnv(env []string) error {
+	for _, v := range env {
+		name, _, found := strings.Cut(v, "=")
+		if !found || name == "" || strings.ContainsAny(name, " \t\n\x00") {
+			return fmt.Errorf("environment variable %q must be written NAME=VALUE", v)
+		}
+	}
+	return nil
+}
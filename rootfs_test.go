@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateImage(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		image string
+		ok    bool
+	}{
+		{"web", "nginx", true},
+		{"web", "nginx:1.25-alpine", true},
+		{"web", "library/nginx:latest", true},
+		{"web", "ghcr.io/acme/api:v2", true},
+		{"web", "localhost:5000/acme/api", true},
+		{"web", "acme/api@sha256:" + strings.Repeat("a", 64), true},
+		{"web.1_a-b", "busybox", true},
+
+		{"web", "", false},
+		{"web", "nginx; reboot", false},
+		{"web", "nginx $(reboot)", false},
+		{"web", "--privileged", false},
+		{"web", "Nginx", false},
+		{"web", "nginx:", false},
+		{"web", "nginx\nreboot", false},
+		{"", "nginx", false},
+		{"web;reboot", "nginx", false},
+		{"../web", "nginx", false},
+		{"-web", "nginx", false},
+		{"web app", "nginx", false},
+	} {
+		err := validateImage(c.name, c.image)
+		if (err == nil) != c.ok {
+			t.Errorf("name %q image %q: got %v", c.name, c.image, err)
+		}
+	}
+
+	if _, err := createOptions(&CreateRequest{Name: "web", DockerImage: "nginx`reboot`"}, anonymous); !errors.Is(err, errInvalidRequest) {
+		t.Errorf("createOptions let the image through: %v", err)
+	}
+	if _, err := decodeSpec(strings.NewReader("vms: [{name: web, image: 'nginx && reboot'}]")); err == nil {
+		t.Errorf("the spec let the image through: %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"time"
+)
+
+// settings holds the daemon wide configuration supplied on the command line
+type settings struct {
+	ListenAddr        string
+	SnapshotDir       string
+	SnapshotMaxSize   int64
+	ConsoleDir        string
+	StateDir          string
+	KernelRegistry    string
+	VolumeDir         string
+	ConsoleBufferSize int
+	ConsoleLogSize    int64
+	RestartBackoff    time.Duration
+	RestartMaxBackoff time.Duration
+	ShutdownTimeout   time.Duration
+	LeaveRunning      bool
+	BlockBandwidth    int64
+	BlockOps          int64
+	NetBandwidth      int64
+	NetOps            int64
+	BalloonStats      int64
+	BalloonReserve    int64
+	ReclaimThreshold  int
+	ReclaimInterval   time.Duration
+	TraceExporter     string
+	OTLPEndpoint      string
+	LogLevel          string
+	LogFormat         string
+	AuthConfig        string
+	TLSCert           string
+	TLSKey            string
+	TLSClientCA       string
+	TLSClientAuth     string
+	TLSReload         time.Duration
+	UnixSocket        string
+	UnixSocketMode    string
+	UnixSocketGroup   string
+	Quotas            string
+	CPUOvercommit     float64
+	MemoryOvercommit  float64
+	Webhooks          string
+}
+
+var conf = settings{
+	ListenAddr:        ":8080",
+	SnapshotDir:       "snapshots",
+	SnapshotMaxSize:   16 * 1024,
+	ConsoleDir:        "consoles",
+	StateDir:          "state",
+	VolumeDir:         "volumes",
+	ConsoleBufferSize: 64 * 1024,
+	ConsoleLogSize:    64,
+	RestartBackoff:    time.Second,
+	RestartMaxBackoff: time.Minute,
+	ShutdownTimeout:   20 * time.Second,
+	BalloonStats:      5,
+	BalloonReserve:    64,
+	ReclaimInterval:   10 * time.Second,
+	LogLevel:          "debug",
+	LogFormat:         "json",
+	CPUOvercommit:     4,
+	MemoryOvercommit:  1,
+	TLSReload:         10 * time.Second,
+	UnixSocketMode:    "0660",
+}
+
+// parseFlags fills conf from the command line arguments
+func parseFlags() {
+	flag.StringVar(&conf.ListenAddr, "listen", conf.ListenAddr, "address the http api listens on, empty to only listen on -unix-socket")
+	flag.StringVar(&conf.SnapshotDir, "snapshot-dir", conf.SnapshotDir, "directory where exported and imported snapshots are kept")
+	flag.Int64Var(&conf.SnapshotMaxSize, "snapshot-max-size", conf.SnapshotMaxSize, "MiB a snapshot archive uploaded for import may take")
+	flag.StringVar(&conf.ConsoleDir, "console-dir", conf.ConsoleDir, "directory where the serial console log of every vm is written")
+	flag.StringVar(&conf.StateDir, "state-dir", conf.StateDir, "directory where running vms are recorded to be reattached after a restart of the daemon")
+	flag.StringVar(&conf.VolumeDir, "volume-dir", conf.VolumeDir, "directory where data volumes are kept, it must be on the same file system as the jails under /tmp")
+	flag.StringVar(&conf.KernelRegistry, "kernels", conf.KernelRegistry, "json file listing the kernels and initrds vms can boot, vmlinux.bin and initrd.cpio are used otherwise")
+	flag.IntVar(&conf.ConsoleBufferSize, "console-buffer", conf.ConsoleBufferSize, "bytes of serial console output kept in memory per vm")
+	flag.Int64Var(&conf.ConsoleLogSize, "console-log-size", conf.ConsoleLogSize, "MiB the console log of a vm grows to before it is moved to a .1 file next to it, 0 for no limit")
+	flag.DurationVar(&conf.RestartBackoff, "restart-backoff", conf.RestartBackoff, "wait before the first restart of a vm, doubled on every following one")
+	flag.DurationVar(&conf.RestartMaxBackoff, "restart-max-backoff", conf.RestartMaxBackoff, "longest wait before restarting a vm")
+	flag.DurationVar(&conf.ShutdownTimeout, "shutdown-timeout", conf.ShutdownTimeout, "time vms get to shut down when the daemon exits before they are killed")
+	flag.BoolVar(&conf.LeaveRunning, "leave-running", conf.LeaveRunning, "leave the vms running when the daemon exits, the next run reattaches to them")
+	flag.Int64Var(&conf.BlockBandwidth, "block-bandwidth", conf.BlockBandwidth, "default bytes per second every drive of a vm can read and write, 0 for no limit")
+	flag.Int64Var(&conf.BlockOps, "block-ops", conf.BlockOps, "default requests per second every drive of a vm can serve, 0 for no limit")
+	flag.Int64Var(&conf.NetBandwidth, "net-bandwidth", conf.NetBandwidth, "default bytes per second a vm can receive and send each, 0 for no limit")
+	flag.Int64Var(&conf.NetOps, "net-ops", conf.NetOps, "default packets per second a vm can receive and send each, 0 for no limit")
+	flag.Int64Var(&conf.BalloonStats, "balloon-stats-interval", conf.BalloonStats, "default seconds between two polls of the balloon statistics of a vm")
+	flag.IntVar(&conf.ReclaimThreshold, "reclaim-threshold", conf.ReclaimThreshold, "percent of available host memory below which memory is reclaimed from idle vms through their balloon, 0 to never reclaim")
+	flag.Int64Var(&conf.BalloonReserve, "balloon-reserve", conf.BalloonReserve, "MiB of available memory left to every vm when reclaiming memory")
+	flag.DurationVar(&conf.ReclaimInterval, "reclaim-interval", conf.ReclaimInterval, "time between two checks of the host memory")
+	flag.StringVar(&conf.TraceExporter, "trace-exporter", conf.TraceExporter, "where traces are sent: otlp, stdout or none")
+	flag.StringVar(&conf.OTLPEndpoint, "otlp-endpoint", conf.OTLPEndpoint, "host:port of the OTLP/HTTP collector receiving traces, the OTEL_EXPORTER_OTLP_* environment is used otherwise")
+	flag.StringVar(&conf.LogLevel, "log-level", conf.LogLevel, "level of the daemon logs: trace, debug, info, warn or error")
+	flag.StringVar(&conf.LogFormat, "log-format", conf.LogFormat, "format of the daemon logs: json or text")
+	flag.StringVar(&conf.AuthConfig, "auth-config", conf.AuthConfig, "json file configuring the authentication of the api callers and the admin tenants, the api is open otherwise")
+	flag.StringVar(&conf.TLSCert, "tls-cert", conf.TLSCert, "certificate file the api is served with over https")
+	flag.StringVar(&conf.TLSKey, "tls-key", conf.TLSKey, "private key file of -tls-cert")
+	flag.StringVar(&conf.TLSClientCA, "tls-client-ca", conf.TLSClientCA, "CA file client certificates are verified against")
+	flag.StringVar(&conf.TLSClientAuth, "tls-client-auth", conf.TLSClientAuth, "whether clients present a certificate: none, optional or require, optional when a client CA is set")
+	flag.DurationVar(&conf.TLSReload, "tls-reload-interval", conf.TLSReload, "time between two checks of the certificate files for renewals")
+	flag.StringVar(&conf.UnixSocket, "unix-socket", conf.UnixSocket, "path of a unix socket the api listens on as well, its callers are admins")
+	flag.StringVar(&conf.UnixSocketMode, "unix-socket-mode", conf.UnixSocketMode, "permissions of -unix-socket")
+	flag.StringVar(&conf.UnixSocketGroup, "unix-socket-group", conf.UnixSocketGroup, "group owning -unix-socket")
+	flag.StringVar(&conf.Quotas, "quotas", conf.Quotas, "json file holding the quotas of the tenants, tenants have no quota otherwise")
+	flag.Float64Var(&conf.CPUOvercommit, "cpu-overcommit", conf.CPUOvercommit, "vcpus the vms may have per cpu of the host, 0 for no limit")
+	flag.Float64Var(&conf.MemoryOvercommit, "memory-overcommit", conf.MemoryOvercommit, "memory the vms may have per MiB of memory of the host, 0 for no limit")
+	flag.StringVar(&conf.Webhooks, "webhooks", conf.Webhooks, "json file listing the webhooks the vm events are delivered to")
+
+	flag.Parse()
+}
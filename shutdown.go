@@ -0,0 +1,73 @@
+// shutdown file is used to stop the vms when the daemon exits, giving their
+// workloads a chance to exit cleanly before firecracker is killed.
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// shutdownVMs stops every vm in parallel and returns once they are all gone.
+// Cancelling ctx kills the vms still running right away.
+func shutdownVMs(ctx context.Context, grace time.Duration) {
+	var wg sync.WaitGroup
+
+	for _, m := range listVms() {
+		wg.Add(1)
+		go func(m *Firecracker) {
+			defer wg.Done()
+			m.shutdown(ctx, grace)
+		}(m)
+	}
+
+	wg.Wait()
+}
+
+// shutdown sends Ctrl-Alt-Del to the vm, which the initrd forwards to the workload as SIGINT,
+// and kills firecracker if it is still running once grace is over. A paused guest can not handle
+// Ctrl-Alt-Del, it is resumed first or killed right away when it can not be.
+func (f *Firecracker) shutdown(ctx context.Context, grace time.Duration) {
+	if f.markStopping() != StateStarted {
+		return
+	}
+
+	if err := f.unpause(ctx); err != nil {
+		f.opts.Logger.Warnf("failed to resume vm %s to shut it down: %v", f.ID, err)
+	} else if err := f.vm.Shutdown(ctx); err != nil {
+		f.opts.Logger.Warnf("failed to ask vm %s to shut down: %v", f.ID, err)
+	} else {
+		waitCtx, cancel := context.WithTimeout(ctx, grace)
+		defer cancel()
+
+		err := f.wait(waitCtx)
+		if waitCtx.Err() == nil {
+			f.opts.Logger.Infof("vm %s shut down", f.ID)
+			return
+		}
+		f.opts.Logger.Warnf("vm %s did not shut down in time: %v", f.ID, err)
+	}
+
+	if err := f.stopVMM(); err != nil {
+		f.opts.Logger.Errorf("failed to stop vm %s: %v", f.ID, err)
+	}
+}
+
+// unpause resumes the vm when it was paused through the api
+func (f *Firecracker) unpause(ctx context.Context) error {
+	f.mu.Lock()
+	paused := f.paused
+	f.mu.Unlock()
+	if !paused {
+		return nil
+	}
+
+	if err := f.vm.ResumeVM(ctx); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.paused = false
+	f.mu.Unlock()
+	f.emit(EventResumed)
+	return nil
+}
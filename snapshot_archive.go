@@ -0,0 +1,561 @@
+// snapshot archive file is used to export a running vm into a single portable
+// archive and to import such an archive back on any host running this daemon.
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/firecracker-microvm/firecracker-go-sdk/client/operations"
+	"github.com/iradukunda1/firecrackerland/cmd/initrd/agent"
+	"github.com/iradukunda1/firecrackerland/cmd/initrd/mmds"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	snapshotFormatVersion = 1
+	snapshotManifestName  = "manifest.json"
+	snapshotMemFile       = "snapshot.mem"
+	snapshotStateFile     = "snapshot.file"
+
+	linkSnapshotHandlerName = "fcland.LinkSnapshot"
+)
+
+var (
+	errSnapshotVersion  = errors.New("snapshot was taken with an incompatible firecracker version")
+	errSnapshotChecksum = errors.New("snapshot archive checksum mismatch")
+	errSnapshotTapInUse = errors.New("tap device of the snapshot is already used by another vm")
+	errSnapshotTooLarge = errors.New("snapshot archive is too large")
+)
+
+// snapshotManifest describes the content of a snapshot archive
+type snapshotManifest struct {
+	FormatVersion      int              `json:"format_version"`
+	FirecrackerVersion string           `json:"firecracker_version"`
+	CreatedAt          time.Time        `json:"created_at"`
+	VM                 snapshotMetadata `json:"vm"`
+	Files              []snapshotFile   `json:"files"`
+}
+
+// snapshotMetadata holds what is needed to bring the vm back on another host
+type snapshotMetadata struct {
+	ID             string                       `json:"id"`
+	Name           string                       `json:"name"`
+	Image          string                       `json:"image"`
+	VmIndex        int64                        `json:"vm_index"`
+	KernelBootArgs string                       `json:"kernel_boot_args"`
+	Tap            string                       `json:"tap"`
+	TapMacAddr     string                       `json:"tap_mac_addr"`
+	FcIP           string                       `json:"fc_ip"`
+	CPUCount       int64                        `json:"cpu_count"`
+	MemSz          int64                        `json:"mem_size_mib"`
+	ImageConfig    *mmds.ContainerRuntimeConfig `json:"image_config,omitempty"`
+	AgentToken     string                       `json:"agent_token"`
+	Balloon        *BalloonConfig               `json:"balloon,omitempty"`
+	Ports          []PortMapping                `json:"ports,omitempty"`
+	Network        NetworkMode                  `json:"network,omitempty"`
+	// Volumes are not part of the archive, the volumes of the same names are attached on import
+	Volumes []VolumeMount `json:"volumes,omitempty"`
+}
+
+// snapshotFile is a single entry of the archive along with its checksum
+type snapshotFile struct {
+	Name   string `json:"name"`
+	Kind   string `json:"kind"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// exportSnapshot pauses the vm, takes a full snapshot of it and writes the memory file,
+// vm state, attached disks and vm metadata as a gzip compressed tar into w.
+func (f *Firecracker) exportSnapshot(ctx context.Context, w io.Writer) error {
+
+	version, err := f.vm.GetFirecrackerVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get firecracker version: %v", err)
+	}
+
+	// a vm paused through the api stays paused
+	if f.status() != StatePaused {
+		if err := f.vm.PauseVM(ctx); err != nil {
+			return fmt.Errorf("failed to pause vm: %v", err)
+		}
+		defer func() {
+			if err := f.vm.ResumeVM(ctx); err != nil {
+				f.opts.Logger.Errorf("failed to resume vm %s after export: %v", f.ID, err)
+			}
+		}()
+	}
+
+	start := time.Now()
+
+	err = f.vm.CreateSnapshot(ctx, snapshotMemFile, snapshotStateFile,
+		func(data *operations.CreateSnapshotParams) {
+			data.Body.SnapshotType = "Full"
+		})
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %v", err)
+	}
+	defer os.Remove(f.chrootPath(snapshotMemFile))
+	defer os.Remove(f.chrootPath(snapshotStateFile))
+
+	observeSince(snapshotSeconds.WithLabelValues("export"), start)
+	f.opts.Logger.Debugf("created snapshot of vm %s in %s", f.ID, time.Since(start))
+
+	// the volumes may be shared with other vms, only the rootfs goes into the archive
+	rootfs := filepath.Base(f.opts.RootFsImage)
+	sources := map[string]string{
+		snapshotMemFile:   "memory",
+		snapshotStateFile: "state",
+		rootfs:            "disk",
+	}
+	names := []string{snapshotMemFile, snapshotStateFile, rootfs}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	manifest := snapshotManifest{
+		FormatVersion:      snapshotFormatVersion,
+		FirecrackerVersion: version,
+		CreatedAt:          time.Now().UTC(),
+		VM:                 f.snapshotMetadata(),
+	}
+
+	for _, name := range names {
+		file, err := addArchiveFile(tw, name, f.chrootPath(name))
+		if err != nil {
+			return err
+		}
+		file.Kind = sources[name]
+		manifest.Files = append(manifest.Files, file)
+	}
+
+	data, err := json.MarshalIndent(&manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal snapshot manifest: %v", err)
+	}
+
+	hdr := &tar.Header{
+		Name:    snapshotManifestName,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: manifest.CreatedAt,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write snapshot manifest: %v", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write snapshot manifest: %v", err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to close snapshot archive: %v", err)
+	}
+
+	return gz.Close()
+}
+
+// snapshotMetadata collects the vm settings stored along the snapshot
+func (f *Firecracker) snapshotMetadata() snapshotMetadata {
+	return snapshotMetadata{
+		ID:             f.ID,
+		Name:           f.opts.Name,
+		Image:          f.opts.ProvidedImage,
+		VmIndex:        f.opts.VmIndex,
+		KernelBootArgs: f.opts.KernelBootArgs,
+		Tap:            f.opts.Tap,
+		TapMacAddr:     f.opts.TapMacAddr,
+		FcIP:           f.opts.FcIP,
+		CPUCount:       f.opts.FcCPUCount,
+		MemSz:          f.opts.FcMemSz,
+		ImageConfig:    f.opts.ImageConfig,
+		AgentToken:     f.opts.AgentToken,
+		Balloon:        f.opts.Balloon,
+		Ports:          f.opts.Ports,
+		Network:        f.opts.Network,
+		Volumes:        f.opts.Volumes,
+	}
+}
+
+// addArchiveFile copies the file at path into the archive under name and returns its checksum
+func addArchiveFile(tw *tar.Writer, name, path string) (snapshotFile, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return snapshotFile{}, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return snapshotFile{}, fmt.Errorf("failed to stat %s: %v", path, err)
+	}
+
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return snapshotFile{}, fmt.Errorf("failed to write archive header for %s: %v", name, err)
+	}
+
+	sum := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tw, sum), file); err != nil {
+		return snapshotFile{}, fmt.Errorf("failed to archive %s: %v", name, err)
+	}
+
+	return snapshotFile{
+		Name:   name,
+		Size:   info.Size(),
+		SHA256: hex.EncodeToString(sum.Sum(nil)),
+	}, nil
+}
+
+// importSnapshot unpacks a snapshot archive, verifies it against the local firecracker
+// binary and restores the vm it contains for the tenant of caller. force skips the firecracker version check.
+func importSnapshot(r io.Reader, force bool, caller *principal) (*Firecracker, error) {
+
+	id := uuid()
+	dir, err := filepath.Abs(filepath.Join(conf.SnapshotDir, id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve snapshot directory: %v", err)
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create snapshot directory: %v", err)
+	}
+
+	manifest, err := extractSnapshotArchive(r, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	if !force {
+		local, err := firecrackerVersion("firecracker")
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		if !compatibleVersions(manifest.FirecrackerVersion, local) {
+			os.RemoveAll(dir)
+			return nil, fmt.Errorf("%w: snapshot %s, host %s", errSnapshotVersion, manifest.FirecrackerVersion, local)
+		}
+	}
+
+	// the manifest comes from the caller, what ends up in the commands setting up the network is
+	// checked like the request of a new vm
+	if err := validateNetwork(manifest.VM.Network, manifest.VM.Ports); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if manifest.VM.CPUCount < 1 || manifest.VM.CPUCount > maxVCPUs || manifest.VM.MemSz < minMemoryMiB {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("%w: the snapshot vm has %d vcpus and %d MiB of memory", errInvalidRequest, manifest.VM.CPUCount, manifest.VM.MemSz)
+	}
+	if err := checkPortsFree(manifest.VM.Ports, nil); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if err := checkVolumes(manifest.VM.Volumes, caller, nil); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	// the guest keeps its ip address, it needs the vm index of the snapshot
+	rsv, err := admit(caller.Tenant, Resources{VMs: 1, VCPUs: manifest.VM.CPUCount, MemoryMiB: manifest.VM.MemSz, DiskMiB: rootfsDiskMiB}, manifest.VM.VmIndex, nil)
+	if errors.Is(err, errVmIndexInUse) {
+		err = fmt.Errorf("%w: fc-tap-%d", errSnapshotTapInUse, manifest.VM.VmIndex)
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	defer rsv.release()
+
+	m, err := restoreSnapshot(id, dir, manifest, caller.Tenant)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	putVm(m)
+	rsv.keep()
+
+	return m, nil
+}
+
+// extractSnapshotArchive writes every archive entry into dir and checks them against the manifest
+func extractSnapshotArchive(r io.Reader, dir string) (*snapshotManifest, error) {
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot archive: %w", err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+
+	sums := make(map[string]string)
+	var manifest *snapshotManifest
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read snapshot archive: %w", err)
+		}
+
+		if hdr.Typeflag != tar.TypeReg || hdr.Name != filepath.Base(hdr.Name) || strings.HasPrefix(hdr.Name, ".") {
+			return nil, fmt.Errorf("unexpected entry %q in snapshot archive", hdr.Name)
+		}
+
+		if hdr.Name == snapshotManifestName {
+			manifest = new(snapshotManifest)
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("failed to decode snapshot manifest: %w", err)
+			}
+			continue
+		}
+
+		file, err := os.OpenFile(filepath.Join(dir, hdr.Name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s: %v", hdr.Name, err)
+		}
+
+		sum := sha256.New()
+		_, err = io.Copy(io.MultiWriter(file, sum), tr)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+		}
+
+		sums[hdr.Name] = hex.EncodeToString(sum.Sum(nil))
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("snapshot archive has no %s", snapshotManifestName)
+	}
+
+	if manifest.FormatVersion != snapshotFormatVersion {
+		return nil, fmt.Errorf("unsupported snapshot format version %d", manifest.FormatVersion)
+	}
+
+	for _, file := range manifest.Files {
+		if sums[file.Name] != file.SHA256 {
+			return nil, fmt.Errorf("%w: %s", errSnapshotChecksum, file.Name)
+		}
+		delete(sums, file.Name)
+	}
+
+	if len(sums) != 0 {
+		return nil, fmt.Errorf("snapshot archive contains files missing from its manifest")
+	}
+
+	return manifest, nil
+}
+
+// restoreSnapshot starts firecracker in a jail out of an extracted snapshot directory, the vm belongs to tenant
+func restoreSnapshot(id, dir string, manifest *snapshotManifest, tenant string) (*Firecracker, error) {
+
+	meta := manifest.VM
+
+	// the tap device, mac and ip address only come from the vm index admit checked, the guest
+	// configured its network from the same index
+	opts := getOptions(CreateRequest{Name: meta.Name, DockerImage: meta.Image})
+	opts.setVmIndex(meta.VmIndex)
+	opts.Id = id
+	opts.Tenant = tenant
+	opts.KernelBootArgs = meta.KernelBootArgs
+	opts.FcCPUCount = meta.CPUCount
+	opts.FcMemSz = meta.MemSz
+	opts.ImageConfig = meta.ImageConfig
+	opts.AgentToken = meta.AgentToken
+	// the balloon device is part of the snapshot, the config tells how to poll it
+	opts.Balloon = meta.Balloon
+	opts.Ports = meta.Ports
+	opts.Network = meta.Network
+	opts.Volumes = meta.Volumes
+	opts.Logger = vmLogger(id, &opts)
+
+	for _, file := range manifest.Files {
+		if file.Kind == "disk" {
+			opts.RootFsImage = filepath.Join(dir, file.Name)
+			break
+		}
+	}
+
+	// a failed restore leaves neither the tap device nor the rules of the vm behind
+	restored := false
+	defer func() {
+		if !restored {
+			opts.ClearNetwork()
+			opts.removeTap()
+		}
+	}()
+
+	if err := opts.SetNetwork(); err != nil {
+		return nil, fmt.Errorf("failed to set network: %s", err)
+	}
+
+	console, err := newConsole(filepath.Join(conf.ConsoleDir, id+".log"), conf.ConsoleBufferSize, conf.ConsoleLogSize<<20)
+	if err != nil {
+		return nil, err
+	}
+	opts.Console = console
+
+	if err := opts.prepareFifos(id); err != nil {
+		console.Close()
+		return nil, err
+	}
+
+	// the snapshot refers to its disks by their names in the jail, they are linked into it like
+	// those of a new vm
+	cfg := opts.getConfig()
+	cfg.VMID = id
+	cfg.JailerCfg.ID = id
+	uid, gid := *cfg.JailerCfg.UID, *cfg.JailerCfg.GID
+
+	files := []string{opts.RootFsImage, filepath.Join(dir, snapshotMemFile), filepath.Join(dir, snapshotStateFile)}
+	for _, v := range opts.Volumes {
+		files = append(files, volumePath(v.Name))
+	}
+	for _, file := range files {
+		if err := exposeBlockDeviceToJail(file, uid, gid); err != nil {
+			console.Close()
+			return nil, fmt.Errorf("failed to expose %s to jail: %v", filepath.Base(file), err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	m, err := firecracker.NewMachine(ctx, cfg, firecracker.WithLogger(opts.Logger), firecracker.WithProcessRunner(jailerCommand(ctx, cfg)))
+	if err != nil {
+		cancel()
+		console.Close()
+		return nil, fmt.Errorf("failed creating machine: %v", err)
+	}
+
+	res := &Firecracker{
+		ID:        id,
+		Name:      meta.Name,
+		ctx:       ctx,
+		cancelCtx: cancel,
+		vm:        m,
+		state:     StateCreated,
+		opts:      &opts,
+		rootDir:   jailRoot(cfg.JailerCfg),
+		console:   console,
+	}
+	res.agent = agent.NewClient(res.chrootPath(agentSocket), agent.DefaultPort, opts.AgentToken)
+
+	// firecracker.WithSnapshot drops the handlers linking the files into the jail, the snapshot is
+	// loaded along with them instead. The devices come with the snapshot.
+	m.Cfg.Snapshot = firecracker.SnapshotConfig{MemFilePath: snapshotMemFile, SnapshotPath: snapshotStateFile, ResumeVM: true}
+	m.Handlers.Validation = firecracker.HandlerList{}.Append(firecracker.JailerConfigValidationHandler)
+	m.Handlers.FcInit = firecracker.HandlerList{}.Append(
+		firecracker.StartVMMHandler,
+		firecracker.CreateLogFilesHandler,
+		res.collectFifosHandler(),
+		firecracker.LinkFilesHandler(filepath.Base(cfg.KernelImagePath)),
+		res.linkSnapshotHandler(dir),
+		firecracker.Handler{
+			Name: listenExitHandlerName,
+			Fn: func(ctx context.Context, m *firecracker.Machine) error {
+				return res.listenExit(uid, gid)
+			},
+		},
+		firecracker.BootstrapLoggingHandler,
+		firecracker.LoadSnapshotHandler,
+	)
+
+	res.emit(EventCreated)
+	start := time.Now()
+
+	if err := m.Start(ctx); err != nil {
+		cancel()
+		console.Close()
+		res.closeFifos()
+		res.closeExit()
+		vmFailures.WithLabelValues("restore").Inc()
+		err = fmt.Errorf("failed to restore snapshot: %v", err)
+		res.emitError(err)
+		return nil, err
+	}
+
+	observeSince(snapshotSeconds.WithLabelValues("restore"), start)
+	log.Debugf("restored snapshot of vm %s as %s in %s", meta.ID, id, time.Since(start))
+
+	res.setState(StateStarted)
+	res.emit(EventStarted)
+
+	if err := res.saveRecord(); err != nil {
+		log.Errorf("failed to save record of vm %s: %v", id, err)
+	}
+
+	go res.monitor()
+
+	restored = true
+	return res, nil
+}
+
+// linkSnapshotHandler links the memory and state files of the snapshot extracted in dir into the jail
+func (f *Firecracker) linkSnapshotHandler(dir string) firecracker.Handler {
+	return firecracker.Handler{
+		Name: linkSnapshotHandlerName,
+		Fn: func(ctx context.Context, m *firecracker.Machine) error {
+			for _, name := range []string{snapshotMemFile, snapshotStateFile} {
+				if err := os.Link(filepath.Join(dir, name), f.chrootPath(name)); err != nil {
+					return fmt.Errorf("failed to link %s into the jail: %v", name, err)
+				}
+			}
+			return nil
+		},
+	}
+}
+
+var versionPattern = regexp.MustCompile(`v?(\d+)\.(\d+)\.(\d+)`)
+
+// firecrackerVersion asks the supplied firecracker binary for its version
+func firecrackerVersion(bin string) (string, error) {
+
+	out, err := RunOutput(fmt.Sprintf("%s --version", bin))
+	if err != nil {
+		return "", fmt.Errorf("failed to get firecracker version: %v", err)
+	}
+
+	version := versionPattern.FindString(string(out))
+	if version == "" {
+		return "", fmt.Errorf("failed to parse firecracker version from %q", out)
+	}
+
+	return strings.TrimPrefix(version, "v"), nil
+}
+
+// compatibleVersions reports whether a snapshot taken by firecracker a can be loaded by b,
+// firecracker only guarantees this within the same major and minor release.
+func compatibleVersions(a, b string) bool {
+	pa := versionPattern.FindStringSubmatch(a)
+	pb := versionPattern.FindStringSubmatch(b)
+	if pa == nil || pb == nil {
+		return false
+	}
+	return pa[1] == pb[1] && pa[2] == pb[2]
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// testSnapshotArchive is an archive holding nothing but the manifest of vm
+func testSnapshotArchive(t *testing.T, vm snapshotMetadata) *bytes.Buffer {
+	t.Helper()
+	manifest, err := json.Marshal(snapshotManifest{FormatVersion: snapshotFormatVersion, VM: vm})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: snapshotManifestName, Mode: 0600, Size: int64(len(manifest)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(manifest)
+	tw.Close()
+	gz.Close()
+	return buf
+}
+
+// TestImportSnapshotManifest checks a manifest can not smuggle anything into the commands
+// setting up the network of the vm, nothing reaches them
+func TestImportSnapshotManifest(t *testing.T) {
+	saved := conf
+	defer func() { conf = saved }()
+	conf.SnapshotDir = t.TempDir()
+
+	valid := snapshotMetadata{VmIndex: firstVmIndex, CPUCount: 1, MemSz: 256}
+
+	for _, c := range []struct {
+		name   string
+		change func(*snapshotMetadata)
+	}{
+		{"port protocol", func(m *snapshotMetadata) {
+			m.Ports = []PortMapping{{HostPort: 8080, GuestPort: 80, Protocol: "tcp; reboot"}}
+		}},
+		{"port out of range", func(m *snapshotMetadata) {
+			m.Ports = []PortMapping{{HostPort: 70000, GuestPort: 80}}
+		}},
+		{"network mode", func(m *snapshotMetadata) { m.Network = "nat; reboot" }},
+		{"no vcpus", func(m *snapshotMetadata) { m.CPUCount = 0 }},
+		{"too little memory", func(m *snapshotMetadata) { m.MemSz = 1 }},
+		{"vm index out of range", func(m *snapshotMetadata) { m.VmIndex = 1000 }},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			vm := valid
+			c.change(&vm)
+			_, err := importSnapshot(testSnapshotArchive(t, vm), true, anonymous)
+			if !errors.Is(err, errInvalidRequest) {
+				t.Fatalf("got %v, want an invalid request", err)
+			}
+		})
+	}
+}
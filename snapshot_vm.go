@@ -17,10 +17,7 @@ func createSnapshot(socketPath string, snapshotPath string) error {
 	cfg := firecracker.Config{SocketPath: socketPath}
 	ctx := context.Background()
 
-	// Create a logger to have a nice output
-	logger := log.New()
-
-	machine, err := firecracker.NewMachine(ctx, cfg, firecracker.WithLogger(log.NewEntry(logger)))
+	machine, err := firecracker.NewMachine(ctx, cfg, firecracker.WithLogger(log.NewEntry(daemonLogger)))
 	if err != nil {
 		return fmt.Errorf("failed to create new machine: %v", err)
 	}
@@ -39,7 +36,8 @@ func createSnapshot(socketPath string, snapshotPath string) error {
 		return fmt.Errorf("failed to create snapshot: %v", err)
 	}
 
-	fmt.Println("Created snapshot duration:", time.Since(start))
+	observeSince(snapshotSeconds.WithLabelValues("create"), start)
+	log.Debugf("created snapshot in %s", time.Since(start))
 
 	if err := machine.ResumeVM(ctx); err != nil {
 		return fmt.Errorf("failed to resume vm: %v", err)
@@ -78,8 +76,6 @@ func (o *options) loadSnapshot(ctx context.Context, snapshotPath string) error {
 		WithStderr(os.Stderr).
 		Build(ctx)
 
-	logger := log.New()
-
 	// Start Firecracker
 	err := cmd.Start()
 	if err != nil {
@@ -87,7 +83,7 @@ func (o *options) loadSnapshot(ctx context.Context, snapshotPath string) error {
 	}
 	defer cmd.Wait()
 
-	machine, err := firecracker.NewMachine(ctx, cfg, firecracker.WithLogger(log.NewEntry(logger)))
+	machine, err := firecracker.NewMachine(ctx, cfg, firecracker.WithLogger(o.Logger))
 	if err != nil {
 		return fmt.Errorf("failed to create new machine: %v", err)
 	}
@@ -109,7 +105,8 @@ func (o *options) loadSnapshot(ctx context.Context, snapshotPath string) error {
 		return fmt.Errorf("wait returned an error %v", err)
 	}
 
-	fmt.Println("resuming snapshot duration:", time.Since(start))
+	observeSince(snapshotSeconds.WithLabelValues("load"), start)
+	log.Debugf("resumed snapshot in %s", time.Since(start))
 
 	return nil
 }
@@ -3,28 +3,42 @@ package main
 import (
 	"context"
 	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
 )
 
 // StartVm is responsible to start vm
-func StartVm(m *Firecracker) (*Firecracker, error) {
+func StartVm(ctx context.Context, m *Firecracker) (*Firecracker, error) {
+
+	_, span := tracer.Start(ctx, "StartVm", trace.WithAttributes(vmAttributes(m.ID, m.opts)...))
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	start := time.Now()
+	m.emit(EventBooting)
 
-	if err := m.vm.Start(ctx); err != nil {
+	// firecracker lives in the context of the vm, not in the one of the request starting it
+	if err := m.vm.Start(m.ctx); err != nil {
 
-		m.state = StateFailed
+		m.setState(StateFailed)
+		m.closeFifos()
 
-		return m, fmt.Errorf("failed to start machine: %v", err)
+		err = fmt.Errorf("failed to start machine: %v", err)
+		endSpan(span, err)
+		m.emitError(err)
+		return m, err
 	}
-	defer m.vm.StopVMM()
+	endSpan(span, nil)
 
-	go func() {
-		m.vm.Wait(ctx)
-	}()
+	m.setState(StateStarted)
+	observeSince(bootSeconds, start)
+	m.emit(EventStarted)
+
+	if err := m.saveRecord(); err != nil {
+		// the vm runs fine, it just can not be reattached by the next run of the daemon
+		m.opts.Logger.Errorf("failed to save record of vm %s: %v", m.ID, err)
+	}
 
-	m.state = StateStarted
-	m.cancelCtx = cancel
+	go m.monitor()
 
 	return m, nil
 }
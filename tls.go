@@ -0,0 +1,231 @@
+// tls file is used to serve the api over https, with certificates reloaded as soon as they
+// are renewed on disk, and over a unix socket restricted by its file permissions.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// certReloader serves the certificate of certFile and keyFile, read again whenever one of them changes
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// newCertReloader loads the certificate and key pair
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// lastModified is the latest modification time of the certificate and key files
+func (c *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// reload reads the pair again when it changed since the last load and tells whether it did.
+// The previous certificate is kept when the new pair is invalid, e.g. half written.
+func (c *certReloader) reload() (bool, error) {
+	modTime, err := c.lastModified()
+	if err != nil {
+		return false, fmt.Errorf("failed to stat tls certificate: %v", err)
+	}
+
+	c.mu.RLock()
+	unchanged := c.cert != nil && modTime.Equal(c.modTime)
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to load tls certificate: %v", err)
+	}
+
+	c.mu.Lock()
+	c.cert, c.modTime = &cert, modTime
+	c.mu.Unlock()
+
+	return true, nil
+}
+
+// GetCertificate hands the current certificate to the tls handshakes
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// watch reloads the certificate every interval until ctx is done
+func (c *certReloader) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reloaded, err := c.reload()
+		if err != nil {
+			log.Errorf("keeping the current tls certificate: %v", err)
+			continue
+		}
+		if reloaded {
+			log.Infof("reloaded tls certificate %s", c.certFile)
+		}
+	}
+}
+
+// apiTLSConfig is the TLS configuration of the api, nil when it is served over plain http.
+// Client certificates are checked against -tls-client-ca and the CA of the client certificate
+// authentication, -tls-client-auth tells whether clients must present one.
+func apiTLSConfig() (*tls.Config, *certReloader, error) {
+	certAuth := auth != nil && auth.ClientCerts != nil
+
+	if conf.TLSCert == "" {
+		if certAuth || conf.TLSClientCA != "" {
+			return nil, nil, fmt.Errorf("client certificates require -tls-cert and -tls-key")
+		}
+		return nil, nil, nil
+	}
+
+	reloader, err := newCertReloader(conf.TLSCert, conf.TLSKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: reloader.GetCertificate}
+
+	if certAuth || conf.TLSClientCA != "" {
+		// a copy, the CA of -tls-client-ca lets clients through the handshake but must not authenticate them
+		cfg.ClientCAs = x509.NewCertPool()
+		if certAuth {
+			cfg.ClientCAs = auth.ClientCerts.pool.Clone()
+		}
+		if conf.TLSClientCA != "" {
+			pem, err := os.ReadFile(conf.TLSClientCA)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to read client ca: %v", err)
+			}
+			if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+				return nil, nil, fmt.Errorf("no certificate found in %s", conf.TLSClientCA)
+			}
+		}
+	}
+
+	switch conf.TLSClientAuth {
+	case "":
+		if cfg.ClientCAs != nil {
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	case "none":
+		if certAuth {
+			return nil, nil, fmt.Errorf("client certificate authentication requires -tls-client-auth optional or require")
+		}
+	case "optional", "require":
+		if cfg.ClientCAs == nil {
+			return nil, nil, fmt.Errorf("-tls-client-auth %s requires -tls-client-ca", conf.TLSClientAuth)
+		}
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if conf.TLSClientAuth == "require" {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown -tls-client-auth %q, use none, optional or require", conf.TLSClientAuth)
+	}
+
+	return cfg, reloader, nil
+}
+
+// listenUnix listens on the unix socket at path with the permissions mode, owned by group when set
+func listenUnix(path, mode, group string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0777 {
+		return nil, fmt.Errorf("invalid unix socket mode %q", mode)
+	}
+
+	gid := -1
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up unix socket group: %v", err)
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	// a socket left behind by a previous run would make the listen fail
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to remove stale unix socket: %v", err)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on unix socket: %v", err)
+	}
+
+	if err := os.Chown(path, -1, gid); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to change unix socket group: %v", err)
+	}
+	if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to change unix socket mode: %v", err)
+	}
+
+	return ln, nil
+}
+
+// markLocal tags the context of the connections of the unix socket, its callers are trusted
+func markLocal(ctx context.Context, c net.Conn) context.Context {
+	if c.LocalAddr().Network() == "unix" {
+		return ctxSetLocal(ctx)
+	}
+	return ctx
+}
+
+// serveAPI serves srv on ln, over https when srv has a TLS configuration and ln is not the unix socket
+func serveAPI(srv *http.Server, ln net.Listener) error {
+	var err error
+	if srv.TLSConfig != nil && ln.Addr().Network() != "unix" {
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
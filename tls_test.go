@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority issuing client certificates to the tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue signs a client certificate for the common name cn
+func (ca *testCA) issue(t *testing.T, cn string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestTransportCANotAuthenticating(t *testing.T) {
+	dir := t.TempDir()
+	authCA, transportCA := newTestCA(t, "auth"), newTestCA(t, "transport")
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// a self signed server certificate is enough for the configuration to load
+	server := newTestCA(t, "localhost")
+	key, err := x509.MarshalECPrivateKey(server.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	savedConf, savedAuth := conf, auth
+	defer func() { conf, auth = savedConf, savedAuth }()
+
+	conf.TLSCert = write("server.pem", server.pem)
+	conf.TLSKey = write("server.key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}))
+	conf.TLSClientCA = write("transport.pem", transportCA.pem)
+	conf.TLSClientAuth = ""
+
+	auth = &authConfig{ClientCerts: &certAuth{CA: write("auth.pem", authCA.pem)}}
+	if err := auth.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, _, err := apiTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transportCert := transportCA.issue(t, "ops")
+	if _, err := transportCert.Verify(x509.VerifyOptions{Roots: cfg.ClientCAs, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Fatalf("the handshake should accept the -tls-client-ca certificate: %v", err)
+	}
+	if _, err := auth.ClientCerts.verify([]*x509.Certificate{transportCert}); err == nil {
+		t.Fatal("a certificate of the -tls-client-ca CA authenticated a tenant")
+	}
+
+	if _, err := auth.ClientCerts.verify([]*x509.Certificate{authCA.issue(t, "acme")}); err != nil {
+		t.Fatalf("a certificate of the client_certs CA was rejected: %v", err)
+	}
+
+	// the holder of a -tls-client-ca certificate still authenticates with its token
+	sum := sha256.Sum256([]byte("ops-token"))
+	auth.Tokens = []*apiToken{{SHA256: hex.EncodeToString(sum[:]), Tenant: "ops"}}
+	for _, c := range []struct {
+		name   string
+		cert   *x509.Certificate
+		token  string
+		tenant string
+		method string
+	}{
+		{"auth CA certificate", authCA.issue(t, "acme"), "", "acme", "mtls"},
+		{"auth CA certificate and token", authCA.issue(t, "acme"), "ops-token", "acme", "mtls"},
+		{"transport CA certificate and token", transportCert, "ops-token", "ops", "token"},
+		{"transport CA certificate", transportCert, "", "", ""},
+		{"transport CA certificate and unknown token", transportCert, "other", "", ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/list", nil)
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{c.cert}}
+			if c.token != "" {
+				r.Header.Set("Authorization", "Bearer "+c.token)
+			}
+			p, err := auth.authenticate(r)
+			if c.tenant == "" {
+				if !errors.Is(err, errUnauthenticated) {
+					t.Fatalf("got %+v, %v, want an authentication error", p, err)
+				}
+				return
+			}
+			if err != nil || p.Tenant != c.tenant || p.Method != c.method {
+				t.Fatalf("got %+v, %v, want %s by %s", p, err, c.tenant, c.method)
+			}
+		})
+	}
+}
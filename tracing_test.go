@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	spansOnce sync.Once
+	spans     *tracetest.SpanRecorder
+)
+
+// recordSpans installs a recorder of the spans of the daemon, the global provider can only be
+// set once for the tracer to follow it
+func recordSpans() *tracetest.SpanRecorder {
+	spansOnce.Do(func() {
+		spans = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	return spans
+}
+
+// endedSpan is the last ended span called name
+func endedSpan(t *testing.T, rec *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	t.Helper()
+	ended := rec.Ended()
+	for i := len(ended) - 1; i >= 0; i-- {
+		if ended[i].Name() == name {
+			return ended[i]
+		}
+	}
+	t.Fatalf("no span %q", name)
+	return nil
+}
+
+func TestSetupTracing(t *testing.T) {
+	saved := conf
+	defer func() { conf = saved }()
+
+	for _, exporter := range []string{"", "none"} {
+		conf.TraceExporter = exporter
+		shutdown, err := setupTracing(context.Background())
+		if err != nil || shutdown(context.Background()) != nil {
+			t.Fatalf("%q: %v", exporter, err)
+		}
+	}
+
+	conf.TraceExporter = "jaeger"
+	if _, err := setupTracing(context.Background()); err == nil {
+		t.Fatal("an unknown exporter was accepted")
+	}
+}
+
+func TestTraceRequests(t *testing.T) {
+	rec := recordSpans()
+
+	r := chi.NewRouter()
+	r.Use(traceRequests)
+	r.Get("/api/vms/{vm_id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	// the trace of the client goes on in the daemon
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("GET", "/api/vms/vm-1", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	span := endedSpan(t, rec, "GET /api/vms/{vm_id}")
+	if got := span.SpanContext().TraceID().String(); got != traceID {
+		t.Fatalf("the span is in the trace %s", got)
+	}
+	if span.Status().Code != codes.Error {
+		t.Fatalf("the failed request has the status %v", span.Status())
+	}
+	attrs := make(map[string]string)
+	for _, kv := range span.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attrs["http.route"] != "/api/vms/{vm_id}" || attrs["http.status_code"] != "502" {
+		t.Fatalf("got attributes %v", attrs)
+	}
+}
+
+func TestTraceStep(t *testing.T) {
+	rec := recordSpans()
+
+	ctx, parent := tracer.Start(context.Background(), "create")
+	failed := errors.New("no space left")
+	if err := traceStep(ctx, "rootfs", func() error { return failed }); err != failed {
+		t.Fatalf("got %v", err)
+	}
+	traceStep(ctx, "boot", func() error { return nil })
+	parent.End()
+
+	rootfs, boot := endedSpan(t, rec, "rootfs"), endedSpan(t, rec, "boot")
+	for _, span := range []sdktrace.ReadOnlySpan{rootfs, boot} {
+		if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Fatalf("%s is not a step of the create", span.Name())
+		}
+	}
+	if rootfs.Status().Code != codes.Error || len(rootfs.Events()) != 1 {
+		t.Fatalf("the failed step has the status %v", rootfs.Status())
+	}
+	if boot.Status().Code == codes.Error {
+		t.Fatal("the step which went through failed")
+	}
+}
@@ -1,31 +1,91 @@
 package main
 
 import (
-	"net"
 	"net/http"
+
+	"github.com/iradukunda1/firecrackerland/client"
+)
+
+// the api types live in the client package, so the daemon and its clients share them
+type (
+	CreateRequest  = client.CreateRequest
+	CreateResponse = client.CreateResponse
+	VmList         = client.VmList
+	VmState        = client.VmState
+	RestartPolicy  = client.RestartPolicy
+	Resources      = client.Resources
+	Usage          = client.Usage
+	HostUsage      = client.HostUsage
+	BalloonConfig  = client.BalloonConfig
+	BalloonRequest = client.BalloonRequest
+	BalloonStats   = client.BalloonStats
+	BalloonState   = client.BalloonState
+	TokenBucket    = client.TokenBucket
+	RateLimit      = client.RateLimit
+	RateLimits     = client.RateLimits
+	VolumeMount    = client.VolumeMount
+	VolumeRequest  = client.VolumeRequest
+	Volume         = client.Volume
+	VmMetrics      = client.VmMetrics
+	LoggingConfig  = client.LoggingConfig
+	DeleteRequest  = client.DeleteRequest
+	SignalRequest  = client.SignalRequest
+	ExecRequest    = client.ExecRequest
+	ExecEvent      = client.ExecEvent
+	ExecControl    = client.ExecControl
+	EventType      = client.EventType
+	Event          = client.Event
+	PortMapping    = client.PortMapping
+	NetworkMode    = client.NetworkMode
+	Spec           = client.Spec
+	VmSpec         = client.VmSpec
+	VmResources    = client.VmResources
+	ApplyAction    = client.ApplyAction
+	ApplyChange    = client.ApplyChange
+	ApplyResult    = client.ApplyResult
+)
+
+// avaliable vmState kind status
+const (
+	StateCreated    = client.StateCreated
+	StateStarted    = client.StateStarted
+	StatePaused     = client.StatePaused
+	StateFailed     = client.StateFailed
+	StateExited     = client.StateExited
+	StateRestarting = client.StateRestarting
 )
 
-type CreateRequest struct {
-	Name        string `json:"name" validate:"required"`
-	DockerImage string `json:"docker-image" validate:"required"`
-}
+// available event types
+const (
+	EventCreated  = client.EventCreated
+	EventBooting  = client.EventBooting
+	EventStarted  = client.EventStarted
+	EventPaused   = client.EventPaused
+	EventResumed  = client.EventResumed
+	EventStopped  = client.EventStopped
+	EventExited   = client.EventExited
+	EventDeleted  = client.EventDeleted
+	EventSnapshot = client.EventSnapshot
+	EventError    = client.EventError
+)
 
-type CreateResponse struct {
-	ID     string  `json:"id,omitempty"`
-	PID    int64   `json:"pid,omitempty"`
-	State  VmState `json:"state,omitempty"`
-	Name   string  `json:"name,omitempty"`
-	IpAddr string  `json:"ip_address,omitempty"`
-	Agent  net.IP  `json:"agent,omitempty"`
-}
+// available network modes
+const (
+	NetworkNAT      = client.NetworkNAT
+	NetworkIsolated = client.NetworkIsolated
+)
 
-type DeleteRequest struct {
-	ID string `json:"id" validate:"required"`
-}
+// available apply actions
+const (
+	ApplyCreate    = client.ApplyCreate
+	ApplyUpdate    = client.ApplyUpdate
+	ApplyReplace   = client.ApplyReplace
+	ApplyStart     = client.ApplyStart
+	ApplyDelete    = client.ApplyDelete
+	ApplyUnchanged = client.ApplyUnchanged
+)
 
 // responseMessage
-type responseMessage struct {
-	Message string `json:"message"`
-}
+type responseMessage = client.Message
 
 type Middleware func(h http.Handler) http.Handler
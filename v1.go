@@ -0,0 +1,391 @@
+// v1 file is used to serve the versioned api under /api/v1, where vms are resources of /vms.
+// The routes are listed once and both the router and the OpenAPI document are built from them.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/iradukunda1/firecrackerland/client"
+)
+
+const v1Prefix = "/api/v1"
+
+// defaultPageSize and maxPageSize bound the vms returned by a single list call
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// available vm actions
+const (
+	actionPause  = client.ActionPause
+	actionResume = client.ActionResume
+	actionStop   = client.ActionStop
+	actionStart  = client.ActionStart
+)
+
+// v1Routes are the routes of the versioned api, their pattern is relative to /api/v1
+var v1Routes = []apiRoute{
+	{
+		ID: "createVm", Method: http.MethodPost, Pattern: "/vms", Handler: CreateVmV1Handler,
+		Summary: "Create a vm out of a docker image and boot it",
+		Request: CreateRequest{}, Status: http.StatusCreated, Response: CreateResponse{},
+	},
+	{
+		ID: "listVms", Method: http.MethodGet, Pattern: "/vms", Handler: ListVmsV1Handler,
+		Summary: "List the vms, sorted by id",
+		Query: []apiParam{
+			{"state", "string", "only the vms in this state"},
+			{"name", "string", "only the vms with this name"},
+			{"image", "string", "only the vms of this docker image"},
+			{"tenant", "string", "only the vms of this tenant, for admins"},
+			{"limit", "integer", fmt.Sprintf("most vms returned, %d by default and at most %d", defaultPageSize, maxPageSize)},
+			{"cursor", "string", "next_cursor of the previous page"},
+		},
+		Status: http.StatusOK, Response: VmList{},
+	},
+	{
+		ID: "getVm", Method: http.MethodGet, Pattern: "/vms/{vm_id}", Handler: InfoVmHandler,
+		Summary: "Get a vm",
+		Status:  http.StatusOK, Response: CreateResponse{},
+	},
+	{
+		ID: "deleteVm", Method: http.MethodDelete, Pattern: "/vms/{vm_id}", Handler: DeleteVmV1Handler,
+		Summary: "Delete a vm, shutting it down when it runs",
+		Status:  http.StatusNoContent,
+	},
+	vmAction(actionPause, "Pause the vcpus of a vm"),
+	vmAction(actionResume, "Resume a paused vm"),
+	vmAction(actionStop, "Shut a vm down, it is kept as exited"),
+	vmAction(actionStart, "Boot an exited or failed vm again"),
+	{
+		ID: "getVmsMetrics", Method: http.MethodGet, Pattern: "/vms/metrics", Handler: PrometheusVmsHandler,
+		Summary: "Scrape the firecracker metrics of every vm in the prometheus text format",
+		Status:  http.StatusOK, ResponseType: "text/plain",
+	},
+	{
+		ID: "getVmMetrics", Method: http.MethodGet, Pattern: "/vms/{vm_id}/metrics", Handler: MetricsVmHandler,
+		Summary: "Get the metrics firecracker reported for a vm",
+		Status:  http.StatusOK, Response: VmMetrics{},
+	},
+	{
+		ID: "exportSnapshot", Method: http.MethodGet, Pattern: "/vms/{vm_id}/snapshot", Handler: ExportSnapshotHandler,
+		Summary: "Export a running vm as a snapshot archive",
+		Status:  http.StatusOK, ResponseType: "application/gzip",
+	},
+	{
+		ID: "getConsole", Method: http.MethodGet, Pattern: "/vms/{vm_id}/console", Handler: ConsoleVmHandler,
+		Summary: "Read the serial console output of a vm",
+		Query: []apiParam{
+			{"tail", "integer", "only the last lines"},
+			{"follow", "boolean", "keep streaming new output"},
+		},
+		Status: http.StatusOK, ResponseType: "text/plain",
+	},
+	{
+		ID: "attachConsole", Method: http.MethodGet, Pattern: "/vms/{vm_id}/console/attach", Handler: AttachConsoleHandler,
+		Summary: "Attach to the serial console of a vm over a websocket",
+		Query: []apiParam{
+			{"tail", "integer", "lines of output sent first"},
+			{"readonly", "boolean", "ignore the input of the client"},
+		},
+		Status: http.StatusSwitchingProtocols,
+	},
+	{
+		ID: "getVmHealth", Method: http.MethodGet, Pattern: "/vms/{vm_id}/health", Handler: HealthVmHandler,
+		Summary: "Check the guest agent of a vm",
+		Status:  http.StatusOK, Response: client.Health{},
+	},
+	{
+		ID: "signalVm", Method: http.MethodPost, Pattern: "/vms/{vm_id}/signal", Handler: SignalVmHandler,
+		Summary: "Deliver a signal to a process of a vm, the container entrypoint by default",
+		Request: SignalRequest{}, Status: http.StatusOK, Response: responseMessage{},
+	},
+	{
+		ID: "execVm", Method: http.MethodPost, Pattern: "/vms/{vm_id}/exec", Handler: ExecVmHandler,
+		Summary: "Run a command in a vm, its output is streamed as json lines of ExecEvent",
+		Request: ExecRequest{}, Status: http.StatusOK, ResponseType: "application/x-ndjson",
+	},
+	{
+		ID: "attachExec", Method: http.MethodGet, Pattern: "/vms/{vm_id}/exec/attach", Handler: AttachExecHandler,
+		Summary: "Run an interactive command in a vm over a websocket",
+		Status:  http.StatusSwitchingProtocols,
+	},
+	{
+		ID: "downloadFiles", Method: http.MethodGet, Pattern: "/vms/{vm_id}/files", Handler: DownloadFilesHandler,
+		Summary: "Pull a file, or a tar archive of a directory, out of a vm",
+		Query: []apiParam{
+			{"path", "string", "absolute path in the vm"},
+			{"archive", "boolean", "get a single file as a tar archive as well"},
+		},
+		Status: http.StatusOK, ResponseType: "application/octet-stream",
+	},
+	{
+		ID: "uploadFiles", Method: http.MethodPut, Pattern: "/vms/{vm_id}/files", Handler: UploadFilesHandler,
+		Summary: "Push a file, or a tar archive extracted into path, into a vm",
+		Query: []apiParam{
+			{"path", "string", "absolute path in the vm"},
+			{"mode", "string", "octal mode of a single file, 0644 by default"},
+			{"uid", "integer", "owner of a single file"},
+			{"gid", "integer", "group of a single file"},
+		},
+		RequestType: "application/octet-stream", Status: http.StatusOK, Response: responseMessage{},
+	},
+	{
+		ID: "setRateLimits", Method: http.MethodPatch, Pattern: "/vms/{vm_id}/rate-limits", Handler: RateLimitsVmHandler,
+		Summary: "Change the disk and network limits of a running vm",
+		Request: RateLimits{}, Status: http.StatusOK, Response: RateLimits{},
+	},
+	{
+		ID: "setBalloon", Method: http.MethodPatch, Pattern: "/vms/{vm_id}/balloon", Handler: BalloonVmHandler,
+		Summary: "Inflate or deflate the memory balloon of a running vm",
+		Request: BalloonRequest{}, Status: http.StatusOK, Response: BalloonState{},
+	},
+	{
+		ID: "importSnapshot", Method: http.MethodPost, Pattern: "/snapshots/import", Handler: ImportSnapshotHandler,
+		Summary:     "Restore the vm of a snapshot archive",
+		Query:       []apiParam{{"force", "boolean", "skip the firecracker version check"}},
+		RequestType: "application/gzip", Status: http.StatusCreated, Response: CreateResponse{},
+	},
+	{
+		ID: "streamEvents", Method: http.MethodGet, Pattern: "/events", Handler: EventsHandler,
+		Summary: "Follow the events of the vms as server-sent events, or json messages over a websocket",
+		Query: []apiParam{
+			{"vm_id", "string", "comma separated ids of the vms whose events are sent"},
+			{"type", "string", "comma separated types of the events sent"},
+			{"last_event_id", "integer", "id of the last event received, the kept events following it are sent first"},
+		},
+		Status: http.StatusOK, ResponseType: "text/event-stream",
+	},
+	{
+		ID: "applySpec", Method: http.MethodPost, Pattern: "/apply", Handler: ApplyHandler,
+		Summary: "Converge the vms of an environment to a yaml or json spec",
+		Query:   []apiParam{{"dry_run", "boolean", "only plan the changes"}},
+		Request: Spec{}, RequestType: "application/yaml", Status: http.StatusOK, Response: ApplyResult{},
+	},
+	{
+		ID: "listKernels", Method: http.MethodGet, Pattern: "/kernels", Handler: ListKernelsHandler,
+		Summary: "List the kernels and initrds vms can boot",
+		Status:  http.StatusOK, Response: client.KernelRegistry{},
+	},
+	{
+		ID: "getUsage", Method: http.MethodGet, Pattern: "/usage", Handler: UsageHandler,
+		Summary: "Get what the vms of the caller hold on to and its quota",
+		Status:  http.StatusOK, Response: Usage{},
+	},
+	{
+		ID: "createVolume", Method: http.MethodPost, Pattern: "/volumes", Handler: CreateVolumeHandler, Admin: true,
+		Summary: "Create an empty ext4 data volume",
+		Request: VolumeRequest{}, Status: http.StatusCreated, Response: Volume{},
+	},
+	{
+		ID: "listVolumes", Method: http.MethodGet, Pattern: "/volumes", Handler: ListVolumesHandler, Admin: true,
+		Summary: "List the data volumes and the vms using them",
+		Status:  http.StatusOK, Response: []Volume{},
+	},
+	{
+		ID: "deleteVolume", Method: http.MethodDelete, Pattern: "/volumes/{name}", Handler: DeleteVolumeHandler, Admin: true,
+		Summary: "Delete a data volume no vm uses",
+		Status:  http.StatusOK, Response: responseMessage{},
+	},
+	{
+		ID: "getLogging", Method: http.MethodGet, Pattern: "/admin/logging", Handler: GetLoggingHandler, Admin: true,
+		Summary: "Get the level and format of the daemon logs",
+		Status:  http.StatusOK, Response: LoggingConfig{},
+	},
+	{
+		ID: "setLogging", Method: http.MethodPut, Pattern: "/admin/logging", Handler: SetLoggingHandler, Admin: true,
+		Summary: "Change the level or format of the daemon logs",
+		Request: LoggingConfig{}, Status: http.StatusOK, Response: LoggingConfig{},
+	},
+	{
+		ID: "getHostUsage", Method: http.MethodGet, Pattern: "/admin/usage", Handler: HostUsageHandler, Admin: true,
+		Summary: "Get what the vms of every tenant hold on to and what the host can give them",
+		Status:  http.StatusOK, Response: HostUsage{},
+	},
+}
+
+// vmAction is the route running action on a vm
+func vmAction(action, summary string) apiRoute {
+	return apiRoute{
+		ID: action + "Vm", Method: http.MethodPost, Pattern: "/vms/{vm_id}/actions/" + action, Handler: VmActionHandler(action),
+		Summary: summary,
+		Status:  http.StatusOK, Response: CreateResponse{},
+	}
+}
+
+// v1Handler registers the routes of the versioned api on r
+func v1Handler(r chi.Router) {
+	for _, route := range v1Routes {
+		if route.Admin {
+			r.With(requireAdmin).Method(route.Method, route.Pattern, route.Handler)
+			continue
+		}
+		r.Method(route.Method, route.Pattern, route.Handler)
+	}
+
+	spec, _ := json.Marshal(openAPI(v1Routes, v1Prefix))
+	r.Get("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(spec)
+	})
+}
+
+// deprecated flags the responses of the unversioned routes, pointing at the versioned route replacing them
+func deprecated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successorRoute(r.URL.Path)))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// successorRoute is the versioned route replacing the unversioned route of path
+func successorRoute(path string) string {
+	route := strings.TrimPrefix(path, "/api")
+	switch {
+	case route == "/create", route == "/list":
+		return v1Prefix + "/vms"
+	case route == "/delete":
+		return v1Prefix + "/vms/{vm_id}"
+	case route == "/stop":
+		return v1Prefix + "/vms/{vm_id}/actions/" + actionPause
+	case route == "/resume":
+		return v1Prefix + "/vms/{vm_id}/actions/" + actionResume
+	case strings.HasPrefix(route, "/vm-state/"):
+		return v1Prefix + "/vms/" + strings.TrimPrefix(route, "/vm-state/")
+	}
+	return v1Prefix + route
+}
+
+// For creating a vm, it is returned once booted
+func CreateVmV1Handler(w http.ResponseWriter, r *http.Request) {
+
+	defer r.Body.Close()
+
+	in := new(CreateRequest)
+	if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+		writeMessage(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return
+	}
+
+	m, err := createVm(r.Context(), in, ctxGetPrincipal(r.Context()), nil)
+	if err != nil {
+		ctxGetLogger(r.Context()).Errorf("failed to create vm: %v", err)
+		writeMessage(w, vmStatus(err), err.Error())
+		return
+	}
+
+	w.Header().Set("Location", v1Prefix+"/vms/"+m.ID)
+	writeResponse(w, http.StatusCreated, vmResource(m))
+}
+
+// For listing the vms of the caller a page at a time, filtered by the query parameters
+func ListVmsV1Handler(w http.ResponseWriter, r *http.Request) {
+
+	q := r.URL.Query()
+	caller := ctxGetPrincipal(r.Context())
+
+	limit := defaultPageSize
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			writeMessage(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageSize))
+			return
+		}
+		limit = n
+	}
+
+	vms := make(map[string]*Firecracker)
+	ids := make([]string, 0)
+	for _, m := range listVms() {
+		switch {
+		case !caller.owns(m):
+		case q.Get("state") != "" && string(m.status()) != q.Get("state"):
+		case q.Get("name") != "" && m.opts.Name != q.Get("name"):
+		case q.Get("image") != "" && m.opts.ProvidedImage != q.Get("image"):
+		case q.Get("tenant") != "" && m.opts.Tenant != q.Get("tenant"):
+		default:
+			ids = append(ids, m.ID)
+			vms[m.ID] = m
+		}
+	}
+
+	// the cursor is the last id of the previous page, vms deleted meanwhile do not shift the pages
+	cursor := q.Get("cursor")
+	start := sort.SearchStrings(ids, cursor)
+	if start < len(ids) && ids[start] == cursor {
+		start++
+	}
+
+	resp := VmList{Items: make([]CreateResponse, 0, limit)}
+	for _, id := range ids[start:] {
+		if len(resp.Items) == limit {
+			resp.NextCursor = resp.Items[len(resp.Items)-1].ID
+			break
+		}
+		resp.Items = append(resp.Items, vmResource(vms[id]))
+	}
+
+	if resp.NextCursor != "" {
+		next := r.URL.Query()
+		next.Set("cursor", resp.NextCursor)
+		w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", v1Prefix+"/vms", next.Encode()))
+	}
+
+	writeResponse(w, http.StatusOK, resp)
+}
+
+// For deleting a vm, it is shut down in the background when it runs
+func DeleteVmV1Handler(w http.ResponseWriter, r *http.Request) {
+
+	id := chi.URLParam(r, "vm_id")
+
+	running, ok := lookupVm(r, id)
+	if !ok {
+		writeMessage(w, http.StatusNotFound, fmt.Sprintf("the vm machine with this id %s is not exist", id))
+		return
+	}
+
+	deleteVm(running)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// VmActionHandler is the handler running action on the vm of the request, it responds with the vm
+func VmActionHandler(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		id := chi.URLParam(r, "vm_id")
+
+		running, ok := lookupVm(r, id)
+		if !ok {
+			writeMessage(w, http.StatusNotFound, fmt.Sprintf("the vm machine with this id %s is not exist", id))
+			return
+		}
+
+		var err error
+		switch action {
+		case actionPause:
+			err = running.pause(r.Context())
+		case actionResume:
+			err = running.resume(r.Context())
+		case actionStop:
+			err = running.stop()
+		case actionStart:
+			running, err = running.boot(r.Context())
+		}
+		if err != nil {
+			writeMessage(w, vmStatus(err), err.Error())
+			return
+		}
+
+		writeResponse(w, http.StatusOK, vmResource(running))
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+)
+
+func TestSuccessorRoute(t *testing.T) {
+	for _, c := range []struct {
+		path string
+		want string
+	}{
+		{"/api/create", "/api/v1/vms"},
+		{"/api/list", "/api/v1/vms"},
+		{"/api/delete", "/api/v1/vms/{vm_id}"},
+		{"/api/stop", "/api/v1/vms/{vm_id}/actions/pause"},
+		{"/api/resume", "/api/v1/vms/{vm_id}/actions/resume"},
+		{"/api/vm-state/vm-1", "/api/v1/vms/vm-1"},
+		{"/api/kernels", "/api/v1/kernels"},
+	} {
+		t.Run(c.path, func(t *testing.T) {
+			if got := successorRoute(c.path); got != c.want {
+				t.Fatalf("got %s, want %s", got, c.want)
+			}
+		})
+	}
+}
+
+func TestListVmsV1(t *testing.T) {
+	// vms of a tenant of their own, the other tests leave theirs behind
+	for i, state := range []VmState{StateStarted, StateExited, StateStarted, StateStarted, StateFailed} {
+		m := testVm(t, fmt.Sprintf("pager-%d", i), 0, state)
+		m.opts.Tenant = "pager"
+		m.opts.Name = fmt.Sprintf("web-%d", i%2)
+		putVm(m)
+		defer takeVm(m.ID)
+	}
+	other := testVm(t, "pager-other", 0, StateStarted)
+	putVm(other)
+	defer takeVm(other.ID)
+
+	list := func(query string) (*httptest.ResponseRecorder, VmList) {
+		r := httptest.NewRequest("GET", "/api/v1/vms?"+query, nil)
+		r = r.WithContext(ctxSetPrincipal(r.Context(), &principal{Tenant: "pager"}))
+		w := httptest.NewRecorder()
+		ListVmsV1Handler(w, r)
+
+		var page VmList
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w, page
+	}
+	ids := func(page VmList) string {
+		var ids []string
+		for _, vm := range page.Items {
+			ids = append(ids, vm.ID)
+		}
+		return strings.Join(ids, ",")
+	}
+
+	for _, c := range []struct {
+		name   string
+		query  string
+		status int
+		ids    string
+		next   string
+	}{
+		{"all of the tenant", "", http.StatusOK, "pager-0,pager-1,pager-2,pager-3,pager-4", ""},
+		{"by state", "state=started", http.StatusOK, "pager-0,pager-2,pager-3", ""},
+		{"by name", "name=web-1", http.StatusOK, "pager-1,pager-3", ""},
+		{"first page", "limit=2", http.StatusOK, "pager-0,pager-1", "pager-1"},
+		{"next page", "limit=2&cursor=pager-1", http.StatusOK, "pager-2,pager-3", "pager-3"},
+		{"last page", "limit=2&cursor=pager-3", http.StatusOK, "pager-4", ""},
+		{"cursor of a deleted vm", "limit=2&cursor=pager-15", http.StatusOK, "pager-2,pager-3", "pager-3"},
+		{"filtered page", "state=started&limit=1&cursor=pager-0", http.StatusOK, "pager-2", "pager-2"},
+		{"zero limit", "limit=0", http.StatusBadRequest, "", ""},
+		{"too large a limit", fmt.Sprintf("limit=%d", maxPageSize+1), http.StatusBadRequest, "", ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			w, page := list(c.query)
+			if w.Code != c.status {
+				t.Fatalf("got status %d, want %d", w.Code, c.status)
+			}
+			if got := ids(page); got != c.ids {
+				t.Fatalf("got vms %s, want %s", got, c.ids)
+			}
+			if page.NextCursor != c.next {
+				t.Fatalf("got next cursor %q, want %q", page.NextCursor, c.next)
+			}
+			if link := w.Header().Get("Link"); (link != "") != (c.next != "") ||
+				c.next != "" && !strings.Contains(link, "cursor="+url.QueryEscape(c.next)) {
+				t.Fatalf("got link %q", link)
+			}
+		})
+	}
+}
+
+func TestV1AdminRoutes(t *testing.T) {
+	r := chi.NewRouter()
+	r.Route(v1Prefix, v1Handler)
+
+	for _, route := range v1Routes {
+		if !route.Admin {
+			continue
+		}
+		t.Run(route.ID, func(t *testing.T) {
+			path := strings.ReplaceAll(v1Prefix+route.Pattern, "{name}", "data")
+			req := httptest.NewRequest(route.Method, path, strings.NewReader("{}"))
+			req = req.WithContext(ctxSetPrincipal(req.Context(), &principal{Tenant: "acme"}))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusForbidden {
+				t.Fatalf("a tenant got status %d", w.Code)
+			}
+		})
+	}
+}
+
+var refPattern = regexp.MustCompile(`"#/components/schemas/([^"]+)"`)
+
+func TestOpenAPI(t *testing.T) {
+	raw, err := json.Marshal(openAPI(v1Routes, v1Prefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Paths      map[string]map[string]json.RawMessage
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]json.RawMessage
+				Required   []string
+			}
+		}
+	}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	// every route is documented and every schema referred to is defined
+	for _, route := range v1Routes {
+		if _, ok := doc.Paths[v1Prefix+route.Pattern][strings.ToLower(route.Method)]; !ok {
+			t.Fatalf("%s %s is not documented", route.Method, route.Pattern)
+		}
+	}
+	for _, ref := range refPattern.FindAllStringSubmatch(string(raw), -1) {
+		if _, ok := doc.Components.Schemas[ref[1]]; !ok {
+			t.Fatalf("the schema %s is not defined", ref[1])
+		}
+	}
+
+	if required := doc.Components.Schemas["CreateRequest"].Required; strings.Join(required, ",") != "name,docker-image" {
+		t.Fatalf("CreateRequest requires %v", required)
+	}
+
+	for _, c := range []struct {
+		schema   string
+		property string
+		want     string
+	}{
+		{"Vm", "state", `"enum":["created","started","paused","restarting","exited","failed"]`},
+		{"Vm", "agent", `"format":"ipv4"`},
+		{"Vm", "vcpus", `"format":"int64"`},
+		{"CreateRequest", "docker-image", `"type":"string"`},
+		{"VmList", "items", `"$ref":"#/components/schemas/Vm"`},
+	} {
+		t.Run(c.schema+"."+c.property, func(t *testing.T) {
+			prop, ok := doc.Components.Schemas[c.schema].Properties[c.property]
+			if !ok {
+				t.Fatalf("no property %s", c.property)
+			}
+			if !strings.Contains(string(prop), c.want) {
+				t.Fatalf("got %s, want %s", prop, c.want)
+			}
+		})
+	}
+}
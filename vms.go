@@ -0,0 +1,75 @@
+// vms file is used to keep track of the vms of the daemon. The api handlers, the monitors and
+// restarts of the vms and the background loops all reach them from goroutines of their own.
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+var (
+	// vmsMu guards runVms, the vms themselves guard their state
+	vmsMu  sync.RWMutex
+	runVms = make(map[string]*Firecracker)
+)
+
+// getVm is the vm id
+func getVm(id string) (*Firecracker, bool) {
+	vmsMu.RLock()
+	defer vmsMu.RUnlock()
+
+	m, ok := runVms[id]
+	return m, ok
+}
+
+// listVms is a copy of the vms sorted by id, vms may come and go while it is ranged over
+func listVms() []*Firecracker {
+	vmsMu.RLock()
+	vms := make([]*Firecracker, 0, len(runVms))
+	for _, m := range runVms {
+		vms = append(vms, m)
+	}
+	vmsMu.RUnlock()
+
+	sort.Slice(vms, func(i, j int) bool { return vms[i].ID < vms[j].ID })
+	return vms
+}
+
+// countVms is the number of vms
+func countVms() int {
+	vmsMu.RLock()
+	defer vmsMu.RUnlock()
+
+	return len(runVms)
+}
+
+// putVm adds the vm m
+func putVm(m *Firecracker) {
+	vmsMu.Lock()
+	defer vmsMu.Unlock()
+
+	runVms[m.ID] = m
+}
+
+// replaceVm puts next, the vm prev booted again, in its place unless prev was deleted meanwhile
+func replaceVm(prev, next *Firecracker) bool {
+	vmsMu.Lock()
+	defer vmsMu.Unlock()
+
+	if runVms[prev.ID] != prev {
+		return false
+	}
+	runVms[next.ID] = next
+	return true
+}
+
+// takeVm removes the vm id and returns it, nil when it is already gone. The vm may have been
+// replaced by a restart since the caller looked it up.
+func takeVm(id string) *Firecracker {
+	vmsMu.Lock()
+	defer vmsMu.Unlock()
+
+	m := runVms[id]
+	delete(runVms, id)
+	return m
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// testVm is a vm without firecracker, as far as the bookkeeping of the daemon goes
+func testVm(t *testing.T, id string, index int64, state VmState) *Firecracker {
+	t.Helper()
+	console, err := newConsole(filepath.Join(t.TempDir(), id+".log"), 1024, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &options{Tenant: "acme", VmIndex: index, FcCPUCount: 1, FcMemSz: 256, Logger: log.NewEntry(log.New())}
+	return &Firecracker{ID: id, opts: opts, console: console, state: state, pid: 1}
+}
+
+// TestConcurrentVms is meant to be run with -race, the api reads the vms while their monitors
+// and the deletes change them
+func TestConcurrentVms(t *testing.T) {
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	r := httptest.NewRequest("GET", "/api/list", nil)
+	r = r.WithContext(ctxSetPrincipal(r.Context(), anonymous))
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, m := range listVms() {
+					vmResource(m)
+					lookupVm(r, m.ID)
+				}
+				runningUsage()
+				usedResources()
+				volumeUsers("data", false)
+			}
+		}()
+	}
+
+	for i := 0; i < 200; i++ {
+		m := testVm(t, fmt.Sprintf("vm-%d", i), 0, StateStarted)
+		putVm(m)
+		m.setState(StateExited)
+		m.mu.Lock()
+		code := i
+		m.exitCode = &code
+		m.mu.Unlock()
+		deleteVm(m)
+	}
+
+	close(done)
+	wg.Wait()
+}
+
+// TestDeleteRestartingVm checks the vm index of a vm deleted while it restarts is given back once
+func TestDeleteRestartingVm(t *testing.T) {
+	rsv, err := admit("acme", Resources{VMs: 1}, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsv.keep()
+	rsv.release()
+
+	m := testVm(t, "restarting", rsv.index, StateRestarting)
+	putVm(m)
+	deleteVm(m)
+
+	if _, err := admit("acme", Resources{VMs: 1}, rsv.index, nil); err == nil {
+		t.Fatal("the vm index was given back before the restart gave up")
+	}
+
+	// the pending restart sees the vm stopping
+	m.finish(StateExited)
+
+	again, err := admit("acme", Resources{VMs: 1}, rsv.index, nil)
+	if err != nil {
+		t.Fatalf("the vm index was not given back: %v", err)
+	}
+	again.release()
+
+	// an exited vm gives its index back right away
+	rsv, err = admit("acme", Resources{VMs: 1}, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsv.keep()
+	rsv.release()
+	m = testVm(t, "exited", rsv.index, StateExited)
+	putVm(m)
+	deleteVm(m)
+	if _, ok := getVm(m.ID); ok {
+		t.Fatal("the vm was not deleted")
+	}
+	again, err = admit("acme", Resources{VMs: 1}, rsv.index, nil)
+	if err != nil {
+		t.Fatalf("the vm index was not given back: %v", err)
+	}
+	again.release()
+}
@@ -0,0 +1,221 @@
+// volumes file is used to manage the named ext4 volumes of the daemon. Volumes are
+// attached to vms as extra drives and outlive them.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	errVolumeInvalid  = errors.New("invalid volume")
+	errVolumeExists   = errors.New("volume already exists")
+	errVolumeNotFound = errors.New("volume does not exist")
+	errVolumeInUse    = errors.New("volume is used by a vm")
+)
+
+// volume names end up in file names and shell commands
+var volumeNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,63}$`)
+
+func volumePath(name string) string {
+	return filepath.Join(conf.VolumeDir, name+".ext4")
+}
+
+// volumeMeta is kept next to the volume file
+type volumeMeta struct {
+	Tenant string `json:"tenant"`
+}
+
+func volumeMetaPath(name string) string {
+	return filepath.Join(conf.VolumeDir, name+".json")
+}
+
+// volumeOwner is the tenant owning the volume name, empty for the volumes created before
+// volumes had owners which only admins may attach
+func volumeOwner(name string) string {
+	data, err := os.ReadFile(volumeMetaPath(name))
+	if err != nil {
+		return ""
+	}
+	var meta volumeMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return ""
+	}
+	return meta.Tenant
+}
+
+// createVolume creates the empty ext4 volume name of sizeMiB MiB owned by tenant
+func createVolume(name string, sizeMiB int64, tenant string) (*Volume, error) {
+	if !volumeNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("%w: name %q", errVolumeInvalid, name)
+	}
+	if sizeMiB <= 0 {
+		return nil, fmt.Errorf("%w: size must be positive", errVolumeInvalid)
+	}
+
+	if err := os.MkdirAll(conf.VolumeDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create volume directory: %v", err)
+	}
+
+	file := volumePath(name)
+
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return nil, fmt.Errorf("%w: %s", errVolumeExists, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create volume file: %v", err)
+	}
+
+	// sparse, the host only spends what the guest writes
+	err = f.Truncate(sizeMiB << 20)
+	f.Close()
+	if err != nil {
+		os.Remove(file)
+		return nil, fmt.Errorf("failed to size volume file: %v", err)
+	}
+
+	if _, err := RunNoneSudo(fmt.Sprintf("mkfs.ext4 -q -F %s", file)); err != nil {
+		os.Remove(file)
+		return nil, fmt.Errorf("failed to create ext4 file system: %v", err)
+	}
+
+	data, err := json.Marshal(volumeMeta{Tenant: tenant})
+	if err == nil {
+		err = os.WriteFile(volumeMetaPath(name), data, 0600)
+	}
+	if err != nil {
+		os.Remove(file)
+		return nil, fmt.Errorf("failed to save volume owner: %v", err)
+	}
+
+	return &Volume{Name: name, SizeMiB: sizeMiB, Tenant: tenant}, nil
+}
+
+// listVolumes returns every volume along with the vms using it
+func listVolumes() ([]*Volume, error) {
+	entries, err := os.ReadDir(conf.VolumeDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []*Volume{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read volume directory: %v", err)
+	}
+
+	volumes := make([]*Volume, 0, len(entries))
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".ext4")
+		if name == entry.Name() || !volumeNamePattern.MatchString(name) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		volumes = append(volumes, &Volume{
+			Name:    name,
+			SizeMiB: info.Size() >> 20,
+			Tenant:  volumeOwner(name),
+			UsedBy:  volumeUsers(name, false),
+		})
+	}
+
+	return volumes, nil
+}
+
+// deleteVolume removes a volume no vm uses
+func deleteVolume(name string) error {
+	if !volumeNamePattern.MatchString(name) {
+		return fmt.Errorf("%w: %s", errVolumeNotFound, name)
+	}
+
+	if users := volumeUsers(name, false); len(users) != 0 {
+		return fmt.Errorf("%w: %s", errVolumeInUse, strings.Join(users, ", "))
+	}
+
+	err := os.Remove(volumePath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s", errVolumeNotFound, name)
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(volumeMetaPath(name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove volume owner: %v", err)
+	}
+	return nil
+}
+
+// volumeUsers returns the ids of the vms which have not exited using the volume name,
+// only those writing to it when writersOnly is set
+func volumeUsers(name string, writersOnly bool) []string {
+	users := []string{}
+	for _, m := range listVms() {
+		if state := m.currentState(); state == StateExited || state == StateFailed {
+			continue
+		}
+		for _, v := range m.opts.Volumes {
+			if v.Name == name && (!writersOnly || !v.ReadOnly) {
+				users = append(users, m.ID)
+			}
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// checkVolumes makes sure the volumes exist and belong to the tenant of caller unless it is an
+// admin, are mounted once at distinct absolute paths and that no other vm than except, which is
+// about to be replaced, writes to them. ext4 can not be shared, except read only by everyone.
+func checkVolumes(mounts []VolumeMount, caller *principal, except *Firecracker) error {
+	names := make(map[string]bool)
+	points := make(map[string]bool)
+
+	for _, v := range mounts {
+		if !volumeNamePattern.MatchString(v.Name) {
+			return fmt.Errorf("%w: %s", errVolumeNotFound, v.Name)
+		}
+		if _, err := os.Stat(volumePath(v.Name)); err != nil {
+			return fmt.Errorf("%w: %s", errVolumeNotFound, v.Name)
+		}
+		// like their vms, the volumes of other tenants are not found
+		if !caller.Admin && volumeOwner(v.Name) != caller.Tenant {
+			return fmt.Errorf("%w: %s", errVolumeNotFound, v.Name)
+		}
+
+		if !path.IsAbs(v.MountPoint) || path.Clean(v.MountPoint) == "/" {
+			return fmt.Errorf("%w: mount point of %s must be an absolute path other than /", errVolumeInvalid, v.Name)
+		}
+		if names[v.Name] || points[path.Clean(v.MountPoint)] {
+			return fmt.Errorf("%w: %s is attached twice or shares its mount point", errVolumeInvalid, v.Name)
+		}
+		names[v.Name] = true
+		points[path.Clean(v.MountPoint)] = true
+
+		users := []string{}
+		for _, id := range volumeUsers(v.Name, v.ReadOnly) {
+			if except == nil || id != except.ID {
+				users = append(users, id)
+			}
+		}
+		if len(users) != 0 {
+			return fmt.Errorf("%w: %s by %s", errVolumeInUse, v.Name, strings.Join(users, ", "))
+		}
+	}
+
+	return nil
+}
+
+// volumeDevice is the guest device of the i-th volume, the rootfs being the first drive
+func volumeDevice(i int) string {
+	return fmt.Sprintf("/dev/vd%c", 'b'+i)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestVolumeOwner(t *testing.T) {
+	saved := conf
+	defer func() { conf = saved }()
+	conf.VolumeDir = t.TempDir()
+
+	// mkfs is not needed to check who may attach the volumes
+	for name, tenant := range map[string]string{"acme-data": "acme", "legacy": ""} {
+		if err := os.WriteFile(volumePath(name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if tenant == "" {
+			continue
+		}
+		data, _ := json.Marshal(volumeMeta{Tenant: tenant})
+		if err := os.WriteFile(volumeMetaPath(name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, c := range []struct {
+		name   string
+		volume string
+		caller *principal
+		err    error
+	}{
+		{"owner", "acme-data", &principal{Tenant: "acme"}, nil},
+		{"other tenant", "acme-data", &principal{Tenant: "globex"}, errVolumeNotFound},
+		{"admin", "acme-data", &principal{Tenant: "ops", Admin: true}, nil},
+		{"no owner", "legacy", &principal{Tenant: "acme"}, errVolumeNotFound},
+		{"no owner admin", "legacy", &principal{Tenant: "ops", Admin: true}, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			err := checkVolumes([]VolumeMount{{Name: c.volume, MountPoint: "/data"}}, c.caller, nil)
+			if !errors.Is(err, c.err) {
+				t.Fatalf("got %v, want %v", err, c.err)
+			}
+		})
+	}
+}
+
+func TestCheckVolumes(t *testing.T) {
+	saved := conf
+	defer func() { conf = saved }()
+	conf.VolumeDir = t.TempDir()
+
+	for _, name := range []string{"data", "cache", "logs"} {
+		if err := os.WriteFile(volumePath(name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// data is written by a running vm, cache read by one and logs only used by an exited vm
+	writer := testVm(t, "writer", 0, StateStarted)
+	writer.opts.Volumes = []VolumeMount{{Name: "data", MountPoint: "/data"}}
+	reader := testVm(t, "reader", 0, StateStarted)
+	reader.opts.Volumes = []VolumeMount{{Name: "cache", MountPoint: "/cache", ReadOnly: true}}
+	exited := testVm(t, "exited", 0, StateExited)
+	exited.opts.Volumes = []VolumeMount{{Name: "logs", MountPoint: "/logs"}}
+	for _, m := range []*Firecracker{writer, reader, exited} {
+		putVm(m)
+		defer takeVm(m.ID)
+	}
+
+	for _, c := range []struct {
+		name   string
+		mounts []VolumeMount
+		except *Firecracker
+		err    error
+	}{
+		{"none", nil, nil, nil},
+		{"invalid name", []VolumeMount{{Name: "../data", MountPoint: "/data"}}, nil, errVolumeNotFound},
+		{"missing", []VolumeMount{{Name: "missing", MountPoint: "/data"}}, nil, errVolumeNotFound},
+		{"relative mount point", []VolumeMount{{Name: "logs", MountPoint: "logs"}}, nil, errVolumeInvalid},
+		{"root mount point", []VolumeMount{{Name: "logs", MountPoint: "/logs/.."}}, nil, errVolumeInvalid},
+		{"attached twice", []VolumeMount{{Name: "logs", MountPoint: "/a"}, {Name: "logs", MountPoint: "/b"}}, nil, errVolumeInvalid},
+		{"shared mount point", []VolumeMount{{Name: "logs", MountPoint: "/a"}, {Name: "cache", MountPoint: "/a/", ReadOnly: true}}, nil, errVolumeInvalid},
+		{"written by another vm", []VolumeMount{{Name: "data", MountPoint: "/data", ReadOnly: true}}, nil, errVolumeInUse},
+		{"read by another vm", []VolumeMount{{Name: "cache", MountPoint: "/cache"}}, nil, errVolumeInUse},
+		{"read by several vms", []VolumeMount{{Name: "cache", MountPoint: "/cache", ReadOnly: true}}, nil, nil},
+		{"used by an exited vm", []VolumeMount{{Name: "logs", MountPoint: "/logs"}}, nil, nil},
+		{"replacing its writer", []VolumeMount{{Name: "data", MountPoint: "/data"}}, writer, nil},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			err := checkVolumes(c.mounts, anonymous, c.except)
+			if !errors.Is(err, c.err) || (c.err == nil) != (err == nil) {
+				t.Fatalf("got %v, want %v", err, c.err)
+			}
+		})
+	}
+
+	if err := deleteVolume("data"); !errors.Is(err, errVolumeInUse) {
+		t.Fatalf("a volume in use was deleted: %v", err)
+	}
+	if err := deleteVolume("logs"); err != nil {
+		t.Fatalf("a volume of an exited vm was not deleted: %v", err)
+	}
+	if err := deleteVolume("logs"); !errors.Is(err, errVolumeNotFound) {
+		t.Fatalf("got %v, want %v", err, errVolumeNotFound)
+	}
+}
+
+func TestCreateVolumeInvalid(t *testing.T) {
+	saved := conf
+	defer func() { conf = saved }()
+	conf.VolumeDir = t.TempDir()
+
+	for _, c := range []struct {
+		name string
+		size int64
+		err  error
+	}{
+		{"../etc", 1, errVolumeInvalid},
+		{"", 1, errVolumeInvalid},
+		{"data", 0, errVolumeInvalid},
+		{"data", -1, errVolumeInvalid},
+	} {
+		if _, err := createVolume(c.name, c.size, "acme"); !errors.Is(err, c.err) {
+			t.Errorf("%q of %d MiB: got %v, want %v", c.name, c.size, err, c.err)
+		}
+	}
+
+	if err := os.WriteFile(volumePath("taken"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createVolume("taken", 1, "acme"); !errors.Is(err, errVolumeExists) {
+		t.Fatalf("got %v, want %v", err, errVolumeExists)
+	}
+
+	if got := []string{volumeDevice(0), volumeDevice(2)}; got[0] != "/dev/vdb" || got[1] != "/dev/vdd" {
+		t.Fatalf("got devices %v", got)
+	}
+}
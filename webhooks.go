@@ -0,0 +1,191 @@
+// webhooks file is used to deliver the events of the bus to the http endpoints listed in the file
+// given by the -webhooks flag, retrying failed deliveries with a growing delay.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// webhookQueueSize is how many events may wait for the delivery to a webhook before new ones are dropped
+const webhookQueueSize = 1024
+
+// webhookTimeout bounds every delivery attempt
+const webhookTimeout = 10 * time.Second
+
+// webhookRetryDelay is the wait before the first retry of a delivery, doubled on every following
+// one up to webhookMaxRetryDelay
+const (
+	webhookRetryDelay    = time.Second
+	webhookMaxRetryDelay = 5 * time.Minute
+)
+
+// webhook receives the events of the bus matching Types and Tenant, all of them when they are empty.
+// Deliveries are signed with Secret when set and retried MaxRetries times.
+type webhook struct {
+	URL        string      `json:"url"`
+	Secret     string      `json:"secret,omitempty"`
+	Types      []EventType `json:"types,omitempty"`
+	Tenant     string      `json:"tenant,omitempty"`
+	MaxRetries *int        `json:"max_retries,omitempty"`
+
+	types map[EventType]bool
+	queue chan Event
+}
+
+// webhooks are the webhooks in use
+var webhooks []*webhook
+
+// webhookClient delivers the events, every attempt gets its own deadline
+var webhookClient = &http.Client{}
+
+// loadWebhooks reads the webhooks from the json file at path
+func loadWebhooks(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read webhooks: %v", err)
+	}
+
+	var hooks []*webhook
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return fmt.Errorf("failed to decode webhooks: %v", err)
+	}
+
+	for _, h := range hooks {
+		u, err := url.Parse(h.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook url %q", h.URL)
+		}
+		if h.MaxRetries != nil && *h.MaxRetries < 0 {
+			return fmt.Errorf("max_retries of webhook %s can not be negative", h.URL)
+		}
+		if len(h.Types) > 0 {
+			h.types = make(map[EventType]bool)
+			for _, t := range h.Types {
+				if !eventTypes[t] {
+					return fmt.Errorf("unknown event type %q of webhook %s", t, h.URL)
+				}
+				h.types[t] = true
+			}
+		}
+		h.queue = make(chan Event, webhookQueueSize)
+	}
+
+	webhooks = hooks
+	return nil
+}
+
+// runWebhooks delivers the queued events until ctx is done, the events still queued then are lost
+func runWebhooks(ctx context.Context) {
+	for _, h := range webhooks {
+		go h.run(ctx)
+	}
+}
+
+// enqueueWebhooks queues e for the webhooks it matches
+func enqueueWebhooks(e Event) {
+	for _, h := range webhooks {
+		if h.types != nil && !h.types[e.Type] || h.Tenant != "" && h.Tenant != e.Tenant {
+			continue
+		}
+		select {
+		case h.queue <- e:
+		default:
+			log.Errorf("dropping event %d, the delivery queue of webhook %s is full", e.ID, h.URL)
+		}
+	}
+}
+
+// run delivers the queued events one at a time, in the order they were published
+func (h *webhook) run(ctx context.Context) {
+	retries := 5
+	if h.MaxRetries != nil {
+		retries = *h.MaxRetries
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-h.queue:
+			h.deliver(ctx, e, retries)
+		}
+	}
+}
+
+// deliver posts e until the webhook takes it, it gives up after retries failed retries or
+// on a client error other than 408 and 429
+func (h *webhook) deliver(ctx context.Context, e Event, retries int) {
+	body, _ := json.Marshal(e)
+
+	for attempt := 0; ; attempt++ {
+		retry, err := h.post(ctx, e, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= retries {
+			log.Errorf("failed to deliver event %d to webhook %s: %v", e.ID, h.URL, err)
+			return
+		}
+
+		delay := webhookRetryDelay
+		for i := 0; i < attempt && delay < webhookMaxRetryDelay; i++ {
+			delay *= 2
+		}
+		if delay > webhookMaxRetryDelay {
+			delay = webhookMaxRetryDelay
+		}
+		log.Warnf("failed to deliver event %d to webhook %s, retrying in %s: %v", e.ID, h.URL, delay, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// post makes one delivery attempt of e and tells whether a failure is worth retrying
+func (h *webhook) post(ctx context.Context, e Event, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Fcland-Event", string(e.Type))
+	req.Header.Set("X-Fcland-Delivery", strconv.FormatUint(e.ID, 10))
+	if h.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(h.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Fcland-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return true, fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return false, fmt.Errorf("webhook answered %s", resp.Status)
+}
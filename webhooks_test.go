@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestLoadWebhooks(t *testing.T) {
+	saved := webhooks
+	defer func() { webhooks = saved }()
+
+	for _, c := range []struct {
+		name  string
+		hooks string
+		err   bool
+	}{
+		{"valid", `[{"url": "https://hooks.example/fcland", "types": ["exited", "error"], "max_retries": 0}]`, false},
+		{"no webhooks", `[]`, false},
+		{"not json", `url: https://hooks.example`, true},
+		{"relative url", `[{"url": "/fcland"}]`, true},
+		{"other scheme", `[{"url": "ftp://hooks.example/fcland"}]`, true},
+		{"negative retries", `[{"url": "https://hooks.example/fcland", "max_retries": -1}]`, true},
+		{"unknown type", `[{"url": "https://hooks.example/fcland", "types": ["exploded"]}]`, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "webhooks.json")
+			if err := os.WriteFile(path, []byte(c.hooks), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := loadWebhooks(path); (err != nil) != c.err {
+				t.Fatalf("got error %v", err)
+			}
+		})
+	}
+}
+
+func TestEnqueueWebhooks(t *testing.T) {
+	saved := webhooks
+	defer func() { webhooks = saved }()
+
+	all := &webhook{queue: make(chan Event, 1)}
+	exits := &webhook{types: map[EventType]bool{EventExited: true}, queue: make(chan Event, 1)}
+	acme := &webhook{Tenant: "acme", queue: make(chan Event, 1)}
+	webhooks = []*webhook{all, exits, acme}
+
+	for _, c := range []struct {
+		name  string
+		event Event
+		hooks []*webhook
+	}{
+		{"started vm of acme", Event{Type: EventStarted, Tenant: "acme"}, []*webhook{all, acme}},
+		{"exited vm of globex", Event{Type: EventExited, Tenant: "globex"}, []*webhook{all, exits}},
+		{"exited vm of acme", Event{Type: EventExited, Tenant: "acme"}, []*webhook{all, exits, acme}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			enqueueWebhooks(c.event)
+			for _, h := range webhooks {
+				want := false
+				for _, m := range c.hooks {
+					want = want || m == h
+				}
+				select {
+				case <-h.queue:
+					if !want {
+						t.Fatalf("the webhook of %q %v got the event", h.Tenant, h.types)
+					}
+				default:
+					if want {
+						t.Fatalf("the webhook of %q %v did not get the event", h.Tenant, h.types)
+					}
+				}
+			}
+		})
+	}
+
+	// a full queue drops the event instead of blocking the bus
+	enqueueWebhooks(Event{Type: EventStarted, Tenant: "acme"})
+	enqueueWebhooks(Event{Type: EventStarted, Tenant: "acme"})
+}
+
+func TestDeliverWebhook(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		statuses []int
+		retries  int
+		attempts int
+	}{
+		{"taken", []int{http.StatusNoContent}, 3, 1},
+		{"client error", []int{http.StatusBadRequest}, 3, 1},
+		{"server error", []int{http.StatusServiceUnavailable, http.StatusOK}, 3, 2},
+		{"rate limited", []int{http.StatusTooManyRequests, http.StatusOK}, 3, 2},
+		{"no retries", []int{http.StatusBadGateway}, 0, 1},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var mu sync.Mutex
+			attempts := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				mac := hmac.New(sha256.New, []byte("s3cret"))
+				mac.Write(body)
+				if r.Header.Get("X-Fcland-Signature") != "sha256="+hex.EncodeToString(mac.Sum(nil)) ||
+					r.Header.Get("X-Fcland-Event") != "exited" || r.Header.Get("X-Fcland-Delivery") != "42" {
+					t.Errorf("got headers %v", r.Header)
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				w.WriteHeader(c.statuses[attempts])
+				attempts++
+			}))
+			defer srv.Close()
+
+			h := &webhook{URL: srv.URL, Secret: "s3cret"}
+			h.deliver(context.Background(), Event{ID: 42, Type: EventExited, VmID: "vm-1"}, c.retries)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if attempts != c.attempts {
+				t.Fatalf("got %d attempts, want %d", attempts, c.attempts)
+			}
+		})
+	}
+}